@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pojntfx/saltpanelo/pkg/config"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	errUnknownAcceptPolicy = errors.New("unknown accept policy")
+	errUnknownCommand      = errors.New("unknown command")
+	errInvalidArgs         = errors.New("invalid arguments")
+	errAPIUnauthorized     = errors.New("missing or invalid API token")
+	errForeignOrigin       = errors.New("request is not from a loopback origin")
+	errInvalidContentType  = errors.New("content type must be application/json")
+	errAPITokenRequired    = errors.New("TCP listeners require an API token")
+	errEmptyAPIToken       = errors.New("API token file is empty")
+)
+
+const (
+	acceptPolicyAll       = "all"
+	acceptPolicyNone      = "none"
+	acceptPolicyAllowlist = "allowlist"
+
+	unixPrefix = "unix://"
+
+	apiTokenEnv = config.EnvPrefix + "API_TOKEN"
+)
+
+type acceptPolicy struct {
+	policy   string
+	emails   []string
+	channels []string
+}
+
+func splitList(raw string) []string {
+	items := []string{}
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func newAcceptPolicy(policy, emails, channels string) (*acceptPolicy, error) {
+	switch policy {
+	case acceptPolicyAll, acceptPolicyNone, acceptPolicyAllowlist:
+	default:
+		return nil, errUnknownAcceptPolicy
+	}
+
+	return &acceptPolicy{
+		policy:   policy,
+		emails:   splitList(emails),
+		channels: splitList(channels),
+	}, nil
+}
+
+func (p *acceptPolicy) accept(srcEmail, channelID string) bool {
+	switch p.policy {
+	case acceptPolicyAll:
+		return true
+	case acceptPolicyAllowlist:
+		// An empty list allows everything
+		if len(p.emails) > 0 && !slices.Contains(p.emails, srcEmail) {
+			return false
+		}
+
+		if len(p.channels) > 0 && !slices.Contains(p.channels, channelID) {
+			return false
+		}
+
+		return true
+	default:
+		return false
+	}
+}
+
+type dialRequest struct {
+	Email     string `json:"email"`
+	ChannelID string `json:"channelID"`
+}
+
+type groupDialRequest struct {
+	Emails    []string `json:"emails"`
+	ChannelID string   `json:"channelID"`
+}
+
+type inviteRequest struct {
+	Email string `json:"email"`
+}
+
+type presenceRequest struct {
+	Presence string `json:"presence"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Could not write response, continuing:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+// loadOrCreateAPIToken loads the token which clients of the control API have to send from the environment or a file,
+// and creates the file with a random token if it doesn't exist yet
+func loadOrCreateAPIToken(tokenPath string) (string, error) {
+	if token := strings.TrimSpace(os.Getenv(apiTokenEnv)); token != "" {
+		return token, nil
+	}
+
+	rawToken, err := os.ReadFile(tokenPath)
+	if err == nil {
+		token := strings.TrimSpace(string(rawToken))
+		if token == "" {
+			return "", errEmptyAPIToken
+		}
+
+		return token, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	rawToken = make([]byte, 32)
+	if _, err := rand.Read(rawToken); err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(tokenPath), 0700); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(rawToken)
+	if err := os.WriteFile(tokenPath, []byte(token+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// needsAPIToken returns whether clients of a listener have to send the API token; Unix sockets are only accessible to
+// the user who runs the adapter, so they don't need one
+func needsAPIToken(laddr string) bool {
+	return strings.TrimSpace(laddr) != "" && !strings.HasPrefix(laddr, unixPrefix)
+}
+
+// listenAPI listens on a Unix socket which only the user who runs the adapter may connect to, or on TCP, where any
+// local or remote user could connect and a token is required
+func listenAPI(laddr, token string) (net.Listener, error) {
+	if strings.HasPrefix(laddr, unixPrefix) {
+		path := strings.TrimPrefix(laddr, unixPrefix)
+
+		// Remove stale sockets from previous runs
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		return listenPrivateUnix(path)
+	}
+
+	if token == "" {
+		return nil, errAPITokenRequired
+	}
+
+	return net.Listen("tcp", laddr)
+}
+
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorizeAPI protects the control API against other users and web pages (CSRF and DNS rebinding), which could otherwise
+// place calls as the user
+func authorizeAPI(token string, unix bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the Unix socket is protected by its permissions, so TCP listeners always need a token
+		if !unix && (token == "" || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")), []byte(token)) != 1) {
+			writeError(w, http.StatusUnauthorized, errAPIUnauthorized)
+
+			return
+		}
+
+		// Browsers set the origin of cross-origin requests
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || !isLoopbackHost(u.Host) {
+				writeError(w, http.StatusForbidden, errForeignOrigin)
+
+				return
+			}
+		}
+
+		// Web pages can't send JSON to other origins without a preflight request, which the API doesn't answer
+		if r.Method != http.MethodGet {
+			if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errInvalidContentType)
+
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func serveAPI(ctx context.Context, lis net.Listener, token string, c *controller) error {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/calls", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, c.list())
+		case http.MethodPost:
+			var req dialRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+
+				return
+			}
+
+			res, err := c.dial(ctx, req.Email, req.ChannelID)
+			if err != nil {
+				writeError(w, http.StatusBadGateway, err)
+
+				return
+			}
+
+			writeJSON(w, http.StatusOK, res)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/calls/", func(w http.ResponseWriter, r *http.Request) {
+		// Calls are held, resumed and transferred with `/calls/<route ID>/{hold,resume,transfer}`
+		routeID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/calls/"), "/")
+		if strings.TrimSpace(routeID) == "" {
+			writeError(w, http.StatusBadRequest, errInvalidArgs)
+
+			return
+		}
+
+		switch {
+		case r.Method == http.MethodPost && (action == "hold" || action == "resume"):
+			if err := c.hold(ctx, routeID, action == "hold"); err != nil {
+				writeError(w, http.StatusBadGateway, err)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && action == "transfer":
+			var req inviteRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+
+				return
+			}
+
+			res, err := c.transfer(ctx, routeID, req.Email)
+			if err != nil {
+				writeError(w, http.StatusBadGateway, err)
+
+				return
+			}
+
+			writeJSON(w, http.StatusOK, res)
+		case r.Method == http.MethodDelete && action == "":
+			if err := c.hangup(ctx, routeID); err != nil {
+				writeError(w, http.StatusBadGateway, err)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/groups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		var req groupDialRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		res, err := c.dialGroup(ctx, req.Emails, req.ChannelID)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	})
+
+	mux.HandleFunc("/groups/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		// Group routes are managed with `/groups/<route ID>/{invite,join,leave}`
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/groups/"), "/")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			writeError(w, http.StatusBadRequest, errInvalidArgs)
+
+			return
+		}
+
+		routeID := parts[0]
+
+		switch parts[1] {
+		case "invite":
+			var req inviteRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+
+				return
+			}
+
+			res, err := c.invite(ctx, routeID, req.Email)
+			if err != nil {
+				writeError(w, http.StatusBadGateway, err)
+
+				return
+			}
+
+			writeJSON(w, http.StatusOK, res)
+		case "join":
+			if err := c.join(ctx, routeID); err != nil {
+				writeError(w, http.StatusBadGateway, err)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		case "leave":
+			if err := c.leave(ctx, routeID); err != nil {
+				writeError(w, http.StatusBadGateway, err)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	mux.HandleFunc("/presence", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, presenceRequest{c.getPresence()})
+		case http.MethodPut:
+			var req presenceRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+
+				return
+			}
+
+			if err := c.setPresence(ctx, req.Presence); err != nil {
+				writeError(w, http.StatusBadGateway, err)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/presence/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		email := strings.TrimPrefix(r.URL.Path, "/presence/")
+		if strings.TrimSpace(email) == "" {
+			writeError(w, http.StatusBadRequest, errInvalidArgs)
+
+			return
+		}
+
+		presence, err := c.lookupPresence(ctx, email)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, presenceRequest{presence})
+	})
+
+	mux.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		limit := 0
+		if rawLimit := r.URL.Query().Get("limit"); rawLimit != "" {
+			var err error
+			limit, err = strconv.Atoi(rawLimit)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+
+				return
+			}
+		}
+
+		cdrs, err := c.history(ctx, limit)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err)
+
+			return
+		}
+
+		writeJSON(w, http.StatusOK, cdrs)
+	})
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		events, unsubscribe := c.subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+
+		flusher, _ := w.(http.Flusher)
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		encoder := json.NewEncoder(w)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e := <-events:
+				if err := encoder.Encode(e); err != nil {
+					return
+				}
+
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	})
+
+	return http.Serve(lis, authorizeAPI(token, lis.Addr().Network() == "unix", mux))
+}
+
+// serveStdin reads commands from `r` and writes results and events as JSON lines to `w`
+func serveStdin(ctx context.Context, r io.Reader, w io.Writer, c *controller) error {
+	var encoderLock sync.Mutex
+	encoder := json.NewEncoder(w)
+
+	events, unsubscribe := c.subscribe()
+	defer unsubscribe()
+
+	go func() {
+		for e := range events {
+			encoderLock.Lock()
+			if err := encoder.Encode(e); err != nil {
+				log.Println("Could not write event, continuing:", err)
+			}
+			encoderLock.Unlock()
+		}
+	}()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) < 1 {
+			continue
+		}
+
+		var (
+			res any
+			err error
+		)
+		switch args[0] {
+		case "dial":
+			if len(args) != 3 {
+				err = fmt.Errorf("%w: usage: dial <email> <channel ID>", errInvalidArgs)
+
+				break
+			}
+
+			res, err = c.dial(ctx, args[1], args[2])
+		case "hangup":
+			if len(args) != 2 {
+				err = fmt.Errorf("%w: usage: hangup <route ID>", errInvalidArgs)
+
+				break
+			}
+
+			err = c.hangup(ctx, args[1])
+		case "group-dial":
+			if len(args) < 3 {
+				err = fmt.Errorf("%w: usage: group-dial <channel ID> <email>...", errInvalidArgs)
+
+				break
+			}
+
+			res, err = c.dialGroup(ctx, args[2:], args[1])
+		case "invite":
+			if len(args) != 3 {
+				err = fmt.Errorf("%w: usage: invite <route ID> <email>", errInvalidArgs)
+
+				break
+			}
+
+			res, err = c.invite(ctx, args[1], args[2])
+		case "join":
+			if len(args) != 2 {
+				err = fmt.Errorf("%w: usage: join <route ID>", errInvalidArgs)
+
+				break
+			}
+
+			err = c.join(ctx, args[1])
+		case "leave":
+			if len(args) != 2 {
+				err = fmt.Errorf("%w: usage: leave <route ID>", errInvalidArgs)
+
+				break
+			}
+
+			err = c.leave(ctx, args[1])
+		case "hold", "resume":
+			if len(args) != 2 {
+				err = fmt.Errorf("%w: usage: %v <route ID>", errInvalidArgs, args[0])
+
+				break
+			}
+
+			err = c.hold(ctx, args[1], args[0] == "hold")
+		case "transfer":
+			if len(args) != 3 {
+				err = fmt.Errorf("%w: usage: transfer <route ID> <email>", errInvalidArgs)
+
+				break
+			}
+
+			res, err = c.transfer(ctx, args[1], args[2])
+		case "list":
+			res = c.list()
+		case "history":
+			if len(args) > 2 {
+				err = fmt.Errorf("%w: usage: history [limit]", errInvalidArgs)
+
+				break
+			}
+
+			limit := 0
+			if len(args) == 2 {
+				limit, err = strconv.Atoi(args[1])
+				if err != nil {
+					break
+				}
+			}
+
+			res, err = c.history(ctx, limit)
+		case "presence":
+			if len(args) != 2 {
+				err = fmt.Errorf("%w: usage: presence <presence>", errInvalidArgs)
+
+				break
+			}
+
+			err = c.setPresence(ctx, args[1])
+		case "presence-of":
+			if len(args) != 2 {
+				err = fmt.Errorf("%w: usage: presence-of <email>", errInvalidArgs)
+
+				break
+			}
+
+			var presence string
+			presence, err = c.lookupPresence(ctx, args[1])
+			res = presenceRequest{presence}
+		default:
+			err = fmt.Errorf("%w: %v", errUnknownCommand, args[0])
+		}
+
+		if err != nil {
+			res = apiError{err.Error()}
+		} else if res == nil {
+			res = struct{}{}
+		}
+
+		encoderLock.Lock()
+		if err := encoder.Encode(res); err != nil {
+			encoderLock.Unlock()
+
+			return err
+		}
+		encoderLock.Unlock()
+	}
+
+	return scanner.Err()
+}
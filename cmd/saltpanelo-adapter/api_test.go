@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeAPI(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		unix        bool
+		method      string
+		header      map[string]string
+		wantStatus  int
+		wantReached bool
+	}{
+		{
+			name:        "TCP with valid token",
+			token:       "secret",
+			method:      http.MethodGet,
+			header:      map[string]string{"Authorization": "Bearer secret"},
+			wantStatus:  http.StatusOK,
+			wantReached: true,
+		},
+		{
+			name:       "TCP with invalid token",
+			token:      "secret",
+			method:     http.MethodGet,
+			header:     map[string]string{"Authorization": "Bearer other"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "TCP without token header",
+			token:      "secret",
+			method:     http.MethodGet,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "TCP without configured token and loopback host",
+			method:     http.MethodGet,
+			header:     map[string]string{"Host": "localhost"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:        "Unix socket without configured token",
+			unix:        true,
+			method:      http.MethodGet,
+			wantStatus:  http.StatusOK,
+			wantReached: true,
+		},
+		{
+			name:        "Unix socket with configured token and without token header",
+			token:       "secret",
+			unix:        true,
+			method:      http.MethodGet,
+			wantStatus:  http.StatusOK,
+			wantReached: true,
+		},
+		{
+			name:       "foreign origin",
+			token:      "secret",
+			method:     http.MethodGet,
+			header:     map[string]string{"Authorization": "Bearer secret", "Origin": "https://example.com"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:        "loopback origin",
+			token:       "secret",
+			method:      http.MethodGet,
+			header:      map[string]string{"Authorization": "Bearer secret", "Origin": "http://127.0.0.1:8080"},
+			wantStatus:  http.StatusOK,
+			wantReached: true,
+		},
+		{
+			name:       "POST without JSON content type",
+			token:      "secret",
+			method:     http.MethodPost,
+			header:     map[string]string{"Authorization": "Bearer secret", "Content-Type": "text/plain"},
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "POST with JSON content type",
+			token:       "secret",
+			method:      http.MethodPost,
+			header:      map[string]string{"Authorization": "Bearer secret", "Content-Type": "application/json; charset=utf-8"},
+			wantStatus:  http.StatusOK,
+			wantReached: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached := false
+			handler := authorizeAPI(tt.token, tt.unix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			}))
+
+			req := httptest.NewRequest(tt.method, "/calls", strings.NewReader("{}"))
+			for key, value := range tt.header {
+				if key == "Host" {
+					req.Host = value
+
+					continue
+				}
+
+				req.Header.Set(key, value)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("authorizeAPI() status = %v, want %v", rec.Code, tt.wantStatus)
+			}
+
+			if reached != tt.wantReached {
+				t.Errorf("authorizeAPI() reached handler = %v, want %v", reached, tt.wantReached)
+			}
+		})
+	}
+}
+
+func TestListenAPIRequiresTokenForTCP(t *testing.T) {
+	if _, err := listenAPI("127.0.0.1:0", ""); err != errAPITokenRequired {
+		t.Errorf("listenAPI() error = %v, want %v", err, errAPITokenRequired)
+	}
+}
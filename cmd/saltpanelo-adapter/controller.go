@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"github.com/pojntfx/saltpanelo/pkg/services"
+)
+
+var (
+	errNoPeersConnected = errors.New("no peers connected")
+	errDraining         = errors.New("could not dial while draining")
+)
+
+const (
+	eventTypeIncomingCall    = "incoming-call"
+	eventTypeCallStarted     = "call-started"
+	eventTypeCallEnded       = "call-ended"
+	eventTypeCallQueued      = "call-queued"
+	eventTypeCallRinging     = "call-ringing"
+	eventTypeCallAnswered    = "call-answered"
+	eventTypeCallDeclined    = "call-declined"
+	eventTypeCallCancelled   = "call-cancelled"
+	eventTypeCallTimedOut    = "call-timed-out"
+	eventTypeCallRejected    = "call-rejected"
+	eventTypeCallHeld        = "call-held"
+	eventTypeCallResumed     = "call-resumed"
+	eventTypeCallTransferred = "call-transferred"
+
+	eventBufferLen = 64
+)
+
+type call struct {
+	RouteID   string `json:"routeID"`
+	ChannelID string `json:"channelID"`
+	Raddr     string `json:"raddr"`
+}
+
+type event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RouteID   string    `json:"routeID,omitempty"`
+	ChannelID string    `json:"channelID,omitempty"`
+	SrcID     string    `json:"srcID,omitempty"`
+	SrcEmail  string    `json:"srcEmail,omitempty"`
+	Raddr     string    `json:"raddr,omitempty"`
+	Accept    bool      `json:"accept,omitempty"`
+	IsCaller  bool      `json:"isCaller,omitempty"`
+}
+
+type ringingCall struct {
+	isCaller bool
+	cancel   func()
+}
+
+type controller struct {
+	verbose  bool
+	draining atomic.Bool
+
+	getIDToken func() (string, error)
+	peers      func() map[string]services.GatewayRemote
+
+	callsLock sync.Mutex
+	calls     map[string]call
+
+	ringingLock sync.Mutex
+	ringing     map[string]ringingCall
+
+	presenceLock sync.Mutex
+	presence     string
+
+	priority int
+
+	subscribersLock sync.Mutex
+	subscribers     map[chan event]struct{}
+}
+
+func newController(verbose bool, getIDToken func() (string, error), presence string, priority int) *controller {
+	return &controller{
+		verbose: verbose,
+
+		getIDToken: getIDToken,
+
+		calls: map[string]call{},
+
+		ringing: map[string]ringingCall{},
+
+		presence: presence,
+
+		priority: priority,
+
+		subscribers: map[chan event]struct{}{},
+	}
+}
+
+func (c *controller) dial(ctx context.Context, email, channelID string) (services.RequestCallResult, error) {
+	if c.peers == nil {
+		return services.RequestCallResult{}, errNoPeersConnected
+	}
+
+	if c.draining.Load() {
+		return services.RequestCallResult{}, errDraining
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return services.RequestCallResult{}, err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.RequestCallByEmail(ctx, token, email, channelID)
+	}
+
+	return services.RequestCallResult{}, errNoPeersConnected
+}
+
+func (c *controller) dialGroup(ctx context.Context, emails []string, channelID string) (services.RequestGroupCallResult, error) {
+	if c.peers == nil {
+		return services.RequestGroupCallResult{}, errNoPeersConnected
+	}
+
+	if c.draining.Load() {
+		return services.RequestGroupCallResult{}, errDraining
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return services.RequestGroupCallResult{}, err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.RequestGroupCall(ctx, token, emails, channelID)
+	}
+
+	return services.RequestGroupCallResult{}, errNoPeersConnected
+}
+
+func (c *controller) invite(ctx context.Context, routeID, email string) (services.RequestGroupCallResult, error) {
+	if c.peers == nil {
+		return services.RequestGroupCallResult{}, errNoPeersConnected
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return services.RequestGroupCallResult{}, err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.InviteToGroupCall(ctx, token, routeID, email)
+	}
+
+	return services.RequestGroupCallResult{}, errNoPeersConnected
+}
+
+func (c *controller) join(ctx context.Context, routeID string) error {
+	if c.peers == nil {
+		return errNoPeersConnected
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.JoinGroupCall(ctx, token, routeID)
+	}
+
+	return errNoPeersConnected
+}
+
+func (c *controller) leave(ctx context.Context, routeID string) error {
+	if c.peers == nil {
+		return errNoPeersConnected
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.LeaveGroupCall(ctx, token, routeID)
+	}
+
+	return errNoPeersConnected
+}
+
+func (c *controller) hold(ctx context.Context, routeID string, hold bool) error {
+	if c.peers == nil {
+		return errNoPeersConnected
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.HoldCall(ctx, token, routeID, hold)
+	}
+
+	return errNoPeersConnected
+}
+
+func (c *controller) transfer(ctx context.Context, routeID, email string) (services.RequestCallResult, error) {
+	if c.peers == nil {
+		return services.RequestCallResult{}, errNoPeersConnected
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return services.RequestCallResult{}, err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.TransferCall(ctx, token, routeID, email)
+	}
+
+	return services.RequestCallResult{}, errNoPeersConnected
+}
+
+func (c *controller) hangup(ctx context.Context, routeID string) error {
+	if c.peers == nil {
+		return errNoPeersConnected
+	}
+
+	if c.verbose {
+		log.Println("Hanging up call with route ID", routeID)
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return err
+	}
+
+	c.ringingLock.Lock()
+	rc, ok := c.ringing[routeID]
+	c.ringingLock.Unlock()
+
+	for _, peer := range c.peers() {
+		// Outgoing calls which are still ringing can only be cancelled
+		if ok && rc.isCaller {
+			return peer.CancelCall(ctx, token, routeID)
+		}
+
+		return peer.HangupCall(ctx, token, routeID)
+	}
+
+	return errNoPeersConnected
+}
+
+func (c *controller) getPresence() string {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+
+	return c.presence
+}
+
+func (c *controller) setPresence(ctx context.Context, presence string) error {
+	c.presenceLock.Lock()
+	c.presence = presence
+	c.presenceLock.Unlock()
+
+	return c.publishPresence(ctx)
+}
+
+// publishPresence sends the current presence and priority to the gateway, i.e. after registering again
+func (c *controller) publishPresence(ctx context.Context) error {
+	if c.peers == nil {
+		return errNoPeersConnected
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return err
+	}
+
+	for _, peer := range c.peers() {
+		if err := peer.SetPriority(ctx, token, c.priority); err != nil {
+			return err
+		}
+
+		return peer.SetPresence(ctx, token, c.getPresence())
+	}
+
+	return errNoPeersConnected
+}
+
+func (c *controller) lookupPresence(ctx context.Context, email string) (string, error) {
+	if c.peers == nil {
+		return "", errNoPeersConnected
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return "", err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.GetPresence(ctx, token, email)
+	}
+
+	return "", errNoPeersConnected
+}
+
+// ringingContext returns a context which is cancelled once the call with the route ID stops ringing
+func (c *controller) ringingContext(ctx context.Context, routeID string) context.Context {
+	c.ringingLock.Lock()
+	defer c.ringingLock.Unlock()
+
+	rc, ok := c.ringing[routeID]
+	if !ok {
+		// The call has already stopped ringing
+		ringCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		return ringCtx
+	}
+
+	ringCtx, cancel := context.WithCancel(ctx)
+
+	previousCancel := rc.cancel
+	rc.cancel = func() {
+		previousCancel()
+		cancel()
+	}
+
+	c.ringing[routeID] = rc
+
+	return ringCtx
+}
+
+func (c *controller) history(ctx context.Context, limit int) ([]persisters.CallDetailRecord, error) {
+	if c.peers == nil {
+		return []persisters.CallDetailRecord{}, errNoPeersConnected
+	}
+
+	token, err := c.getIDToken()
+	if err != nil {
+		return []persisters.CallDetailRecord{}, err
+	}
+
+	for _, peer := range c.peers() {
+		return peer.ListCallHistory(ctx, token, limit)
+	}
+
+	return []persisters.CallDetailRecord{}, errNoPeersConnected
+}
+
+func (c *controller) list() []call {
+	c.callsLock.Lock()
+	defer c.callsLock.Unlock()
+
+	calls := []call{}
+	for _, ca := range c.calls {
+		calls = append(calls, ca)
+	}
+
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].RouteID < calls[j].RouteID
+	})
+
+	return calls
+}
+
+func (c *controller) onIncomingCall(srcID, srcEmail, routeID, channelID string, accept bool) {
+	c.publish(event{
+		Type:      eventTypeIncomingCall,
+		RouteID:   routeID,
+		ChannelID: channelID,
+		SrcID:     srcID,
+		SrcEmail:  srcEmail,
+		Accept:    accept,
+	})
+}
+
+// onCallStateChanged returns true if the call with the route ID just started ringing or was just queued
+func (c *controller) onCallStateChanged(routeID, channelID, state string, isCaller bool) bool {
+	started := false
+
+	c.ringingLock.Lock()
+	if state == services.CallStateQueued || state == services.CallStateRinging {
+		if _, ok := c.ringing[routeID]; !ok {
+			c.ringing[routeID] = ringingCall{
+				isCaller: isCaller,
+				cancel:   func() {},
+			}
+
+			started = true
+		}
+	} else if rc, ok := c.ringing[routeID]; ok {
+		rc.cancel()
+
+		delete(c.ringing, routeID)
+	}
+	c.ringingLock.Unlock()
+
+	eventType := ""
+	switch state {
+	case services.CallStateQueued:
+		eventType = eventTypeCallQueued
+	case services.CallStateRinging:
+		eventType = eventTypeCallRinging
+	case services.CallStateAnswered:
+		eventType = eventTypeCallAnswered
+	case services.CallStateDeclined:
+		eventType = eventTypeCallDeclined
+	case services.CallStateCancelled:
+		eventType = eventTypeCallCancelled
+	case services.CallStateTimedOut:
+		eventType = eventTypeCallTimedOut
+	case services.CallStateRejected:
+		eventType = eventTypeCallRejected
+	case services.CallStateHeld:
+		eventType = eventTypeCallHeld
+	case services.CallStateResumed:
+		eventType = eventTypeCallResumed
+	case services.CallStateTransferred:
+		eventType = eventTypeCallTransferred
+	default:
+		log.Println("Received unknown state", state, "for call with route ID", routeID, ", skipping")
+
+		return started
+	}
+
+	c.publish(event{
+		Type:      eventType,
+		RouteID:   routeID,
+		ChannelID: channelID,
+		IsCaller:  isCaller,
+	})
+
+	return started
+}
+
+func (c *controller) onCallStarted(routeID, channelID, raddr string) {
+	c.callsLock.Lock()
+	c.calls[routeID] = call{
+		RouteID:   routeID,
+		ChannelID: channelID,
+		Raddr:     raddr,
+	}
+	c.callsLock.Unlock()
+
+	c.publish(event{
+		Type:      eventTypeCallStarted,
+		RouteID:   routeID,
+		ChannelID: channelID,
+		Raddr:     raddr,
+	})
+}
+
+func (c *controller) onCallEnded(routeID, channelID string) {
+	c.callsLock.Lock()
+	delete(c.calls, routeID)
+	c.callsLock.Unlock()
+
+	c.publish(event{
+		Type:      eventTypeCallEnded,
+		RouteID:   routeID,
+		ChannelID: channelID,
+	})
+}
+
+func (c *controller) publish(e event) {
+	e.Time = time.Now()
+
+	c.subscribersLock.Lock()
+	defer c.subscribersLock.Unlock()
+
+	for subscriber := range c.subscribers {
+		select {
+		case subscriber <- e:
+		default:
+			log.Println("Could not deliver event of type", e.Type, "to slow subscriber, skipping")
+		}
+	}
+}
+
+func (c *controller) subscribe() (chan event, func()) {
+	subscriber := make(chan event, eventBufferLen)
+
+	c.subscribersLock.Lock()
+	c.subscribers[subscriber] = struct{}{}
+	c.subscribersLock.Unlock()
+
+	return subscriber, func() {
+		c.subscribersLock.Lock()
+		delete(c.subscribers, subscriber)
+		c.subscribersLock.Unlock()
+	}
+}
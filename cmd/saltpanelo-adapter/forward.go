@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/config"
+	"github.com/pojntfx/saltpanelo/pkg/services"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	errInvalidExpose      = errors.New("invalid expose, expected format <channel ID>=<target address>")
+	errInvalidForward     = errors.New("invalid forward, expected format <listen address>=<email>:<channel ID>")
+	errInvalidDestination = errors.New("invalid destination, expected format <email>:<channel ID>")
+	errNothingToForward   = errors.New("could not continue without any channels to expose, forward or proxy")
+	errCallNotAnswered    = errors.New("call was not answered")
+	errRouteTimedOut      = errors.New("route was not provisioned before timeout")
+)
+
+// parseDestination splits a destination like `jean.doe@example.com:postgres` into the email and channel ID
+func parseDestination(destination string) (string, string, error) {
+	i := strings.LastIndex(destination, ":")
+	if i < 1 || i == len(destination)-1 {
+		return "", "", errInvalidDestination
+	}
+
+	return destination[:i], destination[i+1:], nil
+}
+
+type forwarder struct {
+	verbose bool
+
+	c *controller
+
+	exposed       map[string]string
+	allowedEmails []string
+
+	routeTimeout time.Duration
+
+	acceptedRoutesLock sync.Mutex
+	acceptedRoutes     map[string]string
+
+	dialedRoutesLock sync.Mutex
+	dialedRoutes     map[string]chan string
+}
+
+func newForwarder(
+	verbose bool,
+	c *controller,
+	exposed map[string]string,
+	allowedEmails []string,
+	routeTimeout time.Duration,
+) *forwarder {
+	return &forwarder{
+		verbose: verbose,
+
+		c: c,
+
+		exposed:       exposed,
+		allowedEmails: allowedEmails,
+
+		routeTimeout: routeTimeout,
+
+		acceptedRoutes: map[string]string{},
+
+		dialedRoutes: map[string]chan string{},
+	}
+}
+
+func (f *forwarder) getDialedRoute(routeID string) chan string {
+	f.dialedRoutesLock.Lock()
+	defer f.dialedRoutesLock.Unlock()
+
+	raddrs, ok := f.dialedRoutes[routeID]
+	if !ok {
+		raddrs = make(chan string, 1)
+
+		f.dialedRoutes[routeID] = raddrs
+	}
+
+	return raddrs
+}
+
+func (f *forwarder) onRequestCall(srcID, srcEmail, routeID, channelID string) bool {
+	target, ok := f.exposed[channelID]
+	if !ok {
+		if f.verbose {
+			log.Println("Declining call with route ID", routeID, "for unexposed channel ID", channelID)
+		}
+
+		return false
+	}
+
+	if len(f.allowedEmails) > 0 && !slices.Contains(f.allowedEmails, srcEmail) {
+		if f.verbose {
+			log.Println("Declining call with route ID", routeID, "from unauthorized email", srcEmail)
+		}
+
+		return false
+	}
+
+	f.acceptedRoutesLock.Lock()
+	f.acceptedRoutes[routeID] = target
+	f.acceptedRoutesLock.Unlock()
+
+	return true
+}
+
+func (f *forwarder) onHandleCall(ctx context.Context, routeID, channelID, raddr string) {
+	f.acceptedRoutesLock.Lock()
+	target, ok := f.acceptedRoutes[routeID]
+	f.acceptedRoutesLock.Unlock()
+
+	// If we didn't accept the call, we dialed it
+	if !ok {
+		f.getDialedRoute(routeID) <- raddr
+
+		return
+	}
+
+	go func() {
+		defer func() {
+			if err := f.c.hangup(ctx, routeID); err != nil && f.verbose {
+				log.Println("Could not hang up call with route ID", routeID, ", continuing:", err)
+			}
+		}()
+
+		local, err := net.Dial("tcp", raddr)
+		if err != nil {
+			log.Println("Could not connect to route with ID", routeID, ", stopping:", err)
+
+			return
+		}
+
+		remote, err := net.Dial("tcp", target)
+		if err != nil {
+			_ = local.Close()
+
+			log.Println("Could not connect to target", target, "for route with ID", routeID, ", stopping:", err)
+
+			return
+		}
+
+		if f.verbose {
+			log.Println("Forwarding route with ID", routeID, "and channel ID", channelID, "to target", target)
+		}
+
+		utils.Splice(local, remote)
+	}()
+}
+
+func (f *forwarder) onCallDisconnected(routeID string) {
+	f.acceptedRoutesLock.Lock()
+	delete(f.acceptedRoutes, routeID)
+	f.acceptedRoutesLock.Unlock()
+
+	f.dialedRoutesLock.Lock()
+	delete(f.dialedRoutes, routeID)
+	f.dialedRoutesLock.Unlock()
+}
+
+// dialChannel requests a call to the channel and connects to the route once it has been provisioned
+func (f *forwarder) dialChannel(ctx context.Context, email, channelID string) (net.Conn, string, error) {
+	res, err := f.c.dial(ctx, email, channelID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !res.Accept {
+		return nil, "", fmt.Errorf("%w: %v", errCallNotAnswered, res.State)
+	}
+
+	var raddr string
+	select {
+	case raddr = <-f.getDialedRoute(res.RouteID):
+	case <-time.After(f.routeTimeout):
+		_ = f.c.hangup(ctx, res.RouteID)
+
+		return nil, "", errRouteTimedOut
+	}
+
+	conn, err := net.Dial("tcp", raddr)
+	if err != nil {
+		_ = f.c.hangup(ctx, res.RouteID)
+
+		return nil, "", err
+	}
+
+	return conn, res.RouteID, nil
+}
+
+func (f *forwarder) serveForward(ctx context.Context, lis net.Listener, email, channelID string) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			remote, routeID, err := f.dialChannel(ctx, email, channelID)
+			if err != nil {
+				log.Println("Could not dial channel ID", channelID, "of email", email, ", stopping:", err)
+
+				return
+			}
+
+			if f.verbose {
+				log.Println("Forwarding connection from", conn.RemoteAddr(), "to route with ID", routeID)
+			}
+
+			utils.Splice(conn, remote)
+
+			if err := f.c.hangup(ctx, routeID); err != nil && f.verbose {
+				log.Println("Could not hang up call with route ID", routeID, ", continuing:", err)
+			}
+		}()
+	}
+}
+
+func runForward(args []string) {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	configPath := fs.String("config", "", "Path to the YAML config file whose keys are the flag names (e.g. retry-interval: 5s); environment variables (e.g. SALTPANELO_RETRY_INTERVAL) and flags take precedence over it, and SIGHUP reloads verbose")
+	raddr := fs.String("raddr", "wss://localhost:1338", "Comma-separated list of gateway remote addresses (one per control plane replica)")
+	caPath := fs.String("ca", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "ca.cert.pem"), "Path to the CA certificate which the gateway's certificate is verified with in addition to the system roots (e.g. the ca.cert.pem in the working directory of the control plane)")
+	retryInterval := fs.Duration("retry-interval", time.Second*5, "Time to wait before trying all gateway remote addresses again if none of them can be reached (doubles with each attempt up to the maximum retry interval)")
+	maxRetryInterval := fs.Duration("max-retry-interval", time.Minute, "Maximum time to wait before trying all gateway remote addresses again")
+	ahost := fs.String("ahost", "127.0.0.1", "Host to bind to when receiving calls; direct routes are offered on its address only (use 0.0.0.0 to offer them on all interfaces; loopback hosts can't receive direct routes)")
+	direct := fs.Bool("direct", true, "Whether to allow direct routes to other adapters if they are cheaper than routes through switches")
+	timeout := fs.Duration("timeout", time.Minute, "Time after which to assume that a call has timed out")
+	verbose := fs.Bool("verbose", false, "Whether to enable verbose logging")
+	drainTimeout := fs.Duration("drain-timeout", time.Second*30, "Time to wait for calls to end after receiving SIGINT or SIGTERM before hanging them up and shutting down")
+	identity := fs.String("identity", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "adapter-forward.pem"), "Path to the private key which identifies the adapter across restarts and reconnects (will be created if it doesn't exist; use a separate one for each adapter)")
+
+	oidcIssuer := fs.String("oidc-issuer", "", "OIDC issuer (e.g. https://pojntfx.eu.auth0.com/)")
+	oidcClientID := fs.String("oidc-client-id", "", "OIDC client ID")
+	oidcRedirectURL := fs.String("oidc-redirect-url", "http://localhost:11337", "OIDC redirect URL")
+
+	expose := fs.String("expose", "", "Comma-separated list of channel IDs to expose and the targets to forward them to (e.g. postgres=127.0.0.1:5432)")
+	forward := fs.String("forward", "", "Comma-separated list of addresses to listen on and the channels to dial for each connection (e.g. 127.0.0.1:15432=jean.doe@example.com:postgres)")
+	acceptEmails := fs.String("accept-emails", "", "Comma-separated list of caller emails which may connect to exposed channels (leave empty to allow all emails)")
+	proxyLaddr := fs.String("proxy-laddr", "", "Listen address for the SOCKS5 and HTTP CONNECT proxy (e.g. 127.0.0.1:1080 or unix:///tmp/saltpanelo-proxy.sock); leave empty to disable")
+	apiTokenPath := fs.String("api-token-file", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "adapter-api.token"), "Path to the file with the token which clients of the proxy have to send as the SOCKS5 or basic authentication password if it listens on TCP (will be created with a random token if it doesn't exist; "+apiTokenEnv+" takes precedence over it)")
+
+	if err := fs.Parse(args); err != nil {
+		panic(err)
+	}
+
+	loader := config.NewLoader(fs, *configPath)
+	if err := loader.Load(); err != nil {
+		panic(err)
+	}
+
+	if strings.TrimSpace(*oidcIssuer) == "" {
+		panic(auth.ErrEmptyOIDCIssuer)
+	}
+
+	if strings.TrimSpace(*oidcClientID) == "" {
+		panic(auth.ErrEmptyOIDCClientID)
+	}
+
+	if strings.TrimSpace(*oidcRedirectURL) == "" {
+		panic(auth.ErrEmptyOIDCRedirectURL)
+	}
+
+	privKey, err := utils.LoadOrCreateIdentity(*identity)
+	if err != nil {
+		panic(err)
+	}
+
+	dialOptions, err := utils.GetCADialOptions(*caPath)
+	if err != nil {
+		panic(err)
+	}
+
+	exposed := map[string]string{}
+	for _, e := range splitList(*expose) {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			panic(fmt.Errorf("%w: %v", errInvalidExpose, e))
+		}
+
+		exposed[parts[0]] = parts[1]
+	}
+
+	type forwardConfig struct {
+		laddr     string
+		email     string
+		channelID string
+	}
+
+	forwards := []forwardConfig{}
+	for _, f := range splitList(*forward) {
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) != 2 {
+			panic(fmt.Errorf("%w: %v", errInvalidForward, f))
+		}
+
+		email, channelID, err := parseDestination(parts[1])
+		if err != nil {
+			panic(fmt.Errorf("%w: %v", errInvalidForward, f))
+		}
+
+		forwards = append(forwards, forwardConfig{parts[0], email, channelID})
+	}
+
+	if len(exposed) < 1 && len(forwards) < 1 && strings.TrimSpace(*proxyLaddr) == "" {
+		panic(errNothingToForward)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tm := newTokenManager(ctx, *oidcIssuer, *oidcClientID, *oidcRedirectURL, false)
+
+	if err := tm.InitialLogin(); err != nil {
+		panic(err)
+	}
+
+	errs := make(chan error)
+
+	c := newController(*verbose, tm.GetIDToken, services.PresenceAvailable, 0)
+	f := newForwarder(*verbose, c, exposed, splitList(*acceptEmails), *timeout)
+
+	l := services.NewAdapter(
+		*verbose,
+		*ahost,
+		*direct,
+		func(ctx context.Context, srcID, srcEmail, routeID, channelID string) (bool, error) {
+			accept := f.onRequestCall(srcID, srcEmail, routeID, channelID)
+
+			c.onIncomingCall(srcID, srcEmail, routeID, channelID, accept)
+
+			return accept, nil
+		},
+		func(ctx context.Context, routeID, channelID string) error {
+			f.onCallDisconnected(routeID)
+
+			c.onCallEnded(routeID, channelID)
+
+			return nil
+		},
+		func(ctx context.Context, routeID, channelID, raddr string) error {
+			c.onCallStarted(routeID, channelID, raddr)
+
+			f.onHandleCall(ctx, routeID, channelID, raddr)
+
+			return nil
+		},
+		func(ctx context.Context, routeID, channelID, state string, isCaller bool) error {
+			// Another device might have answered the call or it might have been cancelled
+			if state == services.CallStateCancelled || state == services.CallStateTimedOut {
+				f.onCallDisconnected(routeID)
+			}
+
+			c.onCallStateChanged(routeID, channelID, state, isCaller)
+
+			return nil
+		},
+		tm.GetIDToken,
+
+		ctx,
+	)
+
+	linkGateway(ctx, l, tm.GetIDToken, privKey, utils.SplitRemoteAddresses(*raddr), dialOptions, *retryInterval, *maxRetryInterval, *timeout, *verbose, func() {}, errs)
+	c.peers = l.Peers
+
+	loader.Watch(ctx, []string{"verbose"}, func(values config.Values, changed []string) {
+		services.SetAdapterVerbose(l, values.Bool("verbose"))
+	})
+
+	for channelID, target := range exposed {
+		log.Println("Exposing channel ID", channelID, "as", target)
+	}
+
+	for _, fc := range forwards {
+		go func(fc forwardConfig) {
+			lis, err := net.Listen("tcp", fc.laddr)
+			if err != nil {
+				errs <- err
+
+				return
+			}
+			defer lis.Close()
+
+			log.Println("Forwarding", lis.Addr(), "to channel ID", fc.channelID, "of email", fc.email)
+
+			if err := f.serveForward(ctx, lis, fc.email, fc.channelID); err != nil {
+				errs <- err
+
+				return
+			}
+		}(fc)
+	}
+
+	if strings.TrimSpace(*proxyLaddr) != "" {
+		apiToken := ""
+		if needsAPIToken(*proxyLaddr) {
+			apiToken, err = loadOrCreateAPIToken(*apiTokenPath)
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		go func() {
+			if err := listenAndServeProxy(ctx, f, *proxyLaddr, apiToken); err != nil {
+				errs <- err
+
+				return
+			}
+		}()
+	}
+
+	waitForShutdown(ctx, cancel, l, c, *drainTimeout, errs)
+}
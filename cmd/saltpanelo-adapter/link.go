@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"log"
+	"time"
+
+	"github.com/cli/browser"
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/services"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+	"nhooyr.io/websocket"
+)
+
+func newTokenManager(
+	ctx context.Context,
+	oidcIssuer,
+	oidcClientID,
+	oidcRedirectURL string,
+	openBrowser bool,
+) *auth.TokenManagerAuthorizationCode {
+	return auth.NewTokenManagerAuthorizationCode(
+		oidcIssuer,
+		oidcClientID,
+		oidcRedirectURL,
+
+		func(s string) error {
+			if !openBrowser {
+				log.Printf(`Please open the following URL in your browser to authorize:
+%v`, s)
+
+				return nil
+			}
+
+			if err := browser.OpenURL(s); err != nil {
+				log.Printf(`Could not open browser, please open the following URL in your browser manually to authorize:
+%v`, s)
+			}
+
+			return nil
+		},
+
+		ctx,
+	)
+}
+
+func linkGateway(
+	ctx context.Context,
+	l *services.Adapter,
+	getIDToken func() (string, error),
+	privKey ed25519.PrivateKey,
+	raddrs []string,
+	dialOptions *websocket.DialOptions,
+	retryInterval,
+	maxRetryInterval,
+	timeout time.Duration,
+	verbose bool,
+	onRegistered func(),
+	errs chan error,
+) {
+	// Registration errors (e.g. a gateway without a router) close the link so that the adapter fails over and keeps its routes
+	linkedConn := &utils.LinkedConn{}
+
+	clients := 0
+	registry := rpc.NewRegistry(
+		l,
+		services.GatewayRemote{},
+		timeout,
+		ctx,
+		&rpc.Options{
+			ResponseBufferLen: rpc.DefaultResponseBufferLen,
+			OnClientConnect: func(remoteID string) {
+				clients++
+
+				log.Printf("%v clients connected", clients)
+
+				conn := linkedConn.Current()
+
+				go func() {
+					for candidateID, peer := range l.Peers() {
+						if remoteID == candidateID {
+							if verbose {
+								log.Println("Registering with gateway with ID", remoteID)
+							}
+
+							token, err := getIDToken()
+							if err != nil {
+								log.Println("Could not register with gateway with ID", remoteID, ", failing over:", err)
+
+								linkedConn.Fail(conn, err)
+
+								return
+							}
+
+							// Adapters register again with the same identity after reconnecting or failing over to another replica, so that the gateway resumes their routes
+							challenge, err := peer.GetRegistrationChallenge(ctx)
+							if err != nil {
+								log.Println("Could not register with gateway with ID", remoteID, ", failing over:", err)
+
+								linkedConn.Fail(conn, err)
+
+								return
+							}
+
+							caPEM, err := peer.RegisterAdapter(ctx, token, services.NewNodeIdentity(privKey, challenge))
+							if err != nil {
+								log.Println("Could not register with gateway with ID", remoteID, ", failing over:", err)
+
+								linkedConn.Fail(conn, err)
+
+								return
+							}
+
+							services.SetAdapterCA(l, caPEM)
+
+							if verbose {
+								log.Println("Registered with gateway with ID", remoteID)
+							}
+
+							onRegistered()
+						}
+					}
+				}()
+			},
+			OnClientDisconnect: func(remoteID string) {
+				clients--
+
+				log.Printf("%v clients connected", clients)
+			},
+		},
+	)
+	l.Peers = registry.Peers
+
+	go func() {
+		if err := utils.LinkWithFailover(ctx, raddrs, retryInterval, maxRetryInterval, dialOptions, linkedConn.Link(registry.Link)); err != nil {
+			errs <- err
+
+			return
+		}
+	}()
+}
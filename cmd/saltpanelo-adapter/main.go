@@ -6,29 +6,65 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/cli/browser"
 	"github.com/ncruces/zenity"
-	"github.com/pojntfx/dudirekta/pkg/rpc"
 	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/config"
 	"github.com/pojntfx/saltpanelo/pkg/services"
-	"nhooyr.io/websocket"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
 )
 
 func main() {
-	raddr := flag.String("raddr", "ws://localhost:1338", "Gateway remote address")
-	ahost := flag.String("ahost", "127.0.0.1", "Host to bind to when receiving calls")
+	if len(os.Args) > 1 && os.Args[1] == "forward" {
+		runForward(os.Args[2:])
+
+		return
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	configPath := flag.String("config", "", "Path to the YAML config file whose keys are the flag names (e.g. retry-interval: 5s); environment variables (e.g. SALTPANELO_RETRY_INTERVAL) and flags take precedence over it, and SIGHUP reloads verbose")
+	raddr := flag.String("raddr", "wss://localhost:1338", "Comma-separated list of gateway remote addresses (one per control plane replica)")
+	caPath := flag.String("ca", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "ca.cert.pem"), "Path to the CA certificate which the gateway's certificate is verified with in addition to the system roots (e.g. the ca.cert.pem in the working directory of the control plane)")
+	retryInterval := flag.Duration("retry-interval", time.Second*5, "Time to wait before trying all gateway remote addresses again if none of them can be reached (doubles with each attempt up to the maximum retry interval)")
+	maxRetryInterval := flag.Duration("max-retry-interval", time.Minute, "Maximum time to wait before trying all gateway remote addresses again")
+	ahost := flag.String("ahost", "127.0.0.1", "Host to bind to when receiving calls; direct routes are offered on its address only (use 0.0.0.0 to offer them on all interfaces; loopback hosts can't receive direct routes)")
+	direct := flag.Bool("direct", true, "Whether to allow direct routes to other adapters if they are cheaper than routes through switches")
 	timeout := flag.Duration("timeout", time.Minute, "Time after which to assume that a call has timed out")
 	verbose := flag.Bool("verbose", false, "Whether to enable verbose logging")
+	drainTimeout := flag.Duration("drain-timeout", time.Second*30, "Time to wait for calls to end after receiving SIGINT or SIGTERM before hanging them up and shutting down")
+	identity := flag.String("identity", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "adapter.pem"), "Path to the private key which identifies the adapter across restarts and reconnects (will be created if it doesn't exist; use a separate one for each adapter)")
 
 	oidcIssuer := flag.String("oidc-issuer", "", "OIDC issuer (e.g. https://pojntfx.eu.auth0.com/)")
 	oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID")
 	oidcRedirectURL := flag.String("oidc-redirect-url", "http://localhost:11337", "OIDC redirect URL")
 
+	presence := flag.String("presence", services.PresenceAvailable, "Presence to publish to the gateway (available, busy, dnd or away)")
+	priority := flag.Int("priority", 0, "Priority of this device when the gateway rings a user's devices sequentially (devices with lower values ring first)")
+
+	headless := flag.Bool("headless", false, "Whether to run without dialogs (use the control API and stdin instead)")
+	autoAccept := flag.String("auto-accept", acceptPolicyNone, "Policy for incoming calls in headless mode (all, none or allowlist)")
+	acceptEmails := flag.String("accept-emails", "", "Comma-separated list of caller emails to accept with the allowlist policy (leave empty to accept all emails)")
+	acceptChannels := flag.String("accept-channels", "", "Comma-separated list of channel IDs to accept with the allowlist policy (leave empty to accept all channel IDs)")
+	apiLaddr := flag.String("api-laddr", "", "Listen address for the control API (e.g. 127.0.0.1:1341 or unix:///tmp/saltpanelo-adapter.sock); leave empty to disable")
+	apiTokenPath := flag.String("api-token-file", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "adapter-api.token"), "Path to the file with the token which clients of the control API (as a bearer token) and the proxy (as the SOCKS5 or basic authentication password) have to send if they listen on TCP (will be created with a random token if it doesn't exist; "+apiTokenEnv+" takes precedence over it); requests other than GET need a Content-Type of application/json")
+	proxyLaddr := flag.String("proxy-laddr", "", "Listen address for the SOCKS5 and HTTP CONNECT proxy (e.g. 127.0.0.1:1080 or unix:///tmp/saltpanelo-proxy.sock); leave empty to disable")
+	stdin := flag.Bool("stdin", false, "Whether to read commands (dial <email> <channel ID>, group-dial <channel ID> <email>..., invite <route ID> <email>, join <route ID>, leave <route ID>, hold <route ID>, resume <route ID>, transfer <route ID> <email>, hangup <route ID>, list, history [limit], presence <presence>, presence-of <email>) from stdin and write results and events to stdout in headless mode")
+
 	flag.Parse()
 
+	loader := config.NewLoader(flag.CommandLine, *configPath)
+	if err := loader.Load(); err != nil {
+		panic(err)
+	}
+
 	if strings.TrimSpace(*oidcIssuer) == "" {
 		panic(auth.ErrEmptyOIDCIssuer)
 	}
@@ -41,25 +77,25 @@ func main() {
 		panic(auth.ErrEmptyOIDCRedirectURL)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	privKey, err := utils.LoadOrCreateIdentity(*identity)
+	if err != nil {
+		panic(err)
+	}
 
-	tm := auth.NewTokenManagerAuthorizationCode(
-		*oidcIssuer,
-		*oidcClientID,
-		*oidcRedirectURL,
+	dialOptions, err := utils.GetCADialOptions(*caPath)
+	if err != nil {
+		panic(err)
+	}
 
-		func(s string) error {
-			if err := browser.OpenURL(s); err != nil {
-				log.Printf(`Could not open browser, please open the following URL in your browser manually to authorize:
-%v`, s)
-			}
+	policy, err := newAcceptPolicy(*autoAccept, *acceptEmails, *acceptChannels)
+	if err != nil {
+		panic(err)
+	}
 
-			return nil
-		},
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-		ctx,
-	)
+	tm := newTokenManager(ctx, *oidcIssuer, *oidcClientID, *oidcRedirectURL, !*headless)
 
 	if err := tm.InitialLogin(); err != nil {
 		panic(err)
@@ -67,28 +103,62 @@ func main() {
 
 	errs := make(chan error)
 
+	c := newController(*verbose, tm.GetIDToken, *presence, *priority)
+	f := newForwarder(*verbose, c, map[string]string{}, []string{}, *timeout)
+
 	var l *services.Adapter
 	l = services.NewAdapter(
 		*verbose,
 		*ahost,
+		*direct,
 		func(ctx context.Context, srcID, srcEmail, routeID, channelID string) (bool, error) {
+			if *headless {
+				accept := policy.accept(srcEmail, channelID)
+
+				c.onIncomingCall(srcID, srcEmail, routeID, channelID, accept)
+
+				return accept, nil
+			}
+
+			ringCtx := c.ringingContext(ctx, routeID)
+
 			if err := zenity.Question(
 				fmt.Sprintf("Incoming call from remote with with ID %v, email %v, route ID %v and channel ID %v, do you want to answer it?", srcID, srcEmail, routeID, channelID),
 				zenity.Title("Incoming Call"),
 				zenity.QuestionIcon,
 				zenity.OKLabel("Answer"),
 				zenity.CancelLabel("Decline"),
+				zenity.Context(ringCtx),
 			); err != nil {
+				// The caller cancelled the call or it timed out
+				if ringCtx.Err() != nil {
+					c.onIncomingCall(srcID, srcEmail, routeID, channelID, false)
+
+					return false, nil
+				}
+
 				if errors.Is(err, zenity.ErrCanceled) {
+					c.onIncomingCall(srcID, srcEmail, routeID, channelID, false)
+
 					return false, nil
 				}
 
 				return false, err
 			}
 
+			c.onIncomingCall(srcID, srcEmail, routeID, channelID, true)
+
 			return true, nil
 		},
 		func(ctx context.Context, routeID, channelID string) error {
+			f.onCallDisconnected(routeID)
+
+			c.onCallEnded(routeID, channelID)
+
+			if *headless {
+				return nil
+			}
+
 			go func() {
 				if err := zenity.Info(fmt.Sprintf("Call with route ID %v and channel ID %v ended", routeID, channelID)); err != nil {
 					log.Println("Could not display call disconnection message, continuing:", err)
@@ -98,6 +168,16 @@ func main() {
 			return nil
 		},
 		func(ctx context.Context, routeID, channelID, raddr string) error {
+			c.onCallStarted(routeID, channelID, raddr)
+
+			if strings.TrimSpace(*proxyLaddr) != "" {
+				f.onHandleCall(ctx, routeID, channelID, raddr)
+			}
+
+			if *headless {
+				return nil
+			}
+
 			for _, peer := range l.Peers() {
 				go func(peer services.GatewayRemote) {
 					if err := zenity.Question(
@@ -137,137 +217,150 @@ func main() {
 
 			return nil
 		},
-		tm.GetIDToken,
-	)
-	clients := 0
-	registry := rpc.NewRegistry(
-		l,
-		services.GatewayRemote{},
-		*timeout,
-		ctx,
-		&rpc.Options{
-			ResponseBufferLen: rpc.DefaultResponseBufferLen,
-			OnClientConnect: func(remoteID string) {
-				clients++
-
-				log.Printf("%v clients connected", clients)
-
-				go func() {
-					for candidateID, peer := range l.Peers() {
-						if remoteID == candidateID {
-							if *verbose {
-								log.Println("Registering with gateway with ID", remoteID)
-							}
-
-							token, err := tm.GetIDToken()
-							if err != nil {
-								errs <- err
-
-								return
-							}
+		func(ctx context.Context, routeID, channelID, state string, isCaller bool) error {
+			if started := c.onCallStateChanged(routeID, channelID, state, isCaller); *headless || !isCaller || !started {
+				return nil
+			}
 
-							caPEM, err := peer.RegisterAdapter(ctx, token)
-							if err != nil {
-								errs <- err
+			go func() {
+				ringCtx := c.ringingContext(ctx, routeID)
+
+				if err := zenity.Info(
+					fmt.Sprintf("Calling with route ID %v and channel ID %v", routeID, channelID),
+					zenity.Title("Outgoing Call"),
+					zenity.OKLabel("Cancel"),
+					zenity.Context(ringCtx),
+				); err != nil {
+					if ringCtx.Err() != nil || errors.Is(err, zenity.ErrCanceled) {
+						return
+					}
 
-								return
-							}
+					errs <- err
 
-							services.SetAdapterCA(l, caPEM)
+					return
+				}
 
-							if *verbose {
-								log.Println("Registered with gateway with ID", remoteID)
-							}
-						}
-					}
-				}()
-			},
-			OnClientDisconnect: func(remoteID string) {
-				clients--
+				if err := c.hangup(ctx, routeID); err != nil {
+					log.Println("Could not cancel call with route ID", routeID, ", continuing:", err)
+				}
+			}()
 
-				log.Printf("%v clients connected", clients)
-			},
+			return nil
 		},
+		tm.GetIDToken,
+
+		ctx,
 	)
-	l.Peers = registry.Peers
+	linkGateway(ctx, l, tm.GetIDToken, privKey, utils.SplitRemoteAddresses(*raddr), dialOptions, *retryInterval, *maxRetryInterval, *timeout, *verbose, func() {
+		if err := c.publishPresence(ctx); err != nil {
+			log.Println("Could not publish presence and priority, continuing:", err)
+		}
+	}, errs)
+	c.peers = l.Peers
 
-	go func() {
-		rawConn, _, err := websocket.Dial(ctx, *raddr, nil)
-		if err != nil {
-			errs <- err
+	loader.Watch(ctx, []string{"verbose"}, func(values config.Values, changed []string) {
+		services.SetAdapterVerbose(l, values.Bool("verbose"))
+	})
 
-			return
+	// The control API and the proxy share the token, since both can place calls as the user
+	apiToken := ""
+	if needsAPIToken(*apiLaddr) || needsAPIToken(*proxyLaddr) {
+		apiToken, err = loadOrCreateAPIToken(*apiTokenPath)
+		if err != nil {
+			panic(err)
 		}
-		conn := websocket.NetConn(ctx, rawConn, websocket.MessageText)
-		defer conn.Close()
+	}
 
-		log.Println("Connected to", conn.RemoteAddr())
+	if strings.TrimSpace(*apiLaddr) != "" {
+		go func() {
+			lis, err := listenAPI(*apiLaddr, apiToken)
+			if err != nil {
+				errs <- err
 
-		if err := registry.Link(conn); err != nil {
-			errs <- err
+				return
+			}
+			defer lis.Close()
 
-			return
-		}
-	}()
+			log.Println("Control API listening on", lis.Addr())
 
-	go func() {
-		for {
-			email, err := zenity.Entry("Email to call", zenity.Title("Dialer"))
-			if err != nil {
+			if err := serveAPI(ctx, lis, apiToken, c); err != nil {
 				errs <- err
 
 				return
 			}
+		}()
+	}
 
-			token, err := tm.GetIDToken()
-			if err != nil {
+	if strings.TrimSpace(*proxyLaddr) != "" {
+		go func() {
+			if err := listenAndServeProxy(ctx, f, *proxyLaddr, apiToken); err != nil {
 				errs <- err
 
 				return
 			}
+		}()
+	}
 
-			for _, peer := range l.Peers() {
-				dstID, err := peer.ResolveEmailToID(ctx, token, email)
+	if *headless {
+		if *stdin {
+			go func() {
+				errs <- serveStdin(ctx, os.Stdin, os.Stdout, c)
+			}()
+		}
+	} else {
+		go func() {
+			for {
+				email, err := zenity.Entry("Email to call", zenity.Title("Dialer"))
 				if err != nil {
 					errs <- err
 
 					return
 				}
 
-				channelID, err := zenity.Entry("Channel ID to call", zenity.Title("Dialer"))
+				token, err := tm.GetIDToken()
 				if err != nil {
 					errs <- err
 
 					return
 				}
 
-				requestCallResult, err := peer.RequestCall(ctx, token, dstID, channelID)
-				if err != nil {
-					errs <- err
+				for _, peer := range l.Peers() {
+					if _, err := peer.ResolveEmailToIDs(ctx, token, email); err != nil {
+						errs <- err
 
-					return
-				}
+						return
+					}
 
-				if requestCallResult.Accept {
-					if *verbose {
-						log.Println("Callee answered the call with route ID", requestCallResult.RouteID)
+					channelID, err := zenity.Entry("Channel ID to call", zenity.Title("Dialer"))
+					if err != nil {
+						errs <- err
+
+						return
 					}
-				} else {
-					if err := zenity.Error("Callee declined the call"); err != nil {
+
+					requestCallResult, err := peer.RequestCallByEmail(ctx, token, email, channelID)
+					if err != nil {
 						errs <- err
 
 						return
 					}
+
+					if requestCallResult.Accept {
+						if *verbose {
+							log.Println("Callee answered the call with route ID", requestCallResult.RouteID)
+						}
+					} else {
+						if err := zenity.Error(fmt.Sprintf("Call was not answered (%v)", requestCallResult.State)); err != nil {
+							errs <- err
+
+							return
+						}
+					}
 				}
 			}
-		}
-	}()
-
-	for err := range errs {
-		if err == nil {
-			return
-		}
+		}()
 
-		panic(err)
 	}
+
+	waitForShutdown(ctx, cancel, l, c, *drainTimeout, errs)
 }
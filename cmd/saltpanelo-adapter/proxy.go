@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+)
+
+var (
+	errUnsupportedSOCKSVersion     = errors.New("unsupported SOCKS version")
+	errUnsupportedSOCKSCommand     = errors.New("unsupported SOCKS command, only CONNECT is supported")
+	errUnsupportedSOCKSAddressType = errors.New("unsupported SOCKS address type, only domain names are supported")
+	errNoAcceptableSOCKSMethods    = errors.New("no acceptable SOCKS authentication methods")
+	errUnsupportedSOCKSAuthVersion = errors.New("unsupported SOCKS username/password authentication version")
+	errProxyUnauthorized           = errors.New("missing or invalid proxy credentials")
+	errUnsupportedHTTPMethod       = errors.New("unsupported HTTP method, only CONNECT is supported")
+)
+
+const (
+	socksVersion5 = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodPassword     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksPasswordVersion = 0x01
+	socksPasswordSuccess = 0x00
+	socksPasswordFailure = 0x01
+
+	socksCommandConnect = 0x01
+
+	socksAddressTypeIPv4   = 0x01
+	socksAddressTypeDomain = 0x03
+
+	socksReplySucceeded           = 0x00
+	socksReplyGeneralFailure      = 0x01
+	socksReplyConnectionRefused   = 0x05
+	socksReplyCommandNotSupported = 0x07
+	socksReplyAddressNotSupported = 0x08
+)
+
+// parseSOCKSDestination maps a SOCKS destination to an email and channel ID.
+// Destinations like `jean.doe@example.com:postgres` are passed through as domain names,
+// otherwise the port is used as the channel ID (e.g. `jean.doe@example.com` with port 5432).
+func parseSOCKSDestination(host string, port uint16) (string, string, error) {
+	if email, channelID, err := parseDestination(host); err == nil {
+		return email, channelID, nil
+	}
+
+	return parseDestination(host + ":" + strconv.Itoa(int(port)))
+}
+
+func writeSOCKSReply(w io.Writer, reply byte) error {
+	// We don't expose the bind address, so we always reply with 0.0.0.0:0
+	_, err := w.Write([]byte{socksVersion5, reply, 0x00, socksAddressTypeIPv4, 0, 0, 0, 0, 0, 0})
+
+	return err
+}
+
+// checkProxyToken compares the password which proxy clients send with the API token in constant time
+func checkProxyToken(password, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(password), []byte(token)) == 1
+}
+
+// negotiateSOCKS selects the authentication method; with a token, clients have to authenticate with username/password
+// authentication (RFC 1929) and the token as the password, since otherwise any local user could place calls as the user
+func negotiateSOCKS(w io.Writer, r *bufio.Reader, token string) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+
+	if header[0] != socksVersion5 {
+		return errUnsupportedSOCKSVersion
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	wanted := byte(socksMethodNoAuth)
+	if token != "" {
+		wanted = socksMethodPassword
+	}
+
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == wanted {
+			method = wanted
+
+			break
+		}
+	}
+
+	if _, err := w.Write([]byte{socksVersion5, method}); err != nil {
+		return err
+	}
+
+	switch method {
+	case socksMethodNoAcceptable:
+		return errNoAcceptableSOCKSMethods
+	case socksMethodNoAuth:
+		return nil
+	}
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if version != socksPasswordVersion {
+		return errUnsupportedSOCKSAuthVersion
+	}
+
+	// The username is ignored, only the password has to match the token
+	for i := 0; i < 2; i++ {
+		fieldLen, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		field := make([]byte, fieldLen)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return err
+		}
+
+		if i == 1 && checkProxyToken(string(field), token) {
+			_, err := w.Write([]byte{socksPasswordVersion, socksPasswordSuccess})
+
+			return err
+		}
+	}
+
+	_, _ = w.Write([]byte{socksPasswordVersion, socksPasswordFailure})
+
+	return errProxyUnauthorized
+}
+
+// readSOCKSRequest reads a CONNECT request and returns the email and channel ID to dial
+func readSOCKSRequest(w io.Writer, r *bufio.Reader) (string, string, error) {
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return "", "", err
+	}
+
+	if request[0] != socksVersion5 {
+		return "", "", errUnsupportedSOCKSVersion
+	}
+
+	if request[1] != socksCommandConnect {
+		_ = writeSOCKSReply(w, socksReplyCommandNotSupported)
+
+		return "", "", errUnsupportedSOCKSCommand
+	}
+
+	if request[3] != socksAddressTypeDomain {
+		_ = writeSOCKSReply(w, socksReplyAddressNotSupported)
+
+		return "", "", errUnsupportedSOCKSAddressType
+	}
+
+	hostLen, err := r.ReadByte()
+	if err != nil {
+		return "", "", err
+	}
+
+	host := make([]byte, hostLen)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", "", err
+	}
+
+	var port uint16
+	if err := binary.Read(r, binary.BigEndian, &port); err != nil {
+		return "", "", err
+	}
+
+	email, channelID, err := parseSOCKSDestination(string(host), port)
+	if err != nil {
+		_ = writeSOCKSReply(w, socksReplyAddressNotSupported)
+
+		return "", "", err
+	}
+
+	return email, channelID, nil
+}
+
+func (f *forwarder) serveSOCKS(ctx context.Context, conn net.Conn, r *bufio.Reader, token string) error {
+	if err := negotiateSOCKS(conn, r, token); err != nil {
+		return err
+	}
+
+	email, channelID, err := readSOCKSRequest(conn, r)
+	if err != nil {
+		return err
+	}
+
+	remote, routeID, err := f.dialChannel(ctx, email, channelID)
+	if err != nil {
+		reply := byte(socksReplyGeneralFailure)
+		if errors.Is(err, errCallNotAnswered) {
+			reply = socksReplyConnectionRefused
+		}
+
+		_ = writeSOCKSReply(conn, reply)
+
+		return err
+	}
+
+	if err := writeSOCKSReply(conn, socksReplySucceeded); err != nil {
+		_ = remote.Close()
+
+		return err
+	}
+
+	f.spliceRoute(ctx, conn, r, remote, routeID)
+
+	return nil
+}
+
+// authorizeHTTPConnect accepts the token as the password of basic authentication or as a bearer token
+func authorizeHTTPConnect(req *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+
+	scheme, credentials, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	switch strings.ToLower(scheme) {
+	case "bearer":
+		return checkProxyToken(credentials, token)
+	case "basic":
+		rawCredentials, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return false
+		}
+
+		_, password, _ := strings.Cut(string(rawCredentials), ":")
+
+		return checkProxyToken(password, token)
+	default:
+		return false
+	}
+}
+
+func (f *forwarder) serveHTTPConnect(ctx context.Context, conn net.Conn, r *bufio.Reader, token string) error {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return err
+	}
+
+	if !authorizeHTTPConnect(req, token) {
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 %v %v\r\nProxy-Authenticate: Basic realm=\"saltpanelo\"\r\n\r\n", http.StatusProxyAuthRequired, http.StatusText(http.StatusProxyAuthRequired))
+
+		return errProxyUnauthorized
+	}
+
+	if req.Method != http.MethodConnect {
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 %v %v\r\n\r\n", http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+
+		return errUnsupportedHTTPMethod
+	}
+
+	email, channelID, err := parseDestination(req.Host)
+	if err != nil {
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 %v %v\r\n\r\n", http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+
+		return err
+	}
+
+	remote, routeID, err := f.dialChannel(ctx, email, channelID)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, errCallNotAnswered) {
+			status = http.StatusForbidden
+		}
+
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 %v %v\r\n\r\n", status, http.StatusText(status))
+
+		return err
+	}
+
+	if _, err := fmt.Fprintf(conn, "HTTP/1.1 %v Connection Established\r\n\r\n", http.StatusOK); err != nil {
+		_ = remote.Close()
+
+		return err
+	}
+
+	f.spliceRoute(ctx, conn, r, remote, routeID)
+
+	return nil
+}
+
+// spliceRoute splices the proxied connection into the route and hangs up once either side is done
+func (f *forwarder) spliceRoute(ctx context.Context, conn net.Conn, r *bufio.Reader, remote net.Conn, routeID string) {
+	if f.verbose {
+		log.Println("Proxying connection from", conn.RemoteAddr(), "to route with ID", routeID)
+	}
+
+	// The reader might already have buffered data from the client, so we have to read through it
+	utils.Splice(&bufferedConn{conn, r}, remote)
+
+	if err := f.c.hangup(ctx, routeID); err != nil && f.verbose {
+		log.Println("Could not hang up call with route ID", routeID, ", continuing:", err)
+	}
+}
+
+type bufferedConn struct {
+	net.Conn
+
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// serveProxy accepts SOCKS5 and HTTP CONNECT connections and routes them to the requested channels
+func (f *forwarder) serveProxy(ctx context.Context, lis net.Listener, token string) error {
+	// The Unix socket is protected by its permissions, so its clients don't need to authenticate
+	if lis.Addr().Network() == "unix" {
+		token = ""
+	}
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			r := bufio.NewReader(conn)
+
+			version, err := r.Peek(1)
+			if err != nil {
+				if f.verbose {
+					log.Println("Could not read from proxy client, stopping:", err)
+				}
+
+				return
+			}
+
+			if version[0] == socksVersion5 {
+				err = f.serveSOCKS(ctx, conn, r, token)
+			} else {
+				err = f.serveHTTPConnect(ctx, conn, r, token)
+			}
+
+			if err != nil {
+				log.Println("Could not proxy connection from", conn.RemoteAddr(), ", stopping:", err)
+			}
+		}()
+	}
+}
+
+// listenAndServeProxy listens on a Unix socket or on TCP like the control API; on TCP, clients have to send the token
+func listenAndServeProxy(ctx context.Context, f *forwarder, laddr, token string) error {
+	lis, err := listenAPI(laddr, token)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+
+	log.Println("Proxy listening on", lis.Addr())
+
+	return f.serveProxy(ctx, lis, token)
+}
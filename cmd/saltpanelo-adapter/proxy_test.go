@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateSOCKS(t *testing.T) {
+	tests := []struct {
+		name      string
+		token     string
+		request   []byte
+		wantReply []byte
+		wantErr   error
+	}{
+		{
+			name:      "no authentication without token",
+			request:   []byte{socksVersion5, 1, socksMethodNoAuth},
+			wantReply: []byte{socksVersion5, socksMethodNoAuth},
+		},
+		{
+			name:      "no authentication with token",
+			token:     "secret",
+			request:   []byte{socksVersion5, 1, socksMethodNoAuth},
+			wantReply: []byte{socksVersion5, socksMethodNoAcceptable},
+			wantErr:   errNoAcceptableSOCKSMethods,
+		},
+		{
+			name:  "valid password",
+			token: "secret",
+			request: append(
+				[]byte{socksVersion5, 2, socksMethodNoAuth, socksMethodPassword, socksPasswordVersion, 4},
+				append([]byte("user"), append([]byte{6}, []byte("secret")...)...)...,
+			),
+			wantReply: []byte{socksVersion5, socksMethodPassword, socksPasswordVersion, socksPasswordSuccess},
+		},
+		{
+			name:  "invalid password",
+			token: "secret",
+			request: append(
+				[]byte{socksVersion5, 1, socksMethodPassword, socksPasswordVersion, 4},
+				append([]byte("user"), append([]byte{5}, []byte("other")...)...)...,
+			),
+			wantReply: []byte{socksVersion5, socksMethodPassword, socksPasswordVersion, socksPasswordFailure},
+			wantErr:   errProxyUnauthorized,
+		},
+		{
+			name:      "unsupported password authentication version",
+			token:     "secret",
+			request:   []byte{socksVersion5, 1, socksMethodPassword, 0x02},
+			wantReply: []byte{socksVersion5, socksMethodPassword},
+			wantErr:   errUnsupportedSOCKSAuthVersion,
+		},
+		{
+			name:    "unsupported SOCKS version",
+			request: []byte{0x04, 1, socksMethodNoAuth},
+			wantErr: errUnsupportedSOCKSVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := &bytes.Buffer{}
+
+			if err := negotiateSOCKS(reply, bufio.NewReader(bytes.NewReader(tt.request)), tt.token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("negotiateSOCKS() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if !bytes.Equal(reply.Bytes(), tt.wantReply) {
+				t.Errorf("negotiateSOCKS() reply = %v, want %v", reply.Bytes(), tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestReadSOCKSRequest(t *testing.T) {
+	domainRequest := func(host string, port uint16) []byte {
+		return append(
+			append([]byte{socksVersion5, socksCommandConnect, 0x00, socksAddressTypeDomain, byte(len(host))}, []byte(host)...),
+			byte(port>>8), byte(port),
+		)
+	}
+
+	tests := []struct {
+		name          string
+		request       []byte
+		wantEmail     string
+		wantChannelID string
+		wantReply     []byte
+		wantErr       error
+	}{
+		{
+			name:          "channel ID in domain name",
+			request:       domainRequest("jean.doe@example.com:postgres", 0),
+			wantEmail:     "jean.doe@example.com",
+			wantChannelID: "postgres",
+		},
+		{
+			name:          "port as channel ID",
+			request:       domainRequest("jean.doe@example.com", 5432),
+			wantEmail:     "jean.doe@example.com",
+			wantChannelID: "5432",
+		},
+		{
+			name:      "unsupported command",
+			request:   []byte{socksVersion5, 0x02, 0x00, socksAddressTypeDomain},
+			wantReply: []byte{socksVersion5, socksReplyCommandNotSupported, 0x00, socksAddressTypeIPv4, 0, 0, 0, 0, 0, 0},
+			wantErr:   errUnsupportedSOCKSCommand,
+		},
+		{
+			name:      "unsupported address type",
+			request:   []byte{socksVersion5, socksCommandConnect, 0x00, socksAddressTypeIPv4},
+			wantReply: []byte{socksVersion5, socksReplyAddressNotSupported, 0x00, socksAddressTypeIPv4, 0, 0, 0, 0, 0, 0},
+			wantErr:   errUnsupportedSOCKSAddressType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := &bytes.Buffer{}
+
+			email, channelID, err := readSOCKSRequest(reply, bufio.NewReader(bytes.NewReader(tt.request)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("readSOCKSRequest() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if email != tt.wantEmail || channelID != tt.wantChannelID {
+				t.Errorf("readSOCKSRequest() = %v, %v, want %v, %v", email, channelID, tt.wantEmail, tt.wantChannelID)
+			}
+
+			if !bytes.Equal(reply.Bytes(), tt.wantReply) {
+				t.Errorf("readSOCKSRequest() reply = %v, want %v", reply.Bytes(), tt.wantReply)
+			}
+		})
+	}
+}
+
+func TestAuthorizeHTTPConnect(t *testing.T) {
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          bool
+	}{
+		{"no token", "", "", true},
+		{"missing credentials", "secret", "", false},
+		{"valid bearer token", "secret", "Bearer secret", true},
+		{"invalid bearer token", "secret", "Bearer other", false},
+		{"valid basic password", "secret", "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret")), true},
+		{"invalid basic password", "secret", "Basic " + base64.StdEncoding.EncodeToString([]byte("secret:other")), false},
+		{"invalid basic encoding", "secret", "Basic secret", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodConnect, "http://127.0.0.1:1080", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.authorization != "" {
+				req.Header.Set("Proxy-Authorization", tt.authorization)
+			}
+
+			if got := authorizeHTTPConnect(req, tt.token); got != tt.want {
+				t.Errorf("authorizeHTTPConnect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
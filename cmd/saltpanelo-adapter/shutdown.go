@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/services"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+)
+
+// waitForShutdown returns once the calls have drained after an error occurred or after receiving SIGINT or SIGTERM
+func waitForShutdown(
+	ctx context.Context,
+	cancel func(),
+
+	l *services.Adapter,
+	c *controller,
+	drainTimeout time.Duration,
+
+	errs chan error,
+) {
+	signals := utils.NotifyShutdown()
+
+	// Errors take the same path as signals, so that the calls are hung up instead of being dropped
+	select {
+	case err := <-errs:
+		if err != nil {
+			log.Println("Could not continue, shutting down:", err)
+		}
+	case <-signals:
+	}
+
+	log.Println("Draining, waiting up to", drainTimeout, "for calls to end")
+
+	// Incoming calls are declined and outgoing calls are rejected, so the callers can reach the user's other devices
+	services.SetAdapterDraining(l, true)
+	c.draining.Store(true)
+
+	if !utils.WaitForDrain(signals, drainTimeout, func() bool {
+		return len(c.list()) == 0
+	}) {
+		for _, ca := range c.list() {
+			if err := c.hangup(ctx, ca.RouteID); err != nil {
+				log.Println("Could not hang up call with route ID", ca.RouteID, ", continuing:", err)
+			}
+		}
+	}
+
+	log.Println("Shutting down")
+
+	// Cancelling the context closes the connection to the gateway, which unlinks it from the registry
+	cancel()
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivateUnix creates the socket with permissions for the current user only; setting them after listening would
+// allow other users to connect in between
+func listenPrivateUnix(path string) (net.Listener, error) {
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package main
+
+import (
+	"net"
+)
+
+// listenPrivateUnix relies on the ACL which the socket inherits from its directory, since Windows has no umask
+func listenPrivateUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/services"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+)
+
+const (
+	caCertFile     = "ca.cert.pem"
+	caKeyFile      = "ca.key.pem"
+	nextCACertFile = "ca.next.cert.pem"
+	nextCAKeyFile  = "ca.next.key.pem"
+)
+
+// writePrivateKey writes a CA private key which only the user who runs the control plane may read; the permissions are
+// also set if the file already exists, e.g. from a rotation which was interrupted
+func writePrivateKey(path string, caPrivKeyPEM []byte) error {
+	if err := os.WriteFile(path, caPrivKeyPEM, 0600); err != nil {
+		return err
+	}
+
+	return os.Chmod(path, 0600)
+}
+
+func writeCertificateAuthority(workdir string, caPEM, caPrivKeyPEM []byte) error {
+	if err := os.WriteFile(filepath.Join(workdir, caCertFile), caPEM, 0644); err != nil {
+		return err
+	}
+
+	return writePrivateKey(filepath.Join(workdir, caKeyFile), caPrivKeyPEM)
+}
+
+// backupCertificateAuthority copies the CA in the working directory next to it, so that it can be restored if the rotation fails
+func backupCertificateAuthority(workdir string) error {
+	suffix := strconv.FormatInt(time.Now().Unix(), 10)
+
+	for src, dst := range map[string]string{
+		caCertFile: "ca." + suffix + ".cert.pem",
+		caKeyFile:  "ca." + suffix + ".key.pem",
+	} {
+		content, err := os.ReadFile(filepath.Join(workdir, src))
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(filepath.Join(workdir, dst), content, 0600); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rotateCertificateAuthority backs up the CA in the working directory and generates the next CA next to it; once the
+// control plane restarts, it trusts both, re-issues the node certificates of the switches with the next CA and keeps
+// serving the listeners with the current one until the rotation is completed with retireCertificateAuthority
+func rotateCertificateAuthority(verbose bool, workdir string, rsaBits int, caValidity time.Duration) ([]byte, error) {
+	if _, err := os.Stat(filepath.Join(workdir, nextCACertFile)); err == nil {
+		return []byte{}, services.ErrCARotationInProgress
+	}
+
+	if verbose {
+		log.Println("Rotating certificate authority")
+	}
+
+	if err := backupCertificateAuthority(workdir); err != nil {
+		return []byte{}, err
+	}
+
+	_, caPEM, caPrivKeyPEM, _, err := utils.GenerateCertificateAuthority(rsaBits, caValidity)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if err := writePrivateKey(filepath.Join(workdir, nextCAKeyFile), caPrivKeyPEM); err != nil {
+		return []byte{}, err
+	}
+
+	// The certificate is written last, since its existence marks the rotation as started
+	if err := os.WriteFile(filepath.Join(workdir, nextCACertFile), caPEM, 0644); err != nil {
+		return []byte{}, err
+	}
+
+	return caPEM, nil
+}
+
+// retireCertificateAuthority replaces the CA in the working directory with the next CA, which the control plane serves
+// the listeners with once it restarts; the retired CA was backed up when the rotation started
+func retireCertificateAuthority(verbose bool, workdir string) error {
+	if _, err := os.Stat(filepath.Join(workdir, nextCACertFile)); err != nil {
+		return services.ErrCARotationNotStarted
+	}
+
+	if verbose {
+		log.Println("Retiring certificate authority")
+	}
+
+	if err := os.Rename(filepath.Join(workdir, nextCAKeyFile), filepath.Join(workdir, caKeyFile)); err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(workdir, nextCACertFile), filepath.Join(workdir, caCertFile))
+}
+
+// loadNextCertificateAuthority loads the next CA from the working directory if a rotation was started
+func loadNextCertificateAuthority(workdir string) (*x509.Certificate, []byte, *rsa.PrivateKey, bool, error) {
+	caPEM, err := os.ReadFile(filepath.Join(workdir, nextCACertFile))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, []byte{}, nil, false, nil
+		}
+
+		return nil, []byte{}, nil, false, err
+	}
+
+	caPrivKeyPEM, err := os.ReadFile(filepath.Join(workdir, nextCAKeyFile))
+	if err != nil {
+		return nil, []byte{}, nil, false, err
+	}
+
+	caCfg, caPrivKey, err := parseCertificateAuthority(caPEM, caPrivKeyPEM)
+	if err != nil {
+		return nil, []byte{}, nil, false, err
+	}
+
+	return caCfg, caPEM, caPrivKey, true, nil
+}
+
+func parseCertificateAuthority(caPEM, caPrivKeyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	cer, err := tls.X509KeyPair(caPEM, caPrivKeyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(cer.Certificate) < 1 {
+		return nil, nil, errInvalidCertificateCount
+	}
+
+	caCfg, err := x509.ParseCertificate(cer.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, _ := pem.Decode(caPrivKeyPEM)
+	caPrivKey, err := x509.ParsePKCS1PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return caCfg, caPrivKey, nil
+}
+
+// loadCertificateAuthority loads the CA from the working directory, and generates it if it doesn't exist yet or has expired
+func loadCertificateAuthority(verbose bool, workdir string, rsaBits int, caValidity time.Duration) (*x509.Certificate, []byte, *rsa.PrivateKey, error) {
+	if verbose {
+		log.Println("Generating certificate authority")
+	}
+
+	regenerateCertificate := false
+
+	var (
+		caPEMPath        = filepath.Join(workdir, caCertFile)
+		caPrivKeyPEMPath = filepath.Join(workdir, caKeyFile)
+	)
+	if _, err := os.Stat(caPEMPath); err != nil {
+		regenerateCertificate = true
+	}
+	if _, err := os.Stat(caPrivKeyPEMPath); err != nil {
+		regenerateCertificate = true
+	}
+
+	var (
+		caCfg *x509.Certificate
+		caPEM,
+		caPrivKeyPEM []byte
+		caPrivKey *rsa.PrivateKey
+		err       error
+	)
+
+regenerate:
+	if regenerateCertificate {
+		caCfg, caPEM, caPrivKeyPEM, caPrivKey, err = utils.GenerateCertificateAuthority(rsaBits, caValidity)
+		if err != nil {
+			return nil, []byte{}, nil, err
+		}
+
+		if err := writeCertificateAuthority(workdir, caPEM, caPrivKeyPEM); err != nil {
+			return nil, []byte{}, nil, err
+		}
+	} else {
+		caPEM, err = os.ReadFile(caPEMPath)
+		if err != nil {
+			return nil, []byte{}, nil, err
+		}
+
+		caPrivKeyPEM, err = os.ReadFile(caPrivKeyPEMPath)
+		if err != nil {
+			return nil, []byte{}, nil, err
+		}
+
+		caCfg, caPrivKey, err = parseCertificateAuthority(caPEM, caPrivKeyPEM)
+		if err != nil {
+			return nil, []byte{}, nil, err
+		}
+
+		if caCfg.NotAfter.Before(time.Now()) {
+			regenerateCertificate = true
+
+			goto regenerate
+		}
+	}
+
+	return caCfg, caPEM, caPrivKey, nil
+}
+
+// newListenerTLSConfig serves the certificate from the files if they are set, and otherwise issues one with the CA
+func newListenerTLSConfig(certPath, keyPath string, rsaBits int, caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, hosts []string) (*tls.Config, error) {
+	if certPath != "" || keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}, nil
+	}
+
+	certPEM, certPrivKeyPEM, err := utils.GenerateCertificateForHosts(rsaBits, caCfg, caPrivKey, validity, hosts, utils.RoleControlPlaneListener)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, certPrivKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}, nil
+}
+
+// newFederationTLSConfig authenticates the gateways of federated control planes in both directions (mTLS): the certificate
+// from the files (or one issued with the CA) is served and presented to them, and theirs are verified with their CAs
+func newFederationTLSConfig(certPath, keyPath, peerCAPath string, rsaBits int, caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, hosts []string) (*tls.Config, error) {
+	peerCAPEM, err := os.ReadFile(peerCAPath)
+	if err != nil {
+		return nil, err
+	}
+
+	peerCAs := x509.NewCertPool()
+	if !peerCAs.AppendCertsFromPEM(peerCAPEM) {
+		return nil, errInvalidCertificateCount
+	}
+
+	var cert tls.Certificate
+	if certPath != "" || keyPath != "" {
+		cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		certPEM, certPrivKeyPEM, err := utils.GeneratePeerCertificateForHosts(rsaBits, caCfg, caPrivKey, validity, hosts, utils.RoleFederationPeer)
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err = tls.X509KeyPair(certPEM, certPrivKeyPEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      peerCAs,
+		ClientCAs:    peerCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
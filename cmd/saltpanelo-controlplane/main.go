@@ -5,7 +5,6 @@ import (
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
 	"errors"
 	"flag"
 	"log"
@@ -14,17 +13,28 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/pojntfx/dudirekta/pkg/rpc"
 	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/config"
+	"github.com/pojntfx/saltpanelo/pkg/limiters"
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"github.com/pojntfx/saltpanelo/pkg/policies"
+	"github.com/pojntfx/saltpanelo/pkg/replicas"
 	"github.com/pojntfx/saltpanelo/pkg/services"
 	"github.com/pojntfx/saltpanelo/pkg/utils"
-	"nhooyr.io/websocket"
 )
 
 var (
 	errInvalidCertificateCount = errors.New("invalid certificate count")
+	errUnknownRingStrategy     = errors.New("unknown ring strategy")
+	errEmptyFederationCA       = errors.New("could not continue with empty federation CA")
+)
+
+const (
+	unlinkTimeout = time.Second * 5
 )
 
 func main() {
@@ -33,10 +43,16 @@ func main() {
 		panic(err)
 	}
 
+	configPath := flag.String("config", "", "Path to the YAML config file whose keys are the flag names (e.g. test-interval: 10s); environment variables (e.g. SALTPANELO_TEST_INTERVAL) and flags take precedence over it, and SIGHUP reloads verbose, test-interval, the policy file and the limits")
 	workdir := flag.String("workdir", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo"), "Working directory")
 	routerLaddr := flag.String("router-laddr", ":1337", "Router listen address")
+	routerMTLSLaddr := flag.String("router-mtls-laddr", ":1342", "Router listen address for enrolled switches, which authenticate with their node certificates (mTLS) instead of OIDC tokens")
 	gatewayLaddr := flag.String("gateway-laddr", ":1338", "Gateway listen address")
 	metricsLaddr := flag.String("metrics-laddr", ":1339", "Metrics listen address")
+	tlsEnabled := flag.Bool("tls", true, "Whether to serve the router, gateway, metrics, internal and replica listeners over TLS (disable if a reverse proxy terminates TLS in front of them)")
+	tlsCert := flag.String("tls-cert", "", "Path to the certificate for the router, gateway, metrics, internal and replica listeners (leave empty to issue one with the CA in the working directory, which clients verify with its ca.cert.pem)")
+	tlsKey := flag.String("tls-key", "", "Path to the private key for the router, gateway, metrics, internal and replica listeners (leave empty to issue one with the CA in the working directory)")
+	tlsHosts := flag.String("tls-hosts", "localhost,127.0.0.1", "Comma-separated list of IP addresses and hostnames which clients dial the control plane on, used to issue the certificates for its listeners")
 	timeout := flag.Duration("timeout", time.Minute, "Time after which to assume that a call has timed out")
 	verbose := flag.Bool("verbose", false, "Whether to enable verbose logging")
 	testInterval := flag.Duration("test-interval", time.Second*10, "Interval in which to refresh latency values in topology")
@@ -46,6 +62,8 @@ func main() {
 	rsaBits := flag.Int("rsa-bits", 2048, "RSA bits to use when generating mTLS private keys")
 	benchmarkListenCertValidity := flag.Duration("benchmark-listen-cert-validity", time.Hour*24*30*365, "Time until generated certificates for switch benchmark listeners become invalid")
 	benchmarkClientCertValidity := flag.Duration("benchmark-client-cert-validity", time.Minute*5, "Time until generated certificates for benchmark clients become invalid")
+	nodeCertValidity := flag.Duration("node-cert-validity", time.Hour*24*365, "Time until the node certificates of enrolled switches become invalid (switches renew them once half of it has passed)")
+	listenerCertValidity := flag.Duration("listener-cert-validity", time.Hour*24*365, "Time until generated certificates for the control plane listeners become invalid (they are generated again on every start)")
 	gatewayOIDCIssuer := flag.String("gateway-oidc-issuer", "", "Gateway OIDC issuer (e.g. https://pojntfx.eu.auth0.com/)")
 	gatewayOIDCClientID := flag.String("gateway-oidc-client-id", "", "Gateway OIDC client ID")
 	routerOIDCIssuer := flag.String("router-oidc-issuer", "", "Router OIDC issuer (e.g. https://pojntfx.eu.auth0.com/)")
@@ -53,9 +71,54 @@ func main() {
 	routerOIDCAudience := flag.String("router-oidc-audience", "", "Router OIDC audience (e.g. https://saltpanelo-router)")
 	metricsAuthorizedEmail := flag.String("metrics-authorized-email", "", "Authorized email for metrics (e.g. jean.doe@example.com)")
 	benchmarkLimit := flag.Int64("benchmark-length", 1048576*100, "Amount of bytes to stream to benchmark clients before closing connection")
+	ringTimeout := flag.Duration("ring-timeout", time.Second*30, "Time after which to stop ringing if the callee hasn't answered the call")
+	ringStrategy := flag.String("ring-strategy", services.RingStrategyParallel, "Strategy to use when ringing a user with multiple devices (parallel or sequential)")
+	deviceRingTimeout := flag.Duration("device-ring-timeout", time.Second*10, "Time after which to ring the next device when using the sequential ring strategy")
+	policyPath := flag.String("policy", "", "Path to the JSON policy file which decides who may call whom (leave empty to allow all calls)")
+	policyReloadInterval := flag.Duration("policy-reload-interval", time.Second*10, "Interval in which to check the policy file for changes and reload it")
+	callRate := flag.Float64("call-rate", 1, "Calls per second which each identity may request (0 for unlimited)")
+	callBurst := flag.Int("call-burst", 5, "Calls which each identity may request at once before the call rate applies")
+	maxConcurrentCalls := flag.Int("max-concurrent-calls", 10, "Pending and answered calls which each identity may have at once (0 for unlimited)")
+	limitsPath := flag.String("limits", "", "Path to the JSON file with rate limits and quotas which override the defaults for identities with matching OIDC claims (e.g. [{\"claims\": {\"groups\": [\"premium\"]}, \"rate\": 10, \"burst\": 20, \"concurrentCalls\": 50}])")
+	reconnectTimeout := flag.Duration("reconnect-timeout", time.Second*30, "Time to keep the routes of switches and adapters which lost their connection so that they can resume them once they reconnect (0 to unprovision them immediately)")
+	reconcileTimeout := flag.Duration("reconcile-timeout", time.Minute, "Time after which to garbage-collect routes from before a restart whose adapters and switches haven't reconnected")
+	replicaLaddr := flag.String("replica-laddr", ":1336", "Listen address for replication between control plane replicas")
+	replicaRaddr := flag.String("replica-raddr", "", "Address which the other control plane replicas can reach this replica on (e.g. https://10.0.0.1:1336, which has to be in the TLS hosts); all replicas must share the CA in their working directories (leave empty to run a single control plane without replication)")
+	replicaPeers := flag.String("replica-peers", "", "Comma-separated list of the addresses of the other control plane replicas (e.g. https://10.0.0.2:1336,https://10.0.0.3:1336)")
+	replicaToken := flag.String("replica-token", "", "Shared secret which control plane replicas authenticate each other with")
+	heartbeatInterval := flag.Duration("heartbeat-interval", time.Second, "Interval in which the leader sends heartbeats and its state to the other control plane replicas")
+	electionTimeout := flag.Duration("election-timeout", time.Second*5, "Time after which to elect a new leader if the current leader can't be reached")
+	snapshotTimeout := flag.Duration("snapshot-timeout", time.Minute*5, "Time after which to give up sending a snapshot of the state (including the call history) to a control plane replica which is too far behind")
+	federationPath := flag.String("federation", "", "Path to the JSON file with the gateways of federated control planes (e.g. [{\"name\": \"example-org\", \"url\": \"https://saltpanelo.example.org:1335\", \"token\": \"secret\", \"domains\": [\"example.org\"], \"exportDomains\": [\"example.com\"]}]; leave empty to disable federation)")
+	federationLaddr := flag.String("federation-laddr", ":1335", "Listen address for the gateways of federated control planes")
+	federationInterval := flag.Duration("federation-interval", time.Second*30, "Interval in which to sync the directories of federated control planes")
+	federationCA := flag.String("federation-ca", "", "Path to the PEM bundle with the CAs of the federated control planes, which the certificates of their gateways are verified with in both directions (mTLS; required if federation is enabled)")
+	federationTLSCert := flag.String("federation-tls-cert", "", "Path to the certificate which the federation listener serves and which is presented to federated control planes (leave empty to issue one with the CA in the working directory, which federated control planes add to their federation CA bundle)")
+	federationTLSKey := flag.String("federation-tls-key", "", "Path to the private key for the federation certificate (leave empty to issue one with the CA in the working directory)")
+	servicesToRun := flag.String("services", "router,gateway,metrics", "Comma-separated list of services to run in this process (router, gateway and metrics); gateways and metrics services which run in a separate process reach the router through its internal listener")
+	internalLaddr := flag.String("internal-laddr", ":1334", "Listen address for gateways and metrics services which run in a separate process")
+	internalRaddr := flag.String("internal-raddr", "wss://localhost:1334", "Comma-separated list of internal router remote addresses (one per control plane replica) for gateways and metrics services which run in a separate process")
+	internalCA := flag.String("internal-ca", "", "Path to the CA certificate which the certificate of the internal listener is verified with in addition to the system roots (leave empty to use the ca.cert.pem in the working directory)")
+	internalToken := flag.String("internal-token", "", "Shared secret which gateways and metrics services which run in a separate process authenticate to the router with")
+	retryInterval := flag.Duration("retry-interval", time.Second*5, "Time to wait before trying all internal router remote addresses again if none of them can be reached (doubles with each attempt up to the maximum retry interval)")
+	maxRetryInterval := flag.Duration("max-retry-interval", time.Minute, "Maximum time to wait before trying all internal router remote addresses again")
+	drainTimeout := flag.Duration("drain-timeout", time.Second*30, "Time to wait for calls to end after receiving SIGINT or SIGTERM before shutting down (routes which are still active are reconciled once the control plane restarts or by the new leader)")
+	adminEmails := flag.String("admin-emails", "", "Comma-separated list of emails which may administrate the control plane (e.g. list the call history of all users); admins authenticate to the admin API with ID tokens of the gateway OIDC issuer, which must have verified their email")
+	adminLaddr := flag.String("admin-laddr", ":1343", "Listen address for the admin API (served over TLS like the router, gateway and metrics listeners; only started if admin emails are set)")
 
 	flag.Parse()
 
+	loader := config.NewLoader(flag.CommandLine, *configPath)
+	if err := loader.Load(); err != nil {
+		panic(err)
+	}
+
+	runRouter, runGateway, runMetrics, err := parseServices(*servicesToRun)
+	if err != nil {
+		panic(err)
+	}
+
+	// Gateways validate the tokens of adapters, and routers and metrics services the tokens of admins and visualizers
 	if strings.TrimSpace(*gatewayOIDCIssuer) == "" {
 		panic(auth.ErrEmptyOIDCIssuer)
 	}
@@ -64,458 +127,649 @@ func main() {
 		panic(auth.ErrEmptyOIDCClientID)
 	}
 
-	if strings.TrimSpace(*metricsAuthorizedEmail) == "" {
+	if runMetrics && strings.TrimSpace(*metricsAuthorizedEmail) == "" {
 		panic(auth.ErrEmptyMetricsAuthorizedEmail)
 	}
 
+	if !(runRouter && runGateway && runMetrics) && strings.TrimSpace(*internalToken) == "" {
+		panic(errEmptyInternalToken)
+	}
+
+	if *ringStrategy != services.RingStrategyParallel && *ringStrategy != services.RingStrategySequential {
+		panic(errUnknownRingStrategy)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	if err := os.MkdirAll(*workdir, os.ModePerm); err != nil {
-		panic(err)
-	}
+	// The listeners for switches, adapters and gateways are closed once a replica steps down, so that they fail over to the new leader
+	term := newLeaderTerm(ctx)
 
-	if *verbose {
-		log.Println("Generating certificate authority")
-	}
+	errs := make(chan error)
 
-	regenerateCertificate := false
+	// Replicas can step down multiple times without becoming leader again in between, so step-downs are buffered and coalesced
+	stepDowns := make(chan struct{}, 1)
 
-	var (
-		caPEMPath        = filepath.Join(*workdir, "ca.cert.pem")
-		caPrivKeyPEMPath = filepath.Join(*workdir, "ca.key.pem")
-	)
-	if _, err := os.Stat(caPEMPath); err != nil {
-		regenerateCertificate = true
-	}
-	if _, err := os.Stat(caPrivKeyPEMPath); err != nil {
-		regenerateCertificate = true
+	var metrics *services.Metrics
+	if runMetrics {
+		metrics = services.NewMetrics(
+			*verbose,
+			*gatewayOIDCIssuer,
+			*gatewayOIDCClientID,
+			*metricsAuthorizedEmail,
+		)
+
+		if err := metrics.Open(ctx); err != nil {
+			panic(err)
+		}
 	}
 
+	// The CA issues the certificates for calls and enrolled switches, and the certificates for the listeners unless they are set
 	var (
-		caCfg *x509.Certificate
-		caPEM,
-		caPrivKeyPEM []byte
+		caCfg     *x509.Certificate
+		caPEM     []byte
 		caPrivKey *rsa.PrivateKey
 	)
-
-regenerate:
-	if regenerateCertificate {
-		caCfg, caPEM, caPrivKeyPEM, caPrivKey, err = utils.GenerateCertificateAuthority(*rsaBits, *caValidity)
-		if err != nil {
+	if runRouter || (*tlsEnabled && *tlsCert == "" && *tlsKey == "") || (runGateway && *federationPath != "" && *federationTLSCert == "" && *federationTLSKey == "") {
+		if err := os.MkdirAll(*workdir, os.ModePerm); err != nil {
 			panic(err)
 		}
 
-		if err := os.WriteFile(caPEMPath, caPEM, os.ModePerm); err != nil {
+		caCfg, caPEM, caPrivKey, err = loadCertificateAuthority(*verbose, *workdir, *rsaBits, *caValidity)
+		if err != nil {
 			panic(err)
 		}
+	}
 
-		if err := os.WriteFile(caPrivKeyPEMPath, caPrivKeyPEM, os.ModePerm); err != nil {
-			panic(err)
-		}
-	} else {
-		caPEM, err = os.ReadFile(caPEMPath)
+	// While the CA is being rotated, both CAs are trusted and node certificates are re-issued by the next one
+	nodeCACfg, nodeCAPrivKey := caCfg, caPrivKey
+	if runRouter {
+		nextCACfg, nextCAPEM, nextCAPrivKey, rotating, err := loadNextCertificateAuthority(*workdir)
 		if err != nil {
 			panic(err)
 		}
 
-		caPrivKeyPEM, err = os.ReadFile(caPrivKeyPEMPath)
-		if err != nil {
-			panic(err)
+		if rotating {
+			log.Println("Rotating certificate authority, re-issuing node certificates with the next CA")
+
+			caPEM = append(append([]byte{}, caPEM...), nextCAPEM...)
+			nodeCACfg, nodeCAPrivKey = nextCACfg, nextCAPrivKey
 		}
+	}
 
-		cer, err := tls.X509KeyPair(caPEM, caPrivKeyPEM)
+	var listenerTLSConfig *tls.Config
+	if *tlsEnabled {
+		listenerTLSConfig, err = newListenerTLSConfig(*tlsCert, *tlsKey, *rsaBits, caCfg, caPrivKey, *listenerCertValidity, utils.SplitRemoteAddresses(*tlsHosts))
 		if err != nil {
 			panic(err)
 		}
+	}
 
-		if len(cer.Certificate) < 1 {
-			panic(errInvalidCertificateCount)
+	admins := []string{}
+	for _, email := range strings.Split(*adminEmails, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			admins = append(admins, email)
 		}
+	}
 
-		caCfg, err = x509.ParseCertificate(cer.Certificate[0])
-		if err != nil {
+	internalRaddrs := utils.SplitRemoteAddresses(*internalRaddr)
+
+	// Gateways and metrics services which run in a separate process verify the internal listener with the CA of the router
+	if strings.TrimSpace(*internalCA) == "" {
+		*internalCA = filepath.Join(*workdir, caCertFile)
+	}
+
+	internalHTTPClient, err := utils.GetCAHTTPClient(*internalCA)
+	if err != nil {
+		panic(err)
+	}
+
+	// Once the control plane is draining, it doesn't accept new switches, adapters or calls; once it is closing, it unlinks all clients
+	var draining, closing atomic.Bool
+
+	// Only the leader accepts switches, adapters and metrics clients; they fail over to the other replicas
+	isLeader := func() bool {
+		return true
+	}
+
+	isAccepting := func() bool {
+		return !draining.Load() && isLeader()
+	}
+
+	var (
+		router                  *services.Router
+		routerService           *services.RouterService
+		routerRegistry          *rpc.Registry[services.SwitchRemote]
+		internalGatewayRegistry *rpc.Registry[services.GatewayServiceRemote]
+		internalMetricsRegistry *rpc.Registry[services.MetricsServiceRemote]
+		admin                   *services.Admin
+		replica                 *replicas.Replica
+	)
+	if runRouter {
+		persister := persisters.NewControlPlanePersister()
+		if err := persister.Open(filepath.Join(*workdir, "controlplane.db")); err != nil {
 			panic(err)
 		}
+		defer persister.Close()
+
+		router = services.NewRouter(
+			*verbose,
 
-		if caCfg.NotAfter.Before(time.Now()) {
-			regenerateCertificate = true
+			*testInterval,
+			*testTimeout,
 
-			goto regenerate
+			*reconnectTimeout,
+
+			*routerOIDCIssuer,
+			*routerOIDCClientID,
+			*routerOIDCAudience,
+
+			caCfg,
+			caPEM,
+			caPrivKey,
+
+			nodeCACfg,
+			nodeCAPrivKey,
+
+			*callCertValidity,
+			*benchmarkListenCertValidity,
+			*benchmarkClientCertValidity,
+			*nodeCertValidity,
+
+			*rsaBits,
+			*benchmarkLimit,
+
+			persister,
+		)
+
+		admin = services.NewAdmin(
+			*verbose,
+
+			*gatewayOIDCIssuer,
+			*gatewayOIDCClientID,
+
+			admins,
+		)
+
+		if err := router.Open(ctx); err != nil {
+			panic(err)
 		}
 
-		b, _ := pem.Decode(caPrivKeyPEM)
-		caPrivKey, err = x509.ParsePKCS1PrivateKey(b.Bytes)
-		if err != nil {
+		if err := admin.Open(ctx); err != nil {
 			panic(err)
 		}
-	}
 
-	metrics := services.NewMetrics(
-		*verbose,
-		*gatewayOIDCIssuer,
-		*gatewayOIDCClientID,
-		*metricsAuthorizedEmail,
-	)
-	router := services.NewRouter(
-		*verbose,
+		routerClients := 0
+		routerRegistry = rpc.NewRegistry(
+			router,
+			services.SwitchRemote{},
+			*timeout,
+			ctx,
+			&rpc.Options{
+				ResponseBufferLen: rpc.DefaultResponseBufferLen,
+				OnClientConnect: func(remoteID string) {
+					routerClients++
+
+					log.Printf("%v clients connected to router", routerClients)
+				},
+				OnClientDisconnect: func(remoteID string) {
+					routerClients--
+
+					log.Printf("%v clients connected to router", routerClients)
+
+					// Switches which disconnect because the control plane is shutting down or stepping down keep their routes so that they can be reconciled
+					if closing.Load() || !isLeader() {
+						return
+					}
 
-		*testInterval,
-		*testTimeout,
+					if err := services.HandleRouterClientDisconnect(router, remoteID); err != nil {
+						log.Println("Could not handle router client disconnected, continuing:", err)
+					}
+				},
+			},
+		)
+		router.Peers = routerRegistry.Peers
+		router.Metrics = metrics
+
+		routerService = services.NewRouterService(router)
+
+		internalMetricsRegistry = rpc.NewRegistry(
+			routerService,
+			services.MetricsServiceRemote{},
+			*timeout,
+			ctx,
+			&rpc.Options{
+				ResponseBufferLen: rpc.DefaultResponseBufferLen,
+				OnClientConnect: func(remoteID string) {
+					log.Println("Metrics service connected with ID", remoteID)
+				},
+				OnClientDisconnect: func(remoteID string) {
+					log.Println("Metrics service disconnected with ID", remoteID)
+				},
+			},
+		)
+		router.MetricsServices = internalMetricsRegistry.Peers
+
+		internalGatewayRegistry = rpc.NewRegistry(
+			routerService,
+			services.GatewayServiceRemote{},
+			*timeout,
+			ctx,
+			&rpc.Options{
+				ResponseBufferLen: rpc.DefaultResponseBufferLen,
+				OnClientConnect: func(remoteID string) {
+					log.Println("Gateway connected with ID", remoteID)
+				},
+				OnClientDisconnect: func(remoteID string) {
+					log.Println("Gateway disconnected with ID", remoteID)
+
+					// Gateways which disconnect because the control plane is shutting down or stepping down keep their routes so that they can be reconciled
+					if closing.Load() || !isLeader() {
+						return
+					}
 
-		*routerOIDCIssuer,
-		*routerOIDCClientID,
-		*routerOIDCAudience,
+					services.HandleRouterServiceClientDisconnect(routerService)
+				},
+			},
+		)
+		router.Gateways = internalGatewayRegistry.Peers
 
-		caCfg,
-		caPEM,
-		caPrivKey,
+		admin.Router = router
+		admin.RotateCA = func() ([]byte, error) {
+			// Replicas share the CA in their working directories, so it has to be copied to them before they restart
+			return rotateCertificateAuthority(*verbose, *workdir, *rsaBits, *caValidity)
+		}
+		admin.RetireCA = func() error {
+			// The next CA replaces the current one in the working directory of this replica only, so the others have to be retired too
+			return retireCertificateAuthority(*verbose, *workdir)
+		}
 
-		*callCertValidity,
-		*benchmarkListenCertValidity,
-		*benchmarkClientCertValidity,
+		go services.HandleRouterOpen(router)
 
-		*rsaBits,
-		*benchmarkLimit,
-	)
-	gateway := services.NewGateway(
-		*verbose,
+		if strings.TrimSpace(*replicaRaddr) == "" {
+			if err := services.RestoreRoutes(term.context(), router, *reconcileTimeout); err != nil {
+				panic(err)
+			}
+		} else {
+			replica = replicas.NewReplica(
+				*verbose,
 
-		*gatewayOIDCIssuer,
-		*gatewayOIDCClientID,
+				*replicaRaddr,
+				utils.SplitRemoteAddresses(*replicaPeers),
+				*replicaToken,
 
-		caCfg,
-		caPEM,
-		caPrivKey,
+				caPEM,
 
-		*benchmarkClientCertValidity,
+				*heartbeatInterval,
+				*electionTimeout,
+				*snapshotTimeout,
 
-		*rsaBits,
-		*benchmarkLimit,
-	)
+				persister,
 
-	if err := metrics.Open(ctx); err != nil {
-		panic(err)
-	}
+				func() {
+					// The replicated state contains the routes of the previous leader, which switches and adapters reconcile once they fail over
+					if err := services.RestoreRoutes(term.context(), router, *reconcileTimeout); err != nil {
+						errs <- err
+					}
+				},
+				func() {
+					// Switches, adapters and gateways need to reconnect to the new leader, so stop serving them; repeated step-downs are coalesced
+					select {
+					case stepDowns <- struct{}{}:
+					default:
+					}
+				},
+			)
+			if err := replica.Open(ctx); err != nil {
+				panic(err)
+			}
 
-	if err := router.Open(ctx); err != nil {
-		panic(err)
-	}
+			isLeader = replica.IsLeader
 
-	if err := gateway.Open(ctx); err != nil {
-		panic(err)
-	}
+			go func() {
+				lis, err := net.Listen("tcp", *replicaLaddr)
+				if err != nil {
+					errs <- err
 
-	metricsClients := 0
-	metricsRegistry := rpc.NewRegistry(
-		metrics,
-		services.VisualizerRemote{},
-		*timeout,
-		ctx,
-		&rpc.Options{
-			ResponseBufferLen: rpc.DefaultResponseBufferLen,
-			OnClientConnect: func(remoteID string) {
-				metricsClients++
-
-				log.Printf("%v clients connected to metrics", metricsClients)
-
-				if err := services.HandleMetricsClientConnect(router); err != nil {
-					log.Println("Could not handle router client disconnected, continuing:", err)
+					return
 				}
-			},
-			OnClientDisconnect: func(remoteID string) {
-				metricsClients--
+				defer lis.Close()
 
-				log.Printf("%v clients connected to metrics", metricsClients)
-			},
-		},
-	)
-	metrics.Peers = metricsRegistry.Peers
-
-	routerClients := 0
-	routerRegistry := rpc.NewRegistry(
-		router,
-		services.SwitchRemote{},
-		*timeout,
-		ctx,
-		&rpc.Options{
-			ResponseBufferLen: rpc.DefaultResponseBufferLen,
-			OnClientConnect: func(remoteID string) {
-				routerClients++
-
-				log.Printf("%v clients connected to router", routerClients)
-			},
-			OnClientDisconnect: func(remoteID string) {
-				routerClients--
+				if listenerTLSConfig != nil {
+					lis = tls.NewListener(lis, listenerTLSConfig)
+				}
+
+				log.Println("Replica listening on", lis.Addr())
 
-				log.Printf("%v clients connected to router", routerClients)
+				if err := http.Serve(lis, replica); err != nil {
+					errs <- err
 
-				if err := services.HandleRouterClientDisconnect(router, gateway, remoteID); err != nil {
-					log.Println("Could not handle router client disconnected, continuing:", err)
+					return
 				}
-			},
-		},
-	)
-	router.Peers = routerRegistry.Peers
-	router.Metrics = metrics
-
-	gatewayClients := 0
-	gatewayRegistry := rpc.NewRegistry(
-		gateway,
-		services.AdapterRemote{},
-		*timeout,
-		ctx,
-		&rpc.Options{
-			ResponseBufferLen: rpc.DefaultResponseBufferLen,
-			OnClientConnect: func(remoteID string) {
-				gatewayClients++
-
-				log.Printf("%v clients connected to gateway", gatewayClients)
-			},
-			OnClientDisconnect: func(remoteID string) {
-				gatewayClients--
+			}()
+		}
+	}
 
-				log.Printf("%v clients connected to gateway", gatewayClients)
+	var metricsRegistry *rpc.Registry[services.VisualizerRemote]
+	if runMetrics {
+		if runRouter {
+			metricsRegistry = newMetricsRegistry(ctx, metrics, *timeout, func() error {
+				return services.HandleMetricsClientConnect(router)
+			})
+		} else {
+			metricsService := services.NewMetricsService(metrics)
 
-				if err := services.HandleGatewayClientDisconnect(router, gateway, remoteID); err != nil {
-					log.Println("Could not handle gateway client disconnected, continuing:", err)
-				}
-			},
-		},
+			go linkMetricsService(ctx, metricsService, internalRaddrs, *internalToken, internalHTTPClient, *retryInterval, *maxRetryInterval, *timeout, errs)
+
+			metricsRegistry = newMetricsRegistry(ctx, metrics, *timeout, func() error {
+				return services.HandleRemoteMetricsClientConnect(metricsService)
+			})
+		}
+	}
+
+	var (
+		policyEngine    *policies.PolicyEngine
+		limiter         *limiters.CallLimiter
+		gateway         *services.Gateway
+		gatewayRegistry *rpc.Registry[services.AdapterRemote]
+		federation      *services.Federation
+		federationPeers []services.FederationPeer
+
+		federationTLSConfig *tls.Config
 	)
-	gateway.Peers = gatewayRegistry.Peers
-	gateway.Router = router
-	router.Gateway = gateway
+	if runGateway {
+		policyEngine = policies.NewPolicyEngine(
+			*verbose,
+
+			*policyPath,
+			*policyReloadInterval,
+		)
+		if err := policyEngine.Open(ctx); err != nil {
+			panic(err)
+		}
 
-	go services.HandleRouterOpen(router)
+		claimLimits, err := limiters.LoadClaimLimits(*limitsPath)
+		if err != nil {
+			panic(err)
+		}
 
-	errs := make(chan error)
+		limiter, err = limiters.NewCallLimiter(
+			*verbose,
 
-	go func() {
-		lis, err := net.Listen("tcp", *metricsLaddr)
+			limiters.Limits{
+				Rate:            *callRate,
+				Burst:           *callBurst,
+				ConcurrentCalls: *maxConcurrentCalls,
+			},
+			claimLimits,
+		)
 		if err != nil {
-			errs <- err
+			panic(err)
+		}
 
-			return
+		federationPeers, err = services.LoadFederationPeers(*federationPath)
+		if err != nil {
+			panic(err)
 		}
-		defer lis.Close()
 
-		log.Println("Metrics listening on", lis.Addr())
+		gateway = services.NewGateway(
+			*verbose,
 
-		if err := http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				if err := recover(); err != nil && !utils.IsClosedErr(err) {
-					w.WriteHeader(http.StatusInternalServerError)
+			*gatewayOIDCIssuer,
+			*gatewayOIDCClientID,
 
-					log.Printf("Client disconnected from metrics with error: %v", err)
-				}
-			}()
+			*testTimeout,
+			*benchmarkLimit,
 
-			switch r.Method {
-			case http.MethodGet:
-				c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-					OriginPatterns: []string{"*"},
-				})
-				if err != nil {
-					panic(err)
-				}
+			*ringTimeout,
+			*ringStrategy,
+			*deviceRingTimeout,
 
-				pings := time.NewTicker(time.Second / 2)
-				defer pings.Stop()
+			admins,
 
-				httpErrs := make(chan error)
-				go func() {
-					for range pings.C {
-						if err := c.Ping(ctx); err != nil {
-							httpErrs <- err
+			policyEngine,
+			limiter,
+		)
 
-							return
-						}
-					}
-				}()
+		if len(federationPeers) > 0 {
+			if strings.TrimSpace(*federationCA) == "" {
+				panic(errEmptyFederationCA)
+			}
 
-				conn := websocket.NetConn(ctx, c, websocket.MessageText)
-				defer conn.Close()
+			federationTLSConfig, err = newFederationTLSConfig(*federationTLSCert, *federationTLSKey, *federationCA, *rsaBits, caCfg, caPrivKey, *listenerCertValidity, utils.SplitRemoteAddresses(*tlsHosts))
+			if err != nil {
+				panic(err)
+			}
+		}
 
-				go func() {
-					if err := metricsRegistry.Link(conn); err != nil {
-						httpErrs <- err
+		federation = services.NewFederation(
+			*verbose,
 
-						return
-					}
-				}()
+			federationPeers,
+			*federationInterval,
+			*rsaBits,
 
-				if err := <-httpErrs; err != nil {
-					panic(err)
-				}
-			default:
-				w.WriteHeader(http.StatusMethodNotAllowed)
-			}
-		})); err != nil {
+			federationTLSConfig,
+		)
+
+		if err := gateway.Open(ctx); err != nil {
 			panic(err)
 		}
 
-		for {
-			func() {
-				conn, err := lis.Accept()
-				if err != nil {
-					log.Println("could not accept metrics connection, continuing:", err)
+		if err := federation.Open(ctx); err != nil {
+			panic(err)
+		}
 
-					return
-				}
+		gatewayClients := 0
+		gatewayRegistry = rpc.NewRegistry(
+			gateway,
+			services.AdapterRemote{},
+			*timeout,
+			ctx,
+			&rpc.Options{
+				ResponseBufferLen: rpc.DefaultResponseBufferLen,
+				OnClientConnect: func(remoteID string) {
+					gatewayClients++
+
+					log.Printf("%v clients connected to gateway", gatewayClients)
+				},
+				OnClientDisconnect: func(remoteID string) {
+					gatewayClients--
+
+					log.Printf("%v clients connected to gateway", gatewayClients)
+
+					if closing.Load() || !isLeader() {
+						return
+					}
 
-				go func() {
-					defer func() {
-						_ = conn.Close()
+					if err := services.HandleGatewayClientDisconnect(gateway, remoteID); err != nil {
+						log.Println("Could not handle gateway client disconnected, continuing:", err)
+					}
+				},
+			},
+		)
+		gateway.Peers = gatewayRegistry.Peers
+		gateway.Federation = federation
+		federation.Gateway = gateway
+
+		// Gateways which run in the same process as the router call it directly, and the others over the internal listener
+		if runRouter {
+			services.LinkGatewayToRouter(services.NewGatewayService(gateway), routerService)
+		} else {
+			go linkGatewayService(ctx, gateway, internalRaddrs, *internalToken, internalHTTPClient, *retryInterval, *maxRetryInterval, *timeout, errs)
+		}
+	}
 
-						if err := recover(); err != nil && !utils.IsClosedErr(err) {
-							log.Printf("Client disconnected from metrics with error: %v", err)
-						}
-					}()
+	loader.Watch(ctx, []string{"verbose", "test-interval", "call-rate", "call-burst", "max-concurrent-calls", "limits"}, func(values config.Values, changed []string) {
+		verbose := values.Bool("verbose")
 
-					if err := metricsRegistry.Link(conn); err != nil {
-						panic(err)
-					}
-				}()
-			}()
+		if router != nil {
+			services.SetRouterVerbose(router, verbose)
+			admin.SetVerbose(verbose)
+
+			services.SetRouterTestInterval(router, values.Duration("test-interval"))
 		}
-	}()
 
-	go func() {
-		lis, err := net.Listen("tcp", *routerLaddr)
-		if err != nil {
-			errs <- err
+		if replica != nil {
+			replica.SetVerbose(verbose)
+		}
 
+		if metrics != nil {
+			services.SetMetricsVerbose(metrics, verbose)
+		}
+
+		if gateway == nil {
 			return
 		}
-		defer lis.Close()
 
-		log.Println("Router listening on", lis.Addr())
+		services.SetGatewayVerbose(gateway, verbose)
+		federation.SetVerbose(verbose)
+		policyEngine.SetVerbose(verbose)
+		limiter.SetVerbose(verbose)
 
-		if err := http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				if err := recover(); err != nil && !utils.IsClosedErr(err) {
-					w.WriteHeader(http.StatusInternalServerError)
+		// SIGHUP applies edits to the policy file without waiting for the policy reload interval
+		if _, err := policyEngine.Reload(); err != nil {
+			log.Println("Could not reload policy, continuing:", err)
+		}
 
-					log.Printf("Client disconnected from router with error: %v", err)
-				}
-			}()
+		claimLimits, err := limiters.LoadClaimLimits(values.String("limits"))
+		if err != nil {
+			log.Println("Could not reload limits, continuing:", err)
 
-			switch r.Method {
-			case http.MethodGet:
-				c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-					OriginPatterns: []string{"*"},
-				})
-				if err != nil {
-					panic(err)
-				}
+			return
+		}
 
-				pings := time.NewTicker(time.Second / 2)
-				defer pings.Stop()
+		if err := limiter.SetLimits(
+			limiters.Limits{
+				Rate:            values.Float64("call-rate"),
+				Burst:           values.Int("call-burst"),
+				ConcurrentCalls: values.Int("max-concurrent-calls"),
+			},
+			claimLimits,
+		); err != nil {
+			log.Println("Could not reload limits, continuing:", err)
+		}
+	})
 
-				httpErrs := make(chan error)
-				go func() {
-					for range pings.C {
-						if err := c.Ping(ctx); err != nil {
-							httpErrs <- err
+	if runGateway && len(federationPeers) > 0 {
+		go func() {
+			lis, err := net.Listen("tcp", *federationLaddr)
+			if err != nil {
+				errs <- err
 
-							return
-						}
-					}
-				}()
+				return
+			}
+			defer lis.Close()
 
-				conn := websocket.NetConn(ctx, c, websocket.MessageText)
-				defer conn.Close()
+			// Federated gateways authenticate with their client certificates in addition to their tokens
+			lis = tls.NewListener(lis, federationTLSConfig)
 
-				go func() {
-					if err := routerRegistry.Link(conn); err != nil {
-						httpErrs <- err
+			log.Println("Federation listening on", lis.Addr())
 
-						return
-					}
-				}()
+			if err := http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !isAccepting() {
+					w.WriteHeader(http.StatusServiceUnavailable)
 
-				if err := <-httpErrs; err != nil {
-					panic(err)
+					return
 				}
-			default:
-				w.WriteHeader(http.StatusMethodNotAllowed)
+
+				federation.ServeHTTP(w, r)
+			})); err != nil {
+				errs <- err
+
+				return
 			}
-		})); err != nil {
-			panic(err)
+		}()
+	}
+
+	if runRouter {
+		// Admins can still inspect and hang up calls while the control plane is draining
+		if len(admins) > 0 {
+			go serveAdmin(*adminLaddr, listenerTLSConfig, isLeader, admin, errs)
 		}
-	}()
 
-	go func() {
-		lis, err := net.Listen("tcp", *gatewayLaddr)
-		if err != nil {
-			errs <- err
+		if !runGateway || !runMetrics {
+			go serveInternal(term, *internalLaddr, *internalToken, listenerTLSConfig, isAccepting, internalGatewayRegistry.Link, internalMetricsRegistry.Link, errs)
+		}
 
-			return
+		go serveRegistry(term, "Router", *routerLaddr, listenerTLSConfig, isAccepting, routerRegistry.Link, errs)
+
+		// Enrolled switches connect to the same registry, but authenticate with their node certificates
+		routerMTLSConfig, err := newRouterMTLSConfig(*rsaBits, caCfg, caPEM, caPrivKey, *listenerCertValidity, utils.SplitRemoteAddresses(*tlsHosts))
+		if err != nil {
+			panic(err)
 		}
-		defer lis.Close()
 
-		log.Println("Gateway listening on", lis.Addr())
+		go serveRegistry(term, "Router (mTLS)", *routerMTLSLaddr, routerMTLSConfig, isAccepting, routerRegistry.Link, errs)
+	}
 
-		if err := http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				if err := recover(); err != nil && !utils.IsClosedErr(err) {
-					w.WriteHeader(http.StatusInternalServerError)
+	if runMetrics {
+		go serveRegistry(term, "Metrics", *metricsLaddr, listenerTLSConfig, isAccepting, metricsRegistry.Link, errs)
+	}
 
-					log.Printf("Client disconnected from gateway with error: %v", err)
-				}
-			}()
+	if runGateway {
+		go serveRegistry(term, "Gateway", *gatewayLaddr, listenerTLSConfig, isAccepting, gatewayRegistry.Link, errs)
+	}
 
-			switch r.Method {
-			case http.MethodGet:
-				c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
-					OriginPatterns: []string{"*"},
-				})
-				if err != nil {
-					panic(err)
-				}
+	signals := utils.NotifyShutdown()
 
-				pings := time.NewTicker(time.Second / 2)
-				defer pings.Stop()
+	// Errors take the same path as signals, so that calls are drained and the routes are persisted for the next start
+loop:
+	for {
+		select {
+		case <-stepDowns:
+			log.Println("Stopping leader services:", replicas.ErrLostLeadership)
 
-				httpErrs := make(chan error)
-				go func() {
-					for range pings.C {
-						if err := c.Ping(ctx); err != nil {
-							httpErrs <- err
+			term.end()
 
-							return
-						}
-					}
-				}()
+			if router != nil {
+				services.HandleRouterStepDown(router)
+			}
 
-				conn := websocket.NetConn(ctx, c, websocket.MessageText)
-				defer conn.Close()
+			if gateway != nil {
+				services.HandleGatewayStepDown(gateway)
+			}
+		case err := <-errs:
+			if err != nil {
+				log.Println("Could not continue, shutting down:", err)
+			}
 
-				go func() {
-					if err := gatewayRegistry.Link(conn); err != nil {
-						httpErrs <- err
+			break loop
+		case <-signals:
+			break loop
+		}
+	}
 
-						return
-					}
-				}()
+	draining.Store(true)
 
-				if err := <-httpErrs; err != nil {
-					panic(err)
-				}
-			default:
-				w.WriteHeader(http.StatusMethodNotAllowed)
-			}
-		})); err != nil {
-			panic(err)
+	// Calls are tracked by the gateways, so routers which run without one shut down right away and their routes are reconciled by the next leader
+	if gateway != nil {
+		log.Println("Draining, waiting up to", *drainTimeout, "for calls to end")
+
+		services.SetGatewayDraining(gateway, true)
+
+		if !utils.WaitForDrain(signals, *drainTimeout, func() bool {
+			return services.GetGatewayCallCount(gateway) == 0
+		}) {
+			log.Println("Could not drain all calls, continuing with", services.GetGatewayCallCount(gateway), "calls which will be reconciled once the control plane restarts")
 		}
-	}()
+	}
 
-	for err := range errs {
-		if err == nil {
-			return
+	log.Println("Shutting down")
+
+	// Cancelling the context closes the connections of all clients, which unlinks them from the registries
+	closing.Store(true)
+	cancel()
+
+	if !utils.WaitForDrain(signals, unlinkTimeout, func() bool {
+		if router != nil && (len(routerRegistry.Peers()) > 0 || len(internalGatewayRegistry.Peers()) > 0 || len(internalMetricsRegistry.Peers()) > 0) {
+			return false
 		}
 
-		panic(err)
+		return gateway == nil || len(gatewayRegistry.Peers()) == 0
+	}) {
+		log.Println("Could not unlink all clients, continuing")
 	}
+
+	// The persister is closed once main returns, so the routes and the replication state are kept for the next start
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/saltpanelo/pkg/services"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+	"nhooyr.io/websocket"
+)
+
+const (
+	serviceRouter  = "router"
+	serviceGateway = "gateway"
+	serviceMetrics = "metrics"
+)
+
+var (
+	errUnknownService     = errors.New("unknown service")
+	errEmptyInternalToken = errors.New("could not continue with empty internal token")
+)
+
+// parseServices returns which of the router, gateway and metrics services run in this process
+func parseServices(raw string) (bool, bool, bool, error) {
+	runRouter, runGateway, runMetrics := false, false, false
+	for _, service := range strings.Split(raw, ",") {
+		switch strings.TrimSpace(service) {
+		case serviceRouter:
+			runRouter = true
+		case serviceGateway:
+			runGateway = true
+		case serviceMetrics:
+			runMetrics = true
+		case "":
+		default:
+			return false, false, false, errUnknownService
+		}
+	}
+
+	if !runRouter && !runGateway && !runMetrics {
+		return false, false, false, errUnknownService
+	}
+
+	return runRouter, runGateway, runMetrics, nil
+}
+
+// leaderTerm scopes the connections which the leader accepts, so that they can be closed once it steps down and the
+// switches, adapters, gateways and metrics clients fail over to the new leader
+type leaderTerm struct {
+	parent context.Context
+
+	lock   sync.Mutex
+	ctx    context.Context
+	cancel func()
+}
+
+func newLeaderTerm(parent context.Context) *leaderTerm {
+	t := &leaderTerm{
+		parent: parent,
+	}
+	t.ctx, t.cancel = context.WithCancel(parent)
+
+	return t
+}
+
+// context returns the context of the current term
+func (t *leaderTerm) context() context.Context {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.ctx
+}
+
+// end closes the connections which were accepted during the current term and starts the next one; ending a term
+// which no connections were accepted in does nothing, so it can be called multiple times
+func (t *leaderTerm) end() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.cancel()
+
+	t.ctx, t.cancel = context.WithCancel(t.parent)
+}
+
+// serveWebsocket accepts a websocket connection and links it until either side disconnects
+func serveWebsocket(ctx context.Context, w http.ResponseWriter, r *http.Request, link func(conn io.ReadWriteCloser) error) error {
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: []string{"*"},
+	})
+	if err != nil {
+		return err
+	}
+
+	pings := time.NewTicker(time.Second / 2)
+	defer pings.Stop()
+
+	httpErrs := make(chan error)
+	go func() {
+		for range pings.C {
+			if err := c.Ping(ctx); err != nil {
+				httpErrs <- err
+
+				return
+			}
+		}
+	}()
+
+	conn := websocket.NetConn(ctx, c, websocket.MessageText)
+	defer conn.Close()
+
+	go func() {
+		if err := link(conn); err != nil {
+			httpErrs <- err
+
+			return
+		}
+	}()
+
+	return <-httpErrs
+}
+
+// serveRegistry accepts the switches, adapters or visualizers of a service and links them to its registry
+func serveRegistry(
+	term *leaderTerm,
+
+	name,
+	laddr string,
+	tlsConfig *tls.Config,
+	isLeader func() bool,
+
+	link func(conn io.ReadWriteCloser) error,
+
+	errs chan error,
+) {
+	lis, err := net.Listen("tcp", laddr)
+	if err != nil {
+		errs <- err
+
+		return
+	}
+	defer lis.Close()
+
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+
+	log.Println(name, "listening on", lis.Addr())
+
+	if err := http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the leader accepts clients; they fail over to the other replicas
+		if !isLeader() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if err := serveWebsocket(term.context(), w, r, link); err != nil && !utils.IsClosedErr(err) {
+			log.Printf("Client disconnected from %v with error: %v", strings.ToLower(name), err)
+		}
+	})); err != nil {
+		errs <- err
+
+		return
+	}
+}
+
+// serveAdmin serves the admin API of the leader
+func serveAdmin(
+	laddr string,
+	tlsConfig *tls.Config,
+	isLeader func() bool,
+
+	admin *services.Admin,
+
+	errs chan error,
+) {
+	lis, err := net.Listen("tcp", laddr)
+	if err != nil {
+		errs <- err
+
+		return
+	}
+	defer lis.Close()
+
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+
+	log.Println("Admin listening on", lis.Addr())
+
+	if err := http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the leader knows the switches, adapters and routes
+		if !isLeader() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		admin.ServeHTTP(w, r)
+	})); err != nil {
+		errs <- err
+
+		return
+	}
+}
+
+// newRouterMTLSConfig only accepts clients which present the node certificate of an enrolled switch
+func newRouterMTLSConfig(rsaBits int, caCfg *x509.Certificate, caPEM []byte, caPrivKey *rsa.PrivateKey, validity time.Duration, hosts []string) (*tls.Config, error) {
+	certPEM, certPrivKeyPEM, err := utils.GenerateCertificateForHosts(rsaBits, caCfg, caPrivKey, validity, hosts, utils.RoleRouterListener)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, certPrivKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(caPEM)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    caCertPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			// Certificates for calls are issued by the same CA, so they must not be accepted here
+			for _, chain := range verifiedChains {
+				if len(chain) > 0 && utils.VerifyNodeCertificate(caPEM, chain[0], utils.RoleSwitchNode) == nil {
+					return nil
+				}
+			}
+
+			return utils.ErrInvalidNodeCertificate
+		},
+	}, nil
+}
+
+func newMetricsRegistry(ctx context.Context, metrics *services.Metrics, timeout time.Duration, onClientConnect func() error) *rpc.Registry[services.VisualizerRemote] {
+	clients := 0
+	registry := rpc.NewRegistry(
+		metrics,
+		services.VisualizerRemote{},
+		timeout,
+		ctx,
+		&rpc.Options{
+			ResponseBufferLen: rpc.DefaultResponseBufferLen,
+			OnClientConnect: func(remoteID string) {
+				clients++
+
+				log.Printf("%v clients connected to metrics", clients)
+
+				if err := onClientConnect(); err != nil {
+					log.Println("Could not handle metrics client connected, continuing:", err)
+				}
+			},
+			OnClientDisconnect: func(remoteID string) {
+				clients--
+
+				log.Printf("%v clients connected to metrics", clients)
+			},
+		},
+	)
+	metrics.Peers = registry.Peers
+
+	return registry
+}
+
+// serveInternal accepts the gateways and metrics services which run in separate processes
+func serveInternal(
+	term *leaderTerm,
+
+	laddr,
+	token string,
+	tlsConfig *tls.Config,
+	isLeader func() bool,
+
+	linkGateway,
+	linkMetrics func(conn io.ReadWriteCloser) error,
+
+	errs chan error,
+) {
+	lis, err := net.Listen("tcp", laddr)
+	if err != nil {
+		errs <- err
+
+		return
+	}
+	defer lis.Close()
+
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+
+	log.Println("Internal listening on", lis.Addr())
+
+	if err := http.Serve(lis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !services.IsInternalAuthorized(r, token) {
+			http.Error(w, services.ErrInternalUnauthorized.Error(), http.StatusUnauthorized)
+
+			return
+		}
+
+		if !isLeader() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		var link func(conn io.ReadWriteCloser) error
+		switch r.URL.Path {
+		case services.InternalPathGateway:
+			link = linkGateway
+		case services.InternalPathMetrics:
+			link = linkMetrics
+		default:
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		if err := serveWebsocket(term.context(), w, r, link); err != nil && !utils.IsClosedErr(err) {
+			log.Printf("Internal client disconnected from %v with error: %v", r.URL.Path, err)
+		}
+	})); err != nil {
+		errs <- err
+
+		return
+	}
+}
+
+// linkGatewayService links a gateway which runs in a separate process to the router over the internal listener
+func linkGatewayService(
+	ctx context.Context,
+
+	gateway *services.Gateway,
+
+	internalRaddrs []string,
+	internalToken string,
+	internalHTTPClient *http.Client,
+	retryInterval,
+	maxRetryInterval,
+	timeout time.Duration,
+
+	errs chan error,
+) {
+	gatewayService := services.NewGatewayService(gateway)
+
+	registry := rpc.NewRegistry(
+		gatewayService,
+		services.RouterServiceRemote{},
+		timeout,
+		ctx,
+		&rpc.Options{
+			ResponseBufferLen: rpc.DefaultResponseBufferLen,
+			OnClientConnect: func(remoteID string) {
+				log.Println("Gateway connected to router with ID", remoteID)
+
+				// Adapters which are already connected need to be registered with the new router
+				go func() {
+					if err := services.HandleGatewayServiceRouterConnect(gatewayService); err != nil {
+						log.Println("Could not register adapters with router, continuing:", err)
+					}
+				}()
+			},
+			OnClientDisconnect: func(remoteID string) {
+				log.Println("Gateway disconnected from router with ID", remoteID)
+			},
+		},
+	)
+	gateway.Routers = registry.Peers
+
+	raddrs := []string{}
+	for _, raddr := range internalRaddrs {
+		raddrs = append(raddrs, raddr+services.InternalPathGateway)
+	}
+
+	if err := utils.LinkWithFailover(ctx, raddrs, retryInterval, maxRetryInterval, services.GetInternalDialOptions(internalToken, internalHTTPClient), registry.Link); err != nil {
+		errs <- err
+
+		return
+	}
+}
+
+// linkMetricsService links a metrics service which runs in a separate process to the router over the internal listener
+func linkMetricsService(
+	ctx context.Context,
+
+	metricsService *services.MetricsService,
+
+	internalRaddrs []string,
+	internalToken string,
+	internalHTTPClient *http.Client,
+	retryInterval,
+	maxRetryInterval,
+	timeout time.Duration,
+
+	errs chan error,
+) {
+	registry := rpc.NewRegistry(
+		metricsService,
+		services.RouterServiceRemote{},
+		timeout,
+		ctx,
+		&rpc.Options{
+			ResponseBufferLen: rpc.DefaultResponseBufferLen,
+			OnClientConnect: func(remoteID string) {
+				log.Println("Metrics service connected to router with ID", remoteID)
+
+				// Visualizers which are already connected need the topology of the new router
+				go func() {
+					if err := services.HandleRemoteMetricsClientConnect(metricsService); err != nil {
+						log.Println("Could not refresh topology, continuing:", err)
+					}
+				}()
+			},
+			OnClientDisconnect: func(remoteID string) {
+				log.Println("Metrics service disconnected from router with ID", remoteID)
+			},
+		},
+	)
+	metricsService.Peers = registry.Peers
+
+	raddrs := []string{}
+	for _, raddr := range internalRaddrs {
+		raddrs = append(raddrs, raddr+services.InternalPathMetrics)
+	}
+
+	if err := utils.LinkWithFailover(ctx, raddrs, retryInterval, maxRetryInterval, services.GetInternalDialOptions(internalToken, internalHTTPClient), registry.Link); err != nil {
+		errs <- err
+
+		return
+	}
+}
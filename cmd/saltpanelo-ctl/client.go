@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"github.com/pojntfx/saltpanelo/pkg/services"
+)
+
+var (
+	errUnexpectedStatus = errors.New("could not complete admin request: Unexpected status")
+)
+
+// adminClient talks to the admin API of the control plane with the ID token of an admin
+type adminClient struct {
+	raddr      string
+	httpClient *http.Client
+	getIDToken func() (string, error)
+}
+
+func newAdminClient(raddr string, httpClient *http.Client, getIDToken func() (string, error)) *adminClient {
+	return &adminClient{
+		raddr:      raddr,
+		httpClient: httpClient,
+		getIDToken: getIDToken,
+	}
+}
+
+func (c *adminClient) do(ctx context.Context, method, path string, res any) error {
+	token, err := c.getIDToken()
+	if err != nil {
+		return err
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.raddr, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+
+	hreq.Header.Set("Authorization", "Bearer "+token)
+
+	hres, err := c.httpClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hres.Body.Close()
+
+	if hres.StatusCode < http.StatusOK || hres.StatusCode >= http.StatusMultipleChoices {
+		msg, _ := io.ReadAll(io.LimitReader(hres.Body, 1024))
+
+		// The admin API describes most errors, but proxies and non-leader replicas only respond with a status
+		var adminErr services.AdminError
+		if err := json.Unmarshal(msg, &adminErr); err == nil && adminErr.Error != "" {
+			return fmt.Errorf("%w: %v", errUnexpectedStatus, adminErr.Error)
+		}
+
+		return fmt.Errorf("%w: %v", errUnexpectedStatus, hres.Status)
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	return json.NewDecoder(hres.Body).Decode(res)
+}
+
+func (c *adminClient) listSwitches(ctx context.Context) ([]services.AdminSwitch, error) {
+	switches := []services.AdminSwitch{}
+	if err := c.do(ctx, http.MethodGet, "/switches", &switches); err != nil {
+		return []services.AdminSwitch{}, err
+	}
+
+	return switches, nil
+}
+
+func (c *adminClient) drainSwitch(ctx context.Context, swID string) error {
+	return c.do(ctx, http.MethodPost, "/switches/"+swID+"/drain", nil)
+}
+
+func (c *adminClient) listAdapters(ctx context.Context) ([]services.AdminAdapter, error) {
+	adapters := []services.AdminAdapter{}
+	if err := c.do(ctx, http.MethodGet, "/adapters", &adapters); err != nil {
+		return []services.AdminAdapter{}, err
+	}
+
+	return adapters, nil
+}
+
+func (c *adminClient) kickAdapter(ctx context.Context, adapterID string) error {
+	return c.do(ctx, http.MethodPost, "/adapters/"+adapterID+"/kick", nil)
+}
+
+func (c *adminClient) listRoutes(ctx context.Context) ([]persisters.RouteRecord, error) {
+	routes := []persisters.RouteRecord{}
+	if err := c.do(ctx, http.MethodGet, "/routes", &routes); err != nil {
+		return []persisters.RouteRecord{}, err
+	}
+
+	return routes, nil
+}
+
+func (c *adminClient) getRoute(ctx context.Context, routeID string) (persisters.RouteRecord, error) {
+	route := persisters.RouteRecord{}
+	if err := c.do(ctx, http.MethodGet, "/routes/"+routeID, &route); err != nil {
+		return persisters.RouteRecord{}, err
+	}
+
+	return route, nil
+}
+
+func (c *adminClient) hangupRoute(ctx context.Context, routeID string) error {
+	return c.do(ctx, http.MethodDelete, "/routes/"+routeID, nil)
+}
+
+func (c *adminClient) rotateCA(ctx context.Context) (services.AdminCA, error) {
+	ca := services.AdminCA{}
+	if err := c.do(ctx, http.MethodPost, "/ca/rotate", &ca); err != nil {
+		return services.AdminCA{}, err
+	}
+
+	return ca, nil
+}
+
+func (c *adminClient) retireCA(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/ca/retire", nil)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cli/browser"
+	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/config"
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"github.com/pojntfx/saltpanelo/pkg/services"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+)
+
+var (
+	errUnknownCommand = errors.New("unknown command")
+	errInvalidArgs    = errors.New("invalid arguments")
+	errNotConfirmed   = errors.New("could not continue: Command has to be confirmed with -confirm")
+)
+
+const usage = `Usage: %v [flags] <command>
+
+Commands:
+  switches list             List the registered switches
+  switch drain <switch ID>  Stop provisioning new routes through a switch
+  adapters list             List the registered adapters
+  adapter kick <adapter ID> Hang up the calls of an adapter and unregister it
+  routes list               List the provisioned routes
+  routes show <route ID>    Show a route and the call which is active on it
+  routes hangup <route ID>  Hang up a route
+  ca rotate                 Back up the CA and generate the next one; once the control plane restarts, it trusts both and
+                            re-issues the node certificates of switches with the next CA (copy ca.next.cert.pem and
+                            ca.next.key.pem to the other replicas before restarting them; requires -confirm)
+  ca retire                 Replace the CA with the next one once all switches have been re-issued node certificates,
+                            which the control plane serves its listeners with once it restarts (run it on every replica
+                            and distribute the next CA to clients before restarting; requires -confirm)
+  topology export           Write the network and routes graphs as Graphviz DOT (or the topology as JSON)
+
+Flags:
+`
+
+type topology struct {
+	Switches []services.AdminSwitch
+	Adapters []services.AdminAdapter
+	Routes   []persisters.RouteRecord
+}
+
+func main() {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	configPath := flag.String("config", "", "Path to the YAML config file whose keys are the flag names (e.g. raddr: https://localhost:1343); environment variables (e.g. SALTPANELO_RADDR) and flags take precedence over it")
+	raddr := flag.String("raddr", "https://localhost:1343", "Admin API remote address of the control plane")
+	caPath := flag.String("ca", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "ca.cert.pem"), "Path to the CA certificate which the control plane's certificate is verified with in addition to the system roots (e.g. the ca.cert.pem in the working directory of the control plane)")
+	timeout := flag.Duration("timeout", time.Minute, "Time after which to assume that a request has timed out")
+	output := flag.String("output", outputTable, "Output format (table or json)")
+	networkOut := flag.String("network-out", "saltpanelo-network.dot", "Path to write the network graph to when exporting the topology")
+	routesOut := flag.String("routes-out", "saltpanelo-routes.dot", "Path to write the routes graph to when exporting the topology")
+	confirm := flag.Bool("confirm", false, "Whether to confirm commands which change the CA")
+
+	token := flag.String("token", "", "ID token of an admin to authenticate with (leave empty to log in with the OIDC issuer)")
+	oidcIssuer := flag.String("oidc-issuer", "", "OIDC issuer, which must be the gateway OIDC issuer of the control plane (e.g. https://pojntfx.eu.auth0.com/)")
+	oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "http://localhost:11337", "OIDC redirect URL")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), usage, os.Args[0])
+
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	loader := config.NewLoader(flag.CommandLine, *configPath)
+	if err := loader.Load(); err != nil {
+		panic(err)
+	}
+
+	if *output != outputTable && *output != outputJSON {
+		panic(errUnknownOutput)
+	}
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+
+		os.Exit(2)
+	}
+
+	// Commands which change the CA affect every switch and client, so they have to be confirmed before logging in
+	if args[0] == "ca" && !*confirm {
+		panic(errNotConfirmed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	getIDToken := func() (string, error) {
+		return *token, nil
+	}
+	if strings.TrimSpace(*token) == "" {
+		if strings.TrimSpace(*oidcIssuer) == "" {
+			panic(auth.ErrEmptyOIDCIssuer)
+		}
+
+		if strings.TrimSpace(*oidcClientID) == "" {
+			panic(auth.ErrEmptyOIDCClientID)
+		}
+
+		if strings.TrimSpace(*oidcRedirectURL) == "" {
+			panic(auth.ErrEmptyOIDCRedirectURL)
+		}
+
+		tm := auth.NewTokenManagerAuthorizationCode(
+			*oidcIssuer,
+			*oidcClientID,
+			*oidcRedirectURL,
+
+			func(s string) error {
+				if err := browser.OpenURL(s); err != nil {
+					log.Printf(`Could not open browser, please open the following URL in your browser manually to authorize:
+%v`, s)
+				}
+
+				return nil
+			},
+
+			ctx,
+		)
+
+		if err := tm.InitialLogin(); err != nil {
+			panic(err)
+		}
+
+		getIDToken = tm.GetIDToken
+	}
+
+	httpClient, err := utils.GetCAHTTPClient(*caPath)
+	if err != nil {
+		panic(err)
+	}
+	httpClient.Timeout = *timeout
+
+	c := newAdminClient(*raddr, httpClient, getIDToken)
+
+	// Commands which act on a switch, adapter or route take its ID as the last argument
+	getID := func() string {
+		if len(args) < 3 || strings.TrimSpace(args[2]) == "" {
+			panic(errInvalidArgs)
+		}
+
+		return args[2]
+	}
+
+	switch args[0] + " " + args[1] {
+	case "switches list":
+		switches, err := c.listSwitches(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := writeSwitches(os.Stdout, *output, switches); err != nil {
+			panic(err)
+		}
+
+	case "switch drain":
+		swID := getID()
+		if err := c.drainSwitch(ctx, swID); err != nil {
+			panic(err)
+		}
+
+		if err := writeResult(os.Stdout, *output, "Draining switch with ID "+swID); err != nil {
+			panic(err)
+		}
+
+	case "adapters list":
+		adapters, err := c.listAdapters(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := writeAdapters(os.Stdout, *output, adapters); err != nil {
+			panic(err)
+		}
+
+	case "adapter kick":
+		adapterID := getID()
+		if err := c.kickAdapter(ctx, adapterID); err != nil {
+			panic(err)
+		}
+
+		if err := writeResult(os.Stdout, *output, "Kicked adapter with ID "+adapterID); err != nil {
+			panic(err)
+		}
+
+	case "routes list":
+		routes, err := c.listRoutes(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := writeRoutes(os.Stdout, *output, routes); err != nil {
+			panic(err)
+		}
+
+	case "routes show":
+		route, err := c.getRoute(ctx, getID())
+		if err != nil {
+			panic(err)
+		}
+
+		if err := writeRoute(os.Stdout, *output, route); err != nil {
+			panic(err)
+		}
+
+	case "routes hangup":
+		routeID := getID()
+		if err := c.hangupRoute(ctx, routeID); err != nil {
+			panic(err)
+		}
+
+		if err := writeResult(os.Stdout, *output, "Hung up route with ID "+routeID); err != nil {
+			panic(err)
+		}
+
+	case "ca rotate":
+		ca, err := c.rotateCA(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		if *output == outputJSON {
+			if err := writeJSON(os.Stdout, ca); err != nil {
+				panic(err)
+			}
+
+			break
+		}
+
+		if _, err := os.Stdout.Write(ca.CAPEM); err != nil {
+			panic(err)
+		}
+
+	case "ca retire":
+		if err := c.retireCA(ctx); err != nil {
+			panic(err)
+		}
+
+		if err := writeResult(os.Stdout, *output, "Retired CA, the next CA is used once the control plane restarts"); err != nil {
+			panic(err)
+		}
+
+	case "topology export":
+		switches, err := c.listSwitches(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		adapters, err := c.listAdapters(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		routes, err := c.listRoutes(ctx)
+		if err != nil {
+			panic(err)
+		}
+
+		if *output == outputJSON {
+			if err := writeJSON(os.Stdout, topology{switches, adapters, routes}); err != nil {
+				panic(err)
+			}
+
+			break
+		}
+
+		networkFile, err := os.Create(*networkOut)
+		if err != nil {
+			panic(err)
+		}
+		defer networkFile.Close()
+
+		routesFile, err := os.Create(*routesOut)
+		if err != nil {
+			panic(err)
+		}
+		defer routesFile.Close()
+
+		if err := services.ExportTopology(switches, adapters, routes, networkFile, routesFile); err != nil {
+			panic(err)
+		}
+
+		fmt.Println("Wrote network graph to", *networkOut, "and routes graph to", *routesOut)
+
+	default:
+		panic(errUnknownCommand)
+	}
+}
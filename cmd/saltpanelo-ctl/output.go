@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"github.com/pojntfx/saltpanelo/pkg/services"
+)
+
+var (
+	errUnknownOutput = errors.New("unknown output format")
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+func writeJSON(w io.Writer, v any) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+
+	return e.Encode(v)
+}
+
+// writeTable writes the rows as columns which are aligned with the header
+func writeTable(w io.Writer, header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	if _, err := fmt.Fprintln(tw, strings.Join(header, "\t")); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if _, err := fmt.Fprintln(tw, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func formatString(s string) string {
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+func writeSwitches(w io.Writer, output string, switches []services.AdminSwitch) error {
+	if output == outputJSON {
+		return writeJSON(w, switches)
+	}
+
+	rows := [][]string{}
+	for _, sw := range switches {
+		rows = append(rows, []string{
+			sw.ID,
+			sw.Addr,
+			string(sw.NAT.Type),
+			fmt.Sprint(sw.Border),
+			fmt.Sprint(sw.Draining),
+			fmt.Sprint(len(sw.Latencies)),
+		})
+	}
+
+	return writeTable(w, []string{"ID", "ADDR", "NAT", "BORDER", "DRAINING", "MEASURED PEERS"}, rows)
+}
+
+func writeAdapters(w io.Writer, output string, adapters []services.AdminAdapter) error {
+	if output == outputJSON {
+		return writeJSON(w, adapters)
+	}
+
+	rows := [][]string{}
+	for _, adapter := range adapters {
+		rows = append(rows, []string{
+			adapter.ID,
+			adapter.UserEmail,
+			adapter.Presence,
+			fmt.Sprint(adapter.Priority),
+			fmt.Sprint(len(adapter.Latencies)),
+		})
+	}
+
+	return writeTable(w, []string{"ID", "EMAIL", "PRESENCE", "PRIORITY", "MEASURED SWITCHES"}, rows)
+}
+
+func writeRoutes(w io.Writer, output string, routes []persisters.RouteRecord) error {
+	if output == outputJSON {
+		return writeJSON(w, routes)
+	}
+
+	rows := [][]string{}
+	for _, route := range routes {
+		rows = append(rows, []string{
+			route.RouteID,
+			formatString(route.ChannelID),
+			fmt.Sprint(route.Group),
+			formatString(route.ActiveCall.CallerEmail),
+			formatString(route.ActiveCall.CalleeEmail),
+			formatTime(route.ActiveCall.StartedAt),
+			strings.Join(route.Path, " -> "),
+		})
+	}
+
+	return writeTable(w, []string{"ROUTE ID", "CHANNEL ID", "GROUP", "CALLER", "CALLEE", "STARTED", "PATH"}, rows)
+}
+
+func writeRoute(w io.Writer, output string, route persisters.RouteRecord) error {
+	if output == outputJSON {
+		return writeJSON(w, route)
+	}
+
+	// Routes without an active call (e.g. group routes) only have a path
+	rows := [][]string{
+		{"Route ID", route.RouteID},
+		{"Channel ID", formatString(route.ChannelID)},
+		{"Group", fmt.Sprint(route.Group)},
+		{"Path", strings.Join(route.Path, " -> ")},
+		{"Caller", formatString(strings.TrimSpace(route.ActiveCall.CallerEmail + " " + route.ActiveCall.CallerID))},
+		{"Callee", formatString(strings.TrimSpace(route.ActiveCall.CalleeEmail + " " + route.ActiveCall.CalleeID))},
+		{"Started", formatTime(route.ActiveCall.StartedAt)},
+		{"Setup latency", fmt.Sprint(route.ActiveCall.SetupLatency)},
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		if _, err := fmt.Fprintf(tw, "%v:\t%v\n", row[0], row[1]); err != nil {
+			return err
+		}
+	}
+
+	return tw.Flush()
+}
+
+// writeResult reports the result of an action which doesn't return anything, e.g. hanging up a route
+func writeResult(w io.Writer, output, message string) error {
+	if output == outputJSON {
+		return writeJSON(w, struct{}{})
+	}
+
+	_, err := fmt.Fprintln(w, message)
+
+	return err
+}
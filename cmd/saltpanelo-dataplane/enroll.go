@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/saltpanelo/pkg/services"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+	"nhooyr.io/websocket"
+)
+
+var (
+	errRouterNotConnected  = errors.New("could not enroll: Router is not connected")
+	errNoRouterCertificate = errors.New("could not verify router: No certificate")
+)
+
+// nodeCertificate is the certificate which the switch authenticates to the router with once it has enrolled; the router
+// renews it while the switch is registered, so it is only issued again after the switch was offline for too long
+type nodeCertificate struct {
+	lock sync.Mutex
+
+	certPath string
+	caPath   string
+	privKey  ed25519.PrivateKey
+
+	certPEM []byte
+	caPEM   []byte
+	cert    tls.Certificate
+}
+
+func newNodeCertificate(certPath, caPath string, privKey ed25519.PrivateKey) *nodeCertificate {
+	return &nodeCertificate{
+		certPath: certPath,
+		caPath:   caPath,
+		privKey:  privKey,
+	}
+}
+
+func (c *nodeCertificate) parse(certPEM, caPEM []byte) (bool, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return false, utils.ErrInvalidNodeCertificate
+	}
+
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false, err
+	}
+
+	if time.Now().After(leaf.NotAfter) {
+		return false, nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.certPEM = certPEM
+	c.caPEM = caPEM
+	c.cert = tls.Certificate{
+		Certificate: [][]byte{block.Bytes},
+		PrivateKey:  c.privKey,
+		Leaf:        leaf,
+	}
+
+	return true, nil
+}
+
+// load returns false if the switch hasn't enrolled yet or if its node certificate has expired
+func (c *nodeCertificate) load() (bool, error) {
+	certPEM, err := os.ReadFile(c.certPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	caPEM, err := os.ReadFile(c.caPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return c.parse(certPEM, caPEM)
+}
+
+func (c *nodeCertificate) store(nodeCert services.NodeCertificate) error {
+	if _, err := c.parse(nodeCert.CertPEM, nodeCert.CAPEM); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.certPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(c.certPath, nodeCert.CertPEM, 0600); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.caPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	return os.WriteFile(c.caPath, nodeCert.CAPEM, 0600)
+}
+
+func (c *nodeCertificate) getCertPEM() []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.certPEM
+}
+
+// getDialOptions authenticates to the router with the current node certificate, so renewed certificates are used once the switch reconnects
+func (c *nodeCertificate) getDialOptions() *websocket.DialOptions {
+	return &websocket.DialOptions{
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					// The CA can be rotated while the switch is running, so the router's certificate is verified against
+					// the current CA certificates on every handshake instead of against a fixed pool
+					InsecureSkipVerify: true,
+					VerifyConnection:   c.verifyRouter,
+					GetClientCertificate: func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+						c.lock.Lock()
+						defer c.lock.Unlock()
+
+						cert := c.cert
+
+						return &cert, nil
+					},
+				},
+			},
+		},
+	}
+}
+
+// verifyRouter verifies the router's certificate like the default verification would, but with the current CA certificates
+func (c *nodeCertificate) verifyRouter(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) < 1 {
+		return errNoRouterCertificate
+	}
+
+	c.lock.Lock()
+	caPEM := c.caPEM
+	c.lock.Unlock()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+
+	return err
+}
+
+// enrollSwitch requests a node certificate for the identity of the switch once, which is the only time it needs an OIDC token
+func enrollSwitch(
+	ctx context.Context,
+	privKey ed25519.PrivateKey,
+	getIDToken func() (string, error),
+	raddrs []string,
+	dialOptions *websocket.DialOptions,
+	retryInterval,
+	maxRetryInterval,
+	timeout time.Duration,
+) (services.NodeCertificate, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	connected := make(chan string, 1)
+	registry := rpc.NewRegistry(
+		&struct{}{},
+		services.RouterRemote{},
+		timeout,
+		ctx,
+		&rpc.Options{
+			ResponseBufferLen: rpc.DefaultResponseBufferLen,
+			OnClientConnect: func(remoteID string) {
+				select {
+				case connected <- remoteID:
+				default:
+				}
+			},
+		},
+	)
+
+	errs := make(chan error, 1)
+	go func() {
+		if err := utils.LinkWithFailover(ctx, raddrs, retryInterval, maxRetryInterval, dialOptions, registry.Link); err != nil {
+			errs <- err
+		}
+	}()
+
+	var remoteID string
+	select {
+	case err := <-errs:
+		return services.NodeCertificate{}, err
+	case remoteID = <-connected:
+	}
+
+	peer, ok := registry.Peers()[remoteID]
+	if !ok {
+		return services.NodeCertificate{}, errRouterNotConnected
+	}
+
+	token, err := getIDToken()
+	if err != nil {
+		return services.NodeCertificate{}, err
+	}
+
+	challenge, err := peer.GetRegistrationChallenge(ctx)
+	if err != nil {
+		return services.NodeCertificate{}, err
+	}
+
+	return peer.EnrollSwitch(ctx, token, services.NewNodeIdentity(privKey, challenge))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+)
+
+func TestVerifyRouterUsesCurrentCA(t *testing.T) {
+	_, oldCAPEM, _, _, err := utils.GenerateCertificateAuthority(2048, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCACfg, newCAPEM, _, newCAPrivKey, err := utils.GenerateCertificateAuthority(2048, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener certificate is issued by the new CA, like after the old CA was retired
+	certPEM, _, err := utils.GenerateCertificateForHosts(2048, newCACfg, newCAPrivKey, time.Hour, []string{"127.0.0.1"}, "router")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		caPEM      []byte
+		serverName string
+		wantErr    bool
+	}{
+		{"old CA only", oldCAPEM, "127.0.0.1", true},
+		{"rotated CAs", append(append([]byte{}, oldCAPEM...), newCAPEM...), "127.0.0.1", false},
+		{"new CA only", newCAPEM, "127.0.0.1", false},
+		{"wrong server name", newCAPEM, "127.0.0.2", true},
+	}
+
+	c := newNodeCertificate("", "", nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The CA certificates are replaced like when a renewed node certificate is stored
+			c.lock.Lock()
+			c.caPEM = tt.caPEM
+			c.lock.Unlock()
+
+			err := c.verifyRouter(tls.ConnectionState{
+				ServerName:       tt.serverName,
+				PeerCertificates: []*x509.Certificate{cert},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyRouter() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := c.verifyRouter(tls.ConnectionState{}); err != errNoRouterCertificate {
+		t.Errorf("verifyRouter() without certificate error = %v, want %v", err, errNoRouterCertificate)
+	}
+}
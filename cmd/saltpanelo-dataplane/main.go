@@ -6,73 +6,141 @@ import (
 	"crypto/x509"
 	"flag"
 	"log"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/pojntfx/dudirekta/pkg/rpc"
 	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/config"
 	"github.com/pojntfx/saltpanelo/pkg/services"
 	"github.com/pojntfx/saltpanelo/pkg/utils"
-	"nhooyr.io/websocket"
 )
 
 func main() {
-	raddr := flag.String("raddr", "ws://localhost:1337", "Router remote address")
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	configPath := flag.String("config", "", "Path to the YAML config file whose keys are the flag names (e.g. retry-interval: 5s); environment variables (e.g. SALTPANELO_RETRY_INTERVAL) and flags take precedence over it, and SIGHUP reloads verbose")
+	raddr := flag.String("raddr", "wss://localhost:1337", "Comma-separated list of router remote addresses (one per control plane replica) to enroll with using the OIDC client credentials")
+	caPath := flag.String("ca", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "ca.cert.pem"), "Path to the CA certificate which the router's certificate is verified with in addition to the system roots (e.g. the ca.cert.pem in the working directory of the control plane)")
+	mtlsRaddr := flag.String("mtls-raddr", "wss://localhost:1342", "Comma-separated list of router remote addresses (one per control plane replica) to register with using the node certificate once enrolled")
 	laddr := flag.String("laddr", ":1340", "Listen address for latency and throughput tests")
 	taddr := flag.String("taddr", "127.0.0.1:1340", "Listen address to advertise for latency and throughput tests")
 	ahost := flag.String("ahost", "127.0.0.1", "Host to advertise other switches to dial; leave empty to resolve public IP using STUN")
 	timeout := flag.Duration("timeout", time.Minute, "Time after which to assume that a call has timed out")
 	verbose := flag.Bool("verbose", false, "Whether to enable verbose logging")
-	stunAddr := flag.String("stun", "stun.l.google.com:19302", "STUN server address")
+	stunAddrs := flag.String("stun", "stun.l.google.com:19302,stun1.l.google.com:19302", "Comma-separated list of STUN server addresses (at least two are required to classify the NAT)")
+	stunTimeout := flag.Duration("stun-timeout", time.Second*5, "Time after which to assume that a STUN server is unreachable")
+	holePunchTimeout := flag.Duration("hole-punch-timeout", time.Second*10, "Time after which to give up punching a hole to another switch")
 	oidcIssuer := flag.String("oidc-issuer", "", "OIDC issuer (e.g. https://pojntfx.eu.auth0.com/)")
 	oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID")
 	oidcClientSecret := flag.String("oidc-client-secret", "", "OIDC client secret")
 	oidcAudience := flag.String("oidc-audience", "", "Router OIDC audience (e.g. https://saltpanelo-router)")
+	retryInterval := flag.Duration("retry-interval", time.Second*5, "Time to wait before trying all router remote addresses again if none of them can be reached (doubles with each attempt up to the maximum retry interval)")
+	maxRetryInterval := flag.Duration("max-retry-interval", time.Minute, "Maximum time to wait before trying all router remote addresses again")
+	drainTimeout := flag.Duration("drain-timeout", time.Second*30, "Time to wait for routes to end after receiving SIGINT or SIGTERM before shutting down (routes which are still active are hung up)")
+	identity := flag.String("identity", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "switch.pem"), "Path to the private key which identifies the switch across restarts and reconnects (will be created if it doesn't exist)")
+	nodeCertPath := flag.String("node-cert", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "switch.cert.pem"), "Path to the node certificate which the switch authenticates to the router with (will be enrolled for using the OIDC client credentials if it doesn't exist or has expired)")
+	nodeCAPath := flag.String("node-ca", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "switch.ca.pem"), "Path to the CA certificate which the router's certificate is verified with (will be stored when enrolling)")
+	border := flag.Bool("border", false, "Whether to act as a border switch which stitches routes to the border switches of federated control planes (requires a publicly reachable address)")
 
 	flag.Parse()
 
-	if strings.TrimSpace(*oidcIssuer) == "" {
-		panic(auth.ErrEmptyOIDCIssuer)
-	}
-
-	if strings.TrimSpace(*oidcClientID) == "" {
-		panic(auth.ErrEmptyOIDCClientID)
+	loader := config.NewLoader(flag.CommandLine, *configPath)
+	if err := loader.Load(); err != nil {
+		panic(err)
 	}
 
-	if strings.TrimSpace(*oidcClientSecret) == "" {
-		panic(auth.ErrEmptyOIDCClientSecret)
+	nat := utils.NATInfo{
+		Type:     utils.NATTypeNone,
+		PublicIP: *ahost,
 	}
-
 	if strings.TrimSpace(*ahost) == "" {
-		ah, err := utils.GetPublicIP(*stunAddr)
+		var err error
+		nat, err = utils.GetNATInfo(strings.Split(*stunAddrs, ","), *stunTimeout)
 		if err != nil {
 			panic(err)
 		}
 
-		*ahost = ah.String()
+		*ahost = nat.PublicIP
+
+		log.Println("Detected public IP", nat.PublicIP, "and NAT type", nat.Type)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	tm := auth.NewTokenManagerClientCredentials(
-		*oidcIssuer,
-		*oidcClientID,
-		*oidcClientSecret,
-		*oidcAudience,
-
-		ctx,
-	)
+	privKey, err := utils.LoadOrCreateIdentity(*identity)
+	if err != nil {
+		panic(err)
+	}
 
-	if err := tm.InitialLogin(); err != nil {
+	nodeCert := newNodeCertificate(*nodeCertPath, *nodeCAPath, privKey)
+	enrolled, err := nodeCert.load()
+	if err != nil {
 		panic(err)
 	}
 
+	// Once enrolled, the switch registers with its node certificate, so it doesn't depend on the OIDC provider anymore
+	if !enrolled {
+		if strings.TrimSpace(*oidcIssuer) == "" {
+			panic(auth.ErrEmptyOIDCIssuer)
+		}
+
+		if strings.TrimSpace(*oidcClientID) == "" {
+			panic(auth.ErrEmptyOIDCClientID)
+		}
+
+		if strings.TrimSpace(*oidcClientSecret) == "" {
+			panic(auth.ErrEmptyOIDCClientSecret)
+		}
+
+		tm := auth.NewTokenManagerClientCredentials(
+			*oidcIssuer,
+			*oidcClientID,
+			*oidcClientSecret,
+			*oidcAudience,
+
+			ctx,
+		)
+
+		if err := tm.InitialLogin(); err != nil {
+			panic(err)
+		}
+
+		log.Println("Enrolling with router")
+
+		dialOptions, err := utils.GetCADialOptions(*caPath)
+		if err != nil {
+			panic(err)
+		}
+
+		c, err := enrollSwitch(ctx, privKey, tm.GetIDToken, utils.SplitRemoteAddresses(*raddr), dialOptions, *retryInterval, *maxRetryInterval, *timeout)
+		if err != nil {
+			panic(err)
+		}
+
+		if err := nodeCert.store(c); err != nil {
+			panic(err)
+		}
+
+		log.Println("Enrolled with router")
+	}
+
 	errs := make(chan error)
 
-	switchConfigChan := make(chan services.SwitchConfiguration)
+	// Only the first registration configures the listener; switches register again with the same identity after reconnecting
+	// or failing over to another replica, so that the router resumes their routes
+	switchConfigChan := make(chan services.SwitchConfiguration, 1)
 
-	l := services.NewSwitch(*verbose, *ahost)
+	// Registration errors (e.g. a failed write on the router) close the link so that the switch fails over and keeps its routes
+	linkedConn := &utils.LinkedConn{}
+
+	l := services.NewSwitch(*verbose, *ahost, nat, *holePunchTimeout)
 	clients := 0
 	registry := rpc.NewRegistry(
 		l,
@@ -86,6 +154,8 @@ func main() {
 
 				log.Printf("%v clients connected", clients)
 
+				conn := linkedConn.Current()
+
 				go func() {
 					for candidateID, peer := range l.Peers() {
 						if remoteID == candidateID {
@@ -93,21 +163,44 @@ func main() {
 								log.Println("Registering with router with ID", remoteID)
 							}
 
-							token, err := tm.GetIDToken()
+							challenge, err := peer.GetRegistrationChallenge(ctx)
 							if err != nil {
-								errs <- err
+								log.Println("Could not get registration challenge from router with ID", remoteID, ", failing over:", err)
+
+								linkedConn.Fail(conn, err)
 
 								return
 							}
 
-							switchConfig, err := peer.RegisterSwitch(ctx, token, *taddr)
+							identity := services.NewNodeIdentity(privKey, challenge)
+							identity.CertPEM = nodeCert.getCertPEM()
+
+							switchConfig, err := peer.RegisterSwitch(ctx, "", identity, *taddr, nat, *border)
 							if err != nil {
-								log.Fatal("Could not register with router with ID", remoteID, ", stopping:", err)
+								log.Println("Could not register with router with ID", remoteID, ", failing over:", err)
+
+								linkedConn.Fail(conn, err)
+
+								return
+							}
+
+							if len(switchConfig.NodeCertPEM) > 0 {
+								if err := nodeCert.store(services.NodeCertificate{
+									CAPEM:   switchConfig.CAPEM,
+									CertPEM: switchConfig.NodeCertPEM,
+								}); err != nil {
+									log.Println("Could not store renewed node certificate, continuing:", err)
+								} else if *verbose {
+									log.Println("Renewed node certificate with router with ID", remoteID)
+								}
 							}
 
 							services.SetSwitchCA(l, switchConfig.CAPEM)
 
-							switchConfigChan <- switchConfig
+							select {
+							case switchConfigChan <- switchConfig:
+							default:
+							}
 
 							if *verbose {
 								log.Println("Registered with router with ID", remoteID)
@@ -125,19 +218,12 @@ func main() {
 	)
 	l.Peers = registry.Peers
 
-	go func() {
-		rawConn, _, err := websocket.Dial(ctx, *raddr, nil)
-		if err != nil {
-			errs <- err
-
-			return
-		}
-		conn := websocket.NetConn(ctx, rawConn, websocket.MessageText)
-		defer conn.Close()
-
-		log.Println("Connected to", conn.RemoteAddr())
+	loader.Watch(ctx, []string{"verbose"}, func(values config.Values, changed []string) {
+		services.SetSwitchVerbose(l, values.Bool("verbose"))
+	})
 
-		if err := registry.Link(conn); err != nil {
+	go func() {
+		if err := utils.LinkWithFailover(ctx, utils.SplitRemoteAddresses(*mtlsRaddr), *retryInterval, *maxRetryInterval, nodeCert.getDialOptions(), linkedConn.Link(registry.Link)); err != nil {
 			errs <- err
 
 			return
@@ -206,11 +292,38 @@ func main() {
 		}
 	}()
 
-	for err := range errs {
-		if err == nil {
-			return
+	signals := utils.NotifyShutdown()
+
+	// Errors take the same path as signals, so that the routes through this switch are drained instead of being dropped
+	select {
+	case err := <-errs:
+		if err != nil {
+			log.Println("Could not continue, shutting down:", err)
 		}
+	case <-signals:
+	}
 
-		panic(err)
+	log.Println("Draining, waiting up to", *drainTimeout, "for routes to end")
+
+	services.SetSwitchDraining(l, true)
+
+	// The router stops provisioning new routes through this switch, so calls are routed through the other switches
+	for remoteID, peer := range l.Peers() {
+		if err := peer.DrainSwitch(ctx, ""); err != nil {
+			log.Println("Could not drain switch with router with ID", remoteID, ", continuing:", err)
+		}
+	}
+
+	if !utils.WaitForDrain(signals, *drainTimeout, func() bool {
+		routeIDs, err := l.ListRoutes(ctx)
+
+		return err == nil && len(routeIDs) == 0
+	}) {
+		log.Println("Could not drain all routes, continuing")
 	}
+
+	log.Println("Shutting down")
+
+	// Cancelling the context closes the connection to the router, which unlinks it from the registry; the router hangs up the remaining routes
+	cancel()
 }
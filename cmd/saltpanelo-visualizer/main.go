@@ -5,18 +5,29 @@ import (
 	"flag"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/cli/browser"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
 	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/config"
 	"github.com/pojntfx/saltpanelo/pkg/services"
-	"nhooyr.io/websocket"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
 )
 
 func main() {
-	raddr := flag.String("raddr", "ws://localhost:1339", "Metric remote address")
+	home, err := os.UserHomeDir()
+	if err != nil {
+		panic(err)
+	}
+
+	configPath := flag.String("config", "", "Path to the YAML config file whose keys are the flag names (e.g. retry-interval: 5s); environment variables (e.g. SALTPANELO_RETRY_INTERVAL) and flags take precedence over it, and SIGHUP reloads verbose")
+	raddr := flag.String("raddr", "wss://localhost:1339", "Comma-separated list of metric remote addresses (one per control plane replica)")
+	caPath := flag.String("ca", filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "ca.cert.pem"), "Path to the CA certificate which the metrics service's certificate is verified with in addition to the system roots (e.g. the ca.cert.pem in the working directory of the control plane)")
+	retryInterval := flag.Duration("retry-interval", time.Second*5, "Time to wait before trying all metric remote addresses again if none of them can be reached (doubles with each attempt up to the maximum retry interval)")
+	maxRetryInterval := flag.Duration("max-retry-interval", time.Minute, "Maximum time to wait before trying all metric remote addresses again")
 	timeout := flag.Duration("timeout", time.Minute, "Time after which to assume that a call has timed out")
 	verbose := flag.Bool("verbose", false, "Whether to enable verbose logging")
 	networkOut := flag.String("network-out", "saltpanelo-network.svg", "Path to write the network graph to")
@@ -29,6 +40,11 @@ func main() {
 
 	flag.Parse()
 
+	loader := config.NewLoader(flag.CommandLine, *configPath)
+	if err := loader.Load(); err != nil {
+		panic(err)
+	}
+
 	if strings.TrimSpace(*oidcIssuer) == "" {
 		panic(auth.ErrEmptyOIDCIssuer)
 	}
@@ -106,16 +122,32 @@ func main() {
 	)
 	l.Peers = registry.Peers
 
-	rawConn, _, err := websocket.Dial(ctx, *raddr, nil)
+	loader.Watch(ctx, []string{"verbose"}, func(values config.Values, changed []string) {
+		services.SetVisualizerVerbose(l, values.Bool("verbose"))
+	})
+
+	dialOptions, err := utils.GetCADialOptions(*caPath)
 	if err != nil {
 		panic(err)
 	}
-	conn := websocket.NetConn(ctx, rawConn, websocket.MessageText)
-	defer conn.Close()
 
-	log.Println("Connected to", conn.RemoteAddr())
+	errs := make(chan error)
+	go func() {
+		if err := utils.LinkWithFailover(ctx, utils.SplitRemoteAddresses(*raddr), *retryInterval, *maxRetryInterval, dialOptions, registry.Link); err != nil {
+			errs <- err
+
+			return
+		}
+	}()
 
-	if err := registry.Link(conn); err != nil {
+	select {
+	case err := <-errs:
 		panic(err)
+	case <-utils.NotifyShutdown():
 	}
+
+	log.Println("Shutting down")
+
+	// Cancelling the context closes the connection to the metrics service, which unlinks it from the registry; the graphs are closed once main returns
+	cancel()
 }
@@ -52,6 +52,17 @@ char *on_handle_call_handler(char *route_id, char *channel_id, char *raddr,
   return "";
 }
 
+char *on_call_state_changed_handler(char *route_id, char *channel_id,
+                                    char *state, char is_caller,
+                                    void *userdata) {
+  struct example_external_data *example_data = userdata;
+
+  printf("%s call with route ID %s and channel ID %s is %s\n",
+         is_caller ? "Outgoing" : "Incoming", route_id, channel_id, state);
+
+  return "";
+}
+
 char *open_url_handler(char *url, void *userdata) {
   struct example_external_data *example_data = userdata;
 
@@ -65,8 +76,9 @@ int main() {
 
   void *adapter = SaltpaneloNewAdapter(
       &on_request_call_handler, &example_data, &on_call_disconnected_handler,
-      &example_data, &on_handle_call_handler, &example_data, &open_url_handler,
-      &example_data, "ws://localhost:1338", "127.0.0.1", false, 10000,
+      &example_data, &on_handle_call_handler, &example_data,
+      &on_call_state_changed_handler, &example_data, &open_url_handler,
+      &example_data, "wss://localhost:1338", "127.0.0.1", false, 10000,
       "https://pojntfx.eu.auth0.com/", "An94hvwzqxMmFcL8iEpTVrd88zFdhVdl",
       "http://localhost:11337");
 
@@ -12,8 +12,11 @@ require (
 	github.com/ncruces/zenity v0.10.5
 	github.com/pion/stun v0.3.5
 	github.com/pojntfx/dudirekta v0.4.0
+	go.etcd.io/bbolt v1.3.7
 	golang.org/x/exp v0.0.0-20221230185412-738e83a70c30
 	golang.org/x/oauth2 v0.0.0-20220411215720-9780585627b5
+	golang.org/x/sys v0.4.0
+	gopkg.in/yaml.v3 v3.0.1
 	nhooyr.io/websocket v1.8.7
 )
 
@@ -29,7 +32,6 @@ require (
 	golang.org/x/crypto v0.4.0 // indirect
 	golang.org/x/image v0.2.0 // indirect
 	golang.org/x/net v0.4.0 // indirect
-	golang.org/x/sys v0.3.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.28.0 // indirect
 	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
@@ -2,15 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"errors"
 	"log"
+	"os"
+	"path/filepath"
 	"time"
 	"unsafe"
 
 	"github.com/pojntfx/dudirekta/pkg/rpc"
 	"github.com/pojntfx/saltpanelo/pkg/auth"
 	"github.com/pojntfx/saltpanelo/pkg/services"
-	"nhooyr.io/websocket"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+)
+
+const (
+	retryInterval    = time.Second * 5
+	maxRetryInterval = time.Minute
 )
 
 var (
@@ -30,6 +39,9 @@ type adapter struct {
 	onHandleCallCallback func(ctx context.Context, routeID, channelID, raddr string, userdata unsafe.Pointer) error
 	onHandleCallUserdata unsafe.Pointer
 
+	onCallStateChangedCallback func(ctx context.Context, routeID, channelID, state string, isCaller bool, userdata unsafe.Pointer) error
+	onCallStateChangedUserdata unsafe.Pointer
+
 	raddr,
 	ahost string
 	verbose bool
@@ -52,6 +64,9 @@ func newAdapter(
 	onHandleCallCallback func(ctx context.Context, routeID, channelID, raddr string, userdata unsafe.Pointer) error,
 	onHandleCallUserdata unsafe.Pointer,
 
+	onCallStateChangedCallback func(ctx context.Context, routeID, channelID, state string, isCaller bool, userdata unsafe.Pointer) error,
+	onCallStateChangedUserdata unsafe.Pointer,
+
 	openURLCallback func(url string, userdata unsafe.Pointer) error,
 	openURLUserdata unsafe.Pointer,
 
@@ -76,6 +91,9 @@ func newAdapter(
 		onHandleCallCallback,
 		onHandleCallUserdata,
 
+		onCallStateChangedCallback,
+		onCallStateChangedUserdata,
+
 		raddr,
 		ahost,
 		verbose,
@@ -112,6 +130,7 @@ func (a *adapter) link() error {
 	l := services.NewAdapter(
 		a.verbose,
 		a.ahost,
+		true,
 		func(ctx context.Context, srcID, srcEmail, routeID, channelID string) (bool, error) {
 			return a.onRequestCallCallback(ctx, srcID, srcEmail, routeID, channelID, a.onRequestCallUserdata)
 		},
@@ -121,8 +140,21 @@ func (a *adapter) link() error {
 		func(ctx context.Context, routeID, channelID, raddr string) error {
 			return a.onHandleCallCallback(ctx, routeID, channelID, raddr, a.onHandleCallUserdata)
 		},
+		func(ctx context.Context, routeID, channelID, state string, isCaller bool) error {
+			return a.onCallStateChangedCallback(ctx, routeID, channelID, state, isCaller, a.onCallStateChangedUserdata)
+		},
 		a.tm.GetIDToken,
+
+		a.ctx,
 	)
+
+	// The adapter registers again with the same identity after reconnecting, so that the gateway resumes its routes; embedders
+	// don't provide a place to store it, so the identity only lasts as long as the adapter
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
 	clients := 0
 	registry := rpc.NewRegistry(
 		l,
@@ -152,7 +184,14 @@ func (a *adapter) link() error {
 								return
 							}
 
-							caPEM, err := peer.RegisterAdapter(a.ctx, token)
+							challenge, err := peer.GetRegistrationChallenge(a.ctx)
+							if err != nil {
+								errs <- err
+
+								return
+							}
+
+							caPEM, err := peer.RegisterAdapter(a.ctx, token, services.NewNodeIdentity(privKey, challenge))
 							if err != nil {
 								errs <- err
 
@@ -180,21 +219,20 @@ func (a *adapter) link() error {
 	l.Peers = registry.Peers
 	a.peers = l.Peers
 
-	go func() {
-		rawConn, _, err := websocket.Dial(a.ctx, a.raddr, nil)
-		if err != nil {
-			errs <- err
-
-			return
-		}
-		conn := websocket.NetConn(a.ctx, rawConn, websocket.MessageText)
-		defer conn.Close()
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
 
-		if a.verbose {
-			log.Println("Connected to", conn.RemoteAddr())
-		}
+	// The gateway's certificate is verified with the CA of a control plane on the same host in addition to the system roots
+	dialOptions, err := utils.GetCADialOptions(filepath.Join(home, ".local", "share", "saltpanelo", "var", "lib", "saltpanelo", "ca.cert.pem"))
+	if err != nil {
+		return err
+	}
 
-		if err := registry.Link(conn); err != nil {
+	go func() {
+		// The remote address can be a comma-separated list of gateway replicas
+		if err := utils.LinkWithFailover(a.ctx, utils.SplitRemoteAddresses(a.raddr), retryInterval, maxRetryInterval, dialOptions, registry.Link); err != nil {
 			errs <- err
 
 			return
@@ -215,12 +253,7 @@ func (a *adapter) requestCall(email, channelID string) (bool, error) {
 			return false, err
 		}
 
-		dstID, err := peer.ResolveEmailToID(a.ctx, token, email)
-		if err != nil {
-			return false, err
-		}
-
-		requestCallResult, err := peer.RequestCall(a.ctx, token, dstID, channelID)
+		requestCallResult, err := peer.RequestCallByEmail(a.ctx, token, email, channelID)
 		if err != nil {
 			return false, err
 		}
@@ -247,3 +280,54 @@ func (a *adapter) hangupCall(routeID string) error {
 
 	return errNoPeersConnected
 }
+
+func (a *adapter) cancelCall(routeID string) error {
+	if a.peers == nil {
+		return errNotReady
+	}
+
+	for _, peer := range a.peers() {
+		token, err := a.tm.GetIDToken()
+		if err != nil {
+			return err
+		}
+
+		return peer.CancelCall(a.ctx, token, routeID)
+	}
+
+	return errNoPeersConnected
+}
+
+func (a *adapter) setPresence(presence string) error {
+	if a.peers == nil {
+		return errNotReady
+	}
+
+	for _, peer := range a.peers() {
+		token, err := a.tm.GetIDToken()
+		if err != nil {
+			return err
+		}
+
+		return peer.SetPresence(a.ctx, token, presence)
+	}
+
+	return errNoPeersConnected
+}
+
+func (a *adapter) getPresence(email string) (string, error) {
+	if a.peers == nil {
+		return "", errNotReady
+	}
+
+	for _, peer := range a.peers() {
+		token, err := a.tm.GetIDToken()
+		if err != nil {
+			return "", err
+		}
+
+		return peer.GetPresence(a.ctx, token, email)
+	}
+
+	return "", errNoPeersConnected
+}
@@ -35,6 +35,9 @@ func SaltpaneloNewAdapter(
 	onHandleCallCallback C.on_handle_call_callback,
 	onHandleCallUserdata unsafe.Pointer,
 
+	onCallStateChangedCallback C.on_call_state_changed_callback,
+	onCallStateChangedUserdata unsafe.Pointer,
+
 	openURLCallback C.open_url_callback,
 	openURLUserdata unsafe.Pointer,
 
@@ -83,6 +86,21 @@ func SaltpaneloNewAdapter(
 			},
 			onHandleCallUserdata,
 
+			func(ctx context.Context, routeID, channelID, state string, isCaller bool, userdata unsafe.Pointer) error {
+				cIsCaller := CBool(CBoolFalse)
+				if isCaller {
+					cIsCaller = CBoolTrue
+				}
+
+				err := C.GoString(C.bridge_on_call_state_changed(onCallStateChangedCallback, C.CString(routeID), C.CString(channelID), C.CString(state), cIsCaller, userdata))
+				if err == "" {
+					return nil
+				}
+
+				return errors.New(err)
+			},
+			onCallStateChangedUserdata,
+
 			func(url string, userdata unsafe.Pointer) error {
 				err := C.GoString(C.bridge_open_url(openURLCallback, C.CString(url), userdata))
 				if err == "" {
@@ -149,4 +167,34 @@ func SaltpaneloAdapterHangupCall(a unsafe.Pointer, routeID CString) CError {
 	return C.CString("")
 }
 
+//export SaltpaneloAdapterCancelCall
+func SaltpaneloAdapterCancelCall(a unsafe.Pointer, routeID CString) CError {
+	err := (pointer.Restore(a)).(*adapter).cancelCall(C.GoString(routeID))
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString("")
+}
+
+//export SaltpaneloAdapterSetPresence
+func SaltpaneloAdapterSetPresence(a unsafe.Pointer, presence CString) CError {
+	err := (pointer.Restore(a)).(*adapter).setPresence(C.GoString(presence))
+	if err != nil {
+		return C.CString(err.Error())
+	}
+
+	return C.CString("")
+}
+
+//export SaltpaneloAdapterGetPresence
+func SaltpaneloAdapterGetPresence(a unsafe.Pointer, email CString) (CString, CError) {
+	presence, err := (pointer.Restore(a)).(*adapter).getPresence(C.GoString(email))
+	if err != nil {
+		return C.CString(""), C.CString(err.Error())
+	}
+
+	return C.CString(presence), C.CString("")
+}
+
 func main() {}
@@ -19,6 +19,13 @@ char *bridge_on_handle_call(on_handle_call_callback f, char *route_id,
   return f(route_id, channel_id, raddr, userdata);
 }
 
+char *bridge_on_call_state_changed(on_call_state_changed_callback f,
+                                   char *route_id, char *channel_id,
+                                   char *state, char is_caller,
+                                   void *userdata) {
+  return f(route_id, channel_id, state, is_caller, userdata);
+}
+
 char *bridge_open_url(open_url_callback f, char *url, void *userdata) {
   return f(url, userdata);
 }
\ No newline at end of file
@@ -13,6 +13,10 @@ typedef char *(*on_call_disconnected_callback)(char *route_id, char *channel_id,
 typedef char *(*on_handle_call_callback)(char *route_id, char *channel_id,
                                          char *raddr, void *userdata);
 
+typedef char *(*on_call_state_changed_callback)(char *route_id,
+                                                char *channel_id, char *state,
+                                                char is_caller, void *userdata);
+
 typedef char *(*open_url_callback)(char *url, void *userdata);
 
 struct SaltpaneloOnRequestCallResponse
@@ -27,4 +31,9 @@ char *bridge_on_call_disconnected(on_call_disconnected_callback f,
 char *bridge_on_handle_call(on_handle_call_callback f, char *route_id,
                             char *channel_id, char *raddr, void *userdata);
 
+char *bridge_on_call_state_changed(on_call_state_changed_callback f,
+                                   char *route_id, char *channel_id,
+                                   char *state, char is_caller,
+                                   void *userdata);
+
 char *bridge_open_url(open_url_callback f, char *url, void *userdata);
@@ -40,22 +40,36 @@ func (a *OIDCAuthn) Open(ctx context.Context) error {
 }
 
 func (a *OIDCAuthn) Validate(token string) (string, error) {
+	email, _, err := a.ValidateWithClaims(token)
+
+	return email, err
+}
+
+// ValidateWithClaims returns the email and all other claims (e.g. groups) of the token
+func (a *OIDCAuthn) ValidateWithClaims(token string) (string, map[string]any, error) {
 	if a.verifier == nil {
-		return "", ErrClosed
+		return "", map[string]any{}, ErrClosed
 	}
 
 	t, err := a.verifier.Verify(a.ctx, token)
 	if err != nil {
-		return "", err
-	}
-
-	var claims struct {
-		Email string `json:"email"`
+		return "", map[string]any{}, err
 	}
 
+	claims := map[string]any{}
 	if err := t.Claims(&claims); err != nil {
-		return "", err
+		return "", map[string]any{}, err
 	}
 
-	return claims.Email, nil
+	email, _ := claims["email"].(string)
+
+	return email, claims, nil
+}
+
+// IsEmailVerified returns true if the identity provider verified the email in the claims; unverified emails can be chosen by
+// anyone if the identity provider allows that, so they must not grant any privileges
+func IsEmailVerified(claims map[string]any) bool {
+	verified, ok := claims["email_verified"].(bool)
+
+	return ok && verified
 }
@@ -0,0 +1,25 @@
+package auth
+
+import "testing"
+
+func TestIsEmailVerified(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   bool
+	}{
+		{"verified", map[string]any{"email": "jean.doe@example.com", "email_verified": true}, true},
+		{"not verified", map[string]any{"email": "jean.doe@example.com", "email_verified": false}, false},
+		{"missing", map[string]any{"email": "jean.doe@example.com"}, false},
+		{"string", map[string]any{"email": "jean.doe@example.com", "email_verified": "true"}, false},
+		{"no claims", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsEmailVerified(tt.claims); got != tt.want {
+				t.Errorf("IsEmailVerified() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrInvalidConfigValue  = errors.New("could not load config: Value must be a scalar or a list of scalars")
+	ErrUnsupportedFlagType = errors.New("could not reload config: Flag type can't be parsed without setting the flag")
+)
+
+const (
+	EnvPrefix = "SALTPANELO_"
+
+	ConfigFlag = "config"
+)
+
+// normalizeKey allows config files to use the flag names (e.g. `test-interval`) as well as `test_interval` or `testInterval`
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(key))
+}
+
+// getEnvKey returns the environment variable for a flag, e.g. `SALTPANELO_TEST_INTERVAL` for `test-interval`
+func getEnvKey(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func formatValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		// Lists are passed to flags which take comma-separated values
+		values := []string{}
+		for _, candidate := range v {
+			value, err := formatValue(candidate)
+			if err != nil {
+				return "", err
+			}
+
+			values = append(values, value)
+		}
+
+		return strings.Join(values, ","), nil
+	default:
+		return "", fmt.Errorf("%w: %v", ErrInvalidConfigValue, v)
+	}
+}
+
+// parseValue parses a value with a new value of the flag's type, so that the flag itself isn't set while it is being read
+func parseValue(f *flag.Flag, value string) (any, error) {
+	t := reflect.TypeOf(f.Value)
+	if t.Kind() != reflect.Pointer {
+		return nil, ErrUnsupportedFlagType
+	}
+
+	getter, ok := reflect.New(t.Elem()).Interface().(flag.Getter)
+	if !ok {
+		return nil, ErrUnsupportedFlagType
+	}
+
+	if err := getter.Set(value); err != nil {
+		return nil, err
+	}
+
+	return getter.Get(), nil
+}
+
+// Values are the reloaded values of flags by their names
+type Values map[string]any
+
+func (v Values) Bool(name string) bool {
+	value, _ := v[name].(bool)
+
+	return value
+}
+
+func (v Values) Int(name string) int {
+	value, _ := v[name].(int)
+
+	return value
+}
+
+func (v Values) Float64(name string) float64 {
+	value, _ := v[name].(float64)
+
+	return value
+}
+
+func (v Values) Duration(name string) time.Duration {
+	value, _ := v[name].(time.Duration)
+
+	return value
+}
+
+func (v Values) String(name string) string {
+	value, _ := v[name].(string)
+
+	return value
+}
+
+// Loader layers a YAML config file and environment variables under the flags which were set on the command line, so
+// flags take precedence over environment variables, which take precedence over the config file and the defaults
+type Loader struct {
+	flags      *flag.FlagSet
+	configPath string
+
+	explicit map[string]struct{}
+
+	// current are the values which were loaded or reloaded last, since reloading doesn't set the flags again
+	current map[string]string
+}
+
+// NewLoader must be called after the flags have been parsed; without a config path, `SALTPANELO_CONFIG` is used
+func NewLoader(flags *flag.FlagSet, configPath string) *Loader {
+	explicit := map[string]struct{}{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = struct{}{}
+	})
+
+	if strings.TrimSpace(configPath) == "" {
+		configPath = os.Getenv(getEnvKey(ConfigFlag))
+	}
+
+	return &Loader{
+		flags:      flags,
+		configPath: configPath,
+
+		explicit: explicit,
+
+		current: map[string]string{},
+	}
+}
+
+func (l *Loader) readConfig() (map[string]string, error) {
+	values := map[string]string{}
+	if strings.TrimSpace(l.configPath) == "" {
+		return values, nil
+	}
+
+	raw, err := os.ReadFile(l.configPath)
+	if err != nil {
+		return map[string]string{}, err
+	}
+
+	// Keys which no flag matches are ignored so that the binaries can share a config file
+	rawValues := map[string]any{}
+	if err := yaml.Unmarshal(raw, &rawValues); err != nil {
+		return map[string]string{}, err
+	}
+
+	for key, rawValue := range rawValues {
+		value, err := formatValue(rawValue)
+		if err != nil {
+			return map[string]string{}, fmt.Errorf("%v: %w", key, err)
+		}
+
+		values[normalizeKey(key)] = value
+	}
+
+	return values, nil
+}
+
+// lookup returns the value of a flag from the command line, the environment, the config file or its default
+func (l *Loader) lookup(f *flag.Flag, values map[string]string) string {
+	if _, ok := l.explicit[f.Name]; ok || f.Name == ConfigFlag {
+		return f.Value.String()
+	}
+
+	value, ok := os.LookupEnv(getEnvKey(f.Name))
+	if !ok {
+		value, ok = values[normalizeKey(f.Name)]
+	}
+
+	// Settings which have been removed from the config file are reset to their defaults
+	if !ok {
+		value = f.DefValue
+	}
+
+	return value
+}
+
+// Load sets all flags which weren't set on the command line from the environment and the config file; it must be called
+// before the flags are read by other goroutines
+func (l *Loader) Load() error {
+	values, err := l.readConfig()
+	if err != nil {
+		return err
+	}
+
+	l.flags.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		value := l.lookup(f, values)
+		if value == f.Value.String() {
+			return
+		}
+
+		if e := l.flags.Set(f.Name, value); e != nil {
+			err = fmt.Errorf("%v: %w", f.Name, e)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	l.flags.VisitAll(func(f *flag.Flag) {
+		l.current[f.Name] = f.Value.String()
+	})
+
+	return nil
+}
+
+// Reload reads the flags with the given names from the environment and the config file again without setting them, and
+// returns their values and the names of the flags which changed
+func (l *Loader) Reload(names ...string) (Values, []string, error) {
+	values, err := l.readConfig()
+	if err != nil {
+		return Values{}, []string{}, err
+	}
+
+	reloaded := Values{}
+	raw := map[string]string{}
+	changed := []string{}
+	for _, name := range names {
+		f := l.flags.Lookup(name)
+		if f == nil {
+			continue
+		}
+
+		value := l.lookup(f, values)
+
+		parsed, err := parseValue(f, value)
+		if err != nil {
+			return Values{}, []string{}, fmt.Errorf("%v: %w", f.Name, err)
+		}
+
+		reloaded[f.Name] = parsed
+		raw[f.Name] = value
+
+		if value != l.current[f.Name] {
+			changed = append(changed, f.Name)
+		}
+	}
+
+	// Values are only applied once all of them could be parsed
+	for name, value := range raw {
+		l.current[name] = value
+	}
+
+	return reloaded, changed, nil
+}
+
+// Watch reloads the flags with the given names on SIGHUP and passes their values to onReload; since the flags are read
+// concurrently, they aren't set again, so onReload has to store the values in atomics or fields which are guarded by
+// locks. Only settings which are safe to change while connections are open should be reloaded
+func (l *Loader) Watch(ctx context.Context, names []string, onReload func(values Values, changed []string)) {
+	sighups := make(chan os.Signal, 1)
+	signal.Notify(sighups, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sighups)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighups:
+				values, changed, err := l.Reload(names...)
+				if err != nil {
+					log.Println("Could not reload config, continuing:", err)
+
+					continue
+				}
+
+				log.Println("Reloaded config from", l.configPath, "with changed settings", changed)
+
+				onReload(values, changed)
+			}
+		}
+	}()
+}
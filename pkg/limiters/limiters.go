@@ -0,0 +1,285 @@
+package limiters
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/policies"
+)
+
+var (
+	ErrRateLimitExceeded           = errors.New("could not request call: Rate limit exceeded")
+	ErrConcurrentCallQuotaExceeded = errors.New("could not request call: Concurrent call quota exceeded")
+	ErrInvalidLimits               = errors.New("could not load limits: Invalid limits")
+)
+
+// Limits apply to each identity; a rate or quota of 0 is unlimited
+type Limits struct {
+	Rate            float64 `json:"rate"`            // Calls per second
+	Burst           int     `json:"burst"`           // Calls which can be requested at once before the rate applies
+	ConcurrentCalls int     `json:"concurrentCalls"` // Pending and answered calls
+}
+
+// ClaimLimits override the default limits for identities whose claims match; the first match wins
+type ClaimLimits struct {
+	Claims map[string][]string `json:"claims"` // The claim must contain at least one of the values, e.g. `{"groups": ["premium"]}`
+	Limits
+}
+
+func (l Limits) validate() error {
+	if l.Rate < 0 || l.Burst < 0 || l.ConcurrentCalls < 0 {
+		return fmt.Errorf("%w: Rate, burst and concurrent calls can't be negative", ErrInvalidLimits)
+	}
+
+	if l.Rate > 0 && l.Burst < 1 {
+		return fmt.Errorf("%w: Burst must be at least 1 if a rate is set", ErrInvalidLimits)
+	}
+
+	return nil
+}
+
+func (c ClaimLimits) matches(claims map[string]any) bool {
+	if len(c.Claims) < 1 {
+		return false
+	}
+
+	for key, values := range c.Claims {
+		if !policies.ClaimContains(claims[key], values) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LoadClaimLimits reads a JSON list of claim limits; an empty path returns no claim limits
+func LoadClaimLimits(limitsPath string) ([]ClaimLimits, error) {
+	if strings.TrimSpace(limitsPath) == "" {
+		return []ClaimLimits{}, nil
+	}
+
+	raw, err := os.ReadFile(limitsPath)
+	if err != nil {
+		return []ClaimLimits{}, err
+	}
+
+	claimLimits := []ClaimLimits{}
+	if err := json.Unmarshal(raw, &claimLimits); err != nil {
+		return []ClaimLimits{}, err
+	}
+
+	for _, l := range claimLimits {
+		if err := l.validate(); err != nil {
+			return []ClaimLimits{}, err
+		}
+	}
+
+	return claimLimits, nil
+}
+
+// bucketSweepInterval is how often the buckets which refilled are removed; a full bucket is the same as a new one
+const bucketSweepInterval = time.Minute
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+
+	// The limits of the last call which the bucket was used for
+	rate  float64
+	burst int
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.updatedAt).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.updatedAt = now
+}
+
+type CallLimiter struct {
+	verbose atomic.Bool
+
+	limitsLock  sync.Mutex
+	defaults    Limits
+	claimLimits []ClaimLimits
+
+	bucketsLock sync.Mutex
+	buckets     map[string]*bucket
+	sweptAt     time.Time
+
+	concurrentCallsLock sync.Mutex
+	concurrentCalls     map[string]int
+}
+
+func NewCallLimiter(
+	verbose bool,
+
+	defaults Limits,
+	claimLimits []ClaimLimits,
+) (*CallLimiter, error) {
+	if err := defaults.validate(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range claimLimits {
+		if err := l.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	l := &CallLimiter{
+		defaults:    defaults,
+		claimLimits: claimLimits,
+
+		buckets: map[string]*bucket{},
+
+		concurrentCalls: map[string]int{},
+	}
+	l.verbose.Store(verbose)
+
+	return l, nil
+}
+
+func (l *CallLimiter) SetVerbose(verbose bool) {
+	l.verbose.Store(verbose)
+}
+
+// SetLimits replaces the limits; tokens which identities have already taken and their concurrent calls are kept
+func (l *CallLimiter) SetLimits(defaults Limits, claimLimits []ClaimLimits) error {
+	if err := defaults.validate(); err != nil {
+		return err
+	}
+
+	for _, c := range claimLimits {
+		if err := c.validate(); err != nil {
+			return err
+		}
+	}
+
+	l.limitsLock.Lock()
+	defer l.limitsLock.Unlock()
+
+	l.defaults = defaults
+	l.claimLimits = claimLimits
+
+	return nil
+}
+
+func (l *CallLimiter) getLimits(claims map[string]any) Limits {
+	l.limitsLock.Lock()
+	defer l.limitsLock.Unlock()
+
+	for _, c := range l.claimLimits {
+		if c.matches(claims) {
+			return c.Limits
+		}
+	}
+
+	return l.defaults
+}
+
+// Allow takes a token from the identity's bucket
+func (l *CallLimiter) Allow(email string, claims map[string]any) error {
+	limits := l.getLimits(claims)
+	if limits.Rate <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+
+	l.bucketsLock.Lock()
+	defer l.bucketsLock.Unlock()
+
+	l.sweepBuckets(now)
+
+	b, ok := l.buckets[email]
+	if !ok {
+		b = &bucket{
+			tokens:    float64(limits.Burst),
+			updatedAt: now,
+		}
+
+		l.buckets[email] = b
+	}
+
+	b.rate = limits.Rate
+	b.burst = limits.Burst
+	b.refill(now)
+
+	if b.tokens < 1 {
+		if l.verbose.Load() {
+			log.Println("Rate limiting calls from", email)
+		}
+
+		return ErrRateLimitExceeded
+	}
+
+	b.tokens--
+
+	return nil
+}
+
+// sweepBuckets removes the buckets which refilled, so that identities which stopped calling (e.g. foreign callers, whose
+// emails are chosen by federated control planes) don't use memory; it must be called with the buckets lock held
+func (l *CallLimiter) sweepBuckets(now time.Time) {
+	if now.Sub(l.sweptAt) < bucketSweepInterval {
+		return
+	}
+	l.sweptAt = now
+
+	for email, b := range l.buckets {
+		b.refill(now)
+
+		if b.tokens >= float64(b.burst) {
+			delete(l.buckets, email)
+		}
+	}
+}
+
+// Acquire counts a call towards the identity's concurrent call quota; every successful Acquire must be followed by a Release
+func (l *CallLimiter) Acquire(email string, claims map[string]any) error {
+	limits := l.getLimits(claims)
+
+	l.concurrentCallsLock.Lock()
+	defer l.concurrentCallsLock.Unlock()
+
+	if limits.ConcurrentCalls > 0 && l.concurrentCalls[email] >= limits.ConcurrentCalls {
+		if l.verbose.Load() {
+			log.Println("Concurrent call quota of", limits.ConcurrentCalls, "exceeded for", email)
+		}
+
+		return ErrConcurrentCallQuotaExceeded
+	}
+
+	l.concurrentCalls[email]++
+
+	return nil
+}
+
+// Restore counts a call which was already answered (e.g. before the control plane restarted) towards the identity's concurrent
+// call quota, even if the quota is exceeded; like for Acquire, it must be followed by a Release
+func (l *CallLimiter) Restore(email string) {
+	l.concurrentCallsLock.Lock()
+	defer l.concurrentCallsLock.Unlock()
+
+	l.concurrentCalls[email]++
+}
+
+func (l *CallLimiter) Release(email string) {
+	l.concurrentCallsLock.Lock()
+	defer l.concurrentCallsLock.Unlock()
+
+	l.concurrentCalls[email]--
+
+	if l.concurrentCalls[email] <= 0 {
+		delete(l.concurrentCalls, email)
+	}
+}
@@ -0,0 +1,238 @@
+package limiters
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimitsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  Limits
+		wantErr error
+	}{
+		{"unlimited", Limits{}, nil},
+		{"rate with burst", Limits{Rate: 1, Burst: 1}, nil},
+		{"rate without burst", Limits{Rate: 1}, ErrInvalidLimits},
+		{"negative rate", Limits{Rate: -1, Burst: 1}, ErrInvalidLimits},
+		{"negative burst", Limits{Burst: -1}, ErrInvalidLimits},
+		{"negative concurrent calls", Limits{ConcurrentCalls: -1}, ErrInvalidLimits},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limits.validate(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCallLimiterAllow(t *testing.T) {
+	premium := map[string]any{"groups": []any{"premium"}}
+
+	tests := []struct {
+		name     string
+		defaults Limits
+		claims   map[string]any
+		elapsed  time.Duration // Time which passes after the burst was used up
+		want     []error
+	}{
+		{
+			name:     "unlimited",
+			defaults: Limits{},
+			want:     []error{nil, nil, nil},
+		},
+		{
+			name:     "burst",
+			defaults: Limits{Rate: 0.001, Burst: 2},
+			want:     []error{nil, nil, ErrRateLimitExceeded},
+		},
+		{
+			name:     "refill",
+			defaults: Limits{Rate: 1, Burst: 1},
+			elapsed:  time.Second,
+			want:     []error{nil, nil, ErrRateLimitExceeded},
+		},
+		{
+			name:     "refill is capped at burst",
+			defaults: Limits{Rate: 1, Burst: 1},
+			elapsed:  time.Hour,
+			want:     []error{nil, nil, ErrRateLimitExceeded},
+		},
+		{
+			name:     "claim limits override defaults",
+			defaults: Limits{Rate: 0.001, Burst: 1},
+			claims:   premium,
+			want:     []error{nil, nil, nil, ErrRateLimitExceeded},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewCallLimiter(false, tt.defaults, []ClaimLimits{
+				{
+					Claims: map[string][]string{"groups": {"premium"}},
+					Limits: Limits{Rate: 0.001, Burst: 3},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i, want := range tt.want {
+				// Let time pass once the first call used up the burst
+				if i == 1 && tt.elapsed > 0 {
+					l.bucketsLock.Lock()
+					l.buckets["jean.doe@example.com"].updatedAt = time.Now().Add(-tt.elapsed)
+					l.bucketsLock.Unlock()
+				}
+
+				if err := l.Allow("jean.doe@example.com", tt.claims); !errors.Is(err, want) {
+					t.Errorf("Allow() call %v error = %v, want %v", i, err, want)
+				}
+			}
+
+			// Other identities have their own buckets
+			if err := l.Allow("jane.doe@example.com", tt.claims); err != nil {
+				t.Errorf("Allow() for other identity error = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestCallLimiterSweepsRefilledBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration // Time which passed since the identity's last call
+		want    bool
+	}{
+		{"refilling bucket is kept", time.Second, true},
+		{"refilled bucket is removed", time.Hour, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewCallLimiter(false, Limits{Rate: 0.01, Burst: 2}, []ClaimLimits{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := l.Allow("jean.doe@example.com", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			l.bucketsLock.Lock()
+			l.buckets["jean.doe@example.com"].updatedAt = time.Now().Add(-tt.elapsed)
+			l.sweptAt = time.Now().Add(-bucketSweepInterval)
+			l.bucketsLock.Unlock()
+
+			// Calls from other identities sweep the buckets
+			if err := l.Allow("jane.doe@example.com", nil); err != nil {
+				t.Fatal(err)
+			}
+
+			l.bucketsLock.Lock()
+			_, ok := l.buckets["jean.doe@example.com"]
+			l.bucketsLock.Unlock()
+
+			if ok != tt.want {
+				t.Errorf("bucket kept = %v, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestCallLimiterAcquire(t *testing.T) {
+	l, err := NewCallLimiter(false, Limits{ConcurrentCalls: 2}, []ClaimLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		release bool
+		want    error
+	}{
+		{false, nil},
+		{false, nil},
+		{false, ErrConcurrentCallQuotaExceeded},
+		{true, nil},
+		{false, nil},
+		{false, ErrConcurrentCallQuotaExceeded},
+	}
+
+	for i, step := range steps {
+		if step.release {
+			l.Release("jean.doe@example.com")
+
+			continue
+		}
+
+		if err := l.Acquire("jean.doe@example.com", nil); !errors.Is(err, step.want) {
+			t.Errorf("Acquire() step %v error = %v, want %v", i, err, step.want)
+		}
+	}
+
+	if err := l.SetLimits(Limits{ConcurrentCalls: 3}, []ClaimLimits{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Concurrent calls are kept when the limits change
+	if err := l.Acquire("jean.doe@example.com", nil); err != nil {
+		t.Errorf("Acquire() after raising quota error = %v, want nil", err)
+	}
+
+	if err := l.Acquire("jean.doe@example.com", nil); !errors.Is(err, ErrConcurrentCallQuotaExceeded) {
+		t.Errorf("Acquire() after raising quota error = %v, want %v", err, ErrConcurrentCallQuotaExceeded)
+	}
+}
+
+func TestCallLimiterRestore(t *testing.T) {
+	l, err := NewCallLimiter(false, Limits{ConcurrentCalls: 1}, []ClaimLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restored calls count even if they exceed the quota
+	l.Restore("jean.doe@example.com")
+	l.Restore("jean.doe@example.com")
+
+	steps := []struct {
+		release bool
+		want    error
+	}{
+		{false, ErrConcurrentCallQuotaExceeded},
+		{true, nil},
+		{false, ErrConcurrentCallQuotaExceeded},
+		{true, nil},
+		{false, nil},
+	}
+
+	for i, step := range steps {
+		if step.release {
+			l.Release("jean.doe@example.com")
+
+			continue
+		}
+
+		if err := l.Acquire("jean.doe@example.com", nil); !errors.Is(err, step.want) {
+			t.Errorf("Acquire() step %v error = %v, want %v", i, err, step.want)
+		}
+	}
+}
+
+func TestCallLimiterRejectsInvalidLimits(t *testing.T) {
+	if _, err := NewCallLimiter(false, Limits{}, []ClaimLimits{{Limits: Limits{Rate: 1}}}); !errors.Is(err, ErrInvalidLimits) {
+		t.Errorf("NewCallLimiter() error = %v, want %v", err, ErrInvalidLimits)
+	}
+
+	l, err := NewCallLimiter(false, Limits{}, []ClaimLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.SetLimits(Limits{Rate: -1}, []ClaimLimits{}); !errors.Is(err, ErrInvalidLimits) {
+		t.Errorf("SetLimits() error = %v, want %v", err, ErrInvalidLimits)
+	}
+}
@@ -0,0 +1,783 @@
+package persisters
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrNotOpened       = errors.New("could not use persister: Persister has not been opened")
+	ErrEntriesMismatch = errors.New("could not apply entries: Entries don't continue the current revision")
+
+	callDetailRecordsBucket = []byte("call-detail-records")
+	switchesBucket          = []byte("switches")
+	adaptersBucket          = []byte("adapters")
+	routesBucket            = []byte("routes")
+	metaBucket              = []byte("meta")
+
+	revisionKey    = []byte("revision")
+	stateTermKey   = []byte("state-term")
+	replicaTermKey = []byte("replica-term")
+	rolledBackKey  = []byte("rolled-back-revision")
+	votedForKey    = []byte("voted-for")
+
+	// replicatedBuckets are part of snapshots; the meta bucket is local to each replica
+	replicatedBuckets = [][]byte{callDetailRecordsBucket, switchesBucket, adaptersBucket, routesBucket}
+)
+
+// maxEntries is the number of committed entries which are kept for replicas which are behind; replicas which are further
+// behind get a snapshot instead
+const maxEntries = 4096
+
+type CallDetailRecord struct {
+	RouteID           string
+	CallerID          string
+	CallerEmail       string
+	CalleeID          string
+	CalleeEmail       string
+	ChannelID         string
+	Path              []string
+	SetupLatency      time.Duration
+	StartedAt         time.Time
+	EndedAt           time.Time
+	Duration          time.Duration
+	Bytes             int64
+	TerminationReason string
+	TerminatedBy      string
+}
+
+type SwitchRecord struct {
+	ID   string
+	Addr string
+}
+
+type AdapterRecord struct {
+	ID        string
+	UserEmail string
+}
+
+// RouteRecord is a provisioned route; the path contains the IDs of the adapters and switches when the route was provisioned
+type RouteRecord struct {
+	RouteID    string
+	ChannelID  string
+	Path       []string
+	Group      bool
+	ActiveCall CallDetailRecord
+}
+
+// Snapshot is a copy of the replicated buckets; the revision increases with every change
+type Snapshot struct {
+	Revision  uint64
+	Term      uint64
+	Buckets   map[string]map[string][]byte
+	Sequences map[string]uint64
+}
+
+// Change is a write to a replicated bucket; a nil value deletes the key and clear recreates the bucket
+type Change struct {
+	Bucket   string
+	Key      []byte
+	Value    []byte
+	Sequence uint64
+	Clear    bool
+}
+
+// Entry is a committed set of changes; replicas apply entries in order, starting at the revision and term which they have
+type Entry struct {
+	PrevRevision uint64
+	PrevTerm     uint64
+	Revision     uint64
+	Term         uint64
+	Changes      []Change
+}
+
+// undoChange restores the values and the sequence of a bucket which a change overwrote; nil values are deleted
+type undoChange struct {
+	bucket   string
+	sequence uint64
+	values   map[string][]byte
+	clear    bool
+}
+
+type ControlPlanePersister struct {
+	db *bolt.DB
+
+	// Writes are rolled back if they can't be replicated, so only one write may be replicated at a time
+	writeLock sync.Mutex
+
+	commitLock sync.Mutex
+	entries    []Entry
+	onCommit   func(entry Entry) error
+	onRollback func(entry Entry)
+}
+
+func NewControlPlanePersister() *ControlPlanePersister {
+	return &ControlPlanePersister{}
+}
+
+func (p *ControlPlanePersister) Open(dbPath string) error {
+	if err := os.MkdirAll(filepath.Dir(dbPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	// The database contains the emails of callers and callees, so only the user who runs the control plane may read it
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range append(replicatedBuckets, metaBucket) {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		_ = db.Close()
+
+		return err
+	}
+
+	p.db = db
+
+	return nil
+}
+
+func (p *ControlPlanePersister) Close() error {
+	if p.db == nil {
+		return nil
+	}
+
+	return p.db.Close()
+}
+
+func getUint64(tx *bolt.Tx, key []byte) uint64 {
+	value := tx.Bucket(metaBucket).Get(key)
+	if len(value) != 8 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint64(value)
+}
+
+func putUint64(tx *bolt.Tx, key []byte, value uint64) error {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, value)
+
+	return tx.Bucket(metaBucket).Put(key, raw)
+}
+
+// SetOnCommit sets the function which is called after every local commit, e.g. to replicate the entry; its error is returned
+// to the caller of the write
+func (p *ControlPlanePersister) SetOnCommit(onCommit func(entry Entry) error) {
+	p.commitLock.Lock()
+	defer p.commitLock.Unlock()
+
+	p.onCommit = onCommit
+}
+
+// SetOnRollback sets the function which is called after a write was rolled back because the commit function failed, e.g.
+// so that the replicas which stored the rolled back entry are synced again
+func (p *ControlPlanePersister) SetOnRollback(onRollback func(entry Entry)) {
+	p.commitLock.Lock()
+	defer p.commitLock.Unlock()
+
+	p.onRollback = onRollback
+}
+
+// getUndoChange must be called in a transaction before the change is applied; appended keys are only known afterwards
+func getUndoChange(tx *bolt.Tx, c *Change) (undoChange, error) {
+	b := tx.Bucket([]byte(c.Bucket))
+
+	u := undoChange{
+		bucket:   c.Bucket,
+		sequence: b.Sequence(),
+		values:   map[string][]byte{},
+		clear:    c.Clear,
+	}
+
+	if c.Clear {
+		return u, b.ForEach(func(k, v []byte) error {
+			u.values[string(k)] = append([]byte{}, v...)
+
+			return nil
+		})
+	}
+
+	if c.Key != nil {
+		var value []byte
+		if v := b.Get(c.Key); v != nil {
+			value = append([]byte{}, v...)
+		}
+
+		u.values[string(c.Key)] = value
+	}
+
+	return u, nil
+}
+
+// revertChange must be called in a transaction
+func revertChange(tx *bolt.Tx, u undoChange) error {
+	if u.clear {
+		if err := tx.DeleteBucket([]byte(u.bucket)); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucket([]byte(u.bucket)); err != nil {
+			return err
+		}
+	}
+
+	b := tx.Bucket([]byte(u.bucket))
+	for k, v := range u.values {
+		if v == nil {
+			if err := b.Delete([]byte(k)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return b.SetSequence(u.sequence)
+}
+
+// applyChange must be called in a transaction; changes without a key are appended with the next sequence of the bucket, which
+// is stored in the change so that replicas use the same key
+func applyChange(tx *bolt.Tx, c *Change) error {
+	if c.Clear {
+		if err := tx.DeleteBucket([]byte(c.Bucket)); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucket([]byte(c.Bucket))
+
+		return err
+	}
+
+	b := tx.Bucket([]byte(c.Bucket))
+
+	if c.Key == nil {
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		c.Key = make([]byte, 8)
+		binary.BigEndian.PutUint64(c.Key, id)
+		c.Sequence = id
+	} else if c.Sequence > 0 {
+		if err := b.SetSequence(c.Sequence); err != nil {
+			return err
+		}
+	}
+
+	if c.Value == nil {
+		return b.Delete(c.Key)
+	}
+
+	return b.Put(c.Key, c.Value)
+}
+
+// appendEntry must be called with the commit lock held
+func (p *ControlPlanePersister) appendEntry(entry Entry) {
+	p.entries = append(p.entries, entry)
+
+	if len(p.entries) > maxEntries {
+		p.entries = append([]Entry{}, p.entries[len(p.entries)-maxEntries:]...)
+	}
+}
+
+// commit changes the replicated buckets and increases the revision in the same transaction; if term is set, the leader which
+// changes the replicated buckets from now on is set too. If the commit function fails (e.g. because a quorum of replicas
+// didn't store the entry), the changes are rolled back, so that the write doesn't stay applied locally.
+func (p *ControlPlanePersister) commit(changes []Change, term *uint64) error {
+	if p.db == nil {
+		return ErrNotOpened
+	}
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	// Entries have to be logged in the order of their revisions
+	p.commitLock.Lock()
+
+	var (
+		entry Entry
+		undo  []undoChange
+	)
+	if err := p.db.Update(func(tx *bolt.Tx) error {
+		entry.PrevRevision = getUint64(tx, revisionKey)
+		entry.PrevTerm = getUint64(tx, stateTermKey)
+		entry.Revision = entry.PrevRevision + 1
+
+		// Replicas might have stored entries which were rolled back, so their revisions aren't reused
+		if rolledBack := getUint64(tx, rolledBackKey); rolledBack >= entry.Revision {
+			entry.Revision = rolledBack + 1
+		}
+		entry.Term = entry.PrevTerm
+		if term != nil {
+			entry.Term = *term
+		}
+
+		for i := range changes {
+			u, err := getUndoChange(tx, &changes[i])
+			if err != nil {
+				return err
+			}
+
+			if err := applyChange(tx, &changes[i]); err != nil {
+				return err
+			}
+
+			// Appended keys didn't exist before
+			if _, ok := u.values[string(changes[i].Key)]; !ok && !u.clear {
+				u.values[string(changes[i].Key)] = nil
+			}
+
+			undo = append(undo, u)
+		}
+		entry.Changes = changes
+
+		if err := putUint64(tx, revisionKey, entry.Revision); err != nil {
+			return err
+		}
+
+		return putUint64(tx, stateTermKey, entry.Term)
+	}); err != nil {
+		p.commitLock.Unlock()
+
+		return err
+	}
+
+	p.appendEntry(entry)
+	onCommit := p.onCommit
+
+	p.commitLock.Unlock()
+
+	if onCommit == nil {
+		return nil
+	}
+
+	if err := onCommit(entry); err != nil {
+		// The entry which sets the term of a new leader has no changes, and the leader's later entries have to continue it
+		if term == nil {
+			if err := p.rollback(entry, undo); err != nil {
+				log.Println("Could not roll back entry with revision", entry.Revision, ", continuing:", err)
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// rollback reverts the last committed entry unless the revision changed since, e.g. because a snapshot was restored
+func (p *ControlPlanePersister) rollback(entry Entry, undo []undoChange) error {
+	p.commitLock.Lock()
+
+	if err := p.db.Update(func(tx *bolt.Tx) error {
+		if getUint64(tx, revisionKey) != entry.Revision || getUint64(tx, stateTermKey) != entry.Term {
+			return ErrEntriesMismatch
+		}
+
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := revertChange(tx, undo[i]); err != nil {
+				return err
+			}
+		}
+
+		if err := putUint64(tx, revisionKey, entry.PrevRevision); err != nil {
+			return err
+		}
+
+		if err := putUint64(tx, rolledBackKey, entry.Revision); err != nil {
+			return err
+		}
+
+		return putUint64(tx, stateTermKey, entry.PrevTerm)
+	}); err != nil {
+		p.commitLock.Unlock()
+
+		return err
+	}
+
+	if last := len(p.entries) - 1; last >= 0 && p.entries[last].Revision == entry.Revision && p.entries[last].Term == entry.Term {
+		p.entries = p.entries[:last]
+	}
+
+	onRollback := p.onRollback
+
+	p.commitLock.Unlock()
+
+	if onRollback != nil {
+		onRollback(entry)
+	}
+
+	return nil
+}
+
+func (p *ControlPlanePersister) AddCallDetailRecord(cdr CallDetailRecord) error {
+	value, err := json.Marshal(cdr)
+	if err != nil {
+		return err
+	}
+
+	// Sequential keys keep the records sorted by the time they were added
+	return p.commit([]Change{{
+		Bucket: string(callDetailRecordsBucket),
+		Value:  value,
+	}}, nil)
+}
+
+// GetCallDetailRecords returns the newest records first; an empty email returns the records of all users and a limit of 0 returns all records
+func (p *ControlPlanePersister) GetCallDetailRecords(email string, limit int) ([]CallDetailRecord, error) {
+	if p.db == nil {
+		return []CallDetailRecord{}, ErrNotOpened
+	}
+
+	cdrs := []CallDetailRecord{}
+	if err := p.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(callDetailRecordsBucket).Cursor()
+
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var cdr CallDetailRecord
+			if err := json.Unmarshal(v, &cdr); err != nil {
+				return err
+			}
+
+			if email != "" && cdr.CallerEmail != email && cdr.CalleeEmail != email {
+				continue
+			}
+
+			cdrs = append(cdrs, cdr)
+
+			if limit > 0 && len(cdrs) >= limit {
+				break
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return []CallDetailRecord{}, err
+	}
+
+	return cdrs, nil
+}
+
+func (p *ControlPlanePersister) put(bucket []byte, key string, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return p.commit([]Change{{
+		Bucket: string(bucket),
+		Key:    []byte(key),
+		Value:  value,
+	}}, nil)
+}
+
+func (p *ControlPlanePersister) delete(bucket []byte, key string) error {
+	return p.commit([]Change{{
+		Bucket: string(bucket),
+		Key:    []byte(key),
+	}}, nil)
+}
+
+func (p *ControlPlanePersister) clear(bucket []byte) error {
+	return p.commit([]Change{{
+		Bucket: string(bucket),
+		Clear:  true,
+	}}, nil)
+}
+
+func getAll[T any](p *ControlPlanePersister, bucket []byte) ([]T, error) {
+	if p.db == nil {
+		return []T{}, ErrNotOpened
+	}
+
+	values := []T{}
+	if err := p.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var value T
+			if err := json.Unmarshal(v, &value); err != nil {
+				return err
+			}
+
+			values = append(values, value)
+
+			return nil
+		})
+	}); err != nil {
+		return []T{}, err
+	}
+
+	return values, nil
+}
+
+func (p *ControlPlanePersister) PutSwitch(sw SwitchRecord) error {
+	return p.put(switchesBucket, sw.ID, sw)
+}
+
+func (p *ControlPlanePersister) DeleteSwitch(id string) error {
+	return p.delete(switchesBucket, id)
+}
+
+func (p *ControlPlanePersister) GetSwitches() ([]SwitchRecord, error) {
+	return getAll[SwitchRecord](p, switchesBucket)
+}
+
+// ClearSwitches removes all switches, e.g. after restarting since their IDs are only valid for a connection
+func (p *ControlPlanePersister) ClearSwitches() error {
+	return p.clear(switchesBucket)
+}
+
+func (p *ControlPlanePersister) PutAdapter(adapter AdapterRecord) error {
+	return p.put(adaptersBucket, adapter.ID, adapter)
+}
+
+func (p *ControlPlanePersister) DeleteAdapter(id string) error {
+	return p.delete(adaptersBucket, id)
+}
+
+func (p *ControlPlanePersister) GetAdapters() ([]AdapterRecord, error) {
+	return getAll[AdapterRecord](p, adaptersBucket)
+}
+
+// ClearAdapters removes all adapters, e.g. after restarting since their IDs are only valid for a connection
+func (p *ControlPlanePersister) ClearAdapters() error {
+	return p.clear(adaptersBucket)
+}
+
+func (p *ControlPlanePersister) PutRoute(route RouteRecord) error {
+	return p.put(routesBucket, route.RouteID, route)
+}
+
+func (p *ControlPlanePersister) DeleteRoute(routeID string) error {
+	return p.delete(routesBucket, routeID)
+}
+
+func (p *ControlPlanePersister) GetRoutes() ([]RouteRecord, error) {
+	return getAll[RouteRecord](p, routesBucket)
+}
+
+// GetRevision returns the revision and the term of the leader which last changed the replicated buckets
+func (p *ControlPlanePersister) GetRevision() (uint64, uint64, error) {
+	if p.db == nil {
+		return 0, 0, ErrNotOpened
+	}
+
+	var revision, term uint64
+	if err := p.db.View(func(tx *bolt.Tx) error {
+		revision = getUint64(tx, revisionKey)
+		term = getUint64(tx, stateTermKey)
+
+		return nil
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	return revision, term, nil
+}
+
+// SetStateTerm sets the term of the leader which changes the replicated buckets from now on
+func (p *ControlPlanePersister) SetStateTerm(term uint64) error {
+	return p.commit([]Change{}, &term)
+}
+
+// GetEntries returns the committed entries after the revision and term; if they aren't logged anymore, a snapshot is required
+func (p *ControlPlanePersister) GetEntries(revision, term uint64) ([]Entry, bool, error) {
+	currentRevision, currentTerm, err := p.GetRevision()
+	if err != nil {
+		return []Entry{}, false, err
+	}
+
+	p.commitLock.Lock()
+	defer p.commitLock.Unlock()
+
+	if revision == currentRevision && term == currentTerm {
+		return []Entry{}, true, nil
+	}
+
+	for i, entry := range p.entries {
+		if entry.PrevRevision == revision && entry.PrevTerm == term {
+			return append([]Entry{}, p.entries[i:]...), true, nil
+		}
+	}
+
+	return []Entry{}, false, nil
+}
+
+// ApplyEntries applies the entries of the leader, which have to continue the current revision and term
+func (p *ControlPlanePersister) ApplyEntries(entries []Entry) error {
+	if p.db == nil {
+		return ErrNotOpened
+	}
+
+	p.commitLock.Lock()
+	defer p.commitLock.Unlock()
+
+	if err := p.db.Update(func(tx *bolt.Tx) error {
+		for i, entry := range entries {
+			if entry.PrevRevision != getUint64(tx, revisionKey) || entry.PrevTerm != getUint64(tx, stateTermKey) {
+				return ErrEntriesMismatch
+			}
+
+			for j := range entry.Changes {
+				if err := applyChange(tx, &entries[i].Changes[j]); err != nil {
+					return err
+				}
+			}
+
+			if err := putUint64(tx, revisionKey, entry.Revision); err != nil {
+				return err
+			}
+
+			if err := putUint64(tx, stateTermKey, entry.Term); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Followers keep the entries too, so that they can replicate them if they are elected
+	for _, entry := range entries {
+		p.appendEntry(entry)
+	}
+
+	return nil
+}
+
+func (p *ControlPlanePersister) GetSnapshot() (Snapshot, error) {
+	if p.db == nil {
+		return Snapshot{}, ErrNotOpened
+	}
+
+	snapshot := Snapshot{
+		Buckets:   map[string]map[string][]byte{},
+		Sequences: map[string]uint64{},
+	}
+	if err := p.db.View(func(tx *bolt.Tx) error {
+		snapshot.Revision = getUint64(tx, revisionKey)
+		snapshot.Term = getUint64(tx, stateTermKey)
+
+		for _, name := range replicatedBuckets {
+			b := tx.Bucket(name)
+
+			values := map[string][]byte{}
+			if err := b.ForEach(func(k, v []byte) error {
+				values[string(k)] = append([]byte{}, v...)
+
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			snapshot.Buckets[string(name)] = values
+			snapshot.Sequences[string(name)] = b.Sequence()
+		}
+
+		return nil
+	}); err != nil {
+		return Snapshot{}, err
+	}
+
+	return snapshot, nil
+}
+
+// RestoreSnapshot replaces the replicated buckets with the ones in the snapshot
+func (p *ControlPlanePersister) RestoreSnapshot(snapshot Snapshot) error {
+	if p.db == nil {
+		return ErrNotOpened
+	}
+
+	p.commitLock.Lock()
+	defer p.commitLock.Unlock()
+
+	// The logged entries don't continue the restored revision
+	p.entries = []Entry{}
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range replicatedBuckets {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+
+			b, err := tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+
+			for k, v := range snapshot.Buckets[string(name)] {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+
+			if err := b.SetSequence(snapshot.Sequences[string(name)]); err != nil {
+				return err
+			}
+		}
+
+		if err := putUint64(tx, revisionKey, snapshot.Revision); err != nil {
+			return err
+		}
+
+		return putUint64(tx, stateTermKey, snapshot.Term)
+	})
+}
+
+// GetElectionState returns the latest term which this replica has seen and the replica it voted for in that term
+func (p *ControlPlanePersister) GetElectionState() (uint64, string, error) {
+	if p.db == nil {
+		return 0, "", ErrNotOpened
+	}
+
+	var (
+		term     uint64
+		votedFor string
+	)
+	if err := p.db.View(func(tx *bolt.Tx) error {
+		term = getUint64(tx, replicaTermKey)
+		votedFor = string(tx.Bucket(metaBucket).Get(votedForKey))
+
+		return nil
+	}); err != nil {
+		return 0, "", err
+	}
+
+	return term, votedFor, nil
+}
+
+func (p *ControlPlanePersister) PutElectionState(term uint64, votedFor string) error {
+	if p.db == nil {
+		return ErrNotOpened
+	}
+
+	return p.db.Update(func(tx *bolt.Tx) error {
+		if err := putUint64(tx, replicaTermKey, term); err != nil {
+			return err
+		}
+
+		return tx.Bucket(metaBucket).Put(votedForKey, []byte(votedFor))
+	})
+}
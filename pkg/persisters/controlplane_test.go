@@ -0,0 +1,167 @@
+package persisters
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var errReplication = errors.New("could not replicate")
+
+func openPersister(t *testing.T) *ControlPlanePersister {
+	t.Helper()
+
+	p := NewControlPlanePersister()
+	if err := p.Open(filepath.Join(t.TempDir(), "controlplane.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = p.Close()
+	})
+
+	return p
+}
+
+func TestCommitRollsBackFailedWrites(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(p *ControlPlanePersister) error
+	}{
+		{"overwrite", func(p *ControlPlanePersister) error {
+			return p.PutSwitch(SwitchRecord{ID: "1", Addr: "127.0.0.2:1337"})
+		}},
+		{"insert", func(p *ControlPlanePersister) error {
+			return p.PutSwitch(SwitchRecord{ID: "2", Addr: "127.0.0.3:1337"})
+		}},
+		{"delete", func(p *ControlPlanePersister) error { return p.DeleteSwitch("1") }},
+		{"clear", func(p *ControlPlanePersister) error { return p.ClearSwitches() }},
+		{"append", func(p *ControlPlanePersister) error {
+			return p.AddCallDetailRecord(CallDetailRecord{RouteID: "2", CallerEmail: "jean.doe@example.com"})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := openPersister(t)
+
+			if err := p.PutSwitch(SwitchRecord{ID: "1", Addr: "127.0.0.1:1337"}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := p.AddCallDetailRecord(CallDetailRecord{RouteID: "1", CallerEmail: "jean.doe@example.com"}); err != nil {
+				t.Fatal(err)
+			}
+
+			wantSnapshot, err := p.GetSnapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rolledBack := false
+			p.SetOnCommit(func(entry Entry) error {
+				return errReplication
+			})
+			p.SetOnRollback(func(entry Entry) {
+				rolledBack = true
+			})
+
+			if err := tt.write(p); !errors.Is(err, errReplication) {
+				t.Fatalf("write error = %v, want %v", err, errReplication)
+			}
+
+			if !rolledBack {
+				t.Error("write was not rolled back")
+			}
+
+			gotSnapshot, err := p.GetSnapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(gotSnapshot, wantSnapshot) {
+				t.Errorf("snapshot after rollback = %+v, want %+v", gotSnapshot, wantSnapshot)
+			}
+
+			entries, found, err := p.GetEntries(wantSnapshot.Revision, wantSnapshot.Term)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !found || len(entries) != 0 {
+				t.Errorf("GetEntries() = %v, %v, want no entries after rollback", entries, found)
+			}
+		})
+	}
+}
+
+func TestSetStateTermIsNotRolledBack(t *testing.T) {
+	p := openPersister(t)
+
+	p.SetOnCommit(func(entry Entry) error {
+		return errReplication
+	})
+
+	if err := p.SetStateTerm(2); !errors.Is(err, errReplication) {
+		t.Fatalf("SetStateTerm() error = %v, want %v", err, errReplication)
+	}
+
+	_, term, err := p.GetRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if term != 2 {
+		t.Errorf("GetRevision() term = %v, want 2", term)
+	}
+}
+
+func TestCommitDoesNotReuseRolledBackRevisions(t *testing.T) {
+	p := openPersister(t)
+
+	if err := p.PutSwitch(SwitchRecord{ID: "1", Addr: "127.0.0.1:1337"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fail := true
+	var committed Entry
+	p.SetOnCommit(func(entry Entry) error {
+		committed = entry
+
+		if fail {
+			return errReplication
+		}
+
+		return nil
+	})
+
+	if err := p.PutSwitch(SwitchRecord{ID: "2", Addr: "127.0.0.2:1337"}); !errors.Is(err, errReplication) {
+		t.Fatalf("PutSwitch() error = %v, want %v", err, errReplication)
+	}
+
+	rolledBack := committed
+	fail = false
+
+	if err := p.PutSwitch(SwitchRecord{ID: "3", Addr: "127.0.0.3:1337"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replicas which stored the rolled back entry must not find the next entry after it
+	if committed.Revision <= rolledBack.Revision || committed.PrevRevision != rolledBack.PrevRevision {
+		t.Errorf("entry after rollback = %v after %v, want a revision after %v after %v", committed.Revision, committed.PrevRevision, rolledBack.Revision, rolledBack.PrevRevision)
+	}
+
+	if _, found, err := p.GetEntries(rolledBack.Revision, rolledBack.Term); err != nil || found {
+		t.Errorf("GetEntries() after rolled back entry found = %v, error = %v, want not found", found, err)
+	}
+
+	entries, found, err := p.GetEntries(rolledBack.PrevRevision, rolledBack.PrevTerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !found || len(entries) != 1 || entries[0].Revision != committed.Revision {
+		t.Errorf("GetEntries() before rolled back entry = %+v, %v, want the entry after the rollback", entries, found)
+	}
+}
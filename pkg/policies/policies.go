@@ -0,0 +1,284 @@
+package policies
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrUnknownEffect = errors.New("could not load policy: Unknown effect")
+)
+
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+
+	defaultRuleName = "default"
+)
+
+// Subject matches the caller or callee of a call; all of the set fields must match
+type Subject struct {
+	Emails []string            `json:"emails,omitempty"` // Glob patterns, e.g. `*@example.com`
+	Claims map[string][]string `json:"claims,omitempty"` // The claim must contain at least one of the values, e.g. `{"groups": ["support"]}`
+	Not    *Subject            `json:"not,omitempty"`
+}
+
+type Rule struct {
+	Name        string   `json:"name"`
+	Effect      string   `json:"effect"`
+	Caller      *Subject `json:"caller,omitempty"`
+	Callee      *Subject `json:"callee,omitempty"`
+	Channels    []string `json:"channels,omitempty"`    // Glob patterns, e.g. `postgres-*`
+	CrossDomain bool     `json:"crossDomain,omitempty"` // Only match if the email domains of the caller and callee differ
+}
+
+type Policy struct {
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+type Identity struct {
+	Email  string
+	Claims map[string]any
+}
+
+type Request struct {
+	Caller    Identity
+	Callee    Identity
+	ChannelID string
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, value); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ClaimContains returns true if the claim (a string, list, boolean or number) contains at least one of the values
+func ClaimContains(claim any, values []string) bool {
+	switch c := claim.(type) {
+	case string:
+		return matchesAny(values, c)
+	case []any:
+		for _, item := range c {
+			if s, ok := item.(string); ok && matchesAny(values, s) {
+				return true
+			}
+		}
+	case bool, float64:
+		return matchesAny(values, fmt.Sprintf("%v", c))
+	}
+
+	return false
+}
+
+func (s *Subject) matches(identity Identity) bool {
+	if s == nil {
+		return true
+	}
+
+	if len(s.Emails) > 0 && !matchesAny(s.Emails, identity.Email) {
+		return false
+	}
+
+	for key, values := range s.Claims {
+		if !ClaimContains(identity.Claims[key], values) {
+			return false
+		}
+	}
+
+	if s.Not != nil && s.Not.matches(identity) {
+		return false
+	}
+
+	return true
+}
+
+func getDomain(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return email[i+1:]
+	}
+
+	return ""
+}
+
+func (r *Rule) matches(req Request) bool {
+	if len(r.Channels) > 0 && !matchesAny(r.Channels, req.ChannelID) {
+		return false
+	}
+
+	if r.CrossDomain && getDomain(req.Caller.Email) == getDomain(req.Callee.Email) {
+		return false
+	}
+
+	return r.Caller.matches(req.Caller) && r.Callee.matches(req.Callee)
+}
+
+func (p *Policy) validate() error {
+	if p.Default == "" {
+		p.Default = EffectAllow
+	}
+
+	if p.Default != EffectAllow && p.Default != EffectDeny {
+		return fmt.Errorf("%w: %v for default", ErrUnknownEffect, p.Default)
+	}
+
+	for _, rule := range p.Rules {
+		if rule.Effect != EffectAllow && rule.Effect != EffectDeny {
+			return fmt.Errorf("%w: %v for rule %v", ErrUnknownEffect, rule.Effect, rule.Name)
+		}
+	}
+
+	return nil
+}
+
+// Evaluate returns whether the request is allowed by the first matching rule and the rule's name
+func (p *Policy) Evaluate(req Request) (bool, string) {
+	for _, rule := range p.Rules {
+		if rule.matches(req) {
+			return rule.Effect == EffectAllow, rule.Name
+		}
+	}
+
+	return p.Default == EffectAllow, defaultRuleName
+}
+
+type PolicyEngine struct {
+	verbose atomic.Bool
+
+	policyPath     string
+	reloadInterval time.Duration
+
+	policyLock sync.Mutex
+	policy     *Policy
+	modTime    time.Time
+}
+
+func NewPolicyEngine(
+	verbose bool,
+
+	policyPath string,
+	reloadInterval time.Duration,
+) *PolicyEngine {
+	e := &PolicyEngine{
+		policyPath:     policyPath,
+		reloadInterval: reloadInterval,
+
+		policy: &Policy{
+			Default: EffectAllow,
+			Rules:   []Rule{},
+		},
+	}
+	e.verbose.Store(verbose)
+
+	return e
+}
+
+func (e *PolicyEngine) SetVerbose(verbose bool) {
+	e.verbose.Store(verbose)
+}
+
+// Open loads the policy file and reloads it whenever it changes; without a policy file all calls are allowed
+func (e *PolicyEngine) Open(ctx context.Context) error {
+	if strings.TrimSpace(e.policyPath) == "" {
+		return nil
+	}
+
+	if _, err := e.Reload(); err != nil {
+		return err
+	}
+
+	go func() {
+		t := time.NewTicker(e.reloadInterval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				reloaded, err := e.Reload()
+				if err != nil {
+					// Keep the last valid policy so that a typo doesn't allow or deny all calls
+					log.Println("Could not reload policy, keeping previous policy and continuing:", err)
+
+					continue
+				}
+
+				if reloaded {
+					log.Println("Reloaded policy from", e.policyPath)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Reload loads the policy file if it has changed since it was last loaded
+func (e *PolicyEngine) Reload() (bool, error) {
+	if strings.TrimSpace(e.policyPath) == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(e.policyPath)
+	if err != nil {
+		return false, err
+	}
+
+	e.policyLock.Lock()
+	unchanged := info.ModTime().Equal(e.modTime)
+	e.policyLock.Unlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	raw, err := os.ReadFile(e.policyPath)
+	if err != nil {
+		return false, err
+	}
+
+	var policy Policy
+	if err := json.Unmarshal(raw, &policy); err != nil {
+		return false, err
+	}
+
+	if err := policy.validate(); err != nil {
+		return false, err
+	}
+
+	e.policyLock.Lock()
+	e.policy = &policy
+	e.modTime = info.ModTime()
+	e.policyLock.Unlock()
+
+	return true, nil
+}
+
+func (e *PolicyEngine) Authorize(req Request) (bool, string) {
+	e.policyLock.Lock()
+	policy := e.policy
+	e.policyLock.Unlock()
+
+	allow, rule := policy.Evaluate(req)
+
+	if e.verbose.Load() {
+		log.Println("Policy rule", rule, "evaluated call from", req.Caller.Email, "to", req.Callee.Email, "on channel ID", req.ChannelID, "to allow:", allow)
+	}
+
+	return allow, rule
+}
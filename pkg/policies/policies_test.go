@@ -0,0 +1,208 @@
+package policies
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClaimContains(t *testing.T) {
+	tests := []struct {
+		name   string
+		claim  any
+		values []string
+		want   bool
+	}{
+		{"string match", "support", []string{"support"}, true},
+		{"string glob", "support-eu", []string{"support-*"}, true},
+		{"string mismatch", "sales", []string{"support"}, false},
+		{"list match", []any{"sales", "support"}, []string{"support"}, true},
+		{"list mismatch", []any{"sales", 1.0}, []string{"support"}, false},
+		{"boolean", true, []string{"true"}, true},
+		{"number", 42.0, []string{"42"}, true},
+		{"missing claim", nil, []string{"support"}, false},
+		{"unsupported type", map[string]any{"support": true}, []string{"support"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClaimContains(tt.claim, tt.values); got != tt.want {
+				t.Errorf("ClaimContains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy := Policy{
+		Default: EffectDeny,
+		Rules: []Rule{
+			{
+				Name:   "deny-blocked",
+				Effect: EffectDeny,
+				Caller: &Subject{Claims: map[string][]string{"groups": {"blocked"}}},
+			},
+			{
+				Name:        "deny-cross-domain-databases",
+				Effect:      EffectDeny,
+				Channels:    []string{"postgres-*"},
+				CrossDomain: true,
+			},
+			{
+				Name:   "allow-support",
+				Effect: EffectAllow,
+				Callee: &Subject{Emails: []string{"support@example.com"}},
+			},
+			{
+				Name:   "allow-example",
+				Effect: EffectAllow,
+				Caller: &Subject{
+					Emails: []string{"*@example.com"},
+					Not:    &Subject{Emails: []string{"intern@example.com"}},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		req       Request
+		wantAllow bool
+		wantRule  string
+	}{
+		{
+			name: "first matching rule wins",
+			req: Request{
+				Caller:    Identity{Email: "jean.doe@example.com", Claims: map[string]any{"groups": []any{"blocked"}}},
+				Callee:    Identity{Email: "support@example.com"},
+				ChannelID: "chat",
+			},
+			wantAllow: false,
+			wantRule:  "deny-blocked",
+		},
+		{
+			name: "cross-domain channel",
+			req: Request{
+				Caller:    Identity{Email: "jean.doe@example.com"},
+				Callee:    Identity{Email: "jane.doe@example.org"},
+				ChannelID: "postgres-main",
+			},
+			wantAllow: false,
+			wantRule:  "deny-cross-domain-databases",
+		},
+		{
+			name: "same-domain channel",
+			req: Request{
+				Caller:    Identity{Email: "jean.doe@example.com"},
+				Callee:    Identity{Email: "jane.doe@example.com"},
+				ChannelID: "postgres-main",
+			},
+			wantAllow: true,
+			wantRule:  "allow-example",
+		},
+		{
+			name: "callee email",
+			req: Request{
+				Caller:    Identity{Email: "jane.doe@example.org"},
+				Callee:    Identity{Email: "support@example.com"},
+				ChannelID: "chat",
+			},
+			wantAllow: true,
+			wantRule:  "allow-support",
+		},
+		{
+			name: "negated subject",
+			req: Request{
+				Caller:    Identity{Email: "intern@example.com"},
+				Callee:    Identity{Email: "jean.doe@example.com"},
+				ChannelID: "chat",
+			},
+			wantAllow: false,
+			wantRule:  defaultRuleName,
+		},
+		{
+			name: "default",
+			req: Request{
+				Caller:    Identity{Email: "jane.doe@example.org"},
+				Callee:    Identity{Email: "jean.doe@example.com"},
+				ChannelID: "chat",
+			},
+			wantAllow: false,
+			wantRule:  defaultRuleName,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, rule := policy.Evaluate(tt.req)
+			if allow != tt.wantAllow || rule != tt.wantRule {
+				t.Errorf("Evaluate() = %v, %v, want %v, %v", allow, rule, tt.wantAllow, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      Policy
+		wantErr     error
+		wantDefault string
+	}{
+		{"empty default allows", Policy{}, nil, EffectAllow},
+		{"deny default", Policy{Default: EffectDeny}, nil, EffectDeny},
+		{"unknown default", Policy{Default: "maybe"}, ErrUnknownEffect, "maybe"},
+		{"unknown rule effect", Policy{Rules: []Rule{{Name: "test", Effect: "maybe"}}}, ErrUnknownEffect, EffectAllow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); !errors.Is(err, tt.wantErr) {
+				t.Errorf("validate() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.policy.Default != tt.wantDefault {
+				t.Errorf("validate() default = %v, want %v", tt.policy.Default, tt.wantDefault)
+			}
+		})
+	}
+}
+
+func TestPolicyEngineKeepsPolicyOnInvalidReload(t *testing.T) {
+	policyPath := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(policyPath, []byte(`{"default": "deny"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewPolicyEngine(false, policyPath, 0)
+	if reloaded, err := e.Reload(); err != nil || !reloaded {
+		t.Fatalf("Reload() = %v, %v, want true, nil", reloaded, err)
+	}
+
+	if reloaded, err := e.Reload(); err != nil || reloaded {
+		t.Fatalf("Reload() of unchanged policy = %v, %v, want false, nil", reloaded, err)
+	}
+
+	if err := os.WriteFile(policyPath, []byte(`{"default": "maybe"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The modification time might not change within the file system's resolution
+	info, err := os.Stat(policyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(policyPath, info.ModTime(), info.ModTime().Add(1e9)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Reload(); !errors.Is(err, ErrUnknownEffect) {
+		t.Errorf("Reload() error = %v, want %v", err, ErrUnknownEffect)
+	}
+
+	if allow, _ := e.Authorize(Request{}); allow {
+		t.Error("Authorize() = true after invalid reload, want previous policy to deny")
+	}
+}
@@ -0,0 +1,858 @@
+package replicas
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+)
+
+var (
+	ErrEmptyReplicaToken = errors.New("could not continue with empty replica token")
+	ErrUnauthorized      = errors.New("could not authorize replica: Invalid token")
+	ErrCAMismatch        = errors.New("could not replicate state: Replicas don't share the same CA")
+	ErrLostLeadership    = errors.New("could not continue as leader: Lost contact to a quorum of replicas")
+	ErrUnexpectedStatus  = errors.New("could not contact replica: Unexpected status")
+	ErrNoQuorum          = errors.New("could not replicate state: A quorum of replicas didn't acknowledge the write")
+)
+
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+)
+
+type voteRequest struct {
+	Term        uint64
+	CandidateID string
+	Revision    uint64
+	StateTerm   uint64
+}
+
+type voteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+type heartbeatRequest struct {
+	Term          uint64
+	LeaderID      string
+	CAFingerprint string
+	Entries       []persisters.Entry
+	Snapshot      *persisters.Snapshot
+}
+
+type heartbeatResponse struct {
+	Term      uint64
+	Success   bool
+	Revision  uint64
+	StateTerm uint64
+	Error     string
+}
+
+type Status struct {
+	ID       string `json:"id"`
+	Role     string `json:"role"`
+	Term     uint64 `json:"term"`
+	LeaderID string `json:"leaderId"`
+}
+
+type revision struct {
+	revision  uint64
+	stateTerm uint64
+}
+
+// Replica elects a leader among the control plane replicas like Raft does; the leader replicates the entries which the persister
+// commits and only acknowledges a write once a quorum of replicas stored it, while replicas which are too far behind get a snapshot
+// in the background; writes which a quorum didn't acknowledge are rolled back by the persister
+type Replica struct {
+	verbose atomic.Bool
+
+	id    string
+	peers []string
+	token string
+
+	caFingerprint string
+
+	heartbeatInterval time.Duration
+	electionTimeout   time.Duration
+
+	persister *persisters.ControlPlanePersister
+
+	onLeader   func()
+	onStepDown func()
+
+	lock        sync.Mutex
+	role        string
+	term        uint64
+	votedFor    string
+	leaderID    string
+	lastContact time.Time
+
+	ackedLock sync.Mutex
+	acked     map[string]revision
+	// generation increases whenever the acknowledged revisions are reset, so that responses to requests which were sent
+	// before (e.g. with an entry which was rolled back since) can't restore them
+	generation   uint64
+	snapshotting map[string]struct{}
+
+	// Entries have to reach each replica in order, so only one heartbeat or write is sent to a replica at a time
+	peerLocks map[string]*sync.Mutex
+
+	client         *http.Client
+	snapshotClient *http.Client
+}
+
+func NewReplica(
+	verbose bool,
+
+	id string,
+	peers []string,
+	token string,
+
+	caPEM []byte,
+
+	heartbeatInterval,
+	electionTimeout,
+	snapshotTimeout time.Duration,
+
+	persister *persisters.ControlPlanePersister,
+
+	onLeader func(),
+	onStepDown func(),
+) *Replica {
+	fingerprint := sha256.Sum256(caPEM)
+
+	// Replicas serve the certificate which is issued by the shared CA unless their listeners use certificates from files
+	caCertPool, err := x509.SystemCertPool()
+	if err != nil {
+		caCertPool = x509.NewCertPool()
+	}
+	caCertPool.AppendCertsFromPEM(caPEM)
+
+	peerLocks := map[string]*sync.Mutex{}
+	for _, peer := range peers {
+		peerLocks[peer] = &sync.Mutex{}
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs: caCertPool,
+		},
+	}
+
+	r := &Replica{
+		id:    id,
+		peers: peers,
+		token: token,
+
+		caFingerprint: hex.EncodeToString(fingerprint[:]),
+
+		heartbeatInterval: heartbeatInterval,
+		electionTimeout:   electionTimeout,
+
+		persister: persister,
+
+		onLeader:   onLeader,
+		onStepDown: onStepDown,
+
+		role: RoleFollower,
+
+		acked:        map[string]revision{},
+		snapshotting: map[string]struct{}{},
+
+		peerLocks: peerLocks,
+
+		client: &http.Client{
+			Timeout:   electionTimeout / 2,
+			Transport: transport,
+		},
+		// Snapshots contain the call detail records, so they can take much longer to transfer than heartbeats
+		snapshotClient: &http.Client{
+			Timeout:   snapshotTimeout,
+			Transport: transport,
+		},
+	}
+	r.verbose.Store(verbose)
+
+	return r
+}
+
+func (r *Replica) SetVerbose(verbose bool) {
+	r.verbose.Store(verbose)
+}
+
+func (r *Replica) Open(ctx context.Context) error {
+	if strings.TrimSpace(r.token) == "" {
+		return ErrEmptyReplicaToken
+	}
+
+	term, votedFor, err := r.persister.GetElectionState()
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	r.term = term
+	r.votedFor = votedFor
+	r.lastContact = time.Now()
+	r.lock.Unlock()
+
+	r.persister.SetOnCommit(r.replicate)
+	r.persister.SetOnRollback(r.resetPeers)
+
+	go r.run(ctx)
+
+	return nil
+}
+
+func (r *Replica) IsLeader() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.role == RoleLeader
+}
+
+func (r *Replica) GetStatus() Status {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return Status{
+		ID:       r.id,
+		Role:     r.role,
+		Term:     r.term,
+		LeaderID: r.leaderID,
+	}
+}
+
+func (r *Replica) quorum() int {
+	return (len(r.peers)+1)/2 + 1
+}
+
+// Randomized timeouts make it unlikely that multiple replicas start an election at the same time
+func (r *Replica) getElectionTimeout() time.Duration {
+	return r.electionTimeout + time.Duration(rand.Int63n(int64(r.electionTimeout)))
+}
+
+func (r *Replica) run(ctx context.Context) {
+	t := time.NewTicker(r.heartbeatInterval)
+	defer t.Stop()
+
+	electionTimeout := r.getElectionTimeout()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		r.lock.Lock()
+		role := r.role
+		sinceLastContact := time.Since(r.lastContact)
+		r.lock.Unlock()
+
+		if role == RoleLeader {
+			r.sendHeartbeats(ctx)
+
+			continue
+		}
+
+		if sinceLastContact > electionTimeout {
+			electionTimeout = r.getElectionTimeout()
+
+			r.startElection(ctx)
+		}
+	}
+}
+
+// observeTerm must be called with the lock held; it returns true if this replica was the leader
+func (r *Replica) observeTerm(term uint64) bool {
+	wasLeader := r.role == RoleLeader
+
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+
+		if err := r.persister.PutElectionState(r.term, r.votedFor); err != nil {
+			log.Println("Could not persist election state, continuing:", err)
+		}
+	}
+
+	r.role = RoleFollower
+
+	return wasLeader
+}
+
+func (r *Replica) stepDown() {
+	log.Println("Stepping down as leader")
+
+	r.onStepDown()
+}
+
+func (r *Replica) post(ctx context.Context, client *http.Client, peer, path string, req, res any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	hreq.Header.Set("Authorization", "Bearer "+r.token)
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hres, err := client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hres.Body.Close()
+
+	if hres.StatusCode != http.StatusOK {
+		return ErrUnexpectedStatus
+	}
+
+	return json.NewDecoder(hres.Body).Decode(res)
+}
+
+func (r *Replica) startElection(ctx context.Context) {
+	currentRevision, stateTerm, err := r.persister.GetRevision()
+	if err != nil {
+		log.Println("Could not get revision, skipping election:", err)
+
+		return
+	}
+
+	r.lock.Lock()
+	r.term++
+	r.role = RoleCandidate
+	r.votedFor = r.id
+	r.leaderID = ""
+	r.lastContact = time.Now()
+	term := r.term
+
+	if err := r.persister.PutElectionState(r.term, r.votedFor); err != nil {
+		r.lock.Unlock()
+
+		log.Println("Could not persist election state, skipping election:", err)
+
+		return
+	}
+	r.lock.Unlock()
+
+	if r.verbose.Load() {
+		log.Println("Starting election for term", term)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		votes = 1
+		lock  sync.Mutex
+	)
+	for _, peer := range r.peers {
+		wg.Add(1)
+
+		go func(peer string) {
+			defer wg.Done()
+
+			var res voteResponse
+			if err := r.post(ctx, r.client, peer, "/vote", voteRequest{
+				Term:        term,
+				CandidateID: r.id,
+				Revision:    currentRevision,
+				StateTerm:   stateTerm,
+			}, &res); err != nil {
+				if r.verbose.Load() {
+					log.Println("Could not request vote from replica", peer, ", continuing:", err)
+				}
+
+				return
+			}
+
+			if res.Term > term {
+				r.lock.Lock()
+				r.observeTerm(res.Term)
+				r.lock.Unlock()
+
+				return
+			}
+
+			if res.Granted {
+				lock.Lock()
+				votes++
+				lock.Unlock()
+			}
+		}(peer)
+	}
+
+	wg.Wait()
+
+	r.lock.Lock()
+	if r.role != RoleCandidate || r.term != term || votes < r.quorum() {
+		r.lock.Unlock()
+
+		return
+	}
+
+	r.role = RoleLeader
+	r.leaderID = r.id
+	r.lastContact = time.Now()
+	r.lock.Unlock()
+
+	r.resetPeers(persisters.Entry{})
+
+	if err := r.persister.SetStateTerm(term); err != nil {
+		log.Println("Could not set state term, continuing:", err)
+	}
+
+	log.Println("Elected as leader for term", term, "with", votes, "votes")
+
+	r.onLeader()
+}
+
+// resetPeers forgets the revisions which the replicas acknowledged, so that the next heartbeat asks them for their revision; this
+// is required if they might have stored an entry which was rolled back since
+func (r *Replica) resetPeers(persisters.Entry) {
+	r.ackedLock.Lock()
+	defer r.ackedLock.Unlock()
+
+	r.acked = map[string]revision{}
+	r.generation++
+}
+
+// ack stores the revision which a replica acknowledged unless the acknowledged revisions were reset since the request was sent
+func (r *Replica) ack(peer string, generation uint64, res heartbeatResponse) {
+	r.ackedLock.Lock()
+	defer r.ackedLock.Unlock()
+
+	if r.generation == generation {
+		r.acked[peer] = revision{res.Revision, res.StateTerm}
+	}
+}
+
+// syncSnapshot sends a snapshot to the replica in the background if it isn't already receiving one, so that the heartbeats
+// to it and the other replicas continue while it is transferred
+func (r *Replica) syncSnapshot(peer string, term uint64) {
+	r.ackedLock.Lock()
+	if _, ok := r.snapshotting[peer]; ok {
+		r.ackedLock.Unlock()
+
+		return
+	}
+
+	r.snapshotting[peer] = struct{}{}
+	generation := r.generation
+	r.ackedLock.Unlock()
+
+	go func() {
+		defer func() {
+			r.ackedLock.Lock()
+			delete(r.snapshotting, peer)
+			r.ackedLock.Unlock()
+		}()
+
+		snapshot, err := r.persister.GetSnapshot()
+		if err != nil {
+			log.Println("Could not get snapshot for replica", peer, ", continuing:", err)
+
+			return
+		}
+
+		var res heartbeatResponse
+		if err := r.post(context.Background(), r.snapshotClient, peer, "/snapshot", heartbeatRequest{
+			Term:          term,
+			LeaderID:      r.id,
+			CAFingerprint: r.caFingerprint,
+			Snapshot:      &snapshot,
+		}, &res); err != nil {
+			log.Println("Could not send snapshot to replica", peer, ", continuing:", err)
+
+			return
+		}
+
+		// Newer terms are observed with the next heartbeat
+		if res.Term > term || !res.Success {
+			log.Println("Replica", peer, "rejected snapshot, continuing:", res.Error)
+
+			return
+		}
+
+		r.ack(peer, generation, res)
+
+		if r.verbose.Load() {
+			log.Println("Sent snapshot with revision", snapshot.Revision, "to replica", peer)
+		}
+	}()
+}
+
+// syncPeer sends a heartbeat with the entries which the replica doesn't have yet; if the leader doesn't know the replica's
+// revision (e.g. after an election), the heartbeat has no entries and the entries after the revision which the replica responds
+// with are sent with a second heartbeat. If they aren't logged anymore, the replica gets a snapshot in the background.
+func (r *Replica) syncPeer(ctx context.Context, peer string, term uint64) (heartbeatResponse, error) {
+	r.peerLocks[peer].Lock()
+	defer r.peerLocks[peer].Unlock()
+
+	r.ackedLock.Lock()
+	acked, known := r.acked[peer]
+	generation := r.generation
+	r.ackedLock.Unlock()
+
+	req := heartbeatRequest{
+		Term:          term,
+		LeaderID:      r.id,
+		CAFingerprint: r.caFingerprint,
+	}
+
+	if known {
+		entries, found, err := r.persister.GetEntries(acked.revision, acked.stateTerm)
+		if err != nil {
+			return heartbeatResponse{}, err
+		}
+
+		req.Entries = entries
+		known = found
+	}
+
+	var res heartbeatResponse
+	if err := r.post(ctx, r.client, peer, "/heartbeat", req, &res); err != nil {
+		return heartbeatResponse{}, err
+	}
+
+	if res.Term > term || (!res.Success && res.Error == ErrCAMismatch.Error()) {
+		return res, nil
+	}
+
+	// Revisions of rolled back entries aren't reused, so replicas which stored one of them don't find any entries here
+	if !known && res.Success {
+		entries, found, err := r.persister.GetEntries(res.Revision, res.StateTerm)
+		if err != nil {
+			return heartbeatResponse{}, err
+		}
+
+		known = found
+		if found && len(entries) > 0 {
+			req.Entries = entries
+
+			res = heartbeatResponse{}
+			if err := r.post(ctx, r.client, peer, "/heartbeat", req, &res); err != nil {
+				return heartbeatResponse{}, err
+			}
+
+			if res.Term > term {
+				return res, nil
+			}
+		}
+	}
+
+	// Replicas which diverged from the leader (e.g. a previous leader) can't apply the entries, so they get a snapshot instead
+	if !known || !res.Success {
+		r.ackedLock.Lock()
+		delete(r.acked, peer)
+		r.ackedLock.Unlock()
+
+		r.syncSnapshot(peer, term)
+
+		return res, nil
+	}
+
+	r.ack(peer, generation, res)
+
+	return res, nil
+}
+
+// syncPeers sends heartbeats to all replicas and returns the number of replicas (including this one) which stored the revision
+func (r *Replica) syncPeers(ctx context.Context, term, minRevision uint64) (int, bool) {
+	var (
+		wg       sync.WaitGroup
+		acks     = 1
+		lock     sync.Mutex
+		outdated bool
+	)
+	for _, peer := range r.peers {
+		wg.Add(1)
+
+		go func(peer string) {
+			defer wg.Done()
+
+			res, err := r.syncPeer(ctx, peer, term)
+			if err != nil {
+				if r.verbose.Load() {
+					log.Println("Could not send heartbeat to replica", peer, ", continuing:", err)
+				}
+
+				return
+			}
+
+			if res.Term > term {
+				lock.Lock()
+				outdated = true
+				lock.Unlock()
+
+				r.lock.Lock()
+				r.observeTerm(res.Term)
+				r.lock.Unlock()
+
+				return
+			}
+
+			if !res.Success {
+				log.Println("Replica", peer, "rejected heartbeat, continuing:", res.Error)
+
+				return
+			}
+
+			if res.Revision < minRevision {
+				return
+			}
+
+			lock.Lock()
+			acks++
+			lock.Unlock()
+		}(peer)
+	}
+
+	wg.Wait()
+
+	return acks, outdated
+}
+
+// replicate is called after the persister committed an entry; the write is only acknowledged once a quorum of replicas stored it
+func (r *Replica) replicate(entry persisters.Entry) error {
+	r.lock.Lock()
+	role := r.role
+	term := r.term
+	r.lock.Unlock()
+
+	if role != RoleLeader {
+		return ErrLostLeadership
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.electionTimeout)
+	defer cancel()
+
+	acks, outdated := r.syncPeers(ctx, term, entry.Revision)
+	if outdated {
+		r.stepDown()
+
+		return ErrLostLeadership
+	}
+
+	if acks < r.quorum() {
+		return ErrNoQuorum
+	}
+
+	return nil
+}
+
+func (r *Replica) sendHeartbeats(ctx context.Context) {
+	r.lock.Lock()
+	term := r.term
+	r.lock.Unlock()
+
+	acks, outdated := r.syncPeers(ctx, term, 0)
+	if outdated {
+		r.stepDown()
+
+		return
+	}
+
+	r.lock.Lock()
+	if r.role != RoleLeader || r.term != term {
+		r.lock.Unlock()
+
+		return
+	}
+
+	if acks >= r.quorum() {
+		r.lastContact = time.Now()
+		r.lock.Unlock()
+
+		return
+	}
+
+	// Another leader might be elected by the other replicas after the election timeout
+	lostQuorum := time.Since(r.lastContact) > r.electionTimeout
+	if lostQuorum {
+		r.role = RoleFollower
+		r.leaderID = ""
+	}
+	r.lock.Unlock()
+
+	if lostQuorum {
+		r.stepDown()
+	}
+}
+
+func (r *Replica) handleVote(req voteRequest) voteResponse {
+	currentRevision, stateTerm, err := r.persister.GetRevision()
+	if err != nil {
+		log.Println("Could not get revision, rejecting vote:", err)
+
+		return voteResponse{}
+	}
+
+	r.lock.Lock()
+
+	if req.Term < r.term {
+		defer r.lock.Unlock()
+
+		return voteResponse{Term: r.term}
+	}
+
+	wasLeader := false
+	if req.Term > r.term {
+		wasLeader = r.observeTerm(req.Term)
+	}
+
+	// Candidates with an outdated state can't become the leader, like in Raft
+	upToDate := req.StateTerm > stateTerm || (req.StateTerm == stateTerm && req.Revision >= currentRevision)
+
+	granted := false
+	if (r.votedFor == "" || r.votedFor == req.CandidateID) && upToDate {
+		r.votedFor = req.CandidateID
+		r.lastContact = time.Now()
+
+		if err := r.persister.PutElectionState(r.term, r.votedFor); err != nil {
+			log.Println("Could not persist election state, rejecting vote:", err)
+		} else {
+			granted = true
+		}
+	}
+
+	term := r.term
+	r.lock.Unlock()
+
+	if r.verbose.Load() {
+		log.Println("Vote for replica", req.CandidateID, "in term", req.Term, "granted:", granted)
+	}
+
+	if wasLeader {
+		r.stepDown()
+	}
+
+	return voteResponse{
+		Term:    term,
+		Granted: granted,
+	}
+}
+
+func (r *Replica) handleHeartbeat(req heartbeatRequest) heartbeatResponse {
+	r.lock.Lock()
+
+	if req.Term < r.term {
+		defer r.lock.Unlock()
+
+		return heartbeatResponse{Term: r.term}
+	}
+
+	wasLeader := r.observeTerm(req.Term)
+
+	if r.leaderID != req.LeaderID {
+		log.Println("Following leader", req.LeaderID, "in term", req.Term)
+	}
+
+	r.leaderID = req.LeaderID
+	r.lastContact = time.Now()
+	term := r.term
+	r.lock.Unlock()
+
+	if wasLeader {
+		r.stepDown()
+	}
+
+	if req.CAFingerprint != r.caFingerprint {
+		log.Println("Could not follow leader", req.LeaderID, ", continuing:", ErrCAMismatch)
+
+		return heartbeatResponse{Term: term, Error: ErrCAMismatch.Error()}
+	}
+
+	if req.Snapshot != nil {
+		if err := r.persister.RestoreSnapshot(*req.Snapshot); err != nil {
+			return heartbeatResponse{Term: term, Error: err.Error()}
+		}
+
+		if r.verbose.Load() {
+			log.Println("Restored snapshot with revision", req.Snapshot.Revision, "from leader", req.LeaderID)
+		}
+	} else if len(req.Entries) > 0 {
+		if err := r.persister.ApplyEntries(req.Entries); err != nil {
+			return heartbeatResponse{Term: term, Error: err.Error()}
+		}
+
+		if r.verbose.Load() {
+			log.Println("Applied entries up to revision", req.Entries[len(req.Entries)-1].Revision, "from leader", req.LeaderID)
+		}
+	}
+
+	currentRevision, stateTerm, err := r.persister.GetRevision()
+	if err != nil {
+		return heartbeatResponse{Term: term, Error: err.Error()}
+	}
+
+	return heartbeatResponse{
+		Term:      term,
+		Success:   true,
+		Revision:  currentRevision,
+		StateTerm: stateTerm,
+	}
+}
+
+func (r *Replica) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+r.token)) != 1 {
+		http.Error(w, ErrUnauthorized.Error(), http.StatusUnauthorized)
+
+		return
+	}
+
+	var res any
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/status":
+		res = r.GetStatus()
+
+	case req.Method == http.MethodPost && req.URL.Path == "/vote":
+		var vr voteRequest
+		if err := json.NewDecoder(req.Body).Decode(&vr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		res = r.handleVote(vr)
+
+	case req.Method == http.MethodPost && (req.URL.Path == "/heartbeat" || req.URL.Path == "/snapshot"):
+		var hr heartbeatRequest
+		if err := json.NewDecoder(req.Body).Decode(&hr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		res = r.handleHeartbeat(hr)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println("Could not encode replica response, continuing:", err)
+	}
+}
@@ -0,0 +1,513 @@
+package replicas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+)
+
+const testToken = "replica-token"
+
+// testReplica is a replica which is served in-process; unavailable replicas respond with an error like a replica which is down
+type testReplica struct {
+	*Replica
+
+	persister *persisters.ControlPlanePersister
+
+	unavailable atomic.Bool
+	leaderCount atomic.Int32
+	stepDowns   atomic.Int32
+
+	pathsLock sync.Mutex
+	paths     []string
+}
+
+func (r *testReplica) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.unavailable.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		return
+	}
+
+	r.pathsLock.Lock()
+	r.paths = append(r.paths, req.URL.Path)
+	r.pathsLock.Unlock()
+
+	r.Replica.ServeHTTP(w, req)
+}
+
+func (r *testReplica) servedPath(path string) bool {
+	r.pathsLock.Lock()
+	defer r.pathsLock.Unlock()
+
+	for _, candidate := range r.paths {
+		if candidate == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+func openPersister(t *testing.T) *persisters.ControlPlanePersister {
+	t.Helper()
+
+	p := persisters.NewControlPlanePersister()
+	if err := p.Open(filepath.Join(t.TempDir(), "controlplane.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = p.Close()
+	})
+
+	return p
+}
+
+// newTestCluster opens replicas which only start elections and send heartbeats when the test does so; setup can write to their
+// persisters before they are opened, e.g. so that they have a newer revision than the other replicas
+func newTestCluster(t *testing.T, n int, setup func(i int, p *persisters.ControlPlanePersister)) []*testReplica {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	replicas := []*testReplica{}
+	addrs := []string{}
+	for i := 0; i < n; i++ {
+		r := &testReplica{
+			persister: openPersister(t),
+		}
+
+		if setup != nil {
+			setup(i, r.persister)
+		}
+
+		srv := httptest.NewServer(r)
+		t.Cleanup(srv.Close)
+
+		replicas = append(replicas, r)
+		addrs = append(addrs, srv.URL)
+	}
+
+	// Stop the replicas before their servers and persisters are closed
+	t.Cleanup(cancel)
+
+	for i, r := range replicas {
+		peers := []string{}
+		for j, addr := range addrs {
+			if i != j {
+				peers = append(peers, addr)
+			}
+		}
+
+		r := r
+		r.Replica = NewReplica(
+			false,
+
+			fmt.Sprintf("replica-%v", i),
+			peers,
+			testToken,
+
+			[]byte("ca"),
+
+			time.Hour,
+			time.Second,
+			5*time.Second,
+
+			r.persister,
+
+			func() {
+				r.leaderCount.Add(1)
+			},
+			func() {
+				r.stepDowns.Add(1)
+			},
+		)
+
+		if err := r.Open(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return replicas
+}
+
+func electLeader(t *testing.T, r *testReplica) {
+	t.Helper()
+
+	r.startElection(context.Background())
+
+	if !r.IsLeader() {
+		t.Fatal("replica was not elected as leader")
+	}
+}
+
+func waitForRevision(t *testing.T, r *testReplica, wantRevision, wantStateTerm uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		revision, stateTerm, err := r.persister.GetRevision()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if revision == wantRevision && stateTerm == wantStateTerm {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("revision = %v in state term %v, want %v in state term %v", revision, stateTerm, wantRevision, wantStateTerm)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleVote(t *testing.T) {
+	putSwitches := func(count int) func(p *persisters.ControlPlanePersister) error {
+		return func(p *persisters.ControlPlanePersister) error {
+			for i := 0; i < count; i++ {
+				if err := p.PutSwitch(persisters.SwitchRecord{ID: fmt.Sprintf("%v", i)}); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name        string
+		setup       func(p *persisters.ControlPlanePersister) error
+		req         voteRequest
+		wantTerm    uint64
+		wantGranted bool
+	}{
+		{
+			"stale revision is refused",
+			putSwitches(2),
+			voteRequest{Term: 1, CandidateID: "candidate", Revision: 1},
+			1,
+			false,
+		},
+		{
+			"same revision is granted",
+			putSwitches(2),
+			voteRequest{Term: 1, CandidateID: "candidate", Revision: 2},
+			1,
+			true,
+		},
+		{
+			"newer state term is granted despite a lower revision",
+			putSwitches(2),
+			voteRequest{Term: 1, CandidateID: "candidate", Revision: 0, StateTerm: 1},
+			1,
+			true,
+		},
+		{
+			"lower term is refused",
+			func(p *persisters.ControlPlanePersister) error { return p.PutElectionState(3, "") },
+			voteRequest{Term: 2, CandidateID: "candidate"},
+			3,
+			false,
+		},
+		{
+			"second candidate in the same term is refused",
+			func(p *persisters.ControlPlanePersister) error { return p.PutElectionState(1, "other") },
+			voteRequest{Term: 1, CandidateID: "candidate"},
+			1,
+			false,
+		},
+		{
+			"same candidate in the same term is granted again",
+			func(p *persisters.ControlPlanePersister) error { return p.PutElectionState(1, "candidate") },
+			voteRequest{Term: 1, CandidateID: "candidate"},
+			1,
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replicas := newTestCluster(t, 1, func(i int, p *persisters.ControlPlanePersister) {
+				if err := tt.setup(p); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			res := replicas[0].handleVote(tt.req)
+			if res.Term != tt.wantTerm || res.Granted != tt.wantGranted {
+				t.Errorf("handleVote() = %+v, want term %v and granted %v", res, tt.wantTerm, tt.wantGranted)
+			}
+		})
+	}
+}
+
+func TestElectionWithStaleRevisionIsRefused(t *testing.T) {
+	// All replicas except the first one stored an entry which the first one missed
+	replicas := newTestCluster(t, 3, func(i int, p *persisters.ControlPlanePersister) {
+		if i == 0 {
+			return
+		}
+
+		if err := p.PutSwitch(persisters.SwitchRecord{ID: "1", Addr: "127.0.0.1:1337"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	replicas[0].startElection(context.Background())
+
+	if replicas[0].IsLeader() {
+		t.Fatal("replica with stale revision was elected as leader")
+	}
+
+	if count := replicas[0].leaderCount.Load(); count != 0 {
+		t.Errorf("onLeader was called %v times, want 0", count)
+	}
+
+	// Replicas with the latest revision can still be elected, and the stale replica gets the entry
+	electLeader(t, replicas[1])
+
+	waitForRevision(t, replicas[0], 2, 2)
+
+	switches, err := replicas[0].persister.GetSwitches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []persisters.SwitchRecord{{ID: "1", Addr: "127.0.0.1:1337"}}; !reflect.DeepEqual(switches, want) {
+		t.Errorf("switches of stale replica = %+v, want %+v", switches, want)
+	}
+}
+
+func TestWriteWithoutQuorumIsRolledBack(t *testing.T) {
+	replicas := newTestCluster(t, 3, nil)
+
+	electLeader(t, replicas[0])
+
+	wantRevision, wantStateTerm, err := replicas[0].persister.GetRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replicas[1].unavailable.Store(true)
+	replicas[2].unavailable.Store(true)
+
+	if err := replicas[0].persister.PutSwitch(persisters.SwitchRecord{ID: "1", Addr: "127.0.0.1:1337"}); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("PutSwitch() error = %v, want %v", err, ErrNoQuorum)
+	}
+
+	switches, err := replicas[0].persister.GetSwitches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(switches) != 0 {
+		t.Errorf("switches after rollback = %+v, want none", switches)
+	}
+
+	revision, stateTerm, err := replicas[0].persister.GetRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if revision != wantRevision || stateTerm != wantStateTerm {
+		t.Errorf("revision after rollback = %v in state term %v, want %v in state term %v", revision, stateTerm, wantRevision, wantStateTerm)
+	}
+
+	// Once a quorum is reachable again, writes are acknowledged
+	replicas[1].unavailable.Store(false)
+
+	if err := replicas[0].persister.PutSwitch(persisters.SwitchRecord{ID: "2", Addr: "127.0.0.2:1337"}); err != nil {
+		t.Fatalf("PutSwitch() with quorum error = %v, want nil", err)
+	}
+
+	if !replicas[0].IsLeader() {
+		t.Error("leader stepped down after a write without quorum")
+	}
+}
+
+func TestLeaderStepsDownOnHigherTerm(t *testing.T) {
+	replicas := newTestCluster(t, 3, nil)
+
+	electLeader(t, replicas[0])
+
+	// Another replica has seen a newer term, e.g. because it started an election while it was partitioned
+	replicas[1].lock.Lock()
+	replicas[1].observeTerm(5)
+	replicas[1].lock.Unlock()
+
+	replicas[0].sendHeartbeats(context.Background())
+
+	if replicas[0].IsLeader() {
+		t.Fatal("leader didn't step down after observing a higher term")
+	}
+
+	if count := replicas[0].stepDowns.Load(); count != 1 {
+		t.Errorf("onStepDown was called %v times, want 1", count)
+	}
+
+	if status := replicas[0].GetStatus(); status.Term != 5 || status.Role != RoleFollower {
+		t.Errorf("status = %+v, want follower in term 5", status)
+	}
+
+	// Replicas which stepped down can't acknowledge writes anymore
+	if err := replicas[0].persister.PutSwitch(persisters.SwitchRecord{ID: "1", Addr: "127.0.0.1:1337"}); !errors.Is(err, ErrLostLeadership) {
+		t.Errorf("PutSwitch() after step down error = %v, want %v", err, ErrLostLeadership)
+	}
+}
+
+func TestLaggingFollowerCatchesUpWithEntries(t *testing.T) {
+	replicas := newTestCluster(t, 3, nil)
+
+	// The lagging replica misses the election and the writes, so the leader has to ask it for its revision
+	replicas[2].unavailable.Store(true)
+
+	electLeader(t, replicas[0])
+
+	for i := 0; i < 3; i++ {
+		if err := replicas[0].persister.PutSwitch(persisters.SwitchRecord{ID: fmt.Sprintf("%v", i), Addr: "127.0.0.1:1337"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replicas[2].unavailable.Store(false)
+
+	replicas[0].sendHeartbeats(context.Background())
+
+	wantRevision, wantStateTerm, err := replicas[0].persister.GetRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForRevision(t, replicas[2], wantRevision, wantStateTerm)
+
+	if replicas[2].servedPath("/snapshot") {
+		t.Error("lagging replica got a snapshot even though the leader logged the entries which it missed")
+	}
+}
+
+func TestLaggingFollowerCatchesUpWithSnapshot(t *testing.T) {
+	// The lagging replica has a revision which isn't in the leader's log, e.g. because it stored an entry which the other replicas never got
+	replicas := newTestCluster(t, 3, func(i int, p *persisters.ControlPlanePersister) {
+		if i != 2 {
+			return
+		}
+
+		if err := p.PutSwitch(persisters.SwitchRecord{ID: "stale", Addr: "127.0.0.1:1337"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	replicas[2].unavailable.Store(true)
+
+	electLeader(t, replicas[0])
+
+	for i := 0; i < 3; i++ {
+		if err := replicas[0].persister.PutSwitch(persisters.SwitchRecord{ID: fmt.Sprintf("%v", i), Addr: "127.0.0.1:1337"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replicas[2].unavailable.Store(false)
+
+	replicas[0].sendHeartbeats(context.Background())
+
+	wantRevision, wantStateTerm, err := replicas[0].persister.GetRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForRevision(t, replicas[2], wantRevision, wantStateTerm)
+
+	if !replicas[2].servedPath("/snapshot") {
+		t.Error("lagging replica didn't get a snapshot")
+	}
+
+	wantSwitches, err := replicas[0].persister.GetSwitches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switches, err := replicas[2].persister.GetSwitches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(switches, wantSwitches) {
+		t.Errorf("switches of lagging replica = %+v, want %+v", switches, wantSwitches)
+	}
+
+	// Once the snapshot was acknowledged, the replica gets the next entries with the heartbeats again
+	if err := replicas[0].persister.PutSwitch(persisters.SwitchRecord{ID: "3", Addr: "127.0.0.1:1337"}); err != nil {
+		t.Fatal(err)
+	}
+
+	nextRevision, _, err := replicas[0].persister.GetRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitForRevision(t, replicas[2], nextRevision, wantStateTerm)
+}
+
+func TestFollowerWithRolledBackEntryGetsSnapshot(t *testing.T) {
+	replicas := newTestCluster(t, 5, nil)
+
+	electLeader(t, replicas[0])
+
+	// Only the last replica stores the write, which isn't a quorum, so the leader rolls it back
+	for _, r := range replicas[1:4] {
+		r.unavailable.Store(true)
+	}
+
+	if err := replicas[0].persister.PutSwitch(persisters.SwitchRecord{ID: "rolled-back", Addr: "127.0.0.1:1337"}); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("PutSwitch() error = %v, want %v", err, ErrNoQuorum)
+	}
+
+	for _, r := range replicas[1:4] {
+		r.unavailable.Store(false)
+	}
+
+	if err := replicas[0].persister.PutSwitch(persisters.SwitchRecord{ID: "1", Addr: "127.0.0.1:1337"}); err != nil {
+		t.Fatal(err)
+	}
+
+	wantRevision, wantStateTerm, err := replicas[0].persister.GetRevision()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantSwitches, err := replicas[0].persister.GetSwitches()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, r := range replicas[1:] {
+		waitForRevision(t, r, wantRevision, wantStateTerm)
+
+		switches, err := r.persister.GetSwitches()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(switches, wantSwitches) {
+			t.Errorf("switches of replica %v = %+v, want %+v", i+1, switches, wantSwitches)
+		}
+	}
+
+	if !replicas[4].servedPath("/snapshot") {
+		t.Error("replica with rolled back entry didn't get a snapshot")
+	}
+}
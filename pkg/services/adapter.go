@@ -8,24 +8,43 @@ import (
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/utils"
 )
 
 var (
-	ErrNoPeersFound = errors.New("could not find any peers")
+	ErrNoPeersFound             = errors.New("could not find any peers")
+	ErrDirectRouteAlreadyExists = errors.New("could not prepare direct route: A direct route with this route ID is already pending")
 )
 
 func SetAdapterCA(adapter *Adapter, caPEM []byte) {
 	adapter.caPEM = caPEM
 }
 
+func SetAdapterVerbose(adapter *Adapter, verbose bool) {
+	adapter.verbose.Store(verbose)
+}
+
+// SetAdapterDraining declines incoming calls while the calls which are already answered continue
+func SetAdapterDraining(adapter *Adapter, draining bool) {
+	adapter.draining.Store(draining)
+}
+
 type AdapterRemote struct {
-	RequestCall      func(ctx context.Context, srcID, srcEmail, routeID, channelID string) (bool, error)
-	TestLatency      func(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair) ([]time.Duration, error)
-	TestThroughput   func(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair, benchmarkLimit int64) ([]ThroughputResult, error)
-	UnprovisionRoute func(ctx context.Context, routeID string) error
-	ProvisionRoute   func(
+	RequestCall        func(ctx context.Context, srcID, srcEmail, routeID, channelID string) (bool, error)
+	TestLatency        func(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair) ([]time.Duration, error)
+	TestThroughput     func(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair, benchmarkLimit int64) ([]ThroughputResult, error)
+	UnprovisionRoute   func(ctx context.Context, routeID string) (int64, error)
+	ListRoutes         func(ctx context.Context) ([]string, error)
+	CallStateChanged   func(ctx context.Context, routeID, channelID, state string, isCaller bool) error
+	SetHold            func(ctx context.Context, routeID string, hold bool) error
+	GetCandidates      func(ctx context.Context) ([]string, error)
+	PrepareDirectRoute func(ctx context.Context, routeID, channelID string, cert CertPair) ([]string, error)
+	ProvisionRoute     func(
 		ctx context.Context,
 		routeID,
 		channelID,
@@ -39,17 +58,27 @@ func RequestCall(adapter *Adapter, dstID, channelID string) (bool, string, error
 }
 
 type Adapter struct {
-	verbose bool
-	ahost   string
+	verbose  atomic.Bool
+	draining atomic.Bool
+	ahost    string
+
+	directRoutes bool
 
 	onRequestCall      func(ctx context.Context, srcID, srcEmail, routeID, channelID string) (bool, error)
 	onCallDisconnected func(ctx context.Context, routeID, channelID string) error
 	onHandleCall       func(ctx context.Context, routeID, channelID, raddr string) error
+	onCallStateChanged func(ctx context.Context, routeID, channelID, state string, isCaller bool) error
 	getIDToken         func() (string, error)
 
+	// ctx outlives the RPCs, so routes which are handled in the background aren't tied to the RPC which prepared them
+	ctx context.Context
+
 	routes     map[string]connPair
 	routesLock sync.Mutex
 
+	pendingDirectRoutes     map[string]net.Listener
+	pendingDirectRoutesLock sync.Mutex
+
 	caPEM []byte
 
 	Peers func() map[string]GatewayRemote
@@ -59,22 +88,36 @@ func NewAdapter(
 	verbose bool,
 	ahost string,
 
+	directRoutes bool,
+
 	onRequestCall func(ctx context.Context, srcID, srcEmail, routeID, channelID string) (bool, error),
 	onCallDisconnected func(ctx context.Context, routeID, channelID string) error,
 	onHandleCall func(ctx context.Context, routeID, channelID, raddr string) error,
+	onCallStateChanged func(ctx context.Context, routeID, channelID, state string, isCaller bool) error,
 	getIDToken func() (string, error),
+
+	ctx context.Context,
 ) *Adapter {
-	return &Adapter{
-		verbose: verbose,
-		ahost:   ahost,
+	a := &Adapter{
+		ahost: ahost,
+
+		directRoutes: directRoutes,
 
 		onRequestCall:      onRequestCall,
 		onCallDisconnected: onCallDisconnected,
 		onHandleCall:       onHandleCall,
+		onCallStateChanged: onCallStateChanged,
 		getIDToken:         getIDToken,
 
+		ctx: ctx,
+
 		routes: map[string]connPair{},
+
+		pendingDirectRoutes: map[string]net.Listener{},
 	}
+	a.verbose.Store(verbose)
+
+	return a
 }
 
 func (a *Adapter) RequestCall(
@@ -84,19 +127,60 @@ func (a *Adapter) RequestCall(
 	routeID,
 	channelID string,
 ) (bool, error) {
-	if a.verbose {
+	if a.verbose.Load() {
 		log.Println("Remote with ID", srcID, "is requesting a call")
 	}
 
+	if a.draining.Load() {
+		if a.verbose.Load() {
+			log.Println("Declining call with route ID", routeID, "from remote with ID", srcID, "because adapter is draining")
+		}
+
+		return false, nil
+	}
+
 	return a.onRequestCall(ctx, srcID, srcEmail, routeID, channelID)
 }
 
+func (a *Adapter) CallStateChanged(
+	ctx context.Context,
+	routeID,
+	channelID,
+	state string,
+	isCaller bool,
+) error {
+	if a.verbose.Load() {
+		log.Println("Call with route ID", routeID, "and channel ID", channelID, "is", state)
+	}
+
+	return a.onCallStateChanged(ctx, routeID, channelID, state, isCaller)
+}
+
+// SetHold pauses or resumes the media of a call without unprovisioning its route
+func (a *Adapter) SetHold(ctx context.Context, routeID string, hold bool) error {
+	a.routesLock.Lock()
+	defer a.routesLock.Unlock()
+
+	if a.verbose.Load() {
+		log.Println("Setting hold for route with ID", routeID, "to", hold)
+	}
+
+	route, ok := a.routes[routeID]
+	if !ok {
+		return ErrRouteNotFound
+	}
+
+	route.hold.SetHeld(hold)
+
+	return nil
+}
+
 func (a *Adapter) requestCall(
 	ctx context.Context,
 	dstID string,
 	channelID string,
 ) (bool, string, error) {
-	if a.verbose {
+	if a.verbose.Load() {
 		log.Println("Requesting a call with ID", dstID)
 	}
 
@@ -118,7 +202,7 @@ func (a *Adapter) requestCall(
 }
 
 func (a *Adapter) TestLatency(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair) ([]time.Duration, error) {
-	if a.verbose {
+	if a.verbose.Load() {
 		log.Println("Starting latency tests for addrs", addrs)
 	}
 
@@ -139,7 +223,7 @@ func (a *Adapter) TestLatency(ctx context.Context, timeout time.Duration, addrs
 }
 
 func (a *Adapter) TestThroughput(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair, benchmarkLimit int64) ([]ThroughputResult, error) {
-	if a.verbose {
+	if a.verbose.Load() {
 		log.Println("Starting throughput tests for addrs", addrs)
 	}
 
@@ -159,30 +243,68 @@ func (a *Adapter) TestThroughput(ctx context.Context, timeout time.Duration, add
 	}, benchmarkLimit)
 }
 
-func (a *Adapter) UnprovisionRoute(ctx context.Context, routeID string) error {
+func (a *Adapter) popPendingDirectRoute(routeID string) (net.Listener, bool) {
+	a.pendingDirectRoutesLock.Lock()
+	defer a.pendingDirectRoutesLock.Unlock()
+
+	lis, ok := a.pendingDirectRoutes[routeID]
+	if ok {
+		delete(a.pendingDirectRoutes, routeID)
+	}
+
+	return lis, ok
+}
+
+func (a *Adapter) ListRoutes(ctx context.Context) ([]string, error) {
+	a.routesLock.Lock()
+	defer a.routesLock.Unlock()
+
+	routeIDs := []string{}
+	for routeID := range a.routes {
+		routeIDs = append(routeIDs, routeID)
+	}
+
+	return routeIDs, nil
+}
+
+func (a *Adapter) UnprovisionRoute(ctx context.Context, routeID string) (int64, error) {
 	a.routesLock.Lock()
 	defer a.routesLock.Unlock()
 
-	if a.verbose {
+	if a.verbose.Load() {
 		log.Println("Unprovisioning route with ID", routeID)
 	}
 
+	lis, pending := a.popPendingDirectRoute(routeID)
+	if pending {
+		_ = lis.Close()
+	}
+
 	route, ok := a.routes[routeID]
 	if !ok {
-		return ErrRouteNotFound
+		// A direct route that was never connected doesn't need to be disconnected
+		if pending {
+			return 0, nil
+		}
+
+		return 0, ErrRouteNotFound
 	}
 
-	if err := route.src.Close(); err != nil {
-		return err
+	// Release writers which are waiting for a held call to resume
+	route.hold.SetHeld(false)
+
+	// The connections might already have been closed by the application
+	if err := route.src.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return 0, err
 	}
 
-	if err := route.dst.Close(); err != nil {
-		return err
+	if err := route.dst.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return 0, err
 	}
 
 	delete(a.routes, routeID)
 
-	return a.onCallDisconnected(ctx, routeID, route.channelID)
+	return route.transferred.Load(), a.onCallDisconnected(ctx, routeID, route.channelID)
 }
 
 func (a *Adapter) ProvisionRoute(
@@ -192,20 +314,15 @@ func (a *Adapter) ProvisionRoute(
 	raddr string,
 	cert CertPair,
 ) error {
-	if a.verbose {
+	if a.verbose.Load() {
 		log.Println("Provisioning route with ID", routeID, "and channel ID", channelID, "to raddr", raddr)
 	}
 
-	var src net.Conn
-	var dst net.Conn
-
-	cp := connPair{
-		channelID: channelID,
+	// If the route is being provisioned through switches, we don't need the direct route anymore
+	if lis, ok := a.popPendingDirectRoute(routeID); ok {
+		_ = lis.Close()
 	}
 
-	ready := make(chan struct{})
-	errs := make(chan error)
-
 	cer, err := tls.X509KeyPair(cert.CertPEM, cert.CertPrivKeyPEM)
 	if err != nil {
 		return err
@@ -222,6 +339,168 @@ func (a *Adapter) ProvisionRoute(
 		return err
 	}
 
+	return a.handleRoute(ctx, routeID, channelID, conn)
+}
+
+func (a *Adapter) GetCandidates(ctx context.Context) ([]string, error) {
+	if !a.directRoutes {
+		return []string{}, nil
+	}
+
+	if a.verbose.Load() {
+		log.Println("Gathering candidates for direct routes")
+	}
+
+	return utils.GetCandidateIPs(a.ahost)
+}
+
+func (a *Adapter) PrepareDirectRoute(ctx context.Context, routeID, channelID string, cert CertPair) ([]string, error) {
+	if !a.directRoutes {
+		return []string{}, nil
+	}
+
+	if a.verbose.Load() {
+		log.Println("Preparing direct route with ID", routeID, "and channel ID", channelID)
+	}
+
+	cer, err := tls.X509KeyPair(cert.CertPEM, cert.CertPrivKeyPEM)
+	if err != nil {
+		return []string{}, err
+	}
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(a.caPEM)
+
+	a.pendingDirectRoutesLock.Lock()
+	defer a.pendingDirectRoutesLock.Unlock()
+
+	if _, ok := a.pendingDirectRoutes[routeID]; ok {
+		return []string{}, ErrDirectRouteAlreadyExists
+	}
+
+	lis, err := tls.Listen("tcp", net.JoinHostPort(a.ahost, "0"), &tls.Config{
+		Certificates: []tls.Certificate{cer},
+		ClientCAs:    caCertPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			cert := verifiedChains[0][0]
+
+			// Allow the other adapter to measure the latency to this candidate
+			if cert.Subject.CommonName == utils.RoleBenchmarkClient {
+				return nil
+			}
+
+			if cert.Subject.CommonName != utils.RoleAdapterClient {
+				return ErrUnauthenticatedRole
+			}
+
+			if len(cert.Subject.Country) < 1 || cert.Subject.Country[0] != routeID {
+				return ErrUnauthenticatedRoute
+			}
+
+			return nil
+		},
+	})
+	if err != nil {
+		return []string{}, err
+	}
+
+	ips, err := utils.GetCandidateIPs(a.ahost)
+	if err != nil {
+		_ = lis.Close()
+
+		return []string{}, err
+	}
+
+	port := strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)
+
+	laddrs := []string{}
+	for _, ip := range ips {
+		laddrs = append(laddrs, net.JoinHostPort(ip, port))
+	}
+
+	a.pendingDirectRoutes[routeID] = lis
+
+	go func() {
+		for {
+			rawConn, err := lis.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+
+				if a.verbose.Load() {
+					log.Println("Could not accept direct connection, skipping:", err)
+				}
+
+				continue
+			}
+
+			conn, ok := rawConn.(*tls.Conn)
+			if !ok {
+				if a.verbose.Load() {
+					log.Println("Could not accept non-TLS connection, skipping:", err)
+				}
+
+				_ = rawConn.Close()
+
+				continue
+			}
+
+			if err := conn.Handshake(); err != nil {
+				if a.verbose.Load() {
+					log.Println("Could not hanshake TLS connection, skipping:", err)
+				}
+
+				_ = conn.Close()
+
+				continue
+			}
+
+			// Latency tests only need to connect
+			if conn.ConnectionState().PeerCertificates[0].Subject.CommonName == utils.RoleBenchmarkClient {
+				_ = conn.Close()
+
+				continue
+			}
+
+			if _, ok := a.popPendingDirectRoute(routeID); !ok {
+				_ = conn.Close()
+
+				return
+			}
+
+			_ = lis.Close()
+
+			if err := a.handleRoute(a.ctx, routeID, channelID, conn); err != nil {
+				log.Println("Could not handle direct route with ID", routeID, ", stopping:", err)
+			}
+
+			return
+		}
+	}()
+
+	return laddrs, nil
+}
+
+func (a *Adapter) handleRoute(
+	ctx context.Context,
+	routeID string,
+	channelID string,
+	conn net.Conn,
+) error {
+	var src net.Conn
+	var dst net.Conn
+
+	cp := connPair{
+		channelID:   channelID,
+		transferred: &atomic.Int64{},
+		hold:        utils.NewGate(),
+	}
+
+	ready := make(chan struct{})
+	errs := make(chan error)
+
 	cp.src = conn
 	src = conn
 
@@ -243,7 +522,7 @@ func (a *Adapter) ProvisionRoute(
 	go func() {
 		conn, err := lis.Accept()
 		if err != nil {
-			if a.verbose {
+			if a.verbose.Load() {
 				log.Println("Could not accept dst connection, stopping:", err)
 			}
 
@@ -274,7 +553,7 @@ func (a *Adapter) ProvisionRoute(
 		}
 
 		if i < 2 {
-			if a.verbose {
+			if a.verbose.Load() {
 				log.Println("Could not accept src or dst connection, stopping:", err)
 			}
 		}
@@ -283,12 +562,18 @@ func (a *Adapter) ProvisionRoute(
 			defer func() {
 				err := recover()
 
-				if a.verbose && err != nil {
+				if a.verbose.Load() && err != nil {
 					log.Println("Could not copy from dst to src, stopping:", err)
 				}
+
+				// Close both sides so that the application notices that the call ended
+				_ = src.Close()
+				if dst != nil {
+					_ = dst.Close()
+				}
 			}()
 
-			if _, err := io.Copy(src, dst); err != nil {
+			if _, err := io.Copy(utils.GatedWriter{Writer: utils.CountingWriter{Writer: src, Written: cp.transferred}, Gate: cp.hold}, dst); err != nil {
 				panic(err)
 			}
 		}()
@@ -297,12 +582,18 @@ func (a *Adapter) ProvisionRoute(
 			defer func() {
 				err := recover()
 
-				if a.verbose && err != nil {
+				if a.verbose.Load() && err != nil {
 					log.Println("Could not copy from src to dst, stopping:", err)
 				}
+
+				// Close both sides so that the application notices that the call ended
+				_ = src.Close()
+				if dst != nil {
+					_ = dst.Close()
+				}
 			}()
 
-			if _, err := io.Copy(dst, src); err != nil {
+			if _, err := io.Copy(utils.GatedWriter{Writer: utils.CountingWriter{Writer: dst, Written: cp.transferred}, Gate: cp.hold}, src); err != nil {
 				panic(err)
 			}
 		}()
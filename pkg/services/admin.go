@@ -0,0 +1,410 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrAdminUnauthorized           = errors.New("could not authorize admin: Email is not an admin")
+	ErrAdminEmailNotVerified       = errors.New("could not authorize admin: Email is not verified")
+	ErrInvalidAdminArgs            = errors.New("could not handle admin request: Invalid arguments")
+	ErrCARotationNotSupported      = errors.New("could not rotate CA: Not supported by this control plane")
+	ErrCARotationInProgress        = errors.New("could not rotate CA: Previous rotation has not been completed yet")
+	ErrCARotationNotStarted        = errors.New("could not retire CA: No rotation has been started since the control plane restarted")
+	ErrNodeCertificatesNotReissued = errors.New("could not retire CA: Not all switches have been re-issued node certificates yet")
+)
+
+// AdminSwitch is a registered switch as listed by the admin API
+type AdminSwitch struct {
+	ID string
+	SwitchMetadata
+}
+
+// AdminAdapter is a registered adapter as listed by the admin API
+type AdminAdapter struct {
+	ID string
+	AdapterMetadata
+}
+
+// AdminCA is the next CA certificate, which the control plane re-issues node certificates with once it restarts
+type AdminCA struct {
+	CAPEM []byte
+}
+
+// AdminError is the body of failed admin API requests
+type AdminError struct {
+	Error string
+}
+
+// Admin serves the authenticated admin API, which lists the switches, adapters, routes and call detail records of the
+// control plane and lets admins hang up routes, drain switches and kick adapters
+type Admin struct {
+	verbose atomic.Bool
+
+	auth        *auth.OIDCAuthn
+	adminEmails []string
+
+	Router *Router
+
+	// RotateCA backs up the CA and generates the next one, which is trusted alongside it once the control plane restarts
+	RotateCA func() ([]byte, error)
+
+	// RetireCA replaces the CA with the next one, which is used for the listeners once the control plane restarts
+	RetireCA func() error
+}
+
+func NewAdmin(
+	verbose bool,
+
+	oidcIssuer,
+	oidcClientID string,
+
+	adminEmails []string,
+) *Admin {
+	a := &Admin{
+		auth: auth.NewOIDCAuthn(oidcIssuer, oidcClientID),
+
+		adminEmails: adminEmails,
+	}
+	a.verbose.Store(verbose)
+
+	return a
+}
+
+func (a *Admin) SetVerbose(verbose bool) {
+	a.verbose.Store(verbose)
+}
+
+func (a *Admin) Open(ctx context.Context) error {
+	return a.auth.Open(ctx)
+}
+
+// authorizeAdmin returns the email of the admin with the ID token
+func (a *Admin) authorizeAdmin(token string) (string, error) {
+	email, claims, err := a.auth.ValidateWithClaims(token)
+	if err != nil {
+		return "", err
+	}
+
+	if !auth.IsEmailVerified(claims) {
+		return "", ErrAdminEmailNotVerified
+	}
+
+	if !slices.Contains(a.adminEmails, email) {
+		return "", ErrAdminUnauthorized
+	}
+
+	return email, nil
+}
+
+// kickAdapter hangs up the calls of an adapter and unregisters it; the adapter can register again once it reconnects
+func (g *Gateway) kickAdapter(adapterID string) error {
+	if _, ok := g.getPeers()[adapterID]; !ok {
+		return ErrAdapterNotFound
+	}
+
+	router, err := g.getRouter()
+	if err != nil {
+		return err
+	}
+
+	routeIDs, err := router.GetNodeRouteIDs(context.Background(), adapterID)
+	if err != nil {
+		return err
+	}
+
+	for _, routeID := range routeIDs {
+		// Members of group calls only leave the call
+		if gcm, ok := g.getGroupCall(routeID); ok && gcm.hostID != adapterID {
+			if err := router.LeaveGroupRoute(context.Background(), routeID, adapterID); err != nil {
+				log.Println("Could not remove kicked adapter with ID", adapterID, "from group route with ID", routeID, ", continuing:", err)
+			}
+
+			continue
+		}
+
+		if err := g.unprovisionCall(routeID, TerminationReasonAdmin, ""); err != nil {
+			log.Println("Could not unprovision route with ID", routeID, "of kicked adapter with ID", adapterID, ", continuing:", err)
+		}
+	}
+
+	g.adaptersLock.Lock()
+	for remoteID, candidateID := range g.adapterIDs {
+		if candidateID == adapterID {
+			delete(g.adapterIDs, remoteID)
+		}
+	}
+	g.adaptersLock.Unlock()
+
+	return g.onClientDisconnect(adapterID, false)
+}
+
+// kickAdapter asks the gateway which the adapter is connected to to kick it
+func (r *Router) kickAdapter(adapterID string) error {
+	gateway, ok := r.getAdapterGateway(adapterID)
+	if !ok {
+		return ErrAdapterNotFound
+	}
+
+	return gateway.KickAdapter(context.Background(), adapterID)
+}
+
+// getRouteRecords returns the provisioned routes and the calls which are active on them
+func (r *Router) getRouteRecords() []persisters.RouteRecord {
+	r.routesLock.Lock()
+
+	routes := []persisters.RouteRecord{}
+	for routeID, path := range r.routes {
+		route := persisters.RouteRecord{
+			RouteID: routeID,
+			Path:    append([]string{}, path...),
+		}
+
+		if t, ok := r.groupRoutes[routeID]; ok {
+			route.Group = true
+			route.ChannelID = t.channelID
+		}
+
+		routes = append(routes, route)
+	}
+
+	r.routesLock.Unlock()
+
+	// Gateways persist the calls which are active on the routes together with the routes
+	records, err := r.persister.GetRoutes()
+	if err != nil {
+		log.Println("Could not get route records from persister, continuing:", err)
+	}
+
+	activeCalls := map[string]persisters.CallDetailRecord{}
+	for _, record := range records {
+		if record.ActiveCall.RouteID != "" {
+			activeCalls[record.RouteID] = record.ActiveCall
+		}
+	}
+
+	for i, route := range routes {
+		if cdr, ok := activeCalls[route.RouteID]; ok {
+			routes[i].ActiveCall = cdr
+			routes[i].ChannelID = cdr.ChannelID
+		}
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].RouteID < routes[j].RouteID
+	})
+
+	return routes
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("Could not encode admin response, continuing:", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrInvalidAdminArgs):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrCARotationNotSupported):
+		status = http.StatusNotImplemented
+	case errors.Is(err, ErrCARotationInProgress), errors.Is(err, ErrCARotationNotStarted), errors.Is(err, ErrNodeCertificatesNotReissued):
+		status = http.StatusConflict
+	case errors.Is(err, ErrSwitchNotFound), errors.Is(err, ErrAdapterNotFound), errors.Is(err, ErrRouteNotFound):
+		status = http.StatusNotFound
+	}
+
+	writeAdminJSON(w, status, AdminError{err.Error()})
+}
+
+func (a *Admin) listSwitches() []AdminSwitch {
+	switches := []AdminSwitch{}
+	for id, md := range a.Router.getSwitches() {
+		switches = append(switches, AdminSwitch{id, md})
+	}
+
+	sort.Slice(switches, func(i, j int) bool {
+		return switches[i].ID < switches[j].ID
+	})
+
+	return switches
+}
+
+func (a *Admin) listAdapters() []AdminAdapter {
+	metadata, _ := a.Router.getAdapters()
+
+	adapters := []AdminAdapter{}
+	for id, md := range metadata {
+		adapters = append(adapters, AdminAdapter{id, md})
+	}
+
+	sort.Slice(adapters, func(i, j int) bool {
+		return adapters[i].ID < adapters[j].ID
+	})
+
+	return adapters
+}
+
+func (a *Admin) getRoute(routeID string) (persisters.RouteRecord, error) {
+	for _, route := range a.Router.getRouteRecords() {
+		if route.RouteID == routeID {
+			return route, nil
+		}
+	}
+
+	return persisters.RouteRecord{}, ErrRouteNotFound
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	email, err := a.authorizeAdmin(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	if err != nil {
+		writeAdminJSON(w, http.StatusUnauthorized, AdminError{err.Error()})
+
+		return
+	}
+
+	// Switches, adapters and routes are addressed with `/<collection>/<ID>/<action>`
+	collection, rest, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	if a.verbose.Load() && req.Method != http.MethodGet {
+		log.Println("Admin", email, "requested", req.Method, req.URL.Path)
+	}
+
+	switch {
+	case req.Method == http.MethodGet && collection == "switches" && id == "":
+		writeAdminJSON(w, http.StatusOK, a.listSwitches())
+
+	case req.Method == http.MethodPost && collection == "switches" && id != "" && action == "drain":
+		if err := a.Router.drainSwitch(id); err != nil {
+			writeAdminError(w, err)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodGet && collection == "adapters" && id == "":
+		writeAdminJSON(w, http.StatusOK, a.listAdapters())
+
+	case req.Method == http.MethodPost && collection == "adapters" && id != "" && action == "kick":
+		if err := a.Router.kickAdapter(id); err != nil {
+			writeAdminError(w, err)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodGet && collection == "routes" && id == "":
+		writeAdminJSON(w, http.StatusOK, a.Router.getRouteRecords())
+
+	case req.Method == http.MethodGet && collection == "routes" && id != "" && action == "":
+		route, err := a.getRoute(id)
+		if err != nil {
+			writeAdminError(w, err)
+
+			return
+		}
+
+		writeAdminJSON(w, http.StatusOK, route)
+
+	case req.Method == http.MethodDelete && collection == "routes" && id != "" && action == "":
+		if err := a.Router.hangupRoute(id, TerminationReasonAdmin, ""); err != nil {
+			writeAdminError(w, err)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodGet && collection == "cdrs" && id == "":
+		limit := 0
+		if rawLimit := req.URL.Query().Get("limit"); rawLimit != "" {
+			limit, err = strconv.Atoi(rawLimit)
+			if err != nil {
+				writeAdminError(w, ErrInvalidAdminArgs)
+
+				return
+			}
+		}
+
+		// An empty email returns the call detail records of all users
+		cdrs, err := a.Router.persister.GetCallDetailRecords(req.URL.Query().Get("email"), limit)
+		if err != nil {
+			writeAdminError(w, err)
+
+			return
+		}
+
+		writeAdminJSON(w, http.StatusOK, cdrs)
+
+	case req.Method == http.MethodPost && collection == "ca" && id == "rotate":
+		if a.RotateCA == nil {
+			writeAdminError(w, ErrCARotationNotSupported)
+
+			return
+		}
+
+		caPEM, err := a.RotateCA()
+		if err != nil {
+			writeAdminError(w, err)
+
+			return
+		}
+
+		log.Println("Admin", email, "rotated the CA, which node certificates are re-issued with once the control plane restarts")
+
+		writeAdminJSON(w, http.StatusOK, AdminCA{caPEM})
+
+	case req.Method == http.MethodPost && collection == "ca" && id == "retire":
+		if a.RetireCA == nil {
+			writeAdminError(w, ErrCARotationNotSupported)
+
+			return
+		}
+
+		if !a.Router.isRotatingCA() {
+			writeAdminError(w, ErrCARotationNotStarted)
+
+			return
+		}
+
+		// Switches which still hold node certificates of the current CA couldn't register once it is retired
+		if pendingSwitchIDs := a.Router.getPendingNodeCertificates(); len(pendingSwitchIDs) > 0 {
+			writeAdminJSON(w, http.StatusConflict, AdminError{ErrNodeCertificatesNotReissued.Error() + " (" + strings.Join(pendingSwitchIDs, ", ") + ")"})
+
+			return
+		}
+
+		if err := a.RetireCA(); err != nil {
+			writeAdminError(w, err)
+
+			return
+		}
+
+		log.Println("Admin", email, "retired the CA, which is replaced with the next CA once the control plane restarts")
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
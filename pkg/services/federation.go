@@ -0,0 +1,1027 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dominikbraun/graph"
+	"github.com/google/uuid"
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"github.com/pojntfx/saltpanelo/pkg/policies"
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrInvalidFederationPeer      = errors.New("could not load federation peers: Name, URL and token are required")
+	ErrInsecureFederationPeer     = errors.New("could not load federation peers: URL must use HTTPS")
+	ErrFederationUnauthorized     = errors.New("could not authorize federated gateway: Invalid token")
+	ErrForeignCallerNotAllowed    = errors.New("could not answer federated call: Caller's domain is not federated")
+	ErrFederatedCallNotSupported  = errors.New("could not change call: Federated calls can't be held or transferred")
+	ErrFederatedRouteNotFound     = errors.New("could not find federated route")
+	ErrInvalidFederatedRouteID    = errors.New("could not answer federated call: Route ID is not a UUID")
+	ErrFederatedRouteIDInUse      = errors.New("could not answer federated call: Route ID is already in use")
+	ErrNoBorderSwitch             = errors.New("could not find border switch")
+	ErrFederationUnexpectedStatus = errors.New("could not contact federated gateway: Unexpected status")
+)
+
+// FederationPeer is an independent control plane whose users can be called and who can call local users
+type FederationPeer struct {
+	Name  string
+	URL   string
+	Token string
+
+	// Domains are the email domains of the peer's users
+	Domains []string
+
+	// ExportDomains are the local email domains which the peer can look up and call
+	ExportDomains []string
+}
+
+func (p FederationPeer) validate() error {
+	if strings.TrimSpace(p.Name) == "" || strings.TrimSpace(p.URL) == "" || strings.TrimSpace(p.Token) == "" {
+		return ErrInvalidFederationPeer
+	}
+
+	// The token and the call setup must not be sent in plaintext
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(p.URL)), "https://") {
+		return ErrInsecureFederationPeer
+	}
+
+	return nil
+}
+
+// LoadFederationPeers reads a JSON list of federation peers; an empty path returns no peers
+func LoadFederationPeers(peersPath string) ([]FederationPeer, error) {
+	if strings.TrimSpace(peersPath) == "" {
+		return []FederationPeer{}, nil
+	}
+
+	raw, err := os.ReadFile(peersPath)
+	if err != nil {
+		return []FederationPeer{}, err
+	}
+
+	peers := []FederationPeer{}
+	if err := json.Unmarshal(raw, &peers); err != nil {
+		return []FederationPeer{}, err
+	}
+
+	for _, p := range peers {
+		if err := p.validate(); err != nil {
+			return []FederationPeer{}, err
+		}
+	}
+
+	return peers, nil
+}
+
+func getEmailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.ToLower(email[i+1:])
+}
+
+func containsDomain(domains []string, email string) bool {
+	domain := getEmailDomain(email)
+	if domain == "" {
+		return false
+	}
+
+	for _, candidate := range domains {
+		if strings.ToLower(strings.TrimSpace(candidate)) == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ForeignBorder is the border switch of a federated control plane which the first switch in a chain dials
+type ForeignBorder struct {
+	Raddr string
+	Cert  CertPair
+	CAPEM []byte
+}
+
+// BorderRoute is the local half of a federated route; for the callee's half, it contains the address which the border
+// switch of the federated control plane dials it on and the certificate which was issued for the caller's key
+type BorderRoute struct {
+	Raddr   string
+	CertPEM []byte
+	CAPEM   []byte
+}
+
+type federatedDirectory struct {
+	CAPEM     []byte
+	Presences map[string]string
+}
+
+type federatedCallRequest struct {
+	RouteID     string
+	CallerEmail string
+	CalleeEmail string
+	ChannelID   string
+
+	// CSRPEM is the certificate signing request for the key which the caller's border switch dials the callee's with
+	CSRPEM []byte
+}
+
+type federatedCallResponse struct {
+	Accept  bool
+	State   string
+	Raddr   string
+	CertPEM []byte
+	CAPEM   []byte
+}
+
+type federatedHangupRequest struct {
+	RouteID string
+}
+
+type Federation struct {
+	verbose atomic.Bool
+
+	peers        []FederationPeer
+	syncInterval time.Duration
+	rsaBits      int
+
+	client *http.Client
+
+	directoriesLock sync.Mutex
+	directories     map[string]federatedDirectory
+
+	routesLock sync.Mutex
+	routes     map[string]string
+
+	Gateway *Gateway
+}
+
+func NewFederation(
+	verbose bool,
+
+	peers []FederationPeer,
+	syncInterval time.Duration,
+	rsaBits int,
+
+	tlsConfig *tls.Config,
+) *Federation {
+	f := &Federation{
+		peers:        peers,
+		syncInterval: syncInterval,
+		rsaBits:      rsaBits,
+
+		// The gateways of federated control planes are verified with their CAs, and verify this one with its client certificate
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+
+		directories: map[string]federatedDirectory{},
+
+		routes: map[string]string{},
+	}
+	f.verbose.Store(verbose)
+
+	return f
+}
+
+func (f *Federation) SetVerbose(verbose bool) {
+	f.verbose.Store(verbose)
+}
+
+func (f *Federation) Open(ctx context.Context) error {
+	if len(f.peers) < 1 {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(f.syncInterval)
+		defer ticker.Stop()
+
+		for {
+			f.syncDirectories(ctx)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (f *Federation) syncDirectories(ctx context.Context) {
+	for _, peer := range f.peers {
+		reqCtx, cancel := context.WithTimeout(ctx, f.syncInterval)
+
+		var directory federatedDirectory
+		err := f.do(reqCtx, peer, http.MethodGet, "/directory", nil, &directory)
+		cancel()
+		if err != nil {
+			log.Println("Could not sync directory of federated gateway", peer.Name, ", continuing:", err)
+
+			continue
+		}
+
+		// Only keep the entries which belong to the peer's domains
+		presences := map[string]string{}
+		for email, presence := range directory.Presences {
+			if containsDomain(peer.Domains, email) {
+				presences[email] = presence
+			}
+		}
+		directory.Presences = presences
+
+		if f.verbose.Load() {
+			log.Println("Synced directory with", len(presences), "entries from federated gateway", peer.Name)
+		}
+
+		f.directoriesLock.Lock()
+		f.directories[peer.Name] = directory
+		f.directoriesLock.Unlock()
+	}
+}
+
+func (f *Federation) do(ctx context.Context, peer FederationPeer, method, path string, req, res any) error {
+	var body io.Reader
+	if req != nil {
+		raw, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(raw)
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(peer.URL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+
+	hreq.Header.Set("Authorization", "Bearer "+peer.Token)
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hres, err := f.client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hres.Body.Close()
+
+	if hres.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(hres.Body, 1024))
+
+		return fmt.Errorf("%w: %v", ErrFederationUnexpectedStatus, strings.TrimSpace(string(msg)))
+	}
+
+	if res == nil {
+		return nil
+	}
+
+	return json.NewDecoder(hres.Body).Decode(res)
+}
+
+// getPeerForEmail returns the peer whose users include the email
+func (f *Federation) getPeerForEmail(email string) (FederationPeer, bool) {
+	for _, peer := range f.peers {
+		if containsDomain(peer.Domains, email) {
+			return peer, true
+		}
+	}
+
+	return FederationPeer{}, false
+}
+
+func (f *Federation) getPresence(email string) (string, bool) {
+	peer, ok := f.getPeerForEmail(email)
+	if !ok {
+		return "", false
+	}
+
+	f.directoriesLock.Lock()
+	defer f.directoriesLock.Unlock()
+
+	presence, ok := f.directories[peer.Name].Presences[email]
+
+	return presence, ok
+}
+
+func (f *Federation) addRoute(routeID, peerName string) {
+	f.routesLock.Lock()
+	defer f.routesLock.Unlock()
+
+	f.routes[routeID] = peerName
+}
+
+func (f *Federation) isFederated(routeID string) bool {
+	f.routesLock.Lock()
+	defer f.routesLock.Unlock()
+
+	_, ok := f.routes[routeID]
+
+	return ok
+}
+
+func (f *Federation) popRoute(routeID, peerName string) bool {
+	f.routesLock.Lock()
+	defer f.routesLock.Unlock()
+
+	if candidate, ok := f.routes[routeID]; !ok || candidate != peerName {
+		return false
+	}
+
+	delete(f.routes, routeID)
+
+	return true
+}
+
+// onCallFinished tells the peer to unprovision its half of a federated route
+func (f *Federation) onCallFinished(routeID string) {
+	f.routesLock.Lock()
+	peerName, ok := f.routes[routeID]
+	delete(f.routes, routeID)
+	f.routesLock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	for _, peer := range f.peers {
+		if peer.Name != peerName {
+			continue
+		}
+
+		go func(peer FederationPeer) {
+			if err := f.do(context.Background(), peer, http.MethodPost, "/hangup", federatedHangupRequest{routeID}, nil); err != nil {
+				log.Println("Could not hang up federated route with ID", routeID, "on gateway", peer.Name, ", continuing:", err)
+			}
+		}(peer)
+	}
+}
+
+func (f *Federation) getPeerForToken(token string) (FederationPeer, bool) {
+	found := FederationPeer{}
+	ok := false
+	for _, peer := range f.peers {
+		// Compare all tokens to prevent leaking the position of the matching peer
+		if subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+peer.Token)) == 1 {
+			found = peer
+			ok = true
+		}
+	}
+
+	return found, ok
+}
+
+func (f *Federation) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	peer, ok := f.getPeerForToken(req.Header.Get("Authorization"))
+	if !ok {
+		http.Error(w, ErrFederationUnauthorized.Error(), http.StatusUnauthorized)
+
+		return
+	}
+
+	var res any
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/directory":
+		d, err := f.Gateway.getFederatedDirectory(req.Context(), peer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		res = d
+
+	case req.Method == http.MethodPost && req.URL.Path == "/calls":
+		var cr federatedCallRequest
+		if err := json.NewDecoder(req.Body).Decode(&cr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		r, err := f.Gateway.answerFederatedCall(req.Context(), peer, cr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		res = r
+
+	case req.Method == http.MethodPost && req.URL.Path == "/hangup":
+		var hr federatedHangupRequest
+		if err := json.NewDecoder(req.Body).Decode(&hr); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		if !f.popRoute(hr.RouteID, peer.Name) {
+			http.Error(w, ErrFederatedRouteNotFound.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		if err := f.Gateway.unprovisionCall(hr.RouteID, TerminationReasonHangup, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+			return
+		}
+
+		res = struct{}{}
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println("Could not encode federation response, continuing:", err)
+	}
+}
+
+// getFederatedDirectory returns the presences of the local users which the peer can call
+func (g *Gateway) getFederatedDirectory(ctx context.Context, peer FederationPeer) (federatedDirectory, error) {
+	router, err := g.getRouter()
+	if err != nil {
+		return federatedDirectory{}, err
+	}
+
+	caPEM, err := router.GetCertificateAuthority(ctx)
+	if err != nil {
+		return federatedDirectory{}, err
+	}
+
+	g.adaptersLock.Lock()
+	defer g.adaptersLock.Unlock()
+
+	presences := map[string]string{}
+	for _, am := range g.adapters {
+		if !containsDomain(peer.ExportDomains, am.UserEmail) {
+			continue
+		}
+
+		// Like for local lookups, the most reachable device determines the presence
+		if presence, ok := presences[am.UserEmail]; !ok || slices.Index(presenceReachability, am.Presence) < slices.Index(presenceReachability, presence) {
+			presences[am.UserEmail] = am.Presence
+		}
+	}
+
+	return federatedDirectory{
+		CAPEM:     caPEM,
+		Presences: presences,
+	}, nil
+}
+
+// requestFederatedCall forwards a call to the gateway of the federated control plane which the callee belongs to
+func (g *Gateway) requestFederatedCall(ctx context.Context, remoteID string, callerClaims map[string]any, peer FederationPeer, email, channelID string) (RequestCallResult, error) {
+	routeID := uuid.NewString()
+	requestedAt := time.Now()
+
+	if g.verbose.Load() {
+		log.Println("Remote with ID", remoteID, "is requesting a federated call to", email, "on gateway", peer.Name, "with route ID", routeID, "and channel ID", channelID)
+	}
+
+	g.adaptersLock.Lock()
+	sm, ok := g.adapters[remoteID]
+	g.adaptersLock.Unlock()
+
+	if !ok {
+		return RequestCallResult{}, ErrAdapterNotFound
+	}
+
+	caller, ok := g.getPeers()[remoteID]
+	if !ok {
+		return RequestCallResult{}, ErrSrcNotFound
+	}
+
+	if err := g.limiter.Acquire(sm.UserEmail, callerClaims); err != nil {
+		return RequestCallResult{}, err
+	}
+
+	answered := false
+	defer func() {
+		if !answered {
+			g.limiter.Release(sm.UserEmail)
+		}
+	}()
+
+	cdr := persisters.CallDetailRecord{
+		RouteID:     routeID,
+		CallerID:    remoteID,
+		CallerEmail: sm.UserEmail,
+		CalleeEmail: email,
+		ChannelID:   channelID,
+		StartedAt:   requestedAt,
+	}
+
+	// The callee's claims are only known to the remote gateway, which authorizes the call again
+	if allow, rule := g.policies.Authorize(policies.Request{
+		Caller: policies.Identity{
+			Email:  sm.UserEmail,
+			Claims: callerClaims,
+		},
+		Callee: policies.Identity{
+			Email: email,
+		},
+		ChannelID: channelID,
+	}); !allow {
+		if g.verbose.Load() {
+			log.Println("Policy rule", rule, "denied federated call with route ID", routeID, "to", email)
+		}
+
+		g.addCallDetailRecord(cdr, TerminationReasonUnauthorized, "")
+
+		return RequestCallResult{}, ErrCallNotAuthorized
+	}
+
+	// The remote gateway only signs the key which our border switch dials its border switch with, so the key never leaves this control plane
+	csrPEM, borderClientCertPrivKeyPEM, err := utils.GenerateCertificateRequest(g.Federation.rsaBits)
+	if err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return RequestCallResult{}, err
+	}
+
+	cm := &callMetadata{
+		srcID:     remoteID,
+		channelID: channelID,
+		state:     CallStateRinging,
+		cancel:    make(chan struct{}),
+	}
+
+	g.callsLock.Lock()
+	g.calls[routeID] = cm
+	g.callsLock.Unlock()
+
+	defer func() {
+		g.callsLock.Lock()
+		delete(g.calls, routeID)
+		g.callsLock.Unlock()
+	}()
+
+	g.notifyCallState(routeID, channelID, CallStateRinging, &caller, nil)
+
+	// Cancelling the call cancels the request, which makes the remote gateway stop ringing
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-cm.cancel:
+			cancel()
+		case <-reqCtx.Done():
+		}
+	}()
+
+	var res federatedCallResponse
+	err = g.Federation.do(reqCtx, peer, http.MethodPost, "/calls", federatedCallRequest{
+		RouteID:     routeID,
+		CallerEmail: sm.UserEmail,
+		CalleeEmail: email,
+		ChannelID:   channelID,
+		CSRPEM:      csrPEM,
+	}, &res)
+
+	// The call might have been cancelled while we were waiting for the remote gateway
+	failed := false
+	g.callsLock.Lock()
+	if cm.state == CallStateRinging {
+		if err != nil {
+			cm.state = CallStateCancelled
+			failed = true
+		} else {
+			cm.state = res.State
+		}
+	}
+	state := cm.state
+	g.callsLock.Unlock()
+
+	g.notifyCallState(routeID, channelID, state, &caller, nil)
+
+	if failed {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, remoteID)
+
+		return RequestCallResult{}, err
+	}
+
+	if state != CallStateAnswered || !res.Accept {
+		// If the callee answered just as the call was cancelled, the remote half of the route has to be unprovisioned
+		if err == nil && res.Accept {
+			g.Federation.addRoute(routeID, peer.Name)
+			g.Federation.onCallFinished(routeID)
+		}
+
+		terminatedBy := remoteID
+		if state == CallStateDeclined {
+			terminatedBy = ""
+		}
+
+		g.addCallDetailRecord(cdr, state, terminatedBy)
+
+		return RequestCallResult{
+			Accept:  false,
+			RouteID: routeID,
+			State:   state,
+		}, nil
+	}
+
+	answeredAt := time.Now()
+
+	// The remote half of the route is provisioned at this point, so it needs to be unprovisioned if ours can't be
+	g.Federation.addRoute(routeID, peer.Name)
+
+	path, _, err := g.provisionFederatedRoute(ctx, caller, remoteID, routeID, channelID, ForeignBorder{
+		Raddr: res.Raddr,
+		Cert: CertPair{
+			CertPEM:        res.CertPEM,
+			CertPrivKeyPEM: borderClientCertPrivKeyPEM,
+		},
+		CAPEM: res.CAPEM,
+	}, []byte{})
+	if err != nil {
+		g.Federation.onCallFinished(routeID)
+
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return RequestCallResult{}, err
+	}
+
+	cdr.Path = path
+	cdr.SetupLatency = time.Since(answeredAt)
+	cdr.StartedAt = time.Now()
+
+	g.activeCallsLock.Lock()
+	g.activeCalls[routeID] = cdr
+	g.activeCallsLock.Unlock()
+
+	answered = true
+
+	if err := g.persistRoute(cdr, false); err != nil {
+		return RequestCallResult{}, err
+	}
+
+	return RequestCallResult{
+		Accept:  true,
+		RouteID: routeID,
+		State:   CallStateAnswered,
+	}, nil
+}
+
+// reserveFederatedRouteID reserves the route ID which a federated control plane chose for a call; since the peer controls it,
+// IDs which are already used by a local call or route (e.g. one which was federated to the peer) are rejected instead of overwriting it
+func (g *Gateway) reserveFederatedRouteID(ctx context.Context, routeID string) error {
+	if _, err := uuid.Parse(routeID); err != nil {
+		return ErrInvalidFederatedRouteID
+	}
+
+	router, err := g.getRouter()
+	if err != nil {
+		return err
+	}
+
+	path, err := router.GetRoute(ctx, routeID)
+	if err != nil {
+		return err
+	}
+
+	if len(path) > 0 {
+		return ErrFederatedRouteIDInUse
+	}
+
+	// Requested calls are only removed once they are active, so holding the lock while checking the active calls prevents races
+	g.callsLock.Lock()
+	defer g.callsLock.Unlock()
+
+	if _, ok := g.calls[routeID]; ok {
+		return ErrFederatedRouteIDInUse
+	}
+
+	g.activeCallsLock.Lock()
+	_, active := g.activeCalls[routeID]
+	g.activeCallsLock.Unlock()
+
+	g.groupCallsLock.Lock()
+	_, group := g.groupCalls[routeID]
+	g.groupCallsLock.Unlock()
+
+	if active || group {
+		return ErrFederatedRouteIDInUse
+	}
+
+	// The placeholder is replaced once the callees are rung
+	g.calls[routeID] = &callMetadata{
+		state:  CallStateRinging,
+		cancel: make(chan struct{}),
+	}
+
+	return nil
+}
+
+// answerFederatedCall rings the local callee of a call from a federated control plane and provisions the local half of the route
+func (g *Gateway) answerFederatedCall(ctx context.Context, peer FederationPeer, req federatedCallRequest) (federatedCallResponse, error) {
+	if g.verbose.Load() {
+		log.Println("Federated gateway", peer.Name, "is requesting a call from", req.CallerEmail, "to", req.CalleeEmail, "with route ID", req.RouteID, "and channel ID", req.ChannelID)
+	}
+
+	if g.draining.Load() {
+		return federatedCallResponse{}, ErrGatewayDraining
+	}
+
+	if !containsDomain(peer.Domains, req.CallerEmail) {
+		return federatedCallResponse{}, ErrForeignCallerNotAllowed
+	}
+
+	if !containsDomain(peer.ExportDomains, req.CalleeEmail) {
+		return federatedCallResponse{}, ErrDstNotFound
+	}
+
+	// Reject invalid certificate signing requests before ringing the callee
+	if _, err := utils.ParseCertificateRequest(req.CSRPEM); err != nil {
+		return federatedCallResponse{}, err
+	}
+
+	if err := g.limiter.Allow(req.CallerEmail, nil); err != nil {
+		return federatedCallResponse{}, err
+	}
+
+	dstIDs := g.getDeviceIDs(req.CalleeEmail)
+	if len(dstIDs) < 1 {
+		return federatedCallResponse{}, ErrDstNotFound
+	}
+
+	g.adaptersLock.Lock()
+	dms := map[string]AdapterMetadata{}
+	for _, dstID := range dstIDs {
+		if dm, ok := g.adapters[dstID]; ok {
+			dms[dstID] = dm
+		}
+	}
+	g.adaptersLock.Unlock()
+
+	dsts := map[string]AdapterRemote{}
+	for candidateID, candidatePeer := range g.getPeers() {
+		if _, ok := dms[candidateID]; ok {
+			dsts[candidateID] = candidatePeer
+		}
+	}
+
+	if len(dsts) < len(dstIDs) {
+		return federatedCallResponse{}, ErrDstNotFound
+	}
+
+	if err := g.limiter.Acquire(req.CallerEmail, nil); err != nil {
+		return federatedCallResponse{}, err
+	}
+
+	answered := false
+	defer func() {
+		if !answered {
+			g.limiter.Release(req.CallerEmail)
+		}
+	}()
+
+	cdr := persisters.CallDetailRecord{
+		RouteID:     req.RouteID,
+		CallerEmail: req.CallerEmail,
+		CalleeEmail: req.CalleeEmail,
+		ChannelID:   req.ChannelID,
+		StartedAt:   time.Now(),
+	}
+
+	// Foreign callers don't have any claims which the local policies could match
+	dstIDs = g.authorizeCallees(req.RouteID, req.ChannelID, req.CallerEmail, nil, dstIDs, dms)
+	if len(dstIDs) < 1 {
+		g.addCallDetailRecord(cdr, TerminationReasonUnauthorized, "")
+
+		return federatedCallResponse{}, ErrCallNotAuthorized
+	}
+
+	if err := g.reserveFederatedRouteID(ctx, req.RouteID); err != nil {
+		return federatedCallResponse{}, err
+	}
+
+	defer func() {
+		g.callsLock.Lock()
+		delete(g.calls, req.RouteID)
+		g.callsLock.Unlock()
+	}()
+
+	dstID, state, failed, lastErr := g.ringCallees(ctx, req.RouteID, req.ChannelID, "", req.CallerEmail, nil, dstIDs, dsts)
+	if state != CallStateAnswered {
+		if failed {
+			g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+			return federatedCallResponse{}, lastErr
+		}
+
+		g.addCallDetailRecord(cdr, state, "")
+
+		return federatedCallResponse{
+			Accept: false,
+			State:  state,
+		}, nil
+	}
+
+	dst := dsts[dstID]
+	answeredAt := time.Now()
+
+	cdr.CalleeID = dstID
+
+	path, route, err := g.provisionFederatedRoute(ctx, dst, dstID, req.RouteID, req.ChannelID, ForeignBorder{}, req.CSRPEM)
+	if err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return federatedCallResponse{}, err
+	}
+
+	g.Federation.addRoute(req.RouteID, peer.Name)
+
+	cdr.Path = path
+	cdr.SetupLatency = time.Since(answeredAt)
+	cdr.StartedAt = time.Now()
+
+	g.activeCallsLock.Lock()
+	g.activeCalls[req.RouteID] = cdr
+	g.activeCallsLock.Unlock()
+
+	answered = true
+
+	if err := g.persistRoute(cdr, false); err != nil {
+		return federatedCallResponse{}, err
+	}
+
+	return federatedCallResponse{
+		Accept:  true,
+		State:   CallStateAnswered,
+		Raddr:   route.Raddr,
+		CertPEM: route.CertPEM,
+		CAPEM:   route.CAPEM,
+	}, nil
+}
+
+// provisionFederatedRoute benchmarks the adapter against the publicly reachable switches and provisions the path from it
+// to the best border switch; it returns the path and the local half of the federated route
+func (g *Gateway) provisionFederatedRoute(ctx context.Context, remote AdapterRemote, remoteID, routeID, channelID string, foreign ForeignBorder, csrPEM []byte) ([]string, BorderRoute, error) {
+	router, err := g.getRouter()
+	if err != nil {
+		return []string{}, BorderRoute{}, err
+	}
+
+	switches, err := router.GetPubliclyReachableSwitches(ctx)
+	if err != nil {
+		return []string{}, BorderRoute{}, err
+	}
+
+	if err := g.refreshPeerLatency(ctx, router, remote, remoteID, switches); err != nil {
+		return []string{}, BorderRoute{}, err
+	}
+
+	if err := router.RefreshTopology(ctx); err != nil {
+		return []string{}, BorderRoute{}, err
+	}
+
+	if g.verbose.Load() {
+		log.Println("Provisioning federated route with ID", routeID, "for", remoteID)
+	}
+
+	route, err := router.ProvisionBorderRoute(ctx, remoteID, routeID, channelID, foreign, csrPEM)
+	if err != nil {
+		return []string{}, BorderRoute{}, err
+	}
+
+	path, err := router.GetRoute(ctx, routeID)
+	if err != nil {
+		return []string{}, BorderRoute{}, err
+	}
+
+	return path, route, nil
+}
+
+// provisionBorderRoute provisions the path from an adapter to the best border switch; if the foreign border is set, the
+// border switch dials the border switch of the federated control plane, otherwise the federated control plane's border
+// switch dials it on the returned address with the certificate which is issued for the certificate signing request
+func (r *Router) provisionBorderRoute(adapterID, routeID, channelID string, foreign ForeignBorder, csrPEM []byte) (BorderRoute, error) {
+	path, err := r.getBorderPath(adapterID)
+	if err != nil {
+		return BorderRoute{}, err
+	}
+
+	if r.verbose.Load() {
+		log.Println("Provisioning federated route with ID", routeID, "for", adapterID, "through border path", path)
+	}
+
+	_, adapters := r.getAdapters()
+
+	src, ok := adapters[adapterID]
+	if !ok {
+		return BorderRoute{}, ErrAdapterNotFound
+	}
+
+	var f *ForeignBorder
+	if foreign.Raddr != "" {
+		f = &foreign
+	}
+
+	egressLaddr, ingressRaddr, err := r.provisionSwitches(path[1:], routeID, f)
+	if err != nil {
+		r.unprovisionSwitches(path[1:], routeID)
+
+		return BorderRoute{}, err
+	}
+
+	if err := r.provisionPathSrc(src, routeID, channelID, ingressRaddr); err != nil {
+		r.unprovisionSwitches(path[1:], routeID)
+
+		return BorderRoute{}, err
+	}
+
+	route := BorderRoute{
+		CAPEM: r.caPEM,
+	}
+	if f == nil {
+		borderClientCertPEM, err := utils.SignCertificateRequest(r.caCfg, r.caPrivKey, r.callCertValidity, csrPEM, routeID, utils.RoleAdapterClient)
+		if err != nil {
+			r.unprovisionSwitches(path[1:], routeID)
+			_, _ = src.UnprovisionRoute(context.Background(), routeID)
+
+			return BorderRoute{}, err
+		}
+
+		route.Raddr = egressLaddr
+		route.CertPEM = borderClientCertPEM
+	}
+
+	r.routesLock.Lock()
+	r.routes[routeID] = path
+	r.routesLock.Unlock()
+
+	if err := r.updateGraphs(context.Background()); err != nil {
+		return BorderRoute{}, err
+	}
+
+	return route, nil
+}
+
+// getBorderPath returns the cheapest path from the adapter to one of the border switches
+func (r *Router) getBorderPath(adapterID string) ([]string, error) {
+	switches := r.getSwitches()
+
+	r.graphLock.Lock()
+	defer r.graphLock.Unlock()
+
+	var (
+		bestPath   []string
+		bestWeight int
+	)
+	for swID, md := range switches {
+		if !md.Border || md.Draining {
+			continue
+		}
+
+		path, err := graph.ShortestPath(r.graph, adapterID, swID)
+		if err != nil {
+			continue
+		}
+
+		weight, err := getPathWeight(r.graph, path)
+		if err != nil {
+			continue
+		}
+
+		if bestPath == nil || weight < bestWeight {
+			bestPath = path
+			bestWeight = weight
+		}
+	}
+
+	if len(bestPath) < 2 {
+		return []string{}, ErrNoBorderSwitch
+	}
+
+	return bestPath, nil
+}
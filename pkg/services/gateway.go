@@ -2,18 +2,21 @@ package services
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
 	"errors"
 	"log"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
 	"github.com/pojntfx/saltpanelo/pkg/auth"
-	"github.com/pojntfx/saltpanelo/pkg/utils"
+	"github.com/pojntfx/saltpanelo/pkg/limiters"
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"github.com/pojntfx/saltpanelo/pkg/policies"
+	"golang.org/x/exp/slices"
 )
 
 var (
@@ -21,55 +24,190 @@ var (
 	ErrInvalidThroughputTestResultLength = errors.New("received invalid length of throughput test results")
 	ErrSrcNotFound                       = errors.New("could not find source")
 	ErrAdapterNotFound                   = errors.New("could not find adapter")
+	ErrCallNotFound                      = errors.New("could not find call")
+	ErrCallNotRinging                    = errors.New("could not cancel call: Call is not ringing")
+	ErrInvalidPresence                   = errors.New("could not set presence: Unknown presence")
+	ErrCallNotAuthorized                 = errors.New("could not request call: Call is not authorized by policy")
+	ErrNotCaller                         = errors.New("could not cancel call: Only the caller can cancel a call")
+	ErrGroupCallNotFound                 = errors.New("could not find group call")
+	ErrNotGroupCallHost                  = errors.New("could not invite to group call: Only the host can invite to a group call")
+	ErrNotInvitedToGroupCall             = errors.New("could not join group call: User has not been invited")
+	ErrNoGroupCallMembers                = errors.New("could not request group call: No member could join the group call")
+	ErrNotCallParty                      = errors.New("could not change call: Only the caller or callee can change a call")
+	ErrGroupCallNotSupported             = errors.New("could not change call: Group calls can't be held or transferred")
+	ErrGatewayDraining                   = errors.New("could not request call: Gateway is draining")
+)
+
+const (
+	CallStateQueued      = "queued"
+	CallStateRinging     = "ringing"
+	CallStateAnswered    = "answered"
+	CallStateDeclined    = "declined"
+	CallStateCancelled   = "cancelled"
+	CallStateTimedOut    = "timed-out"
+	CallStateRejected    = "rejected"
+	CallStateHeld        = "held"
+	CallStateResumed     = "resumed"
+	CallStateTransferred = "transferred"
+
+	RingStrategyParallel   = "parallel"
+	RingStrategySequential = "sequential"
+
+	TerminationReasonHangup       = "hangup"
+	TerminationReasonDisconnected = "disconnected"
+	TerminationReasonFailed       = "failed"
+	TerminationReasonUnauthorized = "unauthorized"
+	TerminationReasonTransferred  = "transferred"
+	TerminationReasonAdmin        = "admin"
+
+	PresenceAvailable    = "available"
+	PresenceBusy         = "busy"
+	PresenceDoNotDisturb = "dnd"
+	PresenceAway         = "away"
 )
 
 type GatewayRemote struct {
-	RegisterAdapter  func(ctx context.Context, token string) ([]byte, error)
-	RequestCall      func(ctx context.Context, token string, dstID, channelID string) (RequestCallResult, error)
-	HangupCall       func(ctx context.Context, token string, routeID string) error
-	ResolveEmailToID func(ctx context.Context, token string, email string) (string, error)
+	GetRegistrationChallenge func(ctx context.Context) ([]byte, error)
+	RegisterAdapter          func(ctx context.Context, token string, identity NodeIdentity) ([]byte, error)
+	RequestCall              func(ctx context.Context, token string, dstID, channelID string) (RequestCallResult, error)
+	HangupCall               func(ctx context.Context, token string, routeID string) error
+	CancelCall               func(ctx context.Context, token string, routeID string) error
+	ResolveEmailToID         func(ctx context.Context, token string, email string) (string, error)
+	ResolveEmailToIDs        func(ctx context.Context, token string, email string) ([]string, error)
+	RequestCallByEmail       func(ctx context.Context, token string, email, channelID string) (RequestCallResult, error)
+	SetPriority              func(ctx context.Context, token string, priority int) error
+	ListCallHistory          func(ctx context.Context, token string, limit int) ([]persisters.CallDetailRecord, error)
+	SetPresence              func(ctx context.Context, token string, presence string) error
+	GetPresence              func(ctx context.Context, token string, email string) (string, error)
+	RequestGroupCall         func(ctx context.Context, token string, emails []string, channelID string) (RequestGroupCallResult, error)
+	InviteToGroupCall        func(ctx context.Context, token string, routeID string, email string) (RequestGroupCallResult, error)
+	JoinGroupCall            func(ctx context.Context, token string, routeID string) error
+	LeaveGroupCall           func(ctx context.Context, token string, routeID string) error
+	HoldCall                 func(ctx context.Context, token string, routeID string, hold bool) error
+	TransferCall             func(ctx context.Context, token string, routeID string, email string) (RequestCallResult, error)
 }
 
 type RequestCallResult struct {
 	Accept  bool
 	RouteID string
+	State   string
+	DstID   string
+}
+
+type RequestGroupCallResult struct {
+	Accept  bool
+	RouteID string
+	State   string
+	DstIDs  []string
+}
+
+func HandleGatewayClientDisconnect(g *Gateway, remoteID string) error {
+	g.challenges.remove(remoteID)
+
+	adapterID, ok := g.unregisterAdapter(remoteID)
+	if !ok {
+		// The adapter never registered on this connection, or it already registered again on another one
+		return nil
+	}
+
+	// The router keeps the adapter's routes until it reconnects or the reconnect timeout passes
+	return g.onClientDisconnect(adapterID, true)
+}
+
+func SetGatewayVerbose(gateway *Gateway, verbose bool) {
+	gateway.verbose.Store(verbose)
+}
+
+// SetGatewayDraining rejects new calls while the calls which are already pending or answered continue
+func SetGatewayDraining(gateway *Gateway, draining bool) {
+	gateway.draining.Store(draining)
 }
 
-func HandleGatewayClientDisconnect(r *Router, g *Gateway, remoteID string) error {
-	go func() {
-		if err := unprovisionRouteForPeer(r, g, remoteID); err != nil {
-			log.Println("Could not unprovision route for switch with ID", remoteID, ", continuing:", err)
+// GetGatewayCallCount returns the number of calls which are pending or answered
+func GetGatewayCallCount(gateway *Gateway) int {
+	gateway.activeCallsLock.Lock()
+	calls := len(gateway.activeCalls)
+	gateway.activeCallsLock.Unlock()
+
+	gateway.callsLock.Lock()
+	for _, cm := range gateway.calls {
+		if isPendingCallState(cm.state) {
+			calls++
 		}
-	}()
+	}
+	gateway.callsLock.Unlock()
 
-	return g.onClientDisconnect(remoteID)
+	return calls
 }
 
 type AdapterMetadata struct {
 	Latencies   map[string]time.Duration
 	Throughputs map[string]ThroughputResult
 	UserEmail   string
+	Presence    string
+	Priority    int
+
+	claims map[string]any
+}
+
+var presenceReachability = []string{PresenceAvailable, PresenceBusy, PresenceAway, PresenceDoNotDisturb}
+
+type callMetadata struct {
+	srcID     string
+	dstIDs    []string
+	channelID string
+	state     string
+	cancel    chan struct{}
+}
+
+type groupCallMetadata struct {
+	hostID        string
+	hostEmail     string
+	hostClaims    map[string]any
+	channelID     string
+	invitedEmails []string
 }
 
 type Gateway struct {
-	verbose bool
+	verbose  atomic.Bool
+	draining atomic.Bool
 
 	adaptersLock sync.Mutex
 	adapters     map[string]AdapterMetadata
+	adapterIDs   map[string]string // Node IDs of the adapters by the remote IDs of their connections
 
-	auth *auth.OIDCAuthn
+	challenges *registrationChallenges
+
+	callsLock sync.Mutex
+	calls     map[string]*callMetadata
+
+	activeCallsLock sync.Mutex
+	activeCalls     map[string]persisters.CallDetailRecord
 
-	caCfg     *x509.Certificate
-	caPEM     []byte
-	caPrivKey *rsa.PrivateKey
+	groupCallsLock sync.Mutex
+	groupCalls     map[string]*groupCallMetadata
 
-	benchmarkClientCertValidity time.Duration
+	presenceChangesLock sync.Mutex
+	presenceChanges     chan struct{}
 
-	rsaBits int
+	auth *auth.OIDCAuthn
 
+	testTimeout    time.Duration
 	benchmarkLimit int64
 
-	Router *Router
+	ringTimeout       time.Duration
+	ringStrategy      string
+	deviceRingTimeout time.Duration
+
+	adminEmails []string
+
+	policies *policies.PolicyEngine
+	limiter  *limiters.CallLimiter
+
+	Federation *Federation
+
+	// Routers are the routers which the gateway provisions routes through; only the leader accepts gateways, so there is at most one
+	Routers func() map[string]RouterServiceRemote
 
 	Peers func() map[string]AdapterRemote
 }
@@ -80,49 +218,263 @@ func NewGateway(
 	oidcIssuer,
 	oidcClientID string,
 
-	caCfg *x509.Certificate,
-	caPEM []byte,
-	caPrivKey *rsa.PrivateKey,
+	testTimeout time.Duration,
+	benchmarkLimit int64,
 
-	benchmarkClientCertValidity time.Duration,
+	ringTimeout time.Duration,
+	ringStrategy string,
+	deviceRingTimeout time.Duration,
 
-	rsaBits int,
+	adminEmails []string,
 
-	benchmarkLimit int64,
+	policies *policies.PolicyEngine,
+	limiter *limiters.CallLimiter,
 ) *Gateway {
-	return &Gateway{
-		verbose: verbose,
+	g := &Gateway{
+		adapters:   map[string]AdapterMetadata{},
+		adapterIDs: map[string]string{},
+
+		challenges: newRegistrationChallenges(),
 
-		adapters: map[string]AdapterMetadata{},
+		calls: map[string]*callMetadata{},
+
+		activeCalls: map[string]persisters.CallDetailRecord{},
+
+		groupCalls: map[string]*groupCallMetadata{},
+
+		presenceChanges: make(chan struct{}),
 
 		auth: auth.NewOIDCAuthn(oidcIssuer, oidcClientID),
 
-		caCfg:     caCfg,
-		caPEM:     caPEM,
-		caPrivKey: caPrivKey,
+		testTimeout:    testTimeout,
+		benchmarkLimit: benchmarkLimit,
+
+		ringTimeout:       ringTimeout,
+		ringStrategy:      ringStrategy,
+		deviceRingTimeout: deviceRingTimeout,
 
-		benchmarkClientCertValidity: benchmarkClientCertValidity,
+		adminEmails: adminEmails,
 
-		rsaBits: rsaBits,
+		policies: policies,
+		limiter:  limiter,
 	}
+	g.verbose.Store(verbose)
+
+	return g
 }
 
 func (g *Gateway) Open(ctx context.Context) error {
 	return g.auth.Open(ctx)
 }
 
-func (g *Gateway) onClientDisconnect(remoteID string) error {
+// HandleGatewayStepDown forgets the adapters and calls of a gateway whose replica is no longer the leader; the adapters
+// register with the new leader, which restores their calls. It can be called multiple times
+func HandleGatewayStepDown(gateway *Gateway) {
+	gateway.onStepDown()
+}
+
+func (g *Gateway) onStepDown() {
+	g.adaptersLock.Lock()
+	g.adapters = map[string]AdapterMetadata{}
+	g.adapterIDs = map[string]string{}
+	g.adaptersLock.Unlock()
+
+	g.activeCallsLock.Lock()
+	activeCalls := g.activeCalls
+	g.activeCalls = map[string]persisters.CallDetailRecord{}
+	g.activeCallsLock.Unlock()
+
+	// The calls continue on their routes, and count towards the quotas on the new leader instead
+	for _, cdr := range activeCalls {
+		g.limiter.Release(cdr.CallerEmail)
+	}
+
+	g.groupCallsLock.Lock()
+	g.groupCalls = map[string]*groupCallMetadata{}
+	g.groupCallsLock.Unlock()
+}
+
+// getRouter returns the router which the gateway is connected to
+func (g *Gateway) getRouter() (RouterServiceRemote, error) {
+	for _, router := range g.Routers() {
+		return router, nil
+	}
+
+	return RouterServiceRemote{}, ErrRouterNotConnected
+}
+
+// unregisterAdapter returns the node ID of the adapter which registered on the connection with the remote ID
+func (g *Gateway) unregisterAdapter(remoteID string) (string, bool) {
+	g.adaptersLock.Lock()
+	defer g.adaptersLock.Unlock()
+
+	adapterID, ok := g.adapterIDs[remoteID]
+	if ok {
+		delete(g.adapterIDs, remoteID)
+	}
+
+	return adapterID, ok
+}
+
+// getAdapterID returns the node ID of the adapter which is calling, or an empty string if it hasn't registered yet
+func (g *Gateway) getAdapterID(ctx context.Context) string {
+	g.adaptersLock.Lock()
+	defer g.adaptersLock.Unlock()
+
+	return g.adapterIDs[rpc.GetRemoteID(ctx)]
+}
+
+// getPeers returns the registered adapters by their node IDs
+func (g *Gateway) getPeers() map[string]AdapterRemote {
+	peers := g.Peers()
+
+	g.adaptersLock.Lock()
+	defer g.adaptersLock.Unlock()
+
+	adapters := map[string]AdapterRemote{}
+	for remoteID, adapterID := range g.adapterIDs {
+		if peer, ok := peers[remoteID]; ok {
+			adapters[adapterID] = peer
+		}
+	}
+
+	return adapters
+}
+
+func (g *Gateway) onClientDisconnect(remoteID string, disconnected bool) error {
 	g.adaptersLock.Lock()
 
 	delete(g.adapters, remoteID)
 
 	g.adaptersLock.Unlock()
 
-	if g.verbose {
+	// Stop ringing for calls which the disconnected adapter requested
+	g.callsLock.Lock()
+	for _, cm := range g.calls {
+		if cm.srcID == remoteID && isPendingCallState(cm.state) {
+			cm.state = CallStateCancelled
+
+			close(cm.cancel)
+		}
+	}
+	g.callsLock.Unlock()
+
+	// Wake up calls which are queued for the disconnected adapter
+	g.publishPresenceChange()
+
+	if g.verbose.Load() {
 		log.Println("Removed adapter with ID", remoteID, "from topology")
 	}
 
-	return g.Router.updateGraphs(context.Background())
+	router, err := g.getRouter()
+	if err != nil {
+		return err
+	}
+
+	return router.UnregisterAdapter(context.Background(), remoteID, disconnected)
+}
+
+func isPendingCallState(state string) bool {
+	return state == CallStateQueued || state == CallStateRinging
+}
+
+// getPresenceChanges returns a channel which is closed the next time the presence of any adapter changes
+func (g *Gateway) getPresenceChanges() chan struct{} {
+	g.presenceChangesLock.Lock()
+	defer g.presenceChangesLock.Unlock()
+
+	return g.presenceChanges
+}
+
+func (g *Gateway) publishPresenceChange() {
+	g.presenceChangesLock.Lock()
+	defer g.presenceChangesLock.Unlock()
+
+	close(g.presenceChanges)
+
+	g.presenceChanges = make(chan struct{})
+}
+
+// getDeviceIDs returns the IDs of all adapters of a user in the order in which they should ring
+func (g *Gateway) getDeviceIDs(email string) []string {
+	g.adaptersLock.Lock()
+	defer g.adaptersLock.Unlock()
+
+	ids := []string{}
+	for candidateID, am := range g.adapters {
+		if am.UserEmail == email {
+			ids = append(ids, candidateID)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		if g.adapters[ids[i]].Priority == g.adapters[ids[j]].Priority {
+			return ids[i] < ids[j]
+		}
+
+		return g.adapters[ids[i]].Priority < g.adapters[ids[j]].Priority
+	})
+
+	return ids
+}
+
+// getRingableDeviceIDs returns the devices which can ring now and the state of the call if there are none
+func (g *Gateway) getRingableDeviceIDs(dstIDs []string) ([]string, string) {
+	g.adaptersLock.Lock()
+	defer g.adaptersLock.Unlock()
+
+	ringable := []string{}
+	registered := 0
+	queued := 0
+	for _, dstID := range dstIDs {
+		am, ok := g.adapters[dstID]
+		if !ok {
+			continue
+		}
+
+		registered++
+
+		switch am.Presence {
+		case PresenceAvailable:
+			ringable = append(ringable, dstID)
+		case PresenceBusy, PresenceAway:
+			queued++
+		}
+	}
+
+	if len(ringable) > 0 {
+		return ringable, CallStateRinging
+	}
+
+	if registered == 0 {
+		return ringable, CallStateCancelled
+	}
+
+	if queued == 0 {
+		return ringable, CallStateRejected
+	}
+
+	return ringable, CallStateQueued
+}
+
+// waitForPresence blocks until the queued call can ring, has been cancelled, was rejected or timed out
+func (g *Gateway) waitForPresence(cm *callMetadata, timeout <-chan time.Time) ([]string, string) {
+	for {
+		// Subscribe before reading the presence so that we don't miss any changes
+		changes := g.getPresenceChanges()
+
+		if ringable, state := g.getRingableDeviceIDs(cm.dstIDs); state != CallStateQueued {
+			return ringable, state
+		}
+
+		select {
+		case <-changes:
+		case <-cm.cancel:
+			return []string{}, CallStateCancelled
+		case <-timeout:
+			return []string{}, CallStateTimedOut
+		}
+	}
 }
 
 func (g *Gateway) getAdapters() map[string]AdapterMetadata {
@@ -137,36 +489,163 @@ func (g *Gateway) getAdapters() map[string]AdapterMetadata {
 	return a
 }
 
+func (g *Gateway) notifyCallState(routeID, channelID, state string, caller, callee *AdapterRemote) {
+	if g.verbose.Load() {
+		log.Println("Call with route ID", routeID, "and channel ID", channelID, "is", state)
+	}
+
+	for _, candidate := range []struct {
+		remote   *AdapterRemote
+		isCaller bool
+	}{
+		{caller, true},
+		{callee, false},
+	} {
+		if candidate.remote == nil {
+			continue
+		}
+
+		if err := candidate.remote.CallStateChanged(context.Background(), routeID, channelID, state, candidate.isCaller); err != nil {
+			log.Println("Could not notify adapter of state", state, "for call with route ID", routeID, ", continuing:", err)
+		}
+	}
+}
+
+// endCallDetailRecord sets when and why a call ended
+func endCallDetailRecord(cdr persisters.CallDetailRecord, terminationReason, terminatedBy string) persisters.CallDetailRecord {
+	cdr.EndedAt = time.Now()
+	cdr.TerminationReason = terminationReason
+	cdr.TerminatedBy = terminatedBy
+
+	// Only answered calls have a duration
+	if cdr.CalleeID != "" && len(cdr.Path) > 0 {
+		cdr.Duration = cdr.EndedAt.Sub(cdr.StartedAt)
+	}
+
+	return cdr
+}
+
+func (g *Gateway) addCallDetailRecord(cdr persisters.CallDetailRecord, terminationReason, terminatedBy string) {
+	router, err := g.getRouter()
+	if err == nil {
+		err = router.AddCallDetailRecord(context.Background(), endCallDetailRecord(cdr, terminationReason, terminatedBy))
+	}
+
+	if err != nil {
+		log.Println("Could not persist call detail record for route ID", cdr.RouteID, ", continuing:", err)
+	}
+}
+
+// finishCall writes the call detail record for an answered call once its route has been unprovisioned
+func (g *Gateway) finishCall(routeID, terminationReason, terminatedBy string, transferred int64) {
+	g.activeCallsLock.Lock()
+	cdr, ok := g.activeCalls[routeID]
+	if ok {
+		delete(g.activeCalls, routeID)
+	}
+	g.activeCallsLock.Unlock()
+
+	g.groupCallsLock.Lock()
+	delete(g.groupCalls, routeID)
+	g.groupCallsLock.Unlock()
+
+	g.Federation.onCallFinished(routeID)
+
+	if !ok {
+		return
+	}
+
+	cdr.Bytes = transferred
+
+	g.limiter.Release(cdr.CallerEmail)
+
+	g.addCallDetailRecord(cdr, terminationReason, terminatedBy)
+}
+
+// getCallRouteIDs returns the routes of the calls which are being requested
+func (g *Gateway) getCallRouteIDs() []string {
+	g.callsLock.Lock()
+	defer g.callsLock.Unlock()
+
+	routeIDs := []string{}
+	for routeID := range g.calls {
+		routeIDs = append(routeIDs, routeID)
+	}
+
+	return routeIDs
+}
+
+// restoreCall tracks a call again once the router reconciled its route after the control plane restarted
+func (g *Gateway) restoreCall(cdr persisters.CallDetailRecord) {
+	// Restored calls count towards the caller's quota again, even if it is exceeded, since they are released once they finish
+	g.limiter.Restore(cdr.CallerEmail)
+
+	g.activeCallsLock.Lock()
+	g.activeCalls[cdr.RouteID] = cdr
+	g.activeCallsLock.Unlock()
+}
+
+// persistRoute records an active call's route so that it can be reconciled if the control plane restarts or fails over; if
+// the route can't be persisted (e.g. because a quorum of replicas didn't store it), the call is hung up since it would be lost
+func (g *Gateway) persistRoute(cdr persisters.CallDetailRecord, group bool) error {
+	router, err := g.getRouter()
+	if err == nil {
+		err = router.PersistRoute(context.Background(), persisters.RouteRecord{
+			RouteID:    cdr.RouteID,
+			ChannelID:  cdr.ChannelID,
+			Path:       append([]string{}, cdr.Path...),
+			Group:      group,
+			ActiveCall: cdr,
+		})
+	}
+
+	if err != nil {
+		log.Println("Could not persist route with ID", cdr.RouteID, ", hanging up:", err)
+
+		// Finishing the call releases its quota
+		if err := g.unprovisionCall(cdr.RouteID, TerminationReasonFailed, ""); err != nil {
+			log.Println("Could not unprovision route with ID", cdr.RouteID, ", continuing:", err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// refreshPeerLatency benchmarks the adapter against the switches with a benchmark client certificate which the router issues
 func (g *Gateway) refreshPeerLatency(
 	ctx context.Context,
 
+	router RouterServiceRemote,
+
 	remote AdapterRemote,
 	remoteID string,
 
-	addrs []string,
-	swIDs []string,
+	switches map[string]SwitchMetadata,
 ) error {
-	benchmarkClientCertPEM, benchmarkClientPrivKeyPEM, err := utils.GenerateCertificate(g.rsaBits, g.caCfg, g.caPrivKey, g.benchmarkClientCertValidity, "", "", utils.RoleBenchmarkClient)
+	addrs := []string{}
+	swIDs := []string{}
+	for swID, sw := range switches {
+		addrs = append(addrs, sw.Addr)
+		swIDs = append(swIDs, swID)
+	}
+
+	benchmarkClientCert, err := router.IssueBenchmarkCertificate(ctx)
 	if err != nil {
 		return err
 	}
 
-	rawLatencies, err := remote.TestLatency(ctx, g.Router.testTimeout, addrs, CertPair{
-		CertPEM:        benchmarkClientCertPEM,
-		CertPrivKeyPEM: benchmarkClientPrivKeyPEM,
-	})
+	rawLatencies, err := remote.TestLatency(ctx, g.testTimeout, addrs, benchmarkClientCert)
 	if err != nil {
 		return err
 	}
 
 	rawThroughputs, err := remote.TestThroughput(
 		ctx,
-		g.Router.testTimeout,
+		g.testTimeout,
 		addrs,
-		CertPair{
-			CertPEM:        benchmarkClientCertPEM,
-			CertPrivKeyPEM: benchmarkClientPrivKeyPEM,
-		},
+		benchmarkClientCert,
 		g.benchmarkLimit,
 	)
 	if err != nil {
@@ -214,225 +693,653 @@ func (g *Gateway) refreshPeerLatency(
 	return nil
 }
 
-func (g *Gateway) RegisterAdapter(ctx context.Context, token string) ([]byte, error) {
-	email, err := g.auth.Validate(token)
+func (g *Gateway) GetRegistrationChallenge(ctx context.Context) ([]byte, error) {
+	return g.challenges.issue(rpc.GetRemoteID(ctx))
+}
+
+func (g *Gateway) RegisterAdapter(ctx context.Context, token string, identity NodeIdentity) ([]byte, error) {
+	email, claims, err := g.auth.ValidateWithClaims(token)
 	if err != nil {
 		return []byte{}, err
 	}
 
 	remoteID := rpc.GetRemoteID(ctx)
 
+	adapterID, err := g.challenges.verify(remoteID, identity)
+	if err != nil {
+		return []byte{}, err
+	}
+
 	g.adaptersLock.Lock()
 
-	if _, ok := g.adapters[remoteID]; ok {
+	if _, ok := g.adapterIDs[remoteID]; ok {
 		g.adaptersLock.Unlock()
 
 		return []byte{}, ErrAdapterAlreadyRegistered
 	}
 
-	g.adapters[remoteID] = AdapterMetadata{
+	// An adapter which registers again before its previous connection timed out takes over its node ID
+	for candidateID, candidateAdapterID := range g.adapterIDs {
+		if candidateAdapterID == adapterID {
+			delete(g.adapterIDs, candidateID)
+		}
+	}
+
+	g.adapterIDs[remoteID] = adapterID
+
+	g.adapters[adapterID] = AdapterMetadata{
 		map[string]time.Duration{},
 		map[string]ThroughputResult{},
 		email,
+		PresenceAvailable,
+		0,
+		claims,
 	}
 
-	if g.verbose {
-		log.Println("Added adapter with ID", remoteID, "to topology")
+	if g.verbose.Load() {
+		log.Println("Added adapter with ID", adapterID, "to topology")
 	}
 
 	g.adaptersLock.Unlock()
 
-	if err := g.Router.updateGraphs(context.Background()); err != nil {
+	router, err := g.getRouter()
+	if err != nil {
 		return []byte{}, err
 	}
 
-	return g.caPEM, nil
+	// The router resumes and reconciles the routes which the adapter had before it lost its connection or the control plane restarted
+	return router.RegisterAdapter(ctx, adapterID, email)
 }
 
 func (g *Gateway) RequestCall(ctx context.Context, token string, dstID, channelID string) (RequestCallResult, error) {
-	if _, err := g.auth.Validate(token); err != nil {
+	email, claims, err := g.auth.ValidateWithClaims(token)
+	if err != nil {
 		return RequestCallResult{}, err
 	}
 
-	remoteID := rpc.GetRemoteID(ctx)
-	routeID := uuid.NewString()
+	if g.draining.Load() {
+		return RequestCallResult{}, ErrGatewayDraining
+	}
 
-	g.adaptersLock.Lock()
+	// Check the rate limit before ringing or benchmarking since both are expensive
+	if err := g.limiter.Allow(email, claims); err != nil {
+		return RequestCallResult{}, err
+	}
 
-	if g.verbose {
-		log.Println("Remote with ID", remoteID, "is requesting a call with ID", dstID, "with route ID", routeID, "and channel ID", channelID)
+	return g.requestCall(ctx, g.getAdapterID(ctx), claims, []string{dstID}, channelID)
+}
+
+func (g *Gateway) RequestCallByEmail(ctx context.Context, token string, email, channelID string) (RequestCallResult, error) {
+	callerEmail, claims, err := g.auth.ValidateWithClaims(token)
+	if err != nil {
+		return RequestCallResult{}, err
 	}
 
-	sm, ok := g.adapters[remoteID]
-	if !ok {
-		g.adaptersLock.Unlock()
+	if g.draining.Load() {
+		return RequestCallResult{}, ErrGatewayDraining
+	}
 
-		return RequestCallResult{}, ErrAdapterNotFound
+	// Check the rate limit before ringing or benchmarking since both are expensive
+	if err := g.limiter.Allow(callerEmail, claims); err != nil {
+		return RequestCallResult{}, err
 	}
 
-	if _, ok := g.adapters[dstID]; !ok {
-		g.adaptersLock.Unlock()
+	adapterID := g.getAdapterID(ctx)
+
+	// Users can call their other devices, but not the device they are calling from
+	dstIDs := []string{}
+	for _, dstID := range g.getDeviceIDs(email) {
+		if dstID != adapterID {
+			dstIDs = append(dstIDs, dstID)
+		}
+	}
+
+	if len(dstIDs) < 1 {
+		// Users of federated control planes are called through their own gateway
+		if peer, ok := g.Federation.getPeerForEmail(email); ok {
+			return g.requestFederatedCall(ctx, adapterID, claims, peer, email, channelID)
+		}
 
 		return RequestCallResult{}, ErrDstNotFound
 	}
 
-	if remoteID == dstID {
+	return g.requestCall(ctx, adapterID, claims, dstIDs, channelID)
+}
+
+func (g *Gateway) requestCall(ctx context.Context, adapterID string, callerClaims map[string]any, dstIDs []string, channelID string) (RequestCallResult, error) {
+	routeID := uuid.NewString()
+	requestedAt := time.Now()
+
+	g.adaptersLock.Lock()
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "is requesting a call with IDs", dstIDs, "with route ID", routeID, "and channel ID", channelID)
+	}
+
+	sm, ok := g.adapters[adapterID]
+	if !ok {
 		g.adaptersLock.Unlock()
 
-		return RequestCallResult{}, ErrDstIsSrc
+		return RequestCallResult{}, ErrAdapterNotFound
 	}
 
-	g.adaptersLock.Unlock()
-	var dst *AdapterRemote
-	for candidateID, callee := range g.Peers() {
-		if dstID == candidateID {
-			dst = &callee
+	dstEmail := ""
+	dms := map[string]AdapterMetadata{}
+	for _, dstID := range dstIDs {
+		dm, ok := g.adapters[dstID]
+		if !ok {
+			g.adaptersLock.Unlock()
 
-			break
+			return RequestCallResult{}, ErrDstNotFound
 		}
-	}
-	g.adaptersLock.Lock()
 
-	if dst == nil {
-		return RequestCallResult{}, ErrDstNotFound
-	}
+		dstEmail = dm.UserEmail
+		dms[dstID] = dm
 
-	addrs := []string{}
-	swIDs := []string{}
-	for swID, sw := range g.Router.getSwitches() {
-		addrs = append(addrs, sw.Addr)
-		swIDs = append(swIDs, swID)
+		if adapterID == dstID {
+			g.adaptersLock.Unlock()
+
+			return RequestCallResult{}, ErrDstIsSrc
+		}
 	}
 
 	g.adaptersLock.Unlock()
 
-	accept, err := dst.RequestCall(
-		ctx,
-		remoteID,
-		sm.UserEmail,
-		routeID,
-		channelID,
-	)
-	if err != nil {
+	if err := g.limiter.Acquire(sm.UserEmail, callerClaims); err != nil {
 		return RequestCallResult{}, err
 	}
 
-	if !accept {
-		return RequestCallResult{}, nil
-	}
+	// Answered calls count towards the quota until they are finished
+	answered := false
+	defer func() {
+		if !answered {
+			g.limiter.Release(sm.UserEmail)
+		}
+	}()
+
+	var caller *AdapterRemote
+	dsts := map[string]AdapterRemote{}
+	for candidateID, candidatePeer := range g.getPeers() {
+		if adapterID == candidateID {
+			c := candidatePeer
 
-	var caller AdapterRemote
-	found := false
-	for candidateID, candidatePeer := range g.Peers() {
-		if remoteID == candidateID {
-			caller = candidatePeer
+			caller = &c
 
-			found = true
+			continue
+		}
 
-			break
+		if slices.Contains(dstIDs, candidateID) {
+			dsts[candidateID] = candidatePeer
 		}
 	}
 
-	if !found {
+	if len(dsts) < len(dstIDs) {
+		return RequestCallResult{}, ErrDstNotFound
+	}
+
+	if caller == nil {
 		return RequestCallResult{}, ErrSrcNotFound
 	}
 
+	router, err := g.getRouter()
+	if err != nil {
+		return RequestCallResult{}, err
+	}
+
+	switches, err := router.GetPubliclyReachableSwitches(ctx)
+	if err != nil {
+		return RequestCallResult{}, err
+	}
+
+	cdr := persisters.CallDetailRecord{
+		RouteID:     routeID,
+		CallerID:    adapterID,
+		CallerEmail: sm.UserEmail,
+		CalleeEmail: dstEmail,
+		ChannelID:   channelID,
+		StartedAt:   requestedAt,
+	}
+
+	// Only ring the devices which the caller is allowed to call
+	dstIDs = g.authorizeCallees(routeID, channelID, sm.UserEmail, callerClaims, dstIDs, dms)
+	if len(dstIDs) < 1 {
+		g.addCallDetailRecord(cdr, TerminationReasonUnauthorized, "")
+
+		return RequestCallResult{}, ErrCallNotAuthorized
+	}
+
+	defer func() {
+		g.callsLock.Lock()
+		delete(g.calls, routeID)
+		g.callsLock.Unlock()
+	}()
+
+	dstID, state, failed, lastErr := g.ringCallees(ctx, routeID, channelID, adapterID, sm.UserEmail, caller, dstIDs, dsts)
+	if state != CallStateAnswered {
+		// If ringing failed for all devices, return the error like for a single device
+		if failed {
+			g.addCallDetailRecord(cdr, TerminationReasonFailed, adapterID)
+
+			return RequestCallResult{}, lastErr
+		}
+
+		terminatedBy := adapterID
+		if state == CallStateDeclined {
+			terminatedBy = ""
+		}
+
+		g.addCallDetailRecord(cdr, state, terminatedBy)
+
+		return RequestCallResult{
+			Accept:  false,
+			RouteID: routeID,
+			State:   state,
+		}, nil
+	}
+
+	dst := dsts[dstID]
+	answeredAt := time.Now()
+
+	cdr.CalleeID = dstID
+
 	if err := g.refreshPeerLatency(
 		ctx,
 
-		*dst,
+		router,
+
+		dst,
 		dstID,
 
-		addrs,
-		swIDs,
+		switches,
 	); err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
 		return RequestCallResult{}, err
 	}
 
 	if err := g.refreshPeerLatency(
 		ctx,
 
-		caller,
-		remoteID,
+		router,
 
-		addrs,
-		swIDs,
+		*caller,
+		adapterID,
+
+		switches,
 	); err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
 		return RequestCallResult{}, err
 	}
 
-	if g.verbose {
+	if g.verbose.Load() {
 		log.Println("Finished requesting call for ID", dstID)
 	}
 
-	if err := g.Router.updateGraphs(context.Background()); err != nil {
+	if err := router.RefreshTopology(ctx); err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return RequestCallResult{}, err
+	}
+
+	if err := router.ProvisionRoute(ctx, adapterID, dstID, routeID, channelID); err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
 		return RequestCallResult{}, err
 	}
 
-	if err := g.Router.provisionRoute(remoteID, dstID, routeID, channelID); err != nil {
+	cdr.Path, err = router.GetRoute(ctx, routeID)
+	if err != nil {
+		log.Println("Could not get path of route with ID", routeID, ", continuing:", err)
+	}
+	cdr.SetupLatency = time.Since(answeredAt)
+	cdr.StartedAt = time.Now()
+
+	g.activeCallsLock.Lock()
+	g.activeCalls[routeID] = cdr
+	g.activeCallsLock.Unlock()
+
+	answered = true
+
+	if err := g.persistRoute(cdr, false); err != nil {
 		return RequestCallResult{}, err
 	}
 
 	return RequestCallResult{
 		Accept:  true,
 		RouteID: routeID,
+		State:   CallStateAnswered,
+		DstID:   dstID,
 	}, nil
 }
 
-func (g *Gateway) HangupCall(ctx context.Context, token string, routeID string) error {
-	if _, err := g.auth.Validate(token); err != nil {
-		return err
+// authorizeCallees returns the devices which the caller is allowed to call
+func (g *Gateway) authorizeCallees(routeID, channelID, callerEmail string, callerClaims map[string]any, dstIDs []string, dms map[string]AdapterMetadata) []string {
+	authorizedDstIDs := []string{}
+	for _, dstID := range dstIDs {
+		if allow, rule := g.policies.Authorize(policies.Request{
+			Caller: policies.Identity{
+				Email:  callerEmail,
+				Claims: callerClaims,
+			},
+			Callee: policies.Identity{
+				Email:  dms[dstID].UserEmail,
+				Claims: dms[dstID].claims,
+			},
+			ChannelID: channelID,
+		}); !allow {
+			if g.verbose.Load() {
+				log.Println("Policy rule", rule, "denied call with route ID", routeID, "to ID", dstID)
+			}
+
+			continue
+		}
+
+		authorizedDstIDs = append(authorizedDstIDs, dstID)
 	}
 
-	remoteID := rpc.GetRemoteID(ctx)
+	return authorizedDstIDs
+}
+
+// ringCallees rings the devices until one of them answers and returns its ID, the final state of the call and whether ringing failed for all devices
+func (g *Gateway) ringCallees(
+	ctx context.Context,
+
+	routeID,
+	channelID,
+
+	srcID,
+	srcEmail string,
+	caller *AdapterRemote,
+
+	dstIDs []string,
+	dsts map[string]AdapterRemote,
+) (string, string, bool, error) {
+	ringable, state := g.getRingableDeviceIDs(dstIDs)
+	if state == CallStateRejected || state == CallStateCancelled {
+		if g.verbose.Load() {
+			log.Println("Rejecting call with route ID", routeID, "since no callee with IDs", dstIDs, "wants to be disturbed")
+		}
 
-	if g.verbose {
-		log.Println("Unprovisioning route with route ID", routeID)
+		return "", CallStateRejected, false, nil
 	}
 
-	g.Router.routesLock.Lock()
+	cm := &callMetadata{
+		srcID:     srcID,
+		dstIDs:    dstIDs,
+		channelID: channelID,
+		state:     state,
+		cancel:    make(chan struct{}),
+	}
 
-	routerPeers := g.Router.Peers()
-	gatewayPeers := g.Peers()
+	// The caller removes the call once it has been provisioned
+	g.callsLock.Lock()
+	g.calls[routeID] = cm
+	g.callsLock.Unlock()
 
-	switchesToClose := map[string][]SwitchRemote{}
-	adaptersToClose := map[string][]AdapterRemote{}
+	timeout := time.NewTimer(g.ringTimeout)
+	defer timeout.Stop()
 
-	route, ok := g.Router.routes[routeID]
-	if !ok {
-		g.Router.routesLock.Unlock()
+	if state == CallStateQueued {
+		// The callees don't know about queued calls yet, so we only notify the caller
+		g.notifyCallState(routeID, channelID, CallStateQueued, caller, nil)
+
+		ringable, state = g.waitForPresence(cm, timeout.C)
+
+		g.callsLock.Lock()
+		if cm.state == CallStateQueued {
+			cm.state = state
+		}
+		state = cm.state
+		g.callsLock.Unlock()
+
+		if state != CallStateRinging {
+			g.notifyCallState(routeID, channelID, state, caller, nil)
 
-		return ErrRouteNotFound
+			return "", state, false, nil
+		}
 	}
 
-	for _, candidateID := range route {
-		if sw, ok := routerPeers[candidateID]; ok {
-			if _, ok := switchesToClose[routeID]; !ok {
-				switchesToClose[routeID] = []SwitchRemote{}
-			}
+	g.notifyCallState(routeID, channelID, CallStateRinging, caller, nil)
 
-			switchesToClose[routeID] = append(switchesToClose[routeID], sw)
+	type requestCallResponse struct {
+		dstID  string
+		accept bool
+		err    error
+	}
+
+	responses := make(chan requestCallResponse, len(ringable))
+
+	ringing := map[string]struct{}{}
+	rung := []string{}
+	stopped := map[string]struct{}{}
+	next := 0
+	ringNext := func() {
+		dstID := ringable[next]
+		dst := dsts[dstID]
+
+		next++
+
+		ringing[dstID] = struct{}{}
+		rung = append(rung, dstID)
+
+		g.notifyCallState(routeID, channelID, CallStateRinging, nil, &dst)
+
+		go func() {
+			accept, err := dst.RequestCall(
+				ctx,
+				srcID,
+				srcEmail,
+				routeID,
+				channelID,
+			)
+
+			responses <- requestCallResponse{dstID, accept, err}
+		}()
+	}
+
+	var (
+		deviceTimeout  *time.Ticker
+		deviceTimeouts <-chan time.Time
+	)
+	if g.ringStrategy == RingStrategySequential {
+		ringNext()
+
+		deviceTimeout = time.NewTicker(g.deviceRingTimeout)
+		defer deviceTimeout.Stop()
+
+		deviceTimeouts = deviceTimeout.C
+	} else {
+		for next < len(ringable) {
+			ringNext()
 		}
+	}
+
+	var (
+		dstID     string
+		declined  bool
+		failed    bool
+		lastErr   error
+		lastState string
+	)
+	for lastState == "" {
+		select {
+		case res := <-responses:
+			// Ignore late responses from devices which we've stopped ringing
+			if _, ok := ringing[res.dstID]; !ok {
+				continue
+			}
+
+			delete(ringing, res.dstID)
+
+			if res.err != nil {
+				log.Println("Could not ring device with ID", res.dstID, "for call with route ID", routeID, ", continuing:", res.err)
+
+				lastErr = res.err
+			} else if res.accept {
+				dstID = res.dstID
+				lastState = CallStateAnswered
+
+				break
+			} else {
+				declined = true
+			}
+
+			if len(ringing) > 0 {
+				continue
+			}
+
+			if next < len(ringable) {
+				ringNext()
+
+				if deviceTimeout != nil {
+					deviceTimeout.Reset(g.deviceRingTimeout)
+				}
+
+				continue
+			}
+
+			if !declined && lastErr != nil {
+				failed = true
+				lastState = CallStateCancelled
+
+				break
+			}
+
+			lastState = CallStateDeclined
+		case <-deviceTimeouts:
+			if next >= len(ringable) {
+				continue
+			}
+
+			// Move on to the next device and stop ringing the current ones
+			for candidateID := range ringing {
+				dst := dsts[candidateID]
 
-		if ad, ok := gatewayPeers[candidateID]; ok {
-			if _, ok := adaptersToClose[routeID]; !ok {
-				adaptersToClose[routeID] = []AdapterRemote{}
+				g.notifyCallState(routeID, channelID, CallStateCancelled, nil, &dst)
+
+				delete(ringing, candidateID)
+				stopped[candidateID] = struct{}{}
 			}
 
-			adaptersToClose[routeID] = append(adaptersToClose[routeID], ad)
+			ringNext()
+		case <-cm.cancel:
+			lastState = CallStateCancelled
+		case <-ctx.Done():
+			// Federated calls are cancelled by the remote gateway
+			lastState = CallStateCancelled
+		case <-timeout.C:
+			lastState = CallStateTimedOut
+		}
+	}
+
+	// The call might have been cancelled while we were waiting for the callees
+	g.callsLock.Lock()
+	if cm.state == CallStateRinging {
+		cm.state = lastState
+	}
+	state = cm.state
+	g.callsLock.Unlock()
+
+	g.notifyCallState(routeID, channelID, state, caller, nil)
+
+	for _, candidateID := range rung {
+		// We've already notified devices which we've moved on from
+		if _, ok := stopped[candidateID]; ok {
+			continue
+		}
+
+		dst := dsts[candidateID]
+
+		// The first device to accept wins and the others stop ringing
+		if state == CallStateAnswered && candidateID != dstID {
+			g.notifyCallState(routeID, channelID, CallStateCancelled, nil, &dst)
+
+			continue
+		}
+
+		g.notifyCallState(routeID, channelID, state, nil, &dst)
+	}
+
+	return dstID, state, failed && state == CallStateCancelled, lastErr
+}
+
+func (g *Gateway) CancelCall(ctx context.Context, token string, routeID string) error {
+	if _, err := g.auth.Validate(token); err != nil {
+		return err
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "is cancelling call with route ID", routeID)
+	}
+
+	g.callsLock.Lock()
+	defer g.callsLock.Unlock()
+
+	cm, ok := g.calls[routeID]
+	if !ok {
+		return ErrCallNotFound
+	}
+
+	if cm.srcID != adapterID {
+		return ErrNotCaller
+	}
+
+	if !isPendingCallState(cm.state) {
+		return ErrCallNotRinging
+	}
+
+	cm.state = CallStateCancelled
+
+	close(cm.cancel)
+
+	return nil
+}
+
+func (g *Gateway) HangupCall(ctx context.Context, token string, routeID string) error {
+	if _, err := g.auth.Validate(token); err != nil {
+		return err
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	// Members of group calls only leave the call when they hang up
+	if gcm, ok := g.getGroupCall(routeID); ok && gcm.hostID != adapterID {
+		router, err := g.getRouter()
+		if err != nil {
+			return err
 		}
+
+		return router.LeaveGroupRoute(ctx, routeID, adapterID)
+	}
+
+	// Otherwise any adapter which knows the route ID could hang up other adapters' calls
+	if _, err := g.getCallOfParty(routeID, adapterID); err != nil {
+		return err
 	}
 
-	delete(g.Router.routes, routeID)
+	return g.unprovisionCall(routeID, TerminationReasonHangup, adapterID)
+}
 
-	g.Router.routesLock.Unlock()
+func (g *Gateway) unprovisionCall(routeID, terminationReason, remoteID string) error {
+	if g.verbose.Load() {
+		log.Println("Unprovisioning call with route ID", routeID)
+	}
 
-	unprovisionSwitchesAndAdapters(switchesToClose, adaptersToClose, remoteID)
+	router, err := g.getRouter()
+	if err != nil {
+		return err
+	}
 
-	if err := g.Router.updateGraphs(context.Background()); err != nil {
+	transferred, err := router.UnprovisionRoute(context.Background(), routeID, remoteID)
+	if err != nil {
 		return err
 	}
 
+	g.finishCall(routeID, terminationReason, remoteID, transferred)
+
 	return nil
 }
 
@@ -441,25 +1348,804 @@ func (g *Gateway) ResolveEmailToID(ctx context.Context, token string, email stri
 		return "", err
 	}
 
-	if g.verbose {
+	if g.verbose.Load() {
 		log.Println("Looking up ID for email", email)
 	}
 
+	ids := g.getDeviceIDs(email)
+	if len(ids) < 1 || strings.TrimSpace(ids[0]) == "" {
+		return "", ErrAdapterNotFound
+	}
+
+	return ids[0], nil
+}
+
+func (g *Gateway) ResolveEmailToIDs(ctx context.Context, token string, email string) ([]string, error) {
+	if _, err := g.auth.Validate(token); err != nil {
+		return []string{}, err
+	}
+
+	if g.verbose.Load() {
+		log.Println("Looking up IDs for email", email)
+	}
+
+	ids := g.getDeviceIDs(email)
+	if len(ids) < 1 {
+		return []string{}, ErrAdapterNotFound
+	}
+
+	return ids, nil
+}
+
+func (g *Gateway) SetPriority(ctx context.Context, token string, priority int) error {
+	if _, err := g.auth.Validate(token); err != nil {
+		return err
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	g.adaptersLock.Lock()
+	defer g.adaptersLock.Unlock()
+
+	am, ok := g.adapters[adapterID]
+	if !ok {
+		return ErrAdapterNotFound
+	}
+
+	am.Priority = priority
+
+	g.adapters[adapterID] = am
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "changed its priority to", priority)
+	}
+
+	return nil
+}
+
+func (g *Gateway) SetPresence(ctx context.Context, token string, presence string) error {
+	if _, err := g.auth.Validate(token); err != nil {
+		return err
+	}
+
+	switch presence {
+	case PresenceAvailable, PresenceBusy, PresenceDoNotDisturb, PresenceAway:
+	default:
+		return ErrInvalidPresence
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	g.adaptersLock.Lock()
+
+	am, ok := g.adapters[adapterID]
+	if !ok {
+		g.adaptersLock.Unlock()
+
+		return ErrAdapterNotFound
+	}
+
+	am.Presence = presence
+
+	g.adapters[adapterID] = am
+
+	g.adaptersLock.Unlock()
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "changed its presence to", presence)
+	}
+
+	g.publishPresenceChange()
+
+	return nil
+}
+
+func (g *Gateway) GetPresence(ctx context.Context, token string, email string) (string, error) {
+	if _, err := g.auth.Validate(token); err != nil {
+		return "", err
+	}
+
+	if g.verbose.Load() {
+		log.Println("Looking up presence for email", email)
+	}
+
 	g.adaptersLock.Lock()
 	defer g.adaptersLock.Unlock()
 
-	id := ""
-	for candidateID, sm := range g.adapters {
-		if sm.UserEmail == email {
-			id = candidateID
+	// If a user has multiple devices, the most reachable one determines the presence
+	presence := ""
+	for _, am := range g.adapters {
+		if am.UserEmail != email {
+			continue
+		}
 
-			break
+		if presence == "" || slices.Index(presenceReachability, am.Presence) < slices.Index(presenceReachability, presence) {
+			presence = am.Presence
 		}
 	}
 
-	if strings.TrimSpace(id) == "" {
+	if presence == "" {
+		if presence, ok := g.Federation.getPresence(email); ok {
+			return presence, nil
+		}
+
 		return "", ErrAdapterNotFound
 	}
 
-	return id, nil
+	return presence, nil
+}
+
+func (g *Gateway) ListCallHistory(ctx context.Context, token string, limit int) ([]persisters.CallDetailRecord, error) {
+	email, claims, err := g.auth.ValidateWithClaims(token)
+	if err != nil {
+		return []persisters.CallDetailRecord{}, err
+	}
+
+	if g.verbose.Load() {
+		log.Println("Listing call history for email", email)
+	}
+
+	router, err := g.getRouter()
+	if err != nil {
+		return []persisters.CallDetailRecord{}, err
+	}
+
+	// Admins can see the calls of all users if their identity provider verified their email
+	if slices.Contains(g.adminEmails, email) && auth.IsEmailVerified(claims) {
+		return router.GetCallDetailRecords(ctx, "", limit)
+	}
+
+	return router.GetCallDetailRecords(ctx, email, limit)
+}
+
+// refreshGroupLatencies benchmarks the adapters of a group call and returns the IDs of the adapters which could be benchmarked
+func (g *Gateway) refreshGroupLatencies(ctx context.Context, router RouterServiceRemote, ids []string) []string {
+	switches, err := router.GetPubliclyReachableSwitches(ctx)
+	if err != nil {
+		log.Println("Could not get publicly reachable switches, continuing:", err)
+
+		return []string{}
+	}
+
+	peers := g.getPeers()
+
+	refreshed := []string{}
+	for _, id := range ids {
+		peer, ok := peers[id]
+		if !ok {
+			continue
+		}
+
+		if err := g.refreshPeerLatency(ctx, router, peer, id, switches); err != nil {
+			log.Println("Could not refresh latency for adapter with ID", id, ", continuing:", err)
+
+			continue
+		}
+
+		refreshed = append(refreshed, id)
+	}
+
+	return refreshed
+}
+
+// ringGroupMembers rings all available devices of the emails in parallel and returns the first device of each email which answered
+func (g *Gateway) ringGroupMembers(ctx context.Context, gcm *groupCallMetadata, routeID string, emails []string) []string {
+	adapters := g.getAdapters()
+	peers := g.getPeers()
+
+	rung := map[string]string{}
+	for _, email := range emails {
+		authorized := []string{}
+		for _, dstID := range g.getDeviceIDs(email) {
+			if dstID == gcm.hostID {
+				continue
+			}
+
+			if allow, rule := g.policies.Authorize(policies.Request{
+				Caller: policies.Identity{
+					Email:  gcm.hostEmail,
+					Claims: gcm.hostClaims,
+				},
+				Callee: policies.Identity{
+					Email:  adapters[dstID].UserEmail,
+					Claims: adapters[dstID].claims,
+				},
+				ChannelID: gcm.channelID,
+			}); !allow {
+				if g.verbose.Load() {
+					log.Println("Policy rule", rule, "denied group call with route ID", routeID, "to ID", dstID)
+				}
+
+				continue
+			}
+
+			authorized = append(authorized, dstID)
+		}
+
+		// Group calls don't wait for busy or away members, so we only ring devices which are available
+		ringable, _ := g.getRingableDeviceIDs(authorized)
+		for _, dstID := range ringable {
+			if _, ok := peers[dstID]; ok {
+				rung[dstID] = email
+			}
+		}
+	}
+
+	type ringResponse struct {
+		dstID  string
+		accept bool
+		err    error
+	}
+
+	responses := make(chan ringResponse, len(rung))
+	pending := map[string]struct{}{}
+	for dstID := range rung {
+		dst := peers[dstID]
+
+		pending[dstID] = struct{}{}
+
+		g.notifyCallState(routeID, gcm.channelID, CallStateRinging, nil, &dst)
+
+		go func(dstID string) {
+			accept, err := dst.RequestCall(
+				ctx,
+				gcm.hostID,
+				gcm.hostEmail,
+				routeID,
+				gcm.channelID,
+			)
+
+			responses <- ringResponse{dstID, accept, err}
+		}(dstID)
+	}
+
+	timeout := time.NewTimer(g.ringTimeout)
+	defer timeout.Stop()
+
+	states := map[string]string{}
+	answered := map[string]struct{}{}
+l:
+	for len(pending) > 0 {
+		select {
+		case res := <-responses:
+			// Ignore late responses from devices which we've stopped ringing
+			if _, ok := pending[res.dstID]; !ok {
+				continue
+			}
+
+			delete(pending, res.dstID)
+
+			if res.err != nil {
+				log.Println("Could not ring device with ID", res.dstID, "for group call with route ID", routeID, ", continuing:", res.err)
+
+				states[res.dstID] = CallStateCancelled
+
+				continue
+			}
+
+			if !res.accept {
+				states[res.dstID] = CallStateDeclined
+
+				continue
+			}
+
+			states[res.dstID] = CallStateAnswered
+			answered[rung[res.dstID]] = struct{}{}
+
+			// The first device of each user to accept wins and the others stop ringing
+			for candidateID := range pending {
+				if rung[candidateID] == rung[res.dstID] {
+					delete(pending, candidateID)
+
+					states[candidateID] = CallStateCancelled
+				}
+			}
+		case <-timeout.C:
+			break l
+		}
+	}
+
+	memberIDs := []string{}
+	for dstID := range rung {
+		state, ok := states[dstID]
+		if !ok {
+			state = CallStateTimedOut
+		}
+
+		dst := peers[dstID]
+
+		g.notifyCallState(routeID, gcm.channelID, state, nil, &dst)
+
+		if state == CallStateAnswered {
+			memberIDs = append(memberIDs, dstID)
+		}
+	}
+
+	sort.Strings(memberIDs)
+
+	return memberIDs
+}
+
+func (g *Gateway) getGroupCall(routeID string) (*groupCallMetadata, bool) {
+	g.groupCallsLock.Lock()
+	defer g.groupCallsLock.Unlock()
+
+	gcm, ok := g.groupCalls[routeID]
+
+	return gcm, ok
+}
+
+func (g *Gateway) RequestGroupCall(ctx context.Context, token string, emails []string, channelID string) (RequestGroupCallResult, error) {
+	email, claims, err := g.auth.ValidateWithClaims(token)
+	if err != nil {
+		return RequestGroupCallResult{}, err
+	}
+
+	if g.draining.Load() {
+		return RequestGroupCallResult{}, ErrGatewayDraining
+	}
+
+	adapterID := g.getAdapterID(ctx)
+	routeID := uuid.NewString()
+	requestedAt := time.Now()
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "is requesting a group call with emails", emails, "with route ID", routeID, "and channel ID", channelID)
+	}
+
+	if _, ok := g.getAdapters()[adapterID]; !ok {
+		return RequestGroupCallResult{}, ErrAdapterNotFound
+	}
+
+	host, ok := g.getPeers()[adapterID]
+	if !ok {
+		return RequestGroupCallResult{}, ErrSrcNotFound
+	}
+
+	// Check the limits before ringing or benchmarking since both are expensive
+	if err := g.limiter.Allow(email, claims); err != nil {
+		return RequestGroupCallResult{}, err
+	}
+
+	if err := g.limiter.Acquire(email, claims); err != nil {
+		return RequestGroupCallResult{}, err
+	}
+
+	// Answered calls count towards the quota until they are finished
+	answered := false
+	defer func() {
+		if !answered {
+			g.limiter.Release(email)
+		}
+	}()
+
+	gcm := &groupCallMetadata{
+		hostID:        adapterID,
+		hostEmail:     email,
+		hostClaims:    claims,
+		channelID:     channelID,
+		invitedEmails: emails,
+	}
+
+	cdr := persisters.CallDetailRecord{
+		RouteID:     routeID,
+		CallerID:    adapterID,
+		CallerEmail: email,
+		CalleeEmail: strings.Join(emails, ","),
+		ChannelID:   channelID,
+		StartedAt:   requestedAt,
+	}
+
+	g.notifyCallState(routeID, channelID, CallStateRinging, &host, nil)
+
+	memberIDs := g.ringGroupMembers(ctx, gcm, routeID, emails)
+	if len(memberIDs) < 1 {
+		g.notifyCallState(routeID, channelID, CallStateDeclined, &host, nil)
+
+		g.addCallDetailRecord(cdr, CallStateDeclined, "")
+
+		return RequestGroupCallResult{
+			Accept:  false,
+			RouteID: routeID,
+			State:   CallStateDeclined,
+		}, nil
+	}
+
+	answeredAt := time.Now()
+
+	router, err := g.getRouter()
+	if err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return RequestGroupCallResult{}, err
+	}
+
+	if refreshed := g.refreshGroupLatencies(ctx, router, []string{adapterID}); len(refreshed) < 1 {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return RequestGroupCallResult{}, ErrSrcNotFound
+	}
+
+	memberIDs = g.refreshGroupLatencies(ctx, router, memberIDs)
+
+	if err := router.RefreshTopology(ctx); err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return RequestGroupCallResult{}, err
+	}
+
+	// The router updates the graphs once the group route is provisioned
+	joined, err := router.ProvisionGroupRoute(ctx, adapterID, routeID, channelID, memberIDs)
+	if err != nil {
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return RequestGroupCallResult{}, err
+	}
+
+	if len(joined) < 1 {
+		if err := g.unprovisionCall(routeID, TerminationReasonFailed, ""); err != nil {
+			log.Println("Could not unprovision group call with route ID", routeID, ", continuing:", err)
+		}
+
+		g.addCallDetailRecord(cdr, TerminationReasonFailed, "")
+
+		return RequestGroupCallResult{}, ErrNoGroupCallMembers
+	}
+
+	g.notifyCallState(routeID, channelID, CallStateAnswered, &host, nil)
+
+	cdr.CalleeID = strings.Join(joined, ",")
+	cdr.Path, err = router.GetRoute(ctx, routeID)
+	if err != nil {
+		log.Println("Could not get path of route with ID", routeID, ", continuing:", err)
+	}
+	cdr.SetupLatency = time.Since(answeredAt)
+	cdr.StartedAt = time.Now()
+
+	g.groupCallsLock.Lock()
+	g.groupCalls[routeID] = gcm
+	g.groupCallsLock.Unlock()
+
+	g.activeCallsLock.Lock()
+	g.activeCalls[routeID] = cdr
+	g.activeCallsLock.Unlock()
+
+	answered = true
+
+	if err := g.persistRoute(cdr, true); err != nil {
+		return RequestGroupCallResult{}, err
+	}
+
+	return RequestGroupCallResult{
+		Accept:  true,
+		RouteID: routeID,
+		State:   CallStateAnswered,
+		DstIDs:  joined,
+	}, nil
+}
+
+func (g *Gateway) InviteToGroupCall(ctx context.Context, token string, routeID string, email string) (RequestGroupCallResult, error) {
+	hostEmail, claims, err := g.auth.ValidateWithClaims(token)
+	if err != nil {
+		return RequestGroupCallResult{}, err
+	}
+
+	if g.draining.Load() {
+		return RequestGroupCallResult{}, ErrGatewayDraining
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "is inviting email", email, "to group call with route ID", routeID)
+	}
+
+	gcm, ok := g.getGroupCall(routeID)
+	if !ok {
+		return RequestGroupCallResult{}, ErrGroupCallNotFound
+	}
+
+	if gcm.hostID != adapterID {
+		return RequestGroupCallResult{}, ErrNotGroupCallHost
+	}
+
+	if err := g.limiter.Allow(hostEmail, claims); err != nil {
+		return RequestGroupCallResult{}, err
+	}
+
+	g.groupCallsLock.Lock()
+	if !slices.Contains(gcm.invitedEmails, email) {
+		gcm.invitedEmails = append(gcm.invitedEmails, email)
+	}
+	g.groupCallsLock.Unlock()
+
+	memberIDs := g.ringGroupMembers(ctx, gcm, routeID, []string{email})
+	if len(memberIDs) < 1 {
+		return RequestGroupCallResult{
+			Accept:  false,
+			RouteID: routeID,
+			State:   CallStateDeclined,
+		}, nil
+	}
+
+	router, err := g.getRouter()
+	if err != nil {
+		return RequestGroupCallResult{}, err
+	}
+
+	memberIDs = g.refreshGroupLatencies(ctx, router, memberIDs)
+
+	if err := router.RefreshTopology(ctx); err != nil {
+		return RequestGroupCallResult{}, err
+	}
+
+	joined := []string{}
+	for _, memberID := range memberIDs {
+		if err := router.JoinGroupRoute(ctx, routeID, memberID); err != nil {
+			log.Println("Could not add member with ID", memberID, "to group call with route ID", routeID, ", continuing:", err)
+
+			continue
+		}
+
+		joined = append(joined, memberID)
+	}
+
+	if len(joined) < 1 {
+		return RequestGroupCallResult{}, ErrNoGroupCallMembers
+	}
+
+	return RequestGroupCallResult{
+		Accept:  true,
+		RouteID: routeID,
+		State:   CallStateAnswered,
+		DstIDs:  joined,
+	}, nil
+}
+
+func (g *Gateway) JoinGroupCall(ctx context.Context, token string, routeID string) error {
+	email, claims, err := g.auth.ValidateWithClaims(token)
+	if err != nil {
+		return err
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "is joining group call with route ID", routeID)
+	}
+
+	gcm, ok := g.getGroupCall(routeID)
+	if !ok {
+		return ErrGroupCallNotFound
+	}
+
+	// The host's other devices can always join
+	g.groupCallsLock.Lock()
+	invited := email == gcm.hostEmail || slices.Contains(gcm.invitedEmails, email)
+	g.groupCallsLock.Unlock()
+
+	if !invited {
+		return ErrNotInvitedToGroupCall
+	}
+
+	if allow, rule := g.policies.Authorize(policies.Request{
+		Caller: policies.Identity{
+			Email:  gcm.hostEmail,
+			Claims: gcm.hostClaims,
+		},
+		Callee: policies.Identity{
+			Email:  email,
+			Claims: claims,
+		},
+		ChannelID: gcm.channelID,
+	}); !allow {
+		if g.verbose.Load() {
+			log.Println("Policy rule", rule, "denied joining group call with route ID", routeID, "for ID", adapterID)
+		}
+
+		return ErrCallNotAuthorized
+	}
+
+	router, err := g.getRouter()
+	if err != nil {
+		return err
+	}
+
+	if refreshed := g.refreshGroupLatencies(ctx, router, []string{adapterID}); len(refreshed) < 1 {
+		return ErrAdapterNotFound
+	}
+
+	if err := router.RefreshTopology(ctx); err != nil {
+		return err
+	}
+
+	return router.JoinGroupRoute(ctx, routeID, adapterID)
+}
+
+func (g *Gateway) LeaveGroupCall(ctx context.Context, token string, routeID string) error {
+	if _, err := g.auth.Validate(token); err != nil {
+		return err
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "is leaving group call with route ID", routeID)
+	}
+
+	gcm, ok := g.getGroupCall(routeID)
+	if !ok {
+		return ErrGroupCallNotFound
+	}
+
+	// If the host leaves, the group call ends for everyone
+	if gcm.hostID == adapterID {
+		return g.unprovisionCall(routeID, TerminationReasonHangup, adapterID)
+	}
+
+	router, err := g.getRouter()
+	if err != nil {
+		return err
+	}
+
+	return router.LeaveGroupRoute(ctx, routeID, adapterID)
+}
+
+// getActiveCall returns the active call if the remote is one of its parties
+func (g *Gateway) getActiveCall(routeID, remoteID string) (persisters.CallDetailRecord, error) {
+	if _, ok := g.getGroupCall(routeID); ok {
+		return persisters.CallDetailRecord{}, ErrGroupCallNotSupported
+	}
+
+	if g.Federation.isFederated(routeID) {
+		return persisters.CallDetailRecord{}, ErrFederatedCallNotSupported
+	}
+
+	return g.getCallOfParty(routeID, remoteID)
+}
+
+// getCallOfParty returns the active call, which may also be a group or federated call, if the remote is its caller or callee
+func (g *Gateway) getCallOfParty(routeID, remoteID string) (persisters.CallDetailRecord, error) {
+	g.activeCallsLock.Lock()
+	cdr, ok := g.activeCalls[routeID]
+	g.activeCallsLock.Unlock()
+
+	if !ok {
+		return persisters.CallDetailRecord{}, ErrCallNotFound
+	}
+
+	if remoteID != cdr.CallerID && remoteID != cdr.CalleeID {
+		return persisters.CallDetailRecord{}, ErrNotCallParty
+	}
+
+	return cdr, nil
+}
+
+func (g *Gateway) getCallParties(cdr persisters.CallDetailRecord) (*AdapterRemote, *AdapterRemote) {
+	peers := g.getPeers()
+
+	var caller, callee *AdapterRemote
+	if peer, ok := peers[cdr.CallerID]; ok {
+		caller = &peer
+	}
+
+	if peer, ok := peers[cdr.CalleeID]; ok {
+		callee = &peer
+	}
+
+	return caller, callee
+}
+
+func (g *Gateway) setHold(ctx context.Context, cdr persisters.CallDetailRecord, hold bool) error {
+	caller, callee := g.getCallParties(cdr)
+
+	for _, party := range []*AdapterRemote{caller, callee} {
+		if party == nil {
+			continue
+		}
+
+		if err := party.SetHold(ctx, cdr.RouteID, hold); err != nil {
+			return err
+		}
+	}
+
+	state := CallStateResumed
+	if hold {
+		state = CallStateHeld
+	}
+
+	g.notifyCallState(cdr.RouteID, cdr.ChannelID, state, caller, callee)
+
+	return nil
+}
+
+func (g *Gateway) HoldCall(ctx context.Context, token string, routeID string, hold bool) error {
+	if _, err := g.auth.Validate(token); err != nil {
+		return err
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "is setting hold for call with route ID", routeID, "to", hold)
+	}
+
+	cdr, err := g.getActiveCall(routeID, adapterID)
+	if err != nil {
+		return err
+	}
+
+	return g.setHold(ctx, cdr, hold)
+}
+
+// TransferCall rings the devices of the email on behalf of the remaining party and replaces the call with a new route if one of them answers
+func (g *Gateway) TransferCall(ctx context.Context, token string, routeID string, email string) (RequestCallResult, error) {
+	transferorEmail, claims, err := g.auth.ValidateWithClaims(token)
+	if err != nil {
+		return RequestCallResult{}, err
+	}
+
+	if g.draining.Load() {
+		return RequestCallResult{}, ErrGatewayDraining
+	}
+
+	adapterID := g.getAdapterID(ctx)
+
+	if g.verbose.Load() {
+		log.Println("Adapter with ID", adapterID, "is transferring call with route ID", routeID, "to email", email)
+	}
+
+	cdr, err := g.getActiveCall(routeID, adapterID)
+	if err != nil {
+		return RequestCallResult{}, err
+	}
+
+	if err := g.limiter.Allow(transferorEmail, claims); err != nil {
+		return RequestCallResult{}, err
+	}
+
+	remainingID := cdr.CallerID
+	if remainingID == adapterID {
+		remainingID = cdr.CalleeID
+	}
+
+	remaining, ok := g.getAdapters()[remainingID]
+	if !ok {
+		return RequestCallResult{}, ErrAdapterNotFound
+	}
+
+	dstIDs := []string{}
+	for _, dstID := range g.getDeviceIDs(email) {
+		if dstID != adapterID && dstID != remainingID {
+			dstIDs = append(dstIDs, dstID)
+		}
+	}
+
+	if len(dstIDs) < 1 {
+		return RequestCallResult{}, ErrDstNotFound
+	}
+
+	// The remaining party waits on hold while the new party is rung
+	if err := g.setHold(ctx, cdr, true); err != nil {
+		return RequestCallResult{}, err
+	}
+
+	res, err := g.requestCall(ctx, remainingID, remaining.claims, dstIDs, cdr.ChannelID)
+	if err != nil || !res.Accept {
+		if err := g.setHold(ctx, cdr, false); err != nil {
+			log.Println("Could not resume call with route ID", routeID, "after failed transfer, continuing:", err)
+		}
+
+		return res, err
+	}
+
+	caller, callee := g.getCallParties(cdr)
+
+	g.notifyCallState(routeID, cdr.ChannelID, CallStateTransferred, caller, callee)
+
+	if err := g.unprovisionCall(routeID, TerminationReasonTransferred, adapterID); err != nil {
+		log.Println("Could not unprovision transferred call with route ID", routeID, ", continuing:", err)
+	}
+
+	return res, nil
 }
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"sync"
+
+	"github.com/pojntfx/saltpanelo/pkg/utils"
+)
+
+var (
+	ErrNoRegistrationChallenge = errors.New("could not verify node identity: No registration challenge was requested")
+	ErrInvalidNodeIdentity     = errors.New("could not verify node identity: Invalid public key or signature")
+)
+
+const (
+	registrationChallengeLength = 32
+)
+
+// NodeIdentity proves that a switch or adapter owns the private key which its node ID is derived from; enrolled switches
+// also present the node certificate which the CA issued for it
+type NodeIdentity struct {
+	PublicKey []byte
+	Signature []byte
+	CertPEM   []byte
+}
+
+// NodeCertificate is issued by the CA for the identity of an enrolled switch
+type NodeCertificate struct {
+	CAPEM   []byte
+	CertPEM []byte
+}
+
+// NewNodeIdentity signs a registration challenge of the router or gateway
+func NewNodeIdentity(privKey ed25519.PrivateKey, challenge []byte) NodeIdentity {
+	return NodeIdentity{
+		PublicKey: privKey.Public().(ed25519.PublicKey),
+		Signature: ed25519.Sign(privKey, challenge),
+	}
+}
+
+// registrationChallenges are single-use, so a signature can't be replayed on another connection
+type registrationChallenges struct {
+	challengesLock sync.Mutex
+	challenges     map[string][]byte
+}
+
+func newRegistrationChallenges() *registrationChallenges {
+	return &registrationChallenges{
+		challenges: map[string][]byte{},
+	}
+}
+
+func (c *registrationChallenges) issue(remoteID string) ([]byte, error) {
+	challenge := make([]byte, registrationChallengeLength)
+	if _, err := rand.Read(challenge); err != nil {
+		return []byte{}, err
+	}
+
+	c.challengesLock.Lock()
+	defer c.challengesLock.Unlock()
+
+	c.challenges[remoteID] = challenge
+
+	return challenge, nil
+}
+
+func (c *registrationChallenges) remove(remoteID string) {
+	c.challengesLock.Lock()
+	defer c.challengesLock.Unlock()
+
+	delete(c.challenges, remoteID)
+}
+
+// verify returns the node ID of the switch or adapter which signed the challenge for the connection with the remote ID
+func (c *registrationChallenges) verify(remoteID string, identity NodeIdentity) (string, error) {
+	c.challengesLock.Lock()
+
+	challenge, ok := c.challenges[remoteID]
+	delete(c.challenges, remoteID)
+
+	c.challengesLock.Unlock()
+
+	if !ok {
+		return "", ErrNoRegistrationChallenge
+	}
+
+	if len(identity.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(identity.PublicKey, challenge, identity.Signature) {
+		return "", ErrInvalidNodeIdentity
+	}
+
+	return utils.GetNodeID(identity.PublicKey), nil
+}
@@ -0,0 +1,403 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"nhooyr.io/websocket"
+)
+
+var (
+	ErrInternalUnauthorized = errors.New("could not authorize internal service: Invalid token")
+	ErrRouterNotConnected   = errors.New("could not reach router: Gateway is not connected to a router")
+)
+
+const (
+	InternalPathGateway = "/gateway"
+	InternalPathMetrics = "/metrics"
+)
+
+// IsInternalAuthorized checks the shared secret which separately deployed services authenticate to the router with
+func IsInternalAuthorized(r *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// GetInternalDialOptions returns the options which separately deployed services dial the router with; the HTTP client
+// verifies the certificate of the internal listener
+func GetInternalDialOptions(token string, httpClient *http.Client) *websocket.DialOptions {
+	return &websocket.DialOptions{
+		HTTPClient: httpClient,
+		HTTPHeader: http.Header{
+			"Authorization": []string{"Bearer " + token},
+		},
+	}
+}
+
+// RouterServiceRemote is the internal boundary which gateways and metrics services use to reach the router; the router
+// owns the switches, the graph, the routes and the CA, so gateways provision and unprovision routes through it
+type RouterServiceRemote struct {
+	RefreshTopology              func(ctx context.Context) error
+	GetCertificateAuthority      func(ctx context.Context) ([]byte, error)
+	IssueBenchmarkCertificate    func(ctx context.Context) (CertPair, error)
+	GetPubliclyReachableSwitches func(ctx context.Context) (map[string]SwitchMetadata, error)
+	RegisterAdapter              func(ctx context.Context, adapterID, email string) ([]byte, error)
+	UnregisterAdapter            func(ctx context.Context, adapterID string, disconnected bool) error
+	GetNodeRouteIDs              func(ctx context.Context, nodeID string) ([]string, error)
+	GetRoute                     func(ctx context.Context, routeID string) ([]string, error)
+	ProvisionRoute               func(ctx context.Context, srcID, dstID, routeID, channelID string) error
+	ProvisionGroupRoute          func(ctx context.Context, rootID, routeID, channelID string, memberIDs []string) ([]string, error)
+	JoinGroupRoute               func(ctx context.Context, routeID, memberID string) error
+	LeaveGroupRoute              func(ctx context.Context, routeID, memberID string) error
+	ProvisionBorderRoute         func(ctx context.Context, adapterID, routeID, channelID string, foreign ForeignBorder, csrPEM []byte) (BorderRoute, error)
+	UnprovisionRoute             func(ctx context.Context, routeID, remoteID string) (int64, error)
+	PersistRoute                 func(ctx context.Context, route persisters.RouteRecord) error
+	AddCallDetailRecord          func(ctx context.Context, cdr persisters.CallDetailRecord) error
+	GetCallDetailRecords         func(ctx context.Context, email string, limit int) ([]persisters.CallDetailRecord, error)
+}
+
+// GatewayServiceRemote is the internal boundary which the router uses to reach the adapters and calls of a gateway
+type GatewayServiceRemote struct {
+	GetAdapters               func(ctx context.Context) (map[string]AdapterMetadata, error)
+	GetCallRouteIDs           func(ctx context.Context) ([]string, error)
+	RestoreCall               func(ctx context.Context, cdr persisters.CallDetailRecord) error
+	FinishCall                func(ctx context.Context, routeID, terminationReason, terminatedBy string, transferred int64) error
+	KickAdapter               func(ctx context.Context, adapterID string) error
+	TestAdapterLatency        func(ctx context.Context, adapterID string, timeout time.Duration, addrs []string, benchmarkClientCert CertPair) ([]time.Duration, error)
+	GetAdapterCandidates      func(ctx context.Context, adapterID string) ([]string, error)
+	PrepareAdapterDirectRoute func(ctx context.Context, adapterID, routeID, channelID string, cert CertPair) ([]string, error)
+	ProvisionAdapterRoute     func(ctx context.Context, adapterID, routeID, channelID, raddr string, cert CertPair) error
+	UnprovisionAdapterRoute   func(ctx context.Context, adapterID, routeID string) (int64, error)
+	ListAdapterRoutes         func(ctx context.Context, adapterID string) ([]string, error)
+}
+
+// MetricsServiceRemote is the internal boundary which the router uses to publish its topology to separately deployed metrics services
+type MetricsServiceRemote struct {
+	Visualize func(
+		ctx context.Context,
+		switches map[string]SwitchMetadata,
+		adapters map[string]AdapterMetadata,
+		routes map[string][]string,
+	) error
+}
+
+// LinkGatewayToRouter connects a gateway to a router which runs in the same process through the same internal boundary
+// which separately deployed gateways use
+func LinkGatewayToRouter(gateway *GatewayService, router *RouterService) {
+	routerRemote := RouterServiceRemote{
+		RefreshTopology:              router.RefreshTopology,
+		GetCertificateAuthority:      router.GetCertificateAuthority,
+		IssueBenchmarkCertificate:    router.IssueBenchmarkCertificate,
+		GetPubliclyReachableSwitches: router.GetPubliclyReachableSwitches,
+		RegisterAdapter:              router.RegisterAdapter,
+		UnregisterAdapter:            router.UnregisterAdapter,
+		GetNodeRouteIDs:              router.GetNodeRouteIDs,
+		GetRoute:                     router.GetRoute,
+		ProvisionRoute:               router.ProvisionRoute,
+		ProvisionGroupRoute:          router.ProvisionGroupRoute,
+		JoinGroupRoute:               router.JoinGroupRoute,
+		LeaveGroupRoute:              router.LeaveGroupRoute,
+		ProvisionBorderRoute:         router.ProvisionBorderRoute,
+		UnprovisionRoute:             router.UnprovisionRoute,
+		PersistRoute:                 router.PersistRoute,
+		AddCallDetailRecord:          router.AddCallDetailRecord,
+		GetCallDetailRecords:         router.GetCallDetailRecords,
+	}
+
+	gatewayRemote := GatewayServiceRemote{
+		GetAdapters:               gateway.GetAdapters,
+		GetCallRouteIDs:           gateway.GetCallRouteIDs,
+		RestoreCall:               gateway.RestoreCall,
+		FinishCall:                gateway.FinishCall,
+		KickAdapter:               gateway.KickAdapter,
+		TestAdapterLatency:        gateway.TestAdapterLatency,
+		GetAdapterCandidates:      gateway.GetAdapterCandidates,
+		PrepareAdapterDirectRoute: gateway.PrepareAdapterDirectRoute,
+		ProvisionAdapterRoute:     gateway.ProvisionAdapterRoute,
+		UnprovisionAdapterRoute:   gateway.UnprovisionAdapterRoute,
+		ListAdapterRoutes:         gateway.ListAdapterRoutes,
+	}
+
+	gateway.gateway.Routers = func() map[string]RouterServiceRemote {
+		return map[string]RouterServiceRemote{
+			"": routerRemote,
+		}
+	}
+
+	router.router.Gateways = func() map[string]GatewayServiceRemote {
+		return map[string]GatewayServiceRemote{
+			"": gatewayRemote,
+		}
+	}
+}
+
+// HandleRouterServiceClientDisconnect unregisters the adapters of a separately deployed gateway which lost its connection
+// to the router, unless they already registered again on another gateway
+func HandleRouterServiceClientDisconnect(s *RouterService) {
+	s.router.onGatewayDisconnect()
+}
+
+type RouterService struct {
+	router *Router
+}
+
+func NewRouterService(router *Router) *RouterService {
+	return &RouterService{
+		router: router,
+	}
+}
+
+func (s *RouterService) RefreshTopology(ctx context.Context) error {
+	return s.router.updateGraphs(context.Background())
+}
+
+func (s *RouterService) GetCertificateAuthority(ctx context.Context) ([]byte, error) {
+	return s.router.caPEM, nil
+}
+
+func (s *RouterService) IssueBenchmarkCertificate(ctx context.Context) (CertPair, error) {
+	return s.router.issueBenchmarkCertificate()
+}
+
+func (s *RouterService) GetPubliclyReachableSwitches(ctx context.Context) (map[string]SwitchMetadata, error) {
+	return s.router.getPubliclyReachableSwitches(), nil
+}
+
+func (s *RouterService) RegisterAdapter(ctx context.Context, adapterID, email string) ([]byte, error) {
+	return s.router.registerAdapter(adapterID, email)
+}
+
+func (s *RouterService) UnregisterAdapter(ctx context.Context, adapterID string, disconnected bool) error {
+	return s.router.unregisterAdapter(adapterID, disconnected)
+}
+
+func (s *RouterService) GetNodeRouteIDs(ctx context.Context, nodeID string) ([]string, error) {
+	return s.router.getNodeRouteIDs(nodeID), nil
+}
+
+func (s *RouterService) GetRoute(ctx context.Context, routeID string) ([]string, error) {
+	return s.router.getRoute(routeID), nil
+}
+
+func (s *RouterService) ProvisionRoute(ctx context.Context, srcID, dstID, routeID, channelID string) error {
+	return s.router.provisionRoute(srcID, dstID, routeID, channelID)
+}
+
+func (s *RouterService) ProvisionGroupRoute(ctx context.Context, rootID, routeID, channelID string, memberIDs []string) ([]string, error) {
+	joined, err := s.router.provisionGroupRoute(rootID, routeID, channelID, memberIDs)
+	if err != nil {
+		return []string{}, err
+	}
+
+	return joined, s.router.updateGraphs(context.Background())
+}
+
+func (s *RouterService) JoinGroupRoute(ctx context.Context, routeID, memberID string) error {
+	if err := s.router.joinGroupRoute(routeID, memberID); err != nil {
+		return err
+	}
+
+	return s.router.updateGraphs(context.Background())
+}
+
+func (s *RouterService) LeaveGroupRoute(ctx context.Context, routeID, memberID string) error {
+	if _, err := s.router.leaveGroupRoute(routeID, memberID, false); err != nil {
+		return err
+	}
+
+	return s.router.updateGraphs(context.Background())
+}
+
+func (s *RouterService) ProvisionBorderRoute(ctx context.Context, adapterID, routeID, channelID string, foreign ForeignBorder, csrPEM []byte) (BorderRoute, error) {
+	return s.router.provisionBorderRoute(adapterID, routeID, channelID, foreign, csrPEM)
+}
+
+func (s *RouterService) UnprovisionRoute(ctx context.Context, routeID, remoteID string) (int64, error) {
+	return s.router.unprovisionRoute(routeID, remoteID)
+}
+
+func (s *RouterService) PersistRoute(ctx context.Context, route persisters.RouteRecord) error {
+	return s.router.persister.PutRoute(route)
+}
+
+func (s *RouterService) AddCallDetailRecord(ctx context.Context, cdr persisters.CallDetailRecord) error {
+	return s.router.persister.AddCallDetailRecord(cdr)
+}
+
+func (s *RouterService) GetCallDetailRecords(ctx context.Context, email string, limit int) ([]persisters.CallDetailRecord, error) {
+	return s.router.persister.GetCallDetailRecords(email, limit)
+}
+
+type MetricsService struct {
+	metrics *Metrics
+
+	Peers func() map[string]RouterServiceRemote
+}
+
+func NewMetricsService(metrics *Metrics) *MetricsService {
+	return &MetricsService{
+		metrics: metrics,
+	}
+}
+
+func (s *MetricsService) Visualize(
+	ctx context.Context,
+	switches map[string]SwitchMetadata,
+	adapters map[string]AdapterMetadata,
+	routes map[string][]string,
+) error {
+	return s.metrics.visualize(ctx, switches, adapters, routes)
+}
+
+func HandleRemoteMetricsClientConnect(s *MetricsService) error {
+	for _, peer := range s.Peers() {
+		if err := peer.RefreshTopology(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GatewayService exposes the adapters and calls of a gateway to the router
+type GatewayService struct {
+	gateway *Gateway
+}
+
+func NewGatewayService(gateway *Gateway) *GatewayService {
+	return &GatewayService{
+		gateway: gateway,
+	}
+}
+
+// HandleGatewayServiceRouterConnect registers the adapters of a separately deployed gateway again once it connected to a
+// router, e.g. because the previous leader failed over, so that the router resumes and reconciles their routes
+func HandleGatewayServiceRouterConnect(s *GatewayService) error {
+	router, err := s.gateway.getRouter()
+	if err != nil {
+		return err
+	}
+
+	for adapterID, am := range s.gateway.getAdapters() {
+		if _, err := router.RegisterAdapter(context.Background(), adapterID, am.UserEmail); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *GatewayService) GetAdapters(ctx context.Context) (map[string]AdapterMetadata, error) {
+	return s.gateway.getAdapters(), nil
+}
+
+func (s *GatewayService) GetCallRouteIDs(ctx context.Context) ([]string, error) {
+	return s.gateway.getCallRouteIDs(), nil
+}
+
+func (s *GatewayService) RestoreCall(ctx context.Context, cdr persisters.CallDetailRecord) error {
+	s.gateway.restoreCall(cdr)
+
+	return nil
+}
+
+func (s *GatewayService) FinishCall(ctx context.Context, routeID, terminationReason, terminatedBy string, transferred int64) error {
+	s.gateway.finishCall(routeID, terminationReason, terminatedBy, transferred)
+
+	return nil
+}
+
+func (s *GatewayService) KickAdapter(ctx context.Context, adapterID string) error {
+	return s.gateway.kickAdapter(adapterID)
+}
+
+func (s *GatewayService) getAdapter(adapterID string) (AdapterRemote, error) {
+	peer, ok := s.gateway.getPeers()[adapterID]
+	if !ok {
+		return AdapterRemote{}, ErrAdapterNotFound
+	}
+
+	return peer, nil
+}
+
+func (s *GatewayService) TestAdapterLatency(ctx context.Context, adapterID string, timeout time.Duration, addrs []string, benchmarkClientCert CertPair) ([]time.Duration, error) {
+	peer, err := s.getAdapter(adapterID)
+	if err != nil {
+		return []time.Duration{}, err
+	}
+
+	return peer.TestLatency(ctx, timeout, addrs, benchmarkClientCert)
+}
+
+func (s *GatewayService) GetAdapterCandidates(ctx context.Context, adapterID string) ([]string, error) {
+	peer, err := s.getAdapter(adapterID)
+	if err != nil {
+		return []string{}, err
+	}
+
+	return peer.GetCandidates(ctx)
+}
+
+func (s *GatewayService) PrepareAdapterDirectRoute(ctx context.Context, adapterID, routeID, channelID string, cert CertPair) ([]string, error) {
+	peer, err := s.getAdapter(adapterID)
+	if err != nil {
+		return []string{}, err
+	}
+
+	return peer.PrepareDirectRoute(ctx, routeID, channelID, cert)
+}
+
+func (s *GatewayService) ProvisionAdapterRoute(ctx context.Context, adapterID, routeID, channelID, raddr string, cert CertPair) error {
+	peer, err := s.getAdapter(adapterID)
+	if err != nil {
+		return err
+	}
+
+	return peer.ProvisionRoute(ctx, routeID, channelID, raddr, cert)
+}
+
+func (s *GatewayService) UnprovisionAdapterRoute(ctx context.Context, adapterID, routeID string) (int64, error) {
+	peer, err := s.getAdapter(adapterID)
+	if err != nil {
+		return 0, err
+	}
+
+	return peer.UnprovisionRoute(ctx, routeID)
+}
+
+func (s *GatewayService) ListAdapterRoutes(ctx context.Context, adapterID string) ([]string, error) {
+	peer, err := s.getAdapter(adapterID)
+	if err != nil {
+		return []string{}, err
+	}
+
+	return peer.ListRoutes(ctx)
+}
+
+// newGatewayAdapterRemote reaches an adapter through the gateway which it is connected to; only the functions which the
+// router calls are set
+func newGatewayAdapterRemote(gateway GatewayServiceRemote, adapterID string) AdapterRemote {
+	return AdapterRemote{
+		TestLatency: func(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair) ([]time.Duration, error) {
+			return gateway.TestAdapterLatency(ctx, adapterID, timeout, addrs, benchmarkClientCert)
+		},
+		UnprovisionRoute: func(ctx context.Context, routeID string) (int64, error) {
+			return gateway.UnprovisionAdapterRoute(ctx, adapterID, routeID)
+		},
+		ListRoutes: func(ctx context.Context) ([]string, error) {
+			return gateway.ListAdapterRoutes(ctx, adapterID)
+		},
+		GetCandidates: func(ctx context.Context) ([]string, error) {
+			return gateway.GetAdapterCandidates(ctx, adapterID)
+		},
+		PrepareDirectRoute: func(ctx context.Context, routeID, channelID string, cert CertPair) ([]string, error) {
+			return gateway.PrepareAdapterDirectRoute(ctx, adapterID, routeID, channelID, cert)
+		},
+		ProvisionRoute: func(ctx context.Context, routeID, channelID, raddr string, cert CertPair) error {
+			return gateway.ProvisionAdapterRoute(ctx, adapterID, routeID, channelID, raddr, cert)
+		},
+	}
+}
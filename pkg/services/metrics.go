@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"log"
+	"sync/atomic"
 
 	"github.com/pojntfx/saltpanelo/pkg/auth"
 )
@@ -13,8 +14,12 @@ func HandleMetricsClientConnect(router *Router) error {
 	return router.updateGraphs(context.Background())
 }
 
+func SetMetricsVerbose(metrics *Metrics, verbose bool) {
+	metrics.verbose.Store(verbose)
+}
+
 type Metrics struct {
-	verbose bool
+	verbose atomic.Bool
 
 	auth            *auth.OIDCAuthn
 	authorizedEmail string
@@ -28,12 +33,13 @@ func NewMetrics(
 	oidcClientID,
 	authorizedEmail string,
 ) *Metrics {
-	return &Metrics{
-		verbose: verbose,
-
+	m := &Metrics{
 		auth:            auth.NewOIDCAuthn(oidcIssuer, oidcClientID),
 		authorizedEmail: authorizedEmail,
 	}
+	m.verbose.Store(verbose)
+
+	return m
 }
 
 func (m *Metrics) Open(ctx context.Context) error {
@@ -47,7 +53,7 @@ func (m *Metrics) visualize(
 	routes map[string][]string,
 ) error {
 	for remoteID, peer := range m.Peers() {
-		if m.verbose {
+		if m.verbose.Load() {
 			log.Println("Visualizing graph for peer with ID", remoteID)
 		}
 
@@ -58,14 +64,14 @@ func (m *Metrics) visualize(
 			continue
 		}
 
-		email, err := m.auth.Validate(token)
+		email, claims, err := m.auth.ValidateWithClaims(token)
 		if err != nil {
 			log.Println("Could not attest peer with ID", remoteID, ", skipping")
 
 			continue
 		}
 
-		if email != m.authorizedEmail {
+		if email != m.authorizedEmail || !auth.IsEmailVerified(claims) {
 			log.Println("Could not attest peer with ID", remoteID, ", skipping")
 
 			continue
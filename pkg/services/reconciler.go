@@ -0,0 +1,376 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
+	"golang.org/x/exp/slices"
+)
+
+// pendingRoute is a route which was recorded before the control plane restarted and which not all of its adapters and switches have reconnected to yet
+type pendingRoute struct {
+	record    persisters.RouteRecord
+	remaining map[string]struct{}
+}
+
+// RestoreRoutes loads the routes which were recorded before the control plane restarted; routes which can't be reconciled before the timeout are garbage-collected
+func RestoreRoutes(ctx context.Context, r *Router, reconcileTimeout time.Duration) error {
+	routes, err := r.persister.GetRoutes()
+	if err != nil {
+		return err
+	}
+
+	// Switches which were registered before the restart have to register again to be re-issued node certificates by the next CA
+	if r.isRotatingCA() {
+		switches, err := r.persister.GetSwitches()
+		if err != nil {
+			return err
+		}
+
+		r.pendingNodeCertsLock.Lock()
+		r.pendingNodeCerts = map[string]struct{}{}
+		for _, sw := range switches {
+			r.pendingNodeCerts[sw.ID] = struct{}{}
+		}
+		r.pendingNodeCertsLock.Unlock()
+	}
+
+	// Adapters and switches are added again once they register, and their routes are matched by their node IDs
+	if err := r.persister.ClearSwitches(); err != nil {
+		return err
+	}
+
+	if err := r.persister.ClearAdapters(); err != nil {
+		return err
+	}
+
+	r.pendingRoutesLock.Lock()
+	defer r.pendingRoutesLock.Unlock()
+
+	for _, route := range routes {
+		// Multicast trees can't be reconciled, so their adapters and switches unprovision them once they reconnect
+		if route.Group {
+			if route.ActiveCall.RouteID != "" {
+				r.addCallDetailRecord(route.ActiveCall, TerminationReasonDisconnected, "")
+			}
+
+			if err := r.persister.DeleteRoute(route.RouteID); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		remaining := map[string]struct{}{}
+		for _, id := range route.Path {
+			remaining[id] = struct{}{}
+		}
+
+		r.pendingRoutes[route.RouteID] = &pendingRoute{
+			record:    route,
+			remaining: remaining,
+		}
+	}
+
+	if len(r.pendingRoutes) < 1 {
+		return nil
+	}
+
+	log.Println("Reconciling", len(r.pendingRoutes), "routes from before the restart")
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconcileTimeout):
+		}
+
+		r.collectPendingRoutes()
+	}()
+
+	return nil
+}
+
+// reconcileNode matches the routes which a reconnected adapter or switch reports against the recorded routes,
+// and returns the routes which the node should unprovision and the routes which are now fully reconciled
+func (r *Router) reconcileNode(nodeID string, routeIDs []string) ([]string, []persisters.RouteRecord) {
+	// Calls which are still being requested don't have a route yet
+	requested := []string{}
+	for gatewayID, gateway := range r.Gateways() {
+		callRouteIDs, err := gateway.GetCallRouteIDs(context.Background())
+		if err != nil {
+			log.Println("Could not get requested calls of gateway with ID", gatewayID, ", continuing:", err)
+
+			continue
+		}
+
+		requested = append(requested, callRouteIDs...)
+	}
+
+	r.pendingRoutesLock.Lock()
+	defer r.pendingRoutesLock.Unlock()
+
+	orphaned := []string{}
+	restored := []persisters.RouteRecord{}
+	for _, routeID := range routeIDs {
+		pr, ok := r.pendingRoutes[routeID]
+		if !ok {
+			// Routes which were provisioned or requested since the restart are still valid
+			r.routesLock.Lock()
+			_, live := r.routes[routeID]
+			r.routesLock.Unlock()
+
+			if !live && !slices.Contains(requested, routeID) {
+				orphaned = append(orphaned, routeID)
+			}
+
+			continue
+		}
+
+		if _, ok := pr.remaining[nodeID]; !ok {
+			orphaned = append(orphaned, routeID)
+
+			continue
+		}
+
+		delete(pr.remaining, nodeID)
+
+		if len(pr.remaining) == 0 {
+			delete(r.pendingRoutes, routeID)
+
+			restored = append(restored, pr.record)
+		}
+	}
+
+	return orphaned, restored
+}
+
+func (r *Router) restoreRoutes(restored []persisters.RouteRecord) {
+	if len(restored) < 1 {
+		return
+	}
+
+	for _, route := range restored {
+		if r.verbose.Load() {
+			log.Println("Restored route with ID", route.RouteID, "and path", route.Path)
+		}
+
+		r.routesLock.Lock()
+		r.routes[route.RouteID] = route.Path
+		r.routesLock.Unlock()
+
+		if route.ActiveCall.RouteID != "" {
+			// The gateway which the caller or callee is connected to tracks the call again
+			if gateway, ok := r.getAdapterGateway(route.ActiveCall.CallerID, route.ActiveCall.CalleeID); ok {
+				if err := gateway.RestoreCall(context.Background(), route.ActiveCall); err != nil {
+					log.Println("Could not restore call with route ID", route.RouteID, ", continuing:", err)
+				}
+			}
+		}
+
+		if err := r.persister.PutRoute(route); err != nil {
+			log.Println("Could not persist restored route with ID", route.RouteID, ", continuing:", err)
+		}
+	}
+
+	if err := r.updateGraphs(context.Background()); err != nil {
+		log.Println("Could not update graph, continuing:", err)
+	}
+}
+
+// unprovisionLostRoutes unprovisions the routes which an adapter or switch had before it registered again but doesn't report anymore, e.g. because it restarted
+func (r *Router) unprovisionLostRoutes(nodeID string, resumedRouteIDs, routeIDs []string) {
+	for _, routeID := range resumedRouteIDs {
+		if slices.Contains(routeIDs, routeID) {
+			continue
+		}
+
+		if r.verbose.Load() {
+			log.Println("Unprovisioning route with ID", routeID, "which node with ID", nodeID, "lost")
+		}
+
+		if err := r.hangupRoute(routeID, TerminationReasonDisconnected, nodeID); err != nil && !errors.Is(err, ErrRouteNotFound) {
+			log.Println("Could not unprovision route with ID", routeID, "which node with ID", nodeID, "lost, continuing:", err)
+		}
+	}
+}
+
+func (r *Router) reconcileSwitch(swID string, resumedRouteIDs []string) {
+	peer, ok := r.getPeers()[swID]
+	if !ok {
+		return
+	}
+
+	routeIDs, err := peer.ListRoutes(context.Background())
+	if err != nil {
+		log.Println("Could not list routes of switch with ID", swID, ", skipping reconciliation:", err)
+
+		return
+	}
+
+	r.unprovisionLostRoutes(swID, resumedRouteIDs, routeIDs)
+
+	orphaned, restored := r.reconcileNode(swID, routeIDs)
+
+	for _, routeID := range orphaned {
+		if r.verbose.Load() {
+			log.Println("Garbage-collecting orphaned route with ID", routeID, "on switch with ID", swID)
+		}
+
+		if err := peer.UnprovisionRoute(context.Background(), routeID); err != nil {
+			log.Println("Could not unprovision orphaned route with ID", routeID, "on switch with ID", swID, ", continuing:", err)
+		}
+	}
+
+	r.restoreRoutes(restored)
+}
+
+func (r *Router) reconcileAdapter(adapterID string, resumedRouteIDs []string) {
+	_, adapters := r.getAdapters()
+	peer, ok := adapters[adapterID]
+	if !ok {
+		return
+	}
+
+	routeIDs, err := peer.ListRoutes(context.Background())
+	if err != nil {
+		log.Println("Could not list routes of adapter with ID", adapterID, ", skipping reconciliation:", err)
+
+		return
+	}
+
+	r.unprovisionLostRoutes(adapterID, resumedRouteIDs, routeIDs)
+
+	orphaned, restored := r.reconcileNode(adapterID, routeIDs)
+
+	for _, routeID := range orphaned {
+		if r.verbose.Load() {
+			log.Println("Garbage-collecting orphaned route with ID", routeID, "on adapter with ID", adapterID)
+		}
+
+		if _, err := peer.UnprovisionRoute(context.Background(), routeID); err != nil {
+			log.Println("Could not unprovision orphaned route with ID", routeID, "on adapter with ID", adapterID, ", continuing:", err)
+		}
+	}
+
+	r.restoreRoutes(restored)
+}
+
+// collectPendingRoutes unprovisions the routes which couldn't be reconciled on the adapters and switches which did reconnect
+func (r *Router) collectPendingRoutes() {
+	r.pendingRoutesLock.Lock()
+	pending := r.pendingRoutes
+	r.pendingRoutes = map[string]*pendingRoute{}
+	r.pendingRoutesLock.Unlock()
+
+	routerPeers := r.getPeers()
+	_, gatewayPeers := r.getAdapters()
+
+	for routeID, pr := range pending {
+		log.Println("Garbage-collecting route with ID", routeID, "since not all of its adapters and switches reconnected")
+
+		switchesToClose := map[string][]SwitchRemote{}
+		adaptersToClose := map[string][]AdapterRemote{}
+		for _, id := range pr.record.Path {
+			if _, ok := pr.remaining[id]; ok {
+				continue
+			}
+
+			if sw, ok := routerPeers[id]; ok {
+				switchesToClose[routeID] = append(switchesToClose[routeID], sw)
+			}
+
+			if ad, ok := gatewayPeers[id]; ok {
+				adaptersToClose[routeID] = append(adaptersToClose[routeID], ad)
+			}
+		}
+
+		transferred := unprovisionSwitchesAndAdapters(switchesToClose, adaptersToClose, "")
+
+		if pr.record.ActiveCall.RouteID != "" {
+			cdr := pr.record.ActiveCall
+			cdr.Bytes = transferred[routeID]
+
+			r.addCallDetailRecord(cdr, TerminationReasonDisconnected, "")
+		}
+
+		if err := r.persister.DeleteRoute(routeID); err != nil {
+			log.Println("Could not delete garbage-collected route with ID", routeID, ", continuing:", err)
+		}
+	}
+}
+
+// registerNode stops the reconnect timeout of an adapter or switch and returns the routes which it had before it registered again
+func (r *Router) registerNode(nodeID string) []string {
+	r.disconnectedNodesLock.Lock()
+
+	// If the timer already fired, it won't unprovision the routes since it can't find itself anymore
+	if t, disconnected := r.disconnectedNodes[nodeID]; disconnected {
+		t.Stop()
+
+		delete(r.disconnectedNodes, nodeID)
+	}
+
+	r.disconnectedNodesLock.Unlock()
+
+	return r.getNodeRouteIDs(nodeID)
+}
+
+// getNodeRouteIDs returns the routes which an adapter or switch is part of
+func (r *Router) getNodeRouteIDs(nodeID string) []string {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+
+	routeIDs := []string{}
+	for routeID, path := range r.routes {
+		if slices.Contains(path, nodeID) {
+			routeIDs = append(routeIDs, routeID)
+		}
+	}
+
+	return routeIDs
+}
+
+// awaitReconnect calls unprovision unless the adapter or switch registers again before the reconnect timeout, and returns false if it can't reconnect
+func (r *Router) awaitReconnect(nodeID string, unprovision func()) bool {
+	if r.reconnectTimeout <= 0 {
+		return false
+	}
+
+	r.disconnectedNodesLock.Lock()
+	defer r.disconnectedNodesLock.Unlock()
+
+	if r.verbose.Load() {
+		log.Println("Keeping routes of node with ID", nodeID, "for", r.reconnectTimeout, "until it reconnects")
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(r.reconnectTimeout, func() {
+		r.disconnectedNodesLock.Lock()
+
+		if current, ok := r.disconnectedNodes[nodeID]; !ok || current != t {
+			r.disconnectedNodesLock.Unlock()
+
+			return
+		}
+
+		delete(r.disconnectedNodes, nodeID)
+
+		r.disconnectedNodesLock.Unlock()
+
+		log.Println("Node with ID", nodeID, "didn't reconnect before the reconnect timeout, unprovisioning its routes")
+
+		unprovision()
+	})
+
+	if previous, ok := r.disconnectedNodes[nodeID]; ok {
+		previous.Stop()
+	}
+
+	r.disconnectedNodes[nodeID] = t
+
+	return true
+}
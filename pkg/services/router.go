@@ -2,53 +2,106 @@ package services
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dominikbraun/graph"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
 	"github.com/pojntfx/saltpanelo/pkg/auth"
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
 	"github.com/pojntfx/saltpanelo/pkg/utils"
 	"golang.org/x/exp/slices"
 )
 
 var (
-	ErrSwitchAlreadyRegistered  = errors.New("could not register switch: A switch with this remote ID is already registered")
-	ErrAdapterAlreadyRegistered = errors.New("could not register adapter: An adapter with this remote ID is already registered")
-	ErrDstNotFound              = errors.New("could not find destination")
-	ErrDstIsSrc                 = errors.New("could not find route when dst and src are the same")
-	ErrRouteNotFound            = errors.New("could not find route")
-	ErrSwitchNotFound           = errors.New("could not find switch")
-	ErrInvalidPortsCount        = errors.New("could not proceed with invalid ports count")
+	ErrBorderSwitchNotPubliclyReachable = errors.New("could not register switch: Border switches must be publicly reachable")
+	ErrSwitchAlreadyRegistered          = errors.New("could not register switch: A switch is already registered on this connection")
+	ErrAdapterAlreadyRegistered         = errors.New("could not register adapter: An adapter is already registered on this connection")
+	ErrDstNotFound                      = errors.New("could not find destination")
+	ErrDstIsSrc                         = errors.New("could not find route when dst and src are the same")
+	ErrRouteNotFound                    = errors.New("could not find route")
+	ErrSwitchNotFound                   = errors.New("could not find switch")
+	ErrInvalidPortsCount                = errors.New("could not proceed with invalid ports count")
+	ErrNoDirectRouteCandidates          = errors.New("could not find any reachable candidates for direct route")
+	ErrGroupRouteNotFound               = errors.New("could not find group route")
+	ErrAlreadyGroupMember               = errors.New("could not join group route: Adapter is already a member")
+	ErrNotGroupMember                   = errors.New("could not leave group route: Adapter is not a member")
 )
 
 type RouterRemote struct {
-	RegisterSwitch func(ctx context.Context, token string, addr string) (SwitchConfiguration, error)
+	GetRegistrationChallenge func(ctx context.Context) ([]byte, error)
+	EnrollSwitch             func(ctx context.Context, token string, identity NodeIdentity) (NodeCertificate, error)
+	RegisterSwitch           func(ctx context.Context, token string, identity NodeIdentity, addr string, nat utils.NATInfo, border bool) (SwitchConfiguration, error)
+	DrainSwitch              func(ctx context.Context, token string) error
 }
 
-func HandleRouterClientDisconnect(r *Router, g *Gateway, remoteID string) error {
+func HandleRouterClientDisconnect(r *Router, remoteID string) error {
+	r.challenges.remove(remoteID)
+
+	swID, ok := r.unregisterSwitch(remoteID)
+	if !ok {
+		// The switch never registered on this connection, or it already registered again on another one
+		return nil
+	}
+
 	go func() {
-		if err := unprovisionRouteForPeer(r, g, remoteID); err != nil {
-			log.Println("Could not unprovision route for switch with ID", remoteID, ", continuing:", err)
+		unprovision := func(groupRoutesOnly bool) {
+			if err := unprovisionRouteForPeer(r, swID, groupRoutesOnly); err != nil {
+				log.Println("Could not unprovision route for switch with ID", swID, ", continuing:", err)
+			}
+		}
+
+		if r.awaitReconnect(swID, func() {
+			unprovision(false)
+		}) {
+			// Group routes can't be resumed, so they are unprovisioned immediately
+			unprovision(true)
+
+			return
 		}
+
+		unprovision(false)
 	}()
 
-	return r.onClientDisconnect(remoteID)
+	return r.onClientDisconnect(swID)
 }
 
 func HandleRouterOpen(router *Router) {
 	router.onOpen()
 }
 
+// HandleRouterStepDown forgets the switches and routes of a replica which is no longer the leader; the new leader
+// reconciles them, and so does this replica if it is elected again. It can be called multiple times
+func HandleRouterStepDown(router *Router) {
+	router.onStepDown()
+}
+
+func SetRouterVerbose(router *Router, verbose bool) {
+	router.verbose.Store(verbose)
+}
+
+func SetRouterTestInterval(router *Router, testInterval time.Duration) {
+	router.testIntervalLock.Lock()
+	defer router.testIntervalLock.Unlock()
+
+	router.testInterval = testInterval
+}
+
 type SwitchMetadata struct {
 	Addr        string
 	Latencies   map[string]time.Duration
 	Throughputs map[string]ThroughputResult
+	NAT         utils.NATInfo
+	Border      bool
+	Draining    bool
 }
 
 type CertPair struct {
@@ -60,25 +113,81 @@ type SwitchConfiguration struct {
 	CAPEM               []byte
 	BenchmarkListenCert CertPair
 	BenchmarkLimit      int64
+	NodeCertPEM         []byte // Renewed node certificate, which is only set once the current one has passed half of its validity
+}
+
+// groupRouteTree is a multicast tree of switches which is rooted in the switch next to the adapter which requested the group call
+type groupRouteTree struct {
+	lock sync.Mutex
+
+	rootID      string
+	channelID   string
+	topSwitchID string
+
+	parents         map[string]string // Parent switch ID for each switch in the tree, the top switch has no parent
+	downstreamAddrs map[string]string
+	members         map[string][]string // Branch from the root adapter to each member adapter
+}
+
+func (t *groupRouteTree) getNodes() []string {
+	nodes := []string{t.rootID}
+	for swID := range t.parents {
+		nodes = append(nodes, swID)
+	}
+
+	for memberID := range t.members {
+		nodes = append(nodes, memberID)
+	}
+
+	return nodes
+}
+
+func (t *groupRouteTree) getBranch(swID, memberID string) []string {
+	branch := []string{memberID}
+	for candidateID := swID; candidateID != ""; candidateID = t.parents[candidateID] {
+		branch = append([]string{candidateID}, branch...)
+	}
+
+	return append([]string{t.rootID}, branch...)
 }
 
 type Router struct {
 	switchesLock sync.Mutex
 	switches     map[string]SwitchMetadata
+	switchIDs    map[string]string // Node IDs of the switches by the remote IDs of their connections
 
-	testInterval time.Duration
-	testTimeout  time.Duration
+	challenges *registrationChallenges
+
+	testIntervalLock sync.Mutex
+	testInterval     time.Duration
+	testTimeout      time.Duration
 
 	Metrics *Metrics
-	Gateway *Gateway
+
+	// Gateways are the gateways which the adapters are connected to
+	Gateways func() map[string]GatewayServiceRemote
+
+	gatewayAdaptersLock sync.Mutex
+	gatewayAdapters     map[string]struct{} // Node IDs of the adapters which were connected to the gateways the last time they were listed
+
+	// MetricsServices are the separately deployed metrics services which the topology is published to
+	MetricsServices func() map[string]MetricsServiceRemote
 
 	graphLock sync.Mutex
 	graph     graph.Graph[string, string]
 
-	routesLock sync.Mutex
-	routes     map[string][]string
+	routesLock  sync.Mutex
+	routes      map[string][]string
+	groupRoutes map[string]*groupRouteTree
+
+	pendingRoutesLock sync.Mutex
+	pendingRoutes     map[string]*pendingRoute
+
+	disconnectedNodesLock sync.Mutex
+	disconnectedNodes     map[string]*time.Timer
+	reconnectTimeout      time.Duration
 
-	verbose bool
+	verbose atomic.Bool
 
 	auth *auth.JWTAuthn
 
@@ -86,14 +195,25 @@ type Router struct {
 	caPEM     []byte
 	caPrivKey *rsa.PrivateKey
 
+	// Node certificates are issued by the next CA while it is being rotated to, and by the current CA otherwise
+	nodeCACfg     *x509.Certificate
+	nodeCAPrivKey *rsa.PrivateKey
+
+	// Switches which were registered before the restart and haven't been re-issued node certificates by the next CA yet
+	pendingNodeCertsLock sync.Mutex
+	pendingNodeCerts     map[string]struct{}
+
 	callCertValidity,
 	benchmarkListenCertValidity,
-	benchmarkClientCertValidity time.Duration
+	benchmarkClientCertValidity,
+	nodeCertValidity time.Duration
 
 	rsaBits int
 
 	benchmarkLimit int64
 
+	persister *persisters.ControlPlanePersister
+
 	Peers func() map[string]SwitchRemote
 }
 
@@ -103,6 +223,8 @@ func NewRouter(
 	testInterval time.Duration,
 	testTimeout time.Duration,
 
+	reconnectTimeout time.Duration,
+
 	oidcIssuer,
 	oidcClientID,
 	oidcAudience string,
@@ -111,16 +233,27 @@ func NewRouter(
 	caPEM []byte,
 	caPrivKey *rsa.PrivateKey,
 
+	nodeCACfg *x509.Certificate,
+	nodeCAPrivKey *rsa.PrivateKey,
+
 	callCertValidity time.Duration,
 	benchmarkListenCertValidity time.Duration,
 	benchmarkClientCertValidity time.Duration,
+	nodeCertValidity time.Duration,
 
 	rsaBits int,
 
 	benchmarkLimit int64,
+
+	persister *persisters.ControlPlanePersister,
 ) *Router {
-	return &Router{
-		switches: map[string]SwitchMetadata{},
+	r := &Router{
+		switches:  map[string]SwitchMetadata{},
+		switchIDs: map[string]string{},
+
+		challenges: newRegistrationChallenges(),
+
+		gatewayAdapters: map[string]struct{}{},
 
 		testInterval:   testInterval,
 		testTimeout:    testTimeout,
@@ -128,9 +261,13 @@ func NewRouter(
 
 		graph: graph.New(graph.StringHash, graph.Directed(), graph.Weighted()),
 
-		routes: map[string][]string{},
+		routes:      map[string][]string{},
+		groupRoutes: map[string]*groupRouteTree{},
 
-		verbose: verbose,
+		pendingRoutes: map[string]*pendingRoute{},
+
+		disconnectedNodes: map[string]*time.Timer{},
+		reconnectTimeout:  reconnectTimeout,
 
 		auth: auth.NewJWTAuthn(oidcIssuer, oidcClientID, oidcAudience),
 
@@ -138,12 +275,23 @@ func NewRouter(
 		caPEM:     caPEM,
 		caPrivKey: caPrivKey,
 
+		nodeCACfg:     nodeCACfg,
+		nodeCAPrivKey: nodeCAPrivKey,
+
+		pendingNodeCerts: map[string]struct{}{},
+
 		callCertValidity:            callCertValidity,
 		benchmarkListenCertValidity: benchmarkListenCertValidity,
 		benchmarkClientCertValidity: benchmarkClientCertValidity,
+		nodeCertValidity:            nodeCertValidity,
 
 		rsaBits: rsaBits,
+
+		persister: persister,
 	}
+	r.verbose.Store(verbose)
+
+	return r
 }
 
 func (r *Router) Open(ctx context.Context) error {
@@ -160,9 +308,9 @@ func (r *Router) updateGraphs(ctx context.Context) error {
 
 	r.switchesLock.Unlock()
 
-	a := r.Gateway.getAdapters()
+	a, _ := r.getAdapters()
 
-	g, err := createNetworkGraph(s, a)
+	g, err := createNetworkGraph(getRoutableSwitches(s), a, true)
 	if err != nil {
 		return err
 	}
@@ -174,21 +322,344 @@ func (r *Router) updateGraphs(ctx context.Context) error {
 	r.routesLock.Lock()
 
 	routes := map[string][]string{}
+	groupRoutes := map[string]*groupRouteTree{}
 	for k, v := range r.routes {
+		if t, ok := r.groupRoutes[k]; ok {
+			groupRoutes[k] = t
+
+			continue
+		}
+
 		routes[k] = v
 	}
 
 	r.routesLock.Unlock()
 
+	// Group routes are trees, so we visualize each branch as a separate route
+	for routeID, t := range groupRoutes {
+		t.lock.Lock()
+		for memberID, branch := range t.members {
+			routes[routeID+"/"+memberID] = branch
+		}
+		t.lock.Unlock()
+	}
+
 	go func() {
-		if err := r.Metrics.visualize(ctx, s, a, routes); err != nil {
-			log.Println("Could visualize graph, continuing:", err)
+		if r.Metrics != nil {
+			if err := r.Metrics.visualize(ctx, s, a, routes); err != nil {
+				log.Println("Could visualize graph, continuing:", err)
+			}
+		}
+
+		if r.MetricsServices != nil {
+			for remoteID, peer := range r.MetricsServices() {
+				if err := peer.Visualize(ctx, s, a, routes); err != nil {
+					log.Println("Could not publish graph to metrics service with ID", remoteID, ", continuing:", err)
+				}
+			}
 		}
 	}()
 
 	return nil
 }
 
+// unregisterSwitch returns the node ID of the switch which registered on the connection with the remote ID
+func (r *Router) unregisterSwitch(remoteID string) (string, bool) {
+	r.switchesLock.Lock()
+	defer r.switchesLock.Unlock()
+
+	swID, ok := r.switchIDs[remoteID]
+	if ok {
+		delete(r.switchIDs, remoteID)
+	}
+
+	return swID, ok
+}
+
+// getSwitchID returns the node ID of the switch which is calling, or an empty string if it hasn't registered yet
+func (r *Router) getSwitchID(ctx context.Context) string {
+	r.switchesLock.Lock()
+	defer r.switchesLock.Unlock()
+
+	return r.switchIDs[rpc.GetRemoteID(ctx)]
+}
+
+// getPeers returns the registered switches by their node IDs
+func (r *Router) getPeers() map[string]SwitchRemote {
+	peers := r.Peers()
+
+	r.switchesLock.Lock()
+	defer r.switchesLock.Unlock()
+
+	switches := map[string]SwitchRemote{}
+	for remoteID, swID := range r.switchIDs {
+		if peer, ok := peers[remoteID]; ok {
+			switches[swID] = peer
+		}
+	}
+
+	return switches
+}
+
+// getAdapters returns the adapters of all gateways and the remotes which reach them through their gateways
+func (r *Router) getAdapters() (map[string]AdapterMetadata, map[string]AdapterRemote) {
+	adapters := map[string]AdapterMetadata{}
+	peers := map[string]AdapterRemote{}
+	complete := true
+	for remoteID, gateway := range r.Gateways() {
+		candidates, err := gateway.GetAdapters(context.Background())
+		if err != nil {
+			log.Println("Could not list adapters of gateway with ID", remoteID, ", continuing:", err)
+
+			complete = false
+
+			continue
+		}
+
+		for adapterID, am := range candidates {
+			adapters[adapterID] = am
+			peers[adapterID] = newGatewayAdapterRemote(gateway, adapterID)
+		}
+	}
+
+	// Adapters of gateways which couldn't be reached are only unregistered once their gateways disconnect
+	if !complete {
+		return adapters, peers
+	}
+
+	r.gatewayAdaptersLock.Lock()
+	r.gatewayAdapters = map[string]struct{}{}
+	for adapterID := range adapters {
+		r.gatewayAdapters[adapterID] = struct{}{}
+	}
+	r.gatewayAdaptersLock.Unlock()
+
+	return adapters, peers
+}
+
+// getAdapterGateway returns the gateway which the first of the adapters which is connected is connected to
+func (r *Router) getAdapterGateway(adapterIDs ...string) (GatewayServiceRemote, bool) {
+	for remoteID, gateway := range r.Gateways() {
+		candidates, err := gateway.GetAdapters(context.Background())
+		if err != nil {
+			log.Println("Could not list adapters of gateway with ID", remoteID, ", continuing:", err)
+
+			continue
+		}
+
+		for _, adapterID := range adapterIDs {
+			if _, ok := candidates[adapterID]; ok {
+				return gateway, true
+			}
+		}
+	}
+
+	return GatewayServiceRemote{}, false
+}
+
+// onGatewayDisconnect unregisters the adapters which were connected to a gateway that disconnected and which haven't
+// registered on another gateway
+func (r *Router) onGatewayDisconnect() {
+	r.gatewayAdaptersLock.Lock()
+	previous := r.gatewayAdapters
+	r.gatewayAdaptersLock.Unlock()
+
+	adapters, _ := r.getAdapters()
+
+	for adapterID := range previous {
+		if _, ok := adapters[adapterID]; ok {
+			continue
+		}
+
+		if err := r.unregisterAdapter(adapterID, true); err != nil {
+			log.Println("Could not unregister adapter with ID", adapterID, "of disconnected gateway, continuing:", err)
+		}
+	}
+}
+
+// registerAdapter adds an adapter which registered on a gateway to the topology and returns the CA certificate
+func (r *Router) registerAdapter(adapterID, email string) ([]byte, error) {
+	if err := r.persister.PutAdapter(persisters.AdapterRecord{
+		ID:        adapterID,
+		UserEmail: email,
+	}); err != nil {
+		return []byte{}, err
+	}
+
+	// Routes which the adapter had before it lost its connection continue on the new connection
+	resumedRouteIDs := r.registerNode(adapterID)
+
+	if err := r.updateGraphs(context.Background()); err != nil {
+		return []byte{}, err
+	}
+
+	// Routes which the adapter had before the control plane restarted are reconciled once it has registered
+	go r.reconcileAdapter(adapterID, resumedRouteIDs)
+
+	return r.caPEM, nil
+}
+
+// unregisterAdapter removes an adapter from the topology; if it disconnected, its routes are kept until the reconnect timeout
+func (r *Router) unregisterAdapter(adapterID string, disconnected bool) error {
+	if err := r.persister.DeleteAdapter(adapterID); err != nil {
+		log.Println("Could not delete adapter with ID", adapterID, "from persister, continuing:", err)
+	}
+
+	if disconnected {
+		go func() {
+			// Members leave group routes instead of ending them
+			r.leaveGroupRoutes(adapterID)
+
+			unprovision := func(groupRoutesOnly bool) {
+				if err := unprovisionRouteForPeer(r, adapterID, groupRoutesOnly); err != nil {
+					log.Println("Could not unprovision route for adapter with ID", adapterID, ", continuing:", err)
+				}
+			}
+
+			if r.awaitReconnect(adapterID, func() {
+				unprovision(false)
+			}) {
+				// Group routes which the adapter is the root of can't be resumed, so they are unprovisioned immediately
+				unprovision(true)
+
+				return
+			}
+
+			unprovision(false)
+		}()
+	}
+
+	return r.updateGraphs(context.Background())
+}
+
+func (r *Router) issueBenchmarkCertificate() (CertPair, error) {
+	benchmarkClientCertPEM, benchmarkClientPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.benchmarkClientCertValidity, "", "", utils.RoleBenchmarkClient)
+	if err != nil {
+		return CertPair{}, err
+	}
+
+	return CertPair{
+		CertPEM:        benchmarkClientCertPEM,
+		CertPrivKeyPEM: benchmarkClientPrivKeyPEM,
+	}, nil
+}
+
+// unprovisionRoute closes a route on its switches and adapters and returns the bytes which were transferred on it
+func (r *Router) unprovisionRoute(routeID, remoteID string) (int64, error) {
+	if r.verbose.Load() {
+		log.Println("Unprovisioning route with route ID", routeID)
+	}
+
+	routerPeers := r.getPeers()
+	_, gatewayPeers := r.getAdapters()
+
+	r.routesLock.Lock()
+
+	switchesToClose := map[string][]SwitchRemote{}
+	adaptersToClose := map[string][]AdapterRemote{}
+
+	route, ok := r.routes[routeID]
+	if !ok {
+		r.routesLock.Unlock()
+
+		return 0, ErrRouteNotFound
+	}
+
+	for _, candidateID := range route {
+		if sw, ok := routerPeers[candidateID]; ok {
+			switchesToClose[routeID] = append(switchesToClose[routeID], sw)
+		}
+
+		if ad, ok := gatewayPeers[candidateID]; ok {
+			adaptersToClose[routeID] = append(adaptersToClose[routeID], ad)
+		}
+	}
+
+	delete(r.routes, routeID)
+	delete(r.groupRoutes, routeID)
+
+	r.routesLock.Unlock()
+
+	transferred := unprovisionSwitchesAndAdapters(switchesToClose, adaptersToClose, remoteID)
+
+	if err := r.persister.DeleteRoute(routeID); err != nil {
+		log.Println("Could not delete route with ID", routeID, "from persister, continuing:", err)
+	}
+
+	if err := r.updateGraphs(context.Background()); err != nil {
+		return 0, err
+	}
+
+	return transferred[routeID], nil
+}
+
+// finishCall tells the gateways that a route which the router unprovisioned on its own has ended, so that the gateway
+// which the call belongs to can write its call detail record
+func (r *Router) finishCall(routeID, terminationReason, terminatedBy string, transferred int64) {
+	if err := r.persister.DeleteRoute(routeID); err != nil {
+		log.Println("Could not delete route with ID", routeID, "from persister, continuing:", err)
+	}
+
+	for remoteID, gateway := range r.Gateways() {
+		if err := gateway.FinishCall(context.Background(), routeID, terminationReason, terminatedBy, transferred); err != nil {
+			log.Println("Could not finish call with route ID", routeID, "on gateway with ID", remoteID, ", continuing:", err)
+		}
+	}
+}
+
+// hangupRoute unprovisions a route and finishes its call
+func (r *Router) hangupRoute(routeID, terminationReason, terminatedBy string) error {
+	transferred, err := r.unprovisionRoute(routeID, terminatedBy)
+	if err != nil {
+		return err
+	}
+
+	r.finishCall(routeID, terminationReason, terminatedBy, transferred)
+
+	return nil
+}
+
+// addCallDetailRecord persists the call detail record of a call which no gateway knows about anymore, e.g. because it
+// was recorded before the control plane restarted
+func (r *Router) addCallDetailRecord(cdr persisters.CallDetailRecord, terminationReason, terminatedBy string) {
+	if err := r.persister.AddCallDetailRecord(endCallDetailRecord(cdr, terminationReason, terminatedBy)); err != nil {
+		log.Println("Could not persist call detail record for route ID", cdr.RouteID, ", continuing:", err)
+	}
+}
+
+func (r *Router) onStepDown() {
+	r.switchesLock.Lock()
+	r.switches = map[string]SwitchMetadata{}
+	r.switchIDs = map[string]string{}
+	r.switchesLock.Unlock()
+
+	r.gatewayAdaptersLock.Lock()
+	r.gatewayAdapters = map[string]struct{}{}
+	r.gatewayAdaptersLock.Unlock()
+
+	r.routesLock.Lock()
+	r.routes = map[string][]string{}
+	r.groupRoutes = map[string]*groupRouteTree{}
+	r.routesLock.Unlock()
+
+	r.pendingRoutesLock.Lock()
+	r.pendingRoutes = map[string]*pendingRoute{}
+	r.pendingRoutesLock.Unlock()
+
+	// Routes of nodes which haven't reconnected yet are kept by the new leader
+	r.disconnectedNodesLock.Lock()
+	for nodeID, t := range r.disconnectedNodes {
+		t.Stop()
+
+		delete(r.disconnectedNodes, nodeID)
+	}
+	r.disconnectedNodesLock.Unlock()
+
+	r.graphLock.Lock()
+	r.graph = graph.New(graph.StringHash, graph.Directed(), graph.Weighted())
+	r.graphLock.Unlock()
+}
+
 func (r *Router) onClientDisconnect(remoteID string) error {
 	r.switchesLock.Lock()
 
@@ -196,21 +667,35 @@ func (r *Router) onClientDisconnect(remoteID string) error {
 
 	r.switchesLock.Unlock()
 
-	if r.verbose {
+	if err := r.persister.DeleteSwitch(remoteID); err != nil {
+		log.Println("Could not delete switch with ID", remoteID, "from persister, continuing:", err)
+	}
+
+	if r.verbose.Load() {
 		log.Println("Removed switch with ID", remoteID, "from topology")
 	}
 
 	return r.updateGraphs(context.Background())
 }
 
+func (r *Router) getTestInterval() time.Duration {
+	r.testIntervalLock.Lock()
+	defer r.testIntervalLock.Unlock()
+
+	return r.testInterval
+}
+
 func (r *Router) onOpen() {
-	t := time.NewTicker(r.testInterval)
+	t := time.NewTicker(r.getTestInterval())
 	defer t.Stop()
 
 	for range t.C {
+		// The test interval can be changed while the router is running
+		t.Reset(r.getTestInterval())
+
 		var wg sync.WaitGroup
 
-		for remoteID, peer := range r.Peers() {
+		for remoteID, peer := range r.getPeers() {
 			wg.Add(2)
 
 			r.switchesLock.Lock()
@@ -222,6 +707,11 @@ func (r *Router) onOpen() {
 					continue
 				}
 
+				// Switches behind NAT can't be dialed directly, we'll try to punch a hole to them instead
+				if !sw.NAT.IsPubliclyReachable() {
+					continue
+				}
+
 				addrs = append(addrs, sw.Addr)
 				swIDs = append(swIDs, swID)
 			}
@@ -230,7 +720,7 @@ func (r *Router) onOpen() {
 			go func(remoteID string, peer SwitchRemote) {
 				defer wg.Done()
 
-				if r.verbose {
+				if r.verbose.Load() {
 					log.Println("Starting latency tests for switch with ID", remoteID)
 				}
 
@@ -275,7 +765,7 @@ func (r *Router) onOpen() {
 
 				r.switchesLock.Unlock()
 
-				if r.verbose {
+				if r.verbose.Load() {
 					log.Println("Finished latency tests for switch with ID", remoteID, ":", sm.Latencies)
 				}
 
@@ -287,7 +777,7 @@ func (r *Router) onOpen() {
 			go func(remoteID string, peer SwitchRemote) {
 				defer wg.Done()
 
-				if r.verbose {
+				if r.verbose.Load() {
 					log.Println("Starting throughput tests for switch with ID", remoteID)
 				}
 
@@ -332,7 +822,7 @@ func (r *Router) onOpen() {
 
 				r.switchesLock.Unlock()
 
-				if r.verbose {
+				if r.verbose.Load() {
 					log.Println("Finished throughput tests for switch with ID", remoteID, ":", sm.Throughputs)
 				}
 
@@ -346,6 +836,13 @@ func (r *Router) onOpen() {
 	}
 }
 
+func (r *Router) getRoute(routeID string) []string {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+
+	return append([]string{}, r.routes[routeID]...)
+}
+
 func (r *Router) getSwitches() map[string]SwitchMetadata {
 	r.switchesLock.Lock()
 	defer r.switchesLock.Unlock()
@@ -358,57 +855,399 @@ func (r *Router) getSwitches() map[string]SwitchMetadata {
 	return a
 }
 
-func (r *Router) provisionRoute(srcID, dstID, routeID, channelID string) error {
-	if r.verbose {
-		log.Println("Provisioning route from", srcID, "to", dstID, "with route ID", routeID)
+// getRoutableSwitches returns the switches which new routes may be provisioned through
+func getRoutableSwitches(switches map[string]SwitchMetadata) map[string]SwitchMetadata {
+	a := map[string]SwitchMetadata{}
+	for k, v := range switches {
+		if !v.Draining {
+			a[k] = v
+		}
 	}
 
-	r.graphLock.Lock()
-
-	path, err := graph.ShortestPath(r.graph, srcID, dstID)
-	if err != nil {
-		r.graphLock.Unlock()
+	return a
+}
 
-		return err
+func (r *Router) getPubliclyReachableSwitches() map[string]SwitchMetadata {
+	a := map[string]SwitchMetadata{}
+	for k, v := range getRoutableSwitches(r.getSwitches()) {
+		if v.NAT.IsPubliclyReachable() {
+			a[k] = v
+		}
 	}
 
-	if len(path) < 3 {
-		r.graphLock.Unlock()
+	return a
+}
 
-		return ErrRouteNotFound
-	}
+// punchesHole returns whether the switch at the index of a chain (which is in provisioning order, i.e. starts at the switch next
+// to the destination adapter) has to punch a hole to the next switch in the chain
+func punchesHole(chain []SwitchMetadata, i int) bool {
+	// The last switch in the chain is dialed by the source adapter, which can't punch holes
+	return i != len(chain)-1 && !chain[i].NAT.IsPubliclyReachable()
+}
 
-	r.graphLock.Unlock()
+func (r *Router) requiresHolePunch(path []string) bool {
+	if len(path) < 3 {
+		return false
+	}
 
-	routerPeers := r.Peers()
 	switches := r.getSwitches()
 
-	switchesToProvision := []SwitchRemote{}
-	switchMetadata := []SwitchMetadata{}
+	chain := []SwitchMetadata{}
 	for _, swID := range path[1 : len(path)-1] {
-		sw, ok := routerPeers[swID]
+		sw, ok := switches[swID]
 		if !ok {
-			return ErrSwitchNotFound
+			return false
 		}
 
-		md, ok := switches[swID]
-		if !ok {
-			return ErrSwitchNotFound
-		}
+		chain = append([]SwitchMetadata{sw}, chain...)
+	}
 
-		switchesToProvision = append([]SwitchRemote{sw}, switchesToProvision...)
-		switchMetadata = append([]SwitchMetadata{md}, switchMetadata...)
+	for i := range chain {
+		if punchesHole(chain, i) {
+			return true
+		}
 	}
 
-	egressLaddr := ""
-	ingressRaddr := ""
-	for i, sw := range switchesToProvision {
-		publicIP, err := sw.GetPublicIP(context.Background())
+	return false
+}
+
+func getPathWeight(g graph.Graph[string, string], path []string) (int, error) {
+	weight := 0
+	for i := 1; i < len(path); i++ {
+		edge, err := g.Edge(path[i-1], path[i])
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		var (
+		weight += edge.Properties.Weight
+	}
+
+	return weight, nil
+}
+
+func (r *Router) prepareDirectRoute(src, dst AdapterRemote, routeID, channelID string) (string, time.Duration, error) {
+	ips, err := dst.GetCandidates(context.Background())
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(ips) < 1 {
+		return "", 0, ErrNoDirectRouteCandidates
+	}
+
+	adapterListenCertPEM, adapterListenCertPrivKeyPEM, err := utils.GenerateCertificateForIPs(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, ips, utils.RoleAdapterListener)
+	if err != nil {
+		return "", 0, err
+	}
+
+	candidates, err := dst.PrepareDirectRoute(
+		context.Background(),
+		routeID,
+		channelID,
+		CertPair{
+			CertPEM:        adapterListenCertPEM,
+			CertPrivKeyPEM: adapterListenCertPrivKeyPEM,
+		},
+	)
+	if err != nil {
+		return "", 0, err
+	}
+
+	benchmarkClientCertPEM, benchmarkClientPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.benchmarkClientCertValidity, "", "", utils.RoleBenchmarkClient)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var (
+		wg sync.WaitGroup
+
+		bestCandidateLock sync.Mutex
+		bestCandidate     = ""
+		bestLatency       time.Duration
+	)
+
+	// Candidates are tested individually so that an unreachable candidate doesn't invalidate the others
+	for _, candidate := range candidates {
+		wg.Add(1)
+
+		go func(candidate string) {
+			defer wg.Done()
+
+			latencies, err := src.TestLatency(context.Background(), r.testTimeout, []string{candidate}, CertPair{
+				CertPEM:        benchmarkClientCertPEM,
+				CertPrivKeyPEM: benchmarkClientPrivKeyPEM,
+			})
+			if err != nil || len(latencies) < 1 {
+				if r.verbose.Load() {
+					log.Println("Could not reach direct route candidate", candidate, "for route with ID", routeID, ", skipping:", err)
+				}
+
+				return
+			}
+
+			bestCandidateLock.Lock()
+			defer bestCandidateLock.Unlock()
+
+			if bestCandidate == "" || latencies[0] < bestLatency {
+				bestCandidate = candidate
+				bestLatency = latencies[0]
+			}
+		}(candidate)
+	}
+
+	wg.Wait()
+
+	if bestCandidate == "" {
+		return "", 0, ErrNoDirectRouteCandidates
+	}
+
+	return bestCandidate, bestLatency, nil
+}
+
+func (r *Router) provisionDirectRoute(src AdapterRemote, routeID, channelID, raddr string) error {
+	adapterSrcCertPEM, adapterSrcCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleAdapterClient)
+	if err != nil {
+		return err
+	}
+
+	return src.ProvisionRoute(
+		context.Background(),
+		routeID,
+		channelID,
+		raddr,
+		CertPair{
+			CertPEM:        adapterSrcCertPEM,
+			CertPrivKeyPEM: adapterSrcCertPrivKeyPEM,
+		},
+	)
+}
+
+func (r *Router) provisionRoute(srcID, dstID, routeID, channelID string) error {
+	if r.verbose.Load() {
+		log.Println("Provisioning route from", srcID, "to", dstID, "with route ID", routeID)
+	}
+
+	_, adapters := r.getAdapters()
+
+	src, ok := adapters[srcID]
+	if !ok {
+		return ErrAdapterNotFound
+	}
+
+	dst, ok := adapters[dstID]
+	if !ok {
+		return ErrAdapterNotFound
+	}
+
+	r.graphLock.Lock()
+
+	relayWeight := 0
+	path, relayErr := graph.ShortestPath(r.graph, srcID, dstID)
+	if relayErr == nil {
+		if len(path) < 3 {
+			relayErr = ErrRouteNotFound
+		} else {
+			relayWeight, relayErr = getPathWeight(r.graph, path)
+		}
+	}
+
+	r.graphLock.Unlock()
+
+	// Prefer a direct route if it is cheaper than relaying through switches, or if there is no route through switches
+	candidate, directLatency, err := r.prepareDirectRoute(src, dst, routeID, channelID)
+	if err != nil {
+		if r.verbose.Load() {
+			log.Println("Could not prepare direct route with ID", routeID, ", continuing with switches:", err)
+		}
+	} else if relayErr != nil || int(directLatency.Nanoseconds()) <= relayWeight {
+		if r.verbose.Load() {
+			log.Println("Provisioning direct route with ID", routeID, "to candidate", candidate)
+		}
+
+		if err := r.provisionDirectRoute(src, routeID, channelID, candidate); err == nil {
+			r.routesLock.Lock()
+			r.routes[routeID] = []string{srcID, dstID}
+			r.routesLock.Unlock()
+
+			return r.updateGraphs(context.Background())
+		} else if r.verbose.Load() {
+			log.Println("Could not provision direct route with ID", routeID, ", continuing with switches:", err)
+		}
+	}
+
+	if relayErr != nil {
+		// Close the pending direct route, if there is one
+		_, _ = dst.UnprovisionRoute(context.Background(), routeID)
+
+		return relayErr
+	}
+
+	path, err = r.provisionRelayedRoute(path, srcID, dstID, routeID, channelID)
+	if err != nil {
+		_, _ = dst.UnprovisionRoute(context.Background(), routeID)
+
+		return err
+	}
+
+	r.routesLock.Lock()
+	r.routes[routeID] = path
+	r.routesLock.Unlock()
+
+	if err := r.updateGraphs(context.Background()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Router) provisionRelayedRoute(path []string, srcID, dstID, routeID, channelID string) ([]string, error) {
+	if err := r.provisionPath(path, routeID, channelID); err != nil {
+		if !r.requiresHolePunch(path) {
+			return []string{}, err
+		}
+
+		log.Println("Could not provision route with ID", routeID, "using hole punching, falling back to publicly reachable switches:", err)
+
+		r.unprovisionPath(path, routeID)
+
+		adapters, _ := r.getAdapters()
+
+		g, err := createNetworkGraph(getRoutableSwitches(r.getSwitches()), adapters, false)
+		if err != nil {
+			return []string{}, err
+		}
+
+		path, err = graph.ShortestPath(g, srcID, dstID)
+		if err != nil {
+			return []string{}, err
+		}
+
+		if err := r.provisionPath(path, routeID, channelID); err != nil {
+			return []string{}, err
+		}
+	}
+
+	return path, nil
+}
+
+func (r *Router) unprovisionPath(path []string, routeID string) {
+	if len(path) < 3 {
+		return
+	}
+
+	r.unprovisionSwitches(path[1:len(path)-1], routeID)
+}
+
+func (r *Router) unprovisionSwitches(swIDs []string, routeID string) {
+	routerPeers := r.getPeers()
+
+	switchesToClose := map[string][]SwitchRemote{}
+	for _, swID := range swIDs {
+		if sw, ok := routerPeers[swID]; ok {
+			switchesToClose[routeID] = append(switchesToClose[routeID], sw)
+		}
+	}
+
+	unprovisionSwitchesAndAdapters(switchesToClose, map[string][]AdapterRemote{}, "")
+}
+
+func (r *Router) provisionPath(path []string, routeID, channelID string) error {
+	if len(path) < 3 {
+		return ErrRouteNotFound
+	}
+
+	egressLaddr, ingressRaddr, err := r.provisionSwitches(path[1:len(path)-1], routeID, nil)
+	if err != nil {
+		return err
+	}
+
+	_, adapters := r.getAdapters()
+
+	dst, ok := adapters[path[0]]
+	if !ok {
+		return ErrAdapterNotFound
+	}
+
+	src, ok := adapters[path[len(path)-1]]
+	if !ok {
+		return ErrAdapterNotFound
+	}
+
+	adapterDstCertPEM, adapterDstCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleAdapterClient)
+	if err != nil {
+		return err
+	}
+
+	if err := dst.ProvisionRoute(
+		context.Background(),
+		routeID,
+		channelID,
+		egressLaddr,
+		CertPair{
+			CertPEM:        adapterDstCertPEM,
+			CertPrivKeyPEM: adapterDstCertPrivKeyPEM,
+		},
+	); err != nil {
+		return err
+	}
+
+	return r.provisionPathSrc(src, routeID, channelID, ingressRaddr)
+}
+
+func (r *Router) provisionPathSrc(src AdapterRemote, routeID, channelID, ingressRaddr string) error {
+	adapterSrcCertPEM, adapterSrcCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleAdapterClient)
+	if err != nil {
+		return err
+	}
+
+	return src.ProvisionRoute(
+		context.Background(),
+		routeID,
+		channelID,
+		ingressRaddr,
+		CertPair{
+			CertPEM:        adapterSrcCertPEM,
+			CertPrivKeyPEM: adapterSrcCertPrivKeyPEM,
+		},
+	)
+}
+
+// provisionSwitches chains the switches and returns the addresses which the adapters at both ends of the path dial;
+// if a foreign border is set, the first switch in the chain dials the border switch of a federated control plane instead of listening for an adapter
+func (r *Router) provisionSwitches(swIDs []string, routeID string, foreign *ForeignBorder) (string, string, error) {
+	routerPeers := r.getPeers()
+	switches := r.getSwitches()
+
+	switchesToProvision := []SwitchRemote{}
+	switchMetadata := []SwitchMetadata{}
+	for _, swID := range swIDs {
+		sw, ok := routerPeers[swID]
+		if !ok {
+			return "", "", ErrSwitchNotFound
+		}
+
+		md, ok := switches[swID]
+		if !ok {
+			return "", "", ErrSwitchNotFound
+		}
+
+		switchesToProvision = append([]SwitchRemote{sw}, switchesToProvision...)
+		switchMetadata = append([]SwitchMetadata{md}, switchMetadata...)
+	}
+
+	egressLaddr := ""
+	ingressRaddr := ""
+	if foreign != nil {
+		ingressRaddr = foreign.Raddr
+	}
+
+	for i, sw := range switchesToProvision {
+		publicIP, err := sw.GetPublicIP(context.Background())
+		if err != nil {
+			return "", "", err
+		}
+
+		var (
 			switchListenCertPEM,
 			switchListenCertPrivKeyPEM,
 			switchClientCertPEM,
@@ -421,23 +1260,46 @@ func (r *Router) provisionRoute(srcID, dstID, routeID, channelID string) error {
 		if i != len(switchesToProvision)-1 {
 			switchListenCertPEM, switchListenCertPrivKeyPEM, err = utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, publicIP, utils.RoleSwitchListener)
 			if err != nil {
-				return err
+				return "", "", err
 			}
 		}
 
 		// Create a switch client certificate for all but the first switch in the chain
-		if i == 0 && i != len(switchesToProvision)-1 {
+		if i != 0 {
 			switchClientCertPEM, switchClientCertPrivKeyPEM, err = utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleSwitchClient)
 			if err != nil {
-				return err
+				return "", "", err
 			}
 		}
 
+		// The foreign border switch issues the client certificate for the first switch in the chain and authenticates with its own CA
+		var raddrCAPEM []byte
+		if i == 0 && foreign != nil {
+			switchClientCertPEM = foreign.Cert.CertPEM
+			switchClientCertPrivKeyPEM = foreign.Cert.CertPrivKeyPEM
+			raddrCAPEM = foreign.CAPEM
+		}
+
 		// Create an adapter listen certificate for the first and last switches in the chain
 		if i == 0 || i == len(switchesToProvision)-1 {
 			adapterListenCertPEM, adapterListenCertPrivKeyPEM, err = utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, publicIP, utils.RoleAdapterListener)
 			if err != nil {
-				return err
+				return "", "", err
+			}
+		}
+
+		// Switches behind NAT can't listen for the next switch in the chain, so we punch a hole between them
+		punchRaddr := ""
+		punchLaddr := ""
+		if punchesHole(switchMetadata, i) {
+			punchRaddr, err = switchesToProvision[i+1].PrepareHolePunch(context.Background(), routeID, HolePunchSideSrc)
+			if err != nil {
+				return "", "", err
+			}
+
+			punchLaddr, err = sw.PrepareHolePunch(context.Background(), routeID, HolePunchSideDst)
+			if err != nil {
+				return "", "", err
 			}
 		}
 
@@ -445,6 +1307,7 @@ func (r *Router) provisionRoute(srcID, dstID, routeID, channelID string) error {
 			context.Background(),
 			routeID,
 			ingressRaddr,
+			punchRaddr,
 			CertPair{
 				CertPEM:        switchListenCertPEM,
 				CertPrivKeyPEM: switchListenCertPrivKeyPEM,
@@ -457,240 +1320,803 @@ func (r *Router) provisionRoute(srcID, dstID, routeID, channelID string) error {
 				CertPEM:        adapterListenCertPEM,
 				CertPrivKeyPEM: adapterListenCertPrivKeyPEM,
 			},
+			raddrCAPEM,
 		)
 		if err != nil {
+			return "", "", err
+		}
+
+		newRaddr, err := net.ResolveTCPAddr("tcp", switchMetadata[i].Addr)
+		if err != nil {
+			return "", "", err
+		}
+
+		if i == 0 && foreign == nil {
+			if len(laddrs) != 2 {
+				return "", "", ErrInvalidPortsCount
+			}
+
+			newLaddr, err := net.ResolveTCPAddr("tcp", laddrs[0])
+			if err != nil {
+				return "", "", err
+			}
+
+			newRaddr.Port = newLaddr.Port
+
+			egressLaddr = newRaddr.String()
+
+			laddrs = []string{laddrs[1]}
+		} else {
+			if len(laddrs) != 1 {
+				return "", "", ErrInvalidPortsCount
+			}
+		}
+
+		if punchLaddr != "" {
+			ingressRaddr = punchLaddr
+
+			continue
+		}
+
+		newLaddr, err := net.ResolveTCPAddr("tcp", laddrs[0])
+		if err != nil {
+			return "", "", err
+		}
+
+		newRaddr.Port = newLaddr.Port
+
+		ingressRaddr = newRaddr.String()
+	}
+
+	return egressLaddr, ingressRaddr, nil
+}
+
+func unprovisionRouteForPeer(r *Router, remoteID string, groupRoutesOnly bool) error {
+	if r.verbose.Load() {
+		log.Println("Unprovisioning all routes for peer", remoteID)
+	}
+
+	routerPeers := r.getPeers()
+	_, gatewayPeers := r.getAdapters()
+
+	r.routesLock.Lock()
+
+	switchesToClose := map[string][]SwitchRemote{}
+	adaptersToClose := map[string][]AdapterRemote{}
+	routeIDs := []string{}
+
+	for routeID, route := range r.routes {
+		if _, ok := r.groupRoutes[routeID]; groupRoutesOnly && !ok {
+			continue
+		}
+
+		if slices.Contains(route, remoteID) {
+			for _, candidateID := range route {
+				if remoteID == candidateID {
+					// Don't call `close` on the peer with `remoteID` as its already disconnected at this point
+					continue
+				}
+
+				if sw, ok := routerPeers[candidateID]; ok {
+					if _, ok := switchesToClose[routeID]; !ok {
+						switchesToClose[routeID] = []SwitchRemote{}
+					}
+
+					switchesToClose[routeID] = append(switchesToClose[routeID], sw)
+				}
+
+				if ad, ok := gatewayPeers[candidateID]; ok {
+					if _, ok := adaptersToClose[routeID]; !ok {
+						adaptersToClose[routeID] = []AdapterRemote{}
+					}
+
+					adaptersToClose[routeID] = append(adaptersToClose[routeID], ad)
+				}
+			}
+
+			delete(r.routes, routeID)
+			delete(r.groupRoutes, routeID)
+
+			routeIDs = append(routeIDs, routeID)
+		}
+	}
+
+	r.routesLock.Unlock()
+
+	transferred := unprovisionSwitchesAndAdapters(switchesToClose, adaptersToClose, remoteID)
+
+	for _, routeID := range routeIDs {
+		r.finishCall(routeID, TerminationReasonDisconnected, remoteID, transferred[routeID])
+	}
+
+	if err := r.updateGraphs(context.Background()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// unprovisionSwitchesAndAdapters returns the bytes which were transferred on each route
+func unprovisionSwitchesAndAdapters(switchesToClose map[string][]SwitchRemote, adaptersToClose map[string][]AdapterRemote, remoteID string) map[string]int64 {
+	var wg sync.WaitGroup
+
+	var transferredLock sync.Mutex
+	transferred := map[string]int64{}
+
+	for routeID, peers := range switchesToClose {
+		for _, sw := range peers {
+			wg.Add(1)
+
+			go func(routeID string, sw SwitchRemote) {
+				defer wg.Done()
+
+				if err := sw.UnprovisionRoute(context.Background(), routeID); err != nil {
+					log.Println("Could not unprovision route", routeID, "for switch with ID", remoteID, ", continuing:", err)
+				}
+			}(routeID, sw)
+		}
+	}
+
+	for routeID, peers := range adaptersToClose {
+		for _, ad := range peers {
+			wg.Add(1)
+
+			go func(routeID string, ad AdapterRemote) {
+				defer wg.Done()
+
+				n, err := ad.UnprovisionRoute(context.Background(), routeID)
+				if err != nil {
+					log.Println("Could not unprovision route", routeID, "for adapter with ID", remoteID, ", continuing:", err)
+
+					return
+				}
+
+				// Both adapters see the same stream, so we use the larger count in case one of them already disconnected
+				transferredLock.Lock()
+				if n > transferred[routeID] {
+					transferred[routeID] = n
+				}
+				transferredLock.Unlock()
+			}(routeID, ad)
+		}
+	}
+
+	wg.Wait()
+
+	return transferred
+}
+
+func (r *Router) GetRegistrationChallenge(ctx context.Context) ([]byte, error) {
+	return r.challenges.issue(rpc.GetRemoteID(ctx))
+}
+
+// EnrollSwitch issues a node certificate for the identity of a switch, which it can register with instead of a token
+func (r *Router) EnrollSwitch(ctx context.Context, token string, identity NodeIdentity) (NodeCertificate, error) {
+	if err := r.auth.Validate(token); err != nil {
+		return NodeCertificate{}, err
+	}
+
+	swID, err := r.challenges.verify(rpc.GetRemoteID(ctx), identity)
+	if err != nil {
+		return NodeCertificate{}, err
+	}
+
+	certPEM, err := utils.GenerateNodeCertificate(r.nodeCACfg, r.nodeCAPrivKey, r.nodeCertValidity, identity.PublicKey, utils.RoleSwitchNode)
+	if err != nil {
+		return NodeCertificate{}, err
+	}
+
+	if r.verbose.Load() {
+		log.Println("Enrolled switch with ID", swID)
+	}
+
+	return NodeCertificate{
+		CAPEM:   r.caPEM,
+		CertPEM: certPEM,
+	}, nil
+}
+
+// authorizeSwitch accepts switches which present a node certificate without a token, so that enrolled switches can
+// register while the OIDC provider is unavailable
+func (r *Router) authorizeSwitch(token string, identity NodeIdentity) (*x509.Certificate, error) {
+	if len(identity.CertPEM) < 1 {
+		return nil, r.auth.Validate(token)
+	}
+
+	block, _ := pem.Decode(identity.CertPEM)
+	if block == nil {
+		return nil, utils.ErrInvalidNodeCertificate
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := utils.VerifyNodeCertificate(r.caPEM, cert, utils.RoleSwitchNode); err != nil {
+		return nil, err
+	}
+
+	// The registration challenge is signed with the key of the identity, so this proves that the switch owns the certificate
+	if pubKey, ok := cert.PublicKey.(ed25519.PublicKey); !ok || !pubKey.Equal(ed25519.PublicKey(identity.PublicKey)) {
+		return nil, utils.ErrInvalidNodeCertificate
+	}
+
+	return cert, nil
+}
+
+func (r *Router) RegisterSwitch(ctx context.Context, token string, identity NodeIdentity, addr string, nat utils.NATInfo, border bool) (SwitchConfiguration, error) {
+	cert, err := r.authorizeSwitch(token, identity)
+	if err != nil {
+		return SwitchConfiguration{}, err
+	}
+
+	// Border switches of federated control planes dial each other directly
+	if border && !nat.IsPubliclyReachable() {
+		return SwitchConfiguration{}, ErrBorderSwitchNotPubliclyReachable
+	}
+
+	remoteID := rpc.GetRemoteID(ctx)
+
+	swID, err := r.challenges.verify(remoteID, identity)
+	if err != nil {
+		return SwitchConfiguration{}, err
+	}
+
+	parsedAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return SwitchConfiguration{}, err
+	}
+
+	r.switchesLock.Lock()
+
+	if _, ok := r.switchIDs[remoteID]; ok {
+		r.switchesLock.Unlock()
+
+		return SwitchConfiguration{}, ErrSwitchAlreadyRegistered
+	}
+
+	// A switch which registers again before its previous connection timed out takes over its node ID
+	for candidateID, candidateSwID := range r.switchIDs {
+		if candidateSwID == swID {
+			delete(r.switchIDs, candidateID)
+		}
+	}
+
+	r.switchIDs[remoteID] = swID
+
+	r.switches[swID] = SwitchMetadata{
+		addr,
+		map[string]time.Duration{},
+		map[string]ThroughputResult{},
+		nat,
+		border,
+		false,
+	}
+
+	if r.verbose.Load() {
+		log.Println("Added switch with ID", swID, ", NAT type", nat.Type, "and border", border, "to topology")
+	}
+
+	r.switchesLock.Unlock()
+
+	if err := r.persister.PutSwitch(persisters.SwitchRecord{
+		ID:   swID,
+		Addr: addr,
+	}); err != nil {
+		return SwitchConfiguration{}, err
+	}
+
+	// Routes which the switch provisioned before it lost its connection continue on the new connection
+	resumedRouteIDs := r.registerNode(swID)
+
+	if err := r.updateGraphs(context.Background()); err != nil {
+		return SwitchConfiguration{}, err
+	}
+
+	// Routes which the switch provisioned before the control plane restarted are reconciled once it has registered
+	go r.reconcileSwitch(swID, resumedRouteIDs)
+
+	benchmarkListenCertPEM, benchmarkListenCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, "", parsedAddr.IP.String(), utils.RoleAdapterListener)
+	if err != nil {
+		return SwitchConfiguration{}, err
+	}
+
+	// Node certificates of the current CA are re-issued by the next CA while it is being rotated to
+	nodeCertPEM := []byte{}
+	if cert != nil && (time.Until(cert.NotAfter) < r.nodeCertValidity/2 || cert.CheckSignatureFrom(r.nodeCACfg) != nil) {
+		nodeCertPEM, err = utils.GenerateNodeCertificate(r.nodeCACfg, r.nodeCAPrivKey, r.nodeCertValidity, identity.PublicKey, utils.RoleSwitchNode)
+		if err != nil {
+			return SwitchConfiguration{}, err
+		}
+
+		if r.verbose.Load() {
+			log.Println("Renewed node certificate of switch with ID", swID)
+		}
+	}
+
+	r.pendingNodeCertsLock.Lock()
+	delete(r.pendingNodeCerts, swID)
+	r.pendingNodeCertsLock.Unlock()
+
+	return SwitchConfiguration{
+		CAPEM: r.caPEM,
+		BenchmarkListenCert: CertPair{
+			CertPEM:        benchmarkListenCertPEM,
+			CertPrivKeyPEM: benchmarkListenCertPrivKeyPEM,
+		},
+		BenchmarkLimit: r.benchmarkLimit,
+		NodeCertPEM:    nodeCertPEM,
+	}, nil
+}
+
+// isRotatingCA returns whether node certificates are issued by the next CA
+func (r *Router) isRotatingCA() bool {
+	return !r.nodeCACfg.Equal(r.caCfg)
+}
+
+// getPendingNodeCertificates returns the IDs of the switches which haven't been re-issued node certificates by the next CA yet
+func (r *Router) getPendingNodeCertificates() []string {
+	r.pendingNodeCertsLock.Lock()
+	defer r.pendingNodeCertsLock.Unlock()
+
+	swIDs := []string{}
+	for swID := range r.pendingNodeCerts {
+		swIDs = append(swIDs, swID)
+	}
+
+	slices.Sort(swIDs)
+
+	return swIDs
+}
+
+// drainSwitch stops provisioning new routes through a switch; routes which are already provisioned through it continue until they are hung up
+func (r *Router) drainSwitch(swID string) error {
+	r.switchesLock.Lock()
+
+	sm, ok := r.switches[swID]
+	if !ok {
+		r.switchesLock.Unlock()
+
+		return ErrSwitchNotFound
+	}
+
+	sm.Draining = true
+
+	r.switches[swID] = sm
+
+	r.switchesLock.Unlock()
+
+	if r.verbose.Load() {
+		log.Println("Draining switch with ID", swID)
+	}
+
+	return r.updateGraphs(context.Background())
+}
+
+func (r *Router) DrainSwitch(ctx context.Context, token string) error {
+	// Enrolled switches don't have a token, but they can only drain themselves once they have registered with their node certificate
+	if token != "" {
+		if err := r.auth.Validate(token); err != nil {
 			return err
 		}
+	}
 
-		newRaddr, err := net.ResolveTCPAddr("tcp", switchMetadata[i].Addr)
+	return r.drainSwitch(r.getSwitchID(ctx))
+}
+
+func (r *Router) getGroupRouteTree(routeID string) (*groupRouteTree, bool) {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+
+	t, ok := r.groupRoutes[routeID]
+
+	return t, ok
+}
+
+func (r *Router) setGroupRouteNodes(routeID string, t *groupRouteTree) {
+	r.routesLock.Lock()
+	defer r.routesLock.Unlock()
+
+	// The group route might have been hung up in the meantime
+	if _, ok := r.groupRoutes[routeID]; ok {
+		r.routes[routeID] = t.getNodes()
+	}
+}
+
+func (r *Router) createGroupGraph() (graph.Graph[string, string], error) {
+	// Switches in group routes listen for their downstreams, so only publicly reachable switches can be part of the tree
+	adapters, _ := r.getAdapters()
+
+	return createNetworkGraph(r.getPubliclyReachableSwitches(), adapters, false)
+}
+
+// provisionGroupSwitch returns the address which the upstream adapter should dial (only for the top switch) and the address which downstreams should dial
+func (r *Router) provisionGroupSwitch(sw SwitchRemote, md SwitchMetadata, routeID, raddr string) (string, string, error) {
+	publicIP, err := sw.GetPublicIP(context.Background())
+	if err != nil {
+		return "", "", err
+	}
+
+	switchListenCertPEM, switchListenCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, publicIP, utils.RoleSwitchListener)
+	if err != nil {
+		return "", "", err
+	}
+
+	var switchClientCertPEM, switchClientCertPrivKeyPEM []byte
+	if raddr != "" {
+		switchClientCertPEM, switchClientCertPrivKeyPEM, err = utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleSwitchClient)
 		if err != nil {
-			return err
+			return "", "", err
 		}
+	}
 
-		if i == 0 {
-			if len(laddrs) != 2 {
-				return ErrInvalidPortsCount
-			}
+	laddrs, err := sw.ProvisionGroupRoute(
+		context.Background(),
+		routeID,
+		raddr,
+		CertPair{
+			CertPEM:        switchListenCertPEM,
+			CertPrivKeyPEM: switchListenCertPrivKeyPEM,
+		},
+		CertPair{
+			CertPEM:        switchClientCertPEM,
+			CertPrivKeyPEM: switchClientCertPrivKeyPEM,
+		},
+	)
+	if err != nil {
+		return "", "", err
+	}
 
-			newLaddr, err := net.ResolveTCPAddr("tcp", laddrs[0])
-			if err != nil {
-				return err
-			}
+	expectedPorts := 1
+	if raddr == "" {
+		expectedPorts = 2
+	}
 
-			newRaddr.Port = newLaddr.Port
+	if len(laddrs) != expectedPorts {
+		_ = sw.UnprovisionRoute(context.Background(), routeID)
 
-			egressLaddr = newRaddr.String()
+		return "", "", ErrInvalidPortsCount
+	}
 
-			laddrs = []string{laddrs[1]}
-		} else {
-			if len(laddrs) != 1 {
-				return ErrInvalidPortsCount
-			}
+	// The switches listen on their local addresses, but are reachable on their public addresses
+	addrs := []string{}
+	for _, laddr := range laddrs {
+		newRaddr, err := net.ResolveTCPAddr("tcp", md.Addr)
+		if err != nil {
+			_ = sw.UnprovisionRoute(context.Background(), routeID)
+
+			return "", "", err
 		}
 
-		newLaddr, err := net.ResolveTCPAddr("tcp", laddrs[0])
+		newLaddr, err := net.ResolveTCPAddr("tcp", laddr)
 		if err != nil {
-			return err
+			_ = sw.UnprovisionRoute(context.Background(), routeID)
+
+			return "", "", err
 		}
 
 		newRaddr.Port = newLaddr.Port
 
-		ingressRaddr = newRaddr.String()
+		addrs = append(addrs, newRaddr.String())
 	}
 
-	adapters := r.Gateway.Peers()
+	if raddr == "" {
+		return addrs[0], addrs[1], nil
+	}
 
-	dst, ok := adapters[path[0]]
-	if !ok {
-		return ErrAdapterNotFound
+	return "", addrs[0], nil
+}
+
+// provisionGroupRoute returns the IDs of the members which could join the group route
+func (r *Router) provisionGroupRoute(rootID, routeID, channelID string, memberIDs []string) ([]string, error) {
+	if r.verbose.Load() {
+		log.Println("Provisioning group route from", rootID, "to", memberIDs, "with route ID", routeID)
 	}
 
-	src, ok := adapters[path[len(path)-1]]
+	_, adapters := r.getAdapters()
+
+	root, ok := adapters[rootID]
 	if !ok {
-		return ErrAdapterNotFound
+		return []string{}, ErrAdapterNotFound
 	}
 
-	adapterDstCertPEM, adapterDstCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleAdapterClient)
+	g, err := r.createGroupGraph()
 	if err != nil {
-		return err
+		return []string{}, err
 	}
 
-	if err := dst.ProvisionRoute(
-		context.Background(),
-		routeID,
-		channelID,
-		egressLaddr,
-		CertPair{
-			CertPEM:        adapterDstCertPEM,
-			CertPrivKeyPEM: adapterDstCertPrivKeyPEM,
-		},
-	); err != nil {
-		return err
+	// The top switch is the first switch on the shortest path from the root to the first reachable member
+	topSwitchID := ""
+	for _, memberID := range memberIDs {
+		path, err := graph.ShortestPath(g, rootID, memberID)
+		if err == nil && len(path) >= 3 {
+			topSwitchID = path[1]
+
+			break
+		}
 	}
 
-	adapterSrcCertPEM, adapterSrcCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleAdapterClient)
+	if topSwitchID == "" {
+		return []string{}, ErrRouteNotFound
+	}
+
+	sw, ok := r.getPeers()[topSwitchID]
+	if !ok {
+		return []string{}, ErrSwitchNotFound
+	}
+
+	md, ok := r.getSwitches()[topSwitchID]
+	if !ok {
+		return []string{}, ErrSwitchNotFound
+	}
+
+	upstreamAddr, downstreamAddr, err := r.provisionGroupSwitch(sw, md, routeID, "")
 	if err != nil {
-		return err
+		return []string{}, err
+	}
+
+	adapterCertPEM, adapterCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleAdapterClient)
+	if err != nil {
+		_ = sw.UnprovisionRoute(context.Background(), routeID)
+
+		return []string{}, err
 	}
 
-	if err := src.ProvisionRoute(
+	if err := root.ProvisionRoute(
 		context.Background(),
 		routeID,
 		channelID,
-		ingressRaddr,
+		upstreamAddr,
 		CertPair{
-			CertPEM:        adapterSrcCertPEM,
-			CertPrivKeyPEM: adapterSrcCertPrivKeyPEM,
+			CertPEM:        adapterCertPEM,
+			CertPrivKeyPEM: adapterCertPrivKeyPEM,
 		},
 	); err != nil {
-		return err
+		_ = sw.UnprovisionRoute(context.Background(), routeID)
+
+		return []string{}, err
+	}
+
+	t := &groupRouteTree{
+		rootID:      rootID,
+		channelID:   channelID,
+		topSwitchID: topSwitchID,
+
+		parents: map[string]string{
+			topSwitchID: "",
+		},
+		downstreamAddrs: map[string]string{
+			topSwitchID: downstreamAddr,
+		},
+		members: map[string][]string{},
 	}
 
 	r.routesLock.Lock()
-	r.routes[routeID] = path
+	r.groupRoutes[routeID] = t
+	r.routes[routeID] = t.getNodes()
 	r.routesLock.Unlock()
 
-	if err := r.updateGraphs(context.Background()); err != nil {
-		return err
+	joined := []string{}
+	for _, memberID := range memberIDs {
+		if err := r.joinGroupRoute(routeID, memberID); err != nil {
+			log.Println("Could not add member with ID", memberID, "to group route with ID", routeID, ", continuing:", err)
+
+			continue
+		}
+
+		joined = append(joined, memberID)
 	}
 
-	return nil
+	return joined, nil
 }
 
-func unprovisionRouteForPeer(r *Router, g *Gateway, remoteID string) error {
-	if r.verbose {
-		log.Println("Unprovisioning all routes for peer", remoteID)
+func (r *Router) joinGroupRoute(routeID, memberID string) error {
+	if r.verbose.Load() {
+		log.Println("Adding member with ID", memberID, "to group route with ID", routeID)
 	}
 
-	r.routesLock.Lock()
+	t, ok := r.getGroupRouteTree(routeID)
+	if !ok {
+		return ErrGroupRouteNotFound
+	}
 
-	routerPeers := r.Peers()
-	gatewayPeers := g.Peers()
+	t.lock.Lock()
+	defer t.lock.Unlock()
 
-	switchesToClose := map[string][]SwitchRemote{}
-	adaptersToClose := map[string][]AdapterRemote{}
+	if _, ok := t.members[memberID]; ok || memberID == t.rootID {
+		return ErrAlreadyGroupMember
+	}
 
-	for routeID, route := range r.routes {
-		if slices.Contains(route, remoteID) {
-			for _, candidateID := range route {
-				if remoteID == candidateID {
-					// Don't call `close` on the peer with `remoteID` as its already disconnected at this point
-					continue
-				}
+	_, adapters := r.getAdapters()
 
-				if sw, ok := routerPeers[candidateID]; ok {
-					if _, ok := switchesToClose[routeID]; !ok {
-						switchesToClose[routeID] = []SwitchRemote{}
-					}
+	member, ok := adapters[memberID]
+	if !ok {
+		return ErrAdapterNotFound
+	}
 
-					switchesToClose[routeID] = append(switchesToClose[routeID], sw)
-				}
+	g, err := r.createGroupGraph()
+	if err != nil {
+		return err
+	}
 
-				if ad, ok := gatewayPeers[candidateID]; ok {
-					if _, ok := adaptersToClose[routeID]; !ok {
-						adaptersToClose[routeID] = []AdapterRemote{}
-					}
+	path, err := graph.ShortestPath(g, t.topSwitchID, memberID)
+	if err != nil {
+		return err
+	}
 
-					adaptersToClose[routeID] = append(adaptersToClose[routeID], ad)
-				}
-			}
+	if len(path) < 2 {
+		return ErrRouteNotFound
+	}
 
-			delete(r.routes, routeID)
+	// Attach the member to the deepest switch on its path which is already part of the tree
+	attachIndex := 0
+	for i, swID := range path[:len(path)-1] {
+		if _, ok := t.parents[swID]; ok {
+			attachIndex = i
 		}
 	}
 
-	r.routesLock.Unlock()
+	routerPeers := r.getPeers()
+	switches := r.getSwitches()
 
-	unprovisionSwitchesAndAdapters(switchesToClose, adaptersToClose, remoteID)
+	parentID := path[attachIndex]
+	parents := map[string]string{}
+	downstreamAddrs := map[string]string{}
+	provisioned := []SwitchRemote{}
 
-	if err := r.updateGraphs(context.Background()); err != nil {
-		return err
+	unprovisionProvisioned := func() {
+		for _, sw := range provisioned {
+			_ = sw.UnprovisionRoute(context.Background(), routeID)
+		}
 	}
 
-	return nil
-}
+	raddr := t.downstreamAddrs[parentID]
+	for _, swID := range path[attachIndex+1 : len(path)-1] {
+		sw, ok := routerPeers[swID]
+		if !ok {
+			unprovisionProvisioned()
 
-func unprovisionSwitchesAndAdapters(switchesToClose map[string][]SwitchRemote, adaptersToClose map[string][]AdapterRemote, remoteID string) {
-	var wg sync.WaitGroup
+			return ErrSwitchNotFound
+		}
 
-	for routeID, peers := range switchesToClose {
-		for _, sw := range peers {
-			wg.Add(1)
+		md, ok := switches[swID]
+		if !ok {
+			unprovisionProvisioned()
 
-			go func(routeID string, sw SwitchRemote) {
-				defer wg.Done()
+			return ErrSwitchNotFound
+		}
 
-				if err := sw.UnprovisionRoute(context.Background(), routeID); err != nil {
-					log.Println("Could not unprovision route", routeID, "for switch with ID", remoteID, ", continuing:", err)
-				}
-			}(routeID, sw)
+		_, downstreamAddr, err := r.provisionGroupSwitch(sw, md, routeID, raddr)
+		if err != nil {
+			unprovisionProvisioned()
+
+			return err
 		}
+
+		provisioned = append(provisioned, sw)
+		parents[swID] = parentID
+		downstreamAddrs[swID] = downstreamAddr
+
+		parentID = swID
+		raddr = downstreamAddr
 	}
 
-	for routeID, peers := range adaptersToClose {
-		for _, ad := range peers {
-			wg.Add(1)
+	adapterCertPEM, adapterCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, routeID, "", utils.RoleAdapterClient)
+	if err != nil {
+		unprovisionProvisioned()
 
-			go func(routeID string, ad AdapterRemote) {
-				defer wg.Done()
+		return err
+	}
 
-				if err := ad.UnprovisionRoute(context.Background(), routeID); err != nil {
-					log.Println("Could not unprovision route", routeID, "for adapter with ID", remoteID, ", continuing:", err)
-				}
-			}(routeID, ad)
-		}
+	if err := member.ProvisionRoute(
+		context.Background(),
+		routeID,
+		t.channelID,
+		raddr,
+		CertPair{
+			CertPEM:        adapterCertPEM,
+			CertPrivKeyPEM: adapterCertPrivKeyPEM,
+		},
+	); err != nil {
+		unprovisionProvisioned()
+
+		return err
 	}
 
-	wg.Wait()
+	for swID, candidateID := range parents {
+		t.parents[swID] = candidateID
+		t.downstreamAddrs[swID] = downstreamAddrs[swID]
+	}
+
+	t.members[memberID] = t.getBranch(parentID, memberID)
+
+	r.setGroupRouteNodes(routeID, t)
+
+	return nil
 }
 
-func (r *Router) RegisterSwitch(ctx context.Context, token string, addr string) (SwitchConfiguration, error) {
-	if err := r.auth.Validate(token); err != nil {
-		return SwitchConfiguration{}, err
+// leaveGroupRoute removes a member and the switches which no longer lead to any member, and returns the bytes which the member transferred
+func (r *Router) leaveGroupRoute(routeID, memberID string, disconnected bool) (int64, error) {
+	if r.verbose.Load() {
+		log.Println("Removing member with ID", memberID, "from group route with ID", routeID)
 	}
 
-	remoteID := rpc.GetRemoteID(ctx)
+	t, ok := r.getGroupRouteTree(routeID)
+	if !ok {
+		return 0, ErrGroupRouteNotFound
+	}
 
-	parsedAddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		return SwitchConfiguration{}, err
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if _, ok := t.members[memberID]; !ok {
+		return 0, ErrNotGroupMember
 	}
 
-	r.switchesLock.Lock()
+	var transferred int64
+	if !disconnected {
+		_, adapters := r.getAdapters()
 
-	if _, ok := r.switches[remoteID]; ok {
-		r.switchesLock.Unlock()
+		if member, ok := adapters[memberID]; ok {
+			n, err := member.UnprovisionRoute(context.Background(), routeID)
+			if err != nil {
+				log.Println("Could not unprovision group route with ID", routeID, "for adapter with ID", memberID, ", continuing:", err)
+			}
 
-		return SwitchConfiguration{}, ErrSwitchAlreadyRegistered
+			transferred = n
+		}
 	}
 
-	r.switches[remoteID] = SwitchMetadata{
-		addr,
-		map[string]time.Duration{},
-		map[string]ThroughputResult{},
-	}
+	delete(t.members, memberID)
 
-	if r.verbose {
-		log.Println("Added switch with ID", remoteID, "to topology")
+	needed := map[string]struct{}{
+		t.topSwitchID: {},
+	}
+	for _, branch := range t.members {
+		for _, swID := range branch[1 : len(branch)-1] {
+			needed[swID] = struct{}{}
+		}
 	}
 
-	r.switchesLock.Unlock()
+	routerPeers := r.getPeers()
+	for swID := range t.parents {
+		if _, ok := needed[swID]; ok {
+			continue
+		}
 
-	if err := r.updateGraphs(context.Background()); err != nil {
-		return SwitchConfiguration{}, err
+		if sw, ok := routerPeers[swID]; ok {
+			if err := sw.UnprovisionRoute(context.Background(), routeID); err != nil {
+				log.Println("Could not unprovision group route with ID", routeID, "for switch with ID", swID, ", continuing:", err)
+			}
+		}
+
+		delete(t.parents, swID)
+		delete(t.downstreamAddrs, swID)
 	}
 
-	benchmarkListenCertPEM, benchmarkListenCertPrivKeyPEM, err := utils.GenerateCertificate(r.rsaBits, r.caCfg, r.caPrivKey, r.callCertValidity, "", parsedAddr.IP.String(), utils.RoleAdapterListener)
-	if err != nil {
-		return SwitchConfiguration{}, err
+	r.setGroupRouteNodes(routeID, t)
+
+	return transferred, nil
+}
+
+// leaveGroupRoutes removes a disconnected adapter from all group routes which it is a member of
+func (r *Router) leaveGroupRoutes(memberID string) {
+	r.routesLock.Lock()
+
+	routeIDs := []string{}
+	for routeID, t := range r.groupRoutes {
+		// If the root disconnects, the entire group route is unprovisioned instead
+		if t.rootID != memberID {
+			routeIDs = append(routeIDs, routeID)
+		}
 	}
 
-	return SwitchConfiguration{
-		CAPEM: r.caPEM,
-		BenchmarkListenCert: CertPair{
-			CertPEM:        benchmarkListenCertPEM,
-			CertPrivKeyPEM: benchmarkListenCertPrivKeyPEM,
-		},
-		BenchmarkLimit: r.benchmarkLimit,
-	}, nil
+	r.routesLock.Unlock()
+
+	for _, routeID := range routeIDs {
+		if _, err := r.leaveGroupRoute(routeID, memberID, true); err != nil && !errors.Is(err, ErrNotGroupMember) {
+			log.Println("Could not remove member with ID", memberID, "from group route with ID", routeID, ", continuing:", err)
+		}
+	}
 }
@@ -9,34 +9,68 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pojntfx/saltpanelo/pkg/utils"
+	"golang.org/x/exp/slices"
 )
 
 var (
-	ErrUnauthenticatedRole  = errors.New("unauthenticated role")
-	ErrUnauthenticatedRoute = errors.New("unauthenticated route")
+	ErrUnauthenticatedRole      = errors.New("unauthenticated role")
+	ErrUnauthenticatedRoute     = errors.New("unauthenticated route")
+	ErrHolePunchNotPrepared     = errors.New("could not find prepared hole punch")
+	ErrHolePunchAlreadyPrepared = errors.New("could not prepare hole punch: A hole punch for this route and side is already prepared")
+	ErrGroupRouteAlreadyExists  = errors.New("could not provision group route: A group route with this route ID already exists")
+	ErrSwitchDraining           = errors.New("could not provision route: Switch is draining")
+)
+
+const (
+	HolePunchSideSrc = "src"
+	HolePunchSideDst = "dst"
+
+	holePunchInterval = time.Millisecond * 100
 )
 
 func SetSwitchCA(sw *Switch, caPEM []byte) {
 	sw.caPEM = caPEM
 }
 
+func SetSwitchVerbose(sw *Switch, verbose bool) {
+	sw.verbose.Store(verbose)
+}
+
+// SetSwitchDraining rejects new routes while the routes which are already provisioned continue
+func SetSwitchDraining(sw *Switch, draining bool) {
+	sw.draining.Store(draining)
+}
+
 type SwitchRemote struct {
 	TestLatency      func(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair) ([]time.Duration, error)
 	TestThroughput   func(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair, benchmarkLimit int64) ([]ThroughputResult, error)
 	UnprovisionRoute func(ctx context.Context, routeID string) error
+	ListRoutes       func(ctx context.Context) ([]string, error)
 	GetPublicIP      func(ctx context.Context) (string, error)
+	PrepareHolePunch func(ctx context.Context, routeID, side string) (string, error)
 	ProvisionRoute   func(
 		ctx context.Context,
 		routeID string,
 		raddr string,
+		punchRaddr string,
 		switchListenCert,
 		switchClientCert,
 		adapterListenCert CertPair,
+		raddrCAPEM []byte,
+	) ([]string, error)
+	ProvisionGroupRoute func(
+		ctx context.Context,
+		routeID string,
+		raddr string,
+		switchListenCert,
+		switchClientCert CertPair,
 	) ([]string, error)
 }
 
@@ -46,34 +80,235 @@ type ThroughputResult struct {
 }
 
 type connPair struct {
-	src       io.Closer
-	dst       io.Closer
-	channelID string
+	src         io.Closer
+	dst         io.Closer
+	channelID   string
+	transferred *atomic.Int64
+	hold        *utils.Gate
+}
+
+// groupDownstreamQueueLen is the amount of chunks which are queued for a downstream connection before it is removed for falling behind
+const groupDownstreamQueueLen = 64
+
+// groupDownstream queues the chunks which are replicated to a downstream connection, so that a slow participant can't stall the others
+type groupDownstream struct {
+	chunks chan []byte
+}
+
+// groupConns replicates everything read from the upstream connection to all downstream connections,
+// and merges everything read from the downstream connections into the upstream connection
+type groupConns struct {
+	upstreamLis net.Listener
+	upstream    net.Conn
+	upstreamRdy chan struct{}
+
+	downstreamLis net.Listener
+
+	upstreamWriteLock sync.Mutex
+
+	downstreamsLock sync.Mutex
+	downstreams     map[net.Conn]*groupDownstream
+
+	closeOnce sync.Once
+}
+
+func (g *groupConns) close() {
+	g.closeOnce.Do(func() {
+		if g.upstreamLis != nil {
+			_ = g.upstreamLis.Close()
+		}
+
+		_ = g.downstreamLis.Close()
+
+		select {
+		case <-g.upstreamRdy:
+			_ = g.upstream.Close()
+		default:
+		}
+
+		g.downstreamsLock.Lock()
+		for conn, d := range g.downstreams {
+			close(d.chunks)
+
+			_ = conn.Close()
+		}
+		g.downstreams = map[net.Conn]*groupDownstream{}
+		g.downstreamsLock.Unlock()
+	})
+}
+
+// addDownstream starts writing the replicated chunks to the downstream connection
+func (g *groupConns) addDownstream(verbose bool, conn net.Conn) {
+	d := &groupDownstream{
+		chunks: make(chan []byte, groupDownstreamQueueLen),
+	}
+
+	g.downstreamsLock.Lock()
+	g.downstreams[conn] = d
+	g.downstreamsLock.Unlock()
+
+	go func() {
+		for chunk := range d.chunks {
+			if _, err := conn.Write(chunk); err != nil {
+				if verbose && !errors.Is(err, net.ErrClosed) {
+					log.Println("Could not write to downstream connection, removing it:", err)
+				}
+
+				g.removeDownstream(conn)
+
+				return
+			}
+		}
+	}()
+}
+
+// removeDownstream stops replicating to the downstream connection and closes it
+func (g *groupConns) removeDownstream(conn net.Conn) {
+	g.downstreamsLock.Lock()
+	if d, ok := g.downstreams[conn]; ok {
+		close(d.chunks)
+
+		delete(g.downstreams, conn)
+	}
+	g.downstreamsLock.Unlock()
+
+	_ = conn.Close()
+}
+
+func (g *groupConns) replicate(verbose bool) {
+	<-g.upstreamRdy
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := g.upstream.Read(buf)
+		if n > 0 {
+			// The chunk is shared by all downstreams since none of them modify it
+			chunk := append([]byte{}, buf[:n]...)
+
+			g.downstreamsLock.Lock()
+			for conn, d := range g.downstreams {
+				select {
+				case d.chunks <- chunk:
+				default:
+					if verbose {
+						log.Println("Downstream connection", conn.RemoteAddr(), "is falling behind, removing it")
+					}
+
+					close(d.chunks)
+
+					delete(g.downstreams, conn)
+
+					_ = conn.Close()
+				}
+			}
+			g.downstreamsLock.Unlock()
+		}
+
+		if err != nil {
+			if verbose && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Println("Could not read from upstream connection, closing group route:", err)
+			}
+
+			// Without an upstream connection there is nothing left to replicate
+			g.close()
+
+			return
+		}
+	}
+}
+
+func (g *groupConns) merge(verbose bool, conn net.Conn) {
+	defer g.removeDownstream(conn)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			<-g.upstreamRdy
+
+			// Each chunk is written at once so that chunks from different downstreams don't interleave
+			g.upstreamWriteLock.Lock()
+			_, werr := g.upstream.Write(buf[:n])
+			g.upstreamWriteLock.Unlock()
+
+			if werr != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			if verbose && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Println("Could not read from downstream connection, removing it:", err)
+			}
+
+			return
+		}
+	}
 }
 
 type Switch struct {
-	verbose bool
-	ahost   string
+	verbose  atomic.Bool
+	draining atomic.Bool
+	ahost    string
+	nat      utils.NATInfo
+
+	holePunchTimeout time.Duration
 
 	routes     map[string]connPair
 	routesLock sync.Mutex
 
+	holePunches     map[string]net.Listener
+	holePunchesLock sync.Mutex
+
+	groupRoutes     map[string]*groupConns
+	groupRoutesLock sync.Mutex
+
 	caPEM []byte
 
 	Peers func() map[string]RouterRemote
 }
 
-func NewSwitch(verbose bool, ahost string) *Switch {
-	return &Switch{
-		verbose: verbose,
-		ahost:   ahost,
+func NewSwitch(verbose bool, ahost string, nat utils.NATInfo, holePunchTimeout time.Duration) *Switch {
+	s := &Switch{
+		ahost: ahost,
+		nat:   nat,
+
+		holePunchTimeout: holePunchTimeout,
 
 		routes: map[string]connPair{},
+
+		holePunches: map[string]net.Listener{},
+
+		groupRoutes: map[string]*groupConns{},
 	}
+	s.verbose.Store(verbose)
+
+	return s
+}
+
+func (s *Switch) getListenHost() string {
+	// The public IP of a switch behind NAT isn't bound to any local interface
+	if s.nat.IsPubliclyReachable() {
+		return s.ahost
+	}
+
+	return ""
+}
+
+func (s *Switch) popHolePunch(routeID, side string) (net.Listener, bool) {
+	s.holePunchesLock.Lock()
+	defer s.holePunchesLock.Unlock()
+
+	lis, ok := s.holePunches[routeID+"/"+side]
+	if ok {
+		delete(s.holePunches, routeID+"/"+side)
+	}
+
+	return lis, ok
 }
 
 func (s *Switch) TestLatency(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair) ([]time.Duration, error) {
-	if s.verbose {
+	if s.verbose.Load() {
 		log.Println("Starting latency tests for addrs", addrs)
 	}
 
@@ -94,7 +329,7 @@ func (s *Switch) TestLatency(ctx context.Context, timeout time.Duration, addrs [
 }
 
 func (s *Switch) TestThroughput(ctx context.Context, timeout time.Duration, addrs []string, benchmarkClientCert CertPair, benchmarkLimit int64) ([]ThroughputResult, error) {
-	if s.verbose {
+	if s.verbose.Load() {
 		log.Println("Starting throughput tests for addrs", addrs)
 	}
 
@@ -114,14 +349,51 @@ func (s *Switch) TestThroughput(ctx context.Context, timeout time.Duration, addr
 	}, benchmarkLimit)
 }
 
+func (s *Switch) ListRoutes(ctx context.Context) ([]string, error) {
+	routeIDs := []string{}
+
+	s.routesLock.Lock()
+	for routeID := range s.routes {
+		routeIDs = append(routeIDs, routeID)
+	}
+	s.routesLock.Unlock()
+
+	s.groupRoutesLock.Lock()
+	for routeID := range s.groupRoutes {
+		routeIDs = append(routeIDs, routeID)
+	}
+	s.groupRoutesLock.Unlock()
+
+	return routeIDs, nil
+}
+
 func (s *Switch) UnprovisionRoute(ctx context.Context, routeID string) error {
 	s.routesLock.Lock()
 	defer s.routesLock.Unlock()
 
-	if s.verbose {
+	if s.verbose.Load() {
 		log.Println("Unprovisioning route with ID", routeID)
 	}
 
+	for _, side := range []string{HolePunchSideSrc, HolePunchSideDst} {
+		if lis, ok := s.popHolePunch(routeID, side); ok {
+			_ = lis.Close()
+		}
+	}
+
+	s.groupRoutesLock.Lock()
+	gc, ok := s.groupRoutes[routeID]
+	if ok {
+		delete(s.groupRoutes, routeID)
+	}
+	s.groupRoutesLock.Unlock()
+
+	if ok {
+		gc.close()
+
+		return nil
+	}
+
 	route, ok := s.routes[routeID]
 	if !ok {
 		return ErrRouteNotFound
@@ -141,23 +413,52 @@ func (s *Switch) UnprovisionRoute(ctx context.Context, routeID string) error {
 }
 
 func (s *Switch) GetPublicIP(ctx context.Context) (string, error) {
-	if s.verbose {
+	if s.verbose.Load() {
 		log.Println("Getting public IP")
 	}
 
 	return s.ahost, nil
 }
 
+func (s *Switch) PrepareHolePunch(ctx context.Context, routeID, side string) (string, error) {
+	if s.verbose.Load() {
+		log.Println("Preparing hole punch for route with ID", routeID, "on side", side)
+	}
+
+	s.holePunchesLock.Lock()
+	defer s.holePunchesLock.Unlock()
+
+	if _, ok := s.holePunches[routeID+"/"+side]; ok {
+		return "", ErrHolePunchAlreadyPrepared
+	}
+
+	lis, err := utils.ListenHolePunch(ctx, s.getListenHost())
+	if err != nil {
+		return "", err
+	}
+
+	s.holePunches[routeID+"/"+side] = lis
+
+	// We assume that the NAT preserves the port, which is checked by `NATInfo.CanHolePunch`
+	return net.JoinHostPort(s.ahost, strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)), nil
+}
+
 func (s *Switch) ProvisionRoute(
 	ctx context.Context,
 	routeID string,
 	raddr string,
+	punchRaddr string,
 	switchListenCert,
 	switchClientCert,
 	adapterListenCert CertPair,
+	raddrCAPEM []byte,
 ) ([]string, error) {
-	if s.verbose {
-		log.Println("Provisioning route with ID", routeID, "to raddr", raddr)
+	if s.verbose.Load() {
+		log.Println("Provisioning route with ID", routeID, "to raddr", raddr, "and punch raddr", punchRaddr)
+	}
+
+	if s.draining.Load() {
+		return []string{}, ErrSwitchDraining
 	}
 
 	var src net.Conn
@@ -173,7 +474,7 @@ func (s *Switch) ProvisionRoute(
 	caCertPool.AppendCertsFromPEM(s.caPEM)
 
 	if strings.TrimSpace(raddr) == "" {
-		laddr, err := net.ResolveTCPAddr("tcp", s.ahost+":0")
+		laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(s.getListenHost(), "0"))
 		if err != nil {
 			return []string{}, err
 		}
@@ -216,7 +517,7 @@ func (s *Switch) ProvisionRoute(
 						return
 					}
 
-					if s.verbose {
+					if s.verbose.Load() {
 						log.Println("Could not accept src connection, skipping:", err)
 					}
 
@@ -225,7 +526,7 @@ func (s *Switch) ProvisionRoute(
 
 				conn, ok := rawConn.(*tls.Conn)
 				if !ok {
-					if s.verbose {
+					if s.verbose.Load() {
 						log.Println("Could not accept non-TLS connection, skipping:", err)
 					}
 
@@ -235,7 +536,7 @@ func (s *Switch) ProvisionRoute(
 				}
 
 				if err := conn.Handshake(); err != nil {
-					if s.verbose {
+					if s.verbose.Load() {
 						log.Println("Could not hanshake TLS connection, skipping:", err)
 					}
 
@@ -257,14 +558,49 @@ func (s *Switch) ProvisionRoute(
 			return []string{}, err
 		}
 
-		conn, err := tls.Dial("tcp", raddr, &tls.Config{
-			RootCAs:      caCertPool,
-			Certificates: []tls.Certificate{cer},
-		})
+		host, _, err := net.SplitHostPort(raddr)
 		if err != nil {
 			return []string{}, err
 		}
 
+		// Border switches of federated control planes are signed by their own CA
+		rootCAs := caCertPool
+		if len(raddrCAPEM) > 0 {
+			rootCAs = x509.NewCertPool()
+			rootCAs.AppendCertsFromPEM(raddrCAPEM)
+		}
+
+		cfg := &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{cer},
+			ServerName:   host,
+		}
+
+		var conn *tls.Conn
+		if lis, ok := s.popHolePunch(routeID, HolePunchSideSrc); ok {
+			if s.verbose.Load() {
+				log.Println("Punching hole for route with ID", routeID, "to raddr", raddr)
+			}
+
+			rawConn, err := utils.PunchHole(lis, raddr, s.holePunchTimeout, holePunchInterval)
+			_ = lis.Close()
+			if err != nil {
+				return []string{}, err
+			}
+
+			conn = tls.Client(rawConn, cfg)
+			if err := conn.Handshake(); err != nil {
+				_ = conn.Close()
+
+				return []string{}, err
+			}
+		} else {
+			conn, err = tls.Dial("tcp", raddr, cfg)
+			if err != nil {
+				return []string{}, err
+			}
+		}
+
 		cp.src = conn
 		src = conn
 
@@ -273,12 +609,10 @@ func (s *Switch) ProvisionRoute(
 		}()
 	}
 
-	laddr, err := net.ResolveTCPAddr("tcp", s.ahost+":0")
-	if err != nil {
-		return []string{}, err
-	}
-
-	var cer tls.Certificate
+	var (
+		cer tls.Certificate
+		err error
+	)
 	if len(switchListenCert.CertPEM) > 0 {
 		cer, err = tls.X509KeyPair(switchListenCert.CertPEM, switchListenCert.CertPrivKeyPEM)
 		if err != nil {
@@ -291,7 +625,7 @@ func (s *Switch) ProvisionRoute(
 		}
 	}
 
-	lis, err := tls.Listen("tcp", laddr.String(), &tls.Config{
+	dstCfg := &tls.Config{
 		Certificates: []tls.Certificate{cer},
 		ClientCAs:    caCertPool,
 		ClientAuth:   tls.RequireAndVerifyClientCert,
@@ -314,57 +648,100 @@ func (s *Switch) ProvisionRoute(
 
 			return nil
 		},
-	})
-	if err != nil {
-		return []string{}, err
 	}
 
-	cp.dst = lis
-	addrs = append(addrs, lis.Addr().String())
-
-	go func() {
-		for {
-			rawConn, err := lis.Accept()
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return
-				}
+	if strings.TrimSpace(punchRaddr) != "" {
+		lis, ok := s.popHolePunch(routeID, HolePunchSideDst)
+		if !ok {
+			return []string{}, ErrHolePunchNotPrepared
+		}
 
-				if s.verbose {
-					log.Println("Could not accept src connection, skipping:", err)
-				}
+		cp.dst = lis
+		addrs = append(addrs, lis.Addr().String())
 
-				continue
+		go func() {
+			if s.verbose.Load() {
+				log.Println("Punching hole for route with ID", routeID, "to punch raddr", punchRaddr)
 			}
 
-			conn, ok := rawConn.(*tls.Conn)
-			if !ok {
-				if s.verbose {
-					log.Println("Could not accept non-TLS connection, skipping:", err)
-				}
-
-				_ = conn.Close()
+			rawConn, err := utils.PunchHole(lis, punchRaddr, s.holePunchTimeout, holePunchInterval)
+			if err != nil {
+				errs <- err
 
-				continue
+				return
 			}
 
+			conn := tls.Server(rawConn, dstCfg)
 			if err := conn.Handshake(); err != nil {
-				if s.verbose {
-					log.Println("Could not hanshake TLS connection, skipping:", err)
-				}
-
 				_ = conn.Close()
 
-				continue
+				errs <- err
+
+				return
 			}
 
 			dst = conn
 
 			ready <- struct{}{}
+		}()
+	} else {
+		laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(s.getListenHost(), "0"))
+		if err != nil {
+			return []string{}, err
+		}
 
-			break
+		lis, err := tls.Listen("tcp", laddr.String(), dstCfg)
+		if err != nil {
+			return []string{}, err
 		}
-	}()
+
+		cp.dst = lis
+		addrs = append(addrs, lis.Addr().String())
+
+		go func() {
+			for {
+				rawConn, err := lis.Accept()
+				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+
+					if s.verbose.Load() {
+						log.Println("Could not accept src connection, skipping:", err)
+					}
+
+					continue
+				}
+
+				conn, ok := rawConn.(*tls.Conn)
+				if !ok {
+					if s.verbose.Load() {
+						log.Println("Could not accept non-TLS connection, skipping:", err)
+					}
+
+					_ = conn.Close()
+
+					continue
+				}
+
+				if err := conn.Handshake(); err != nil {
+					if s.verbose.Load() {
+						log.Println("Could not hanshake TLS connection, skipping:", err)
+					}
+
+					_ = conn.Close()
+
+					continue
+				}
+
+				dst = conn
+
+				ready <- struct{}{}
+
+				break
+			}
+		}()
+	}
 
 	go func() {
 		i := 0
@@ -383,7 +760,7 @@ func (s *Switch) ProvisionRoute(
 		}
 
 		if i < 2 {
-			if s.verbose {
+			if s.verbose.Load() {
 				log.Println("Could not accept src or dst connection, stopping:", err)
 			}
 		}
@@ -392,7 +769,7 @@ func (s *Switch) ProvisionRoute(
 			defer func() {
 				err := recover()
 
-				if s.verbose && err != nil {
+				if s.verbose.Load() && err != nil {
 					log.Println("Could not copy from dst to src, stopping:", err)
 				}
 			}()
@@ -406,7 +783,7 @@ func (s *Switch) ProvisionRoute(
 			defer func() {
 				err := recover()
 
-				if s.verbose && err != nil {
+				if s.verbose.Load() && err != nil {
 					log.Println("Could not copy from src to dst, stopping:", err)
 				}
 			}()
@@ -424,6 +801,174 @@ func (s *Switch) ProvisionRoute(
 	return addrs, nil
 }
 
+func (s *Switch) acceptTLS(lis net.Listener, onConn func(conn *tls.Conn) bool) {
+	for {
+		rawConn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			if s.verbose.Load() {
+				log.Println("Could not accept connection, skipping:", err)
+			}
+
+			continue
+		}
+
+		conn, ok := rawConn.(*tls.Conn)
+		if !ok {
+			if s.verbose.Load() {
+				log.Println("Could not accept non-TLS connection, skipping")
+			}
+
+			_ = rawConn.Close()
+
+			continue
+		}
+
+		if err := conn.Handshake(); err != nil {
+			if s.verbose.Load() {
+				log.Println("Could not hanshake TLS connection, skipping:", err)
+			}
+
+			_ = conn.Close()
+
+			continue
+		}
+
+		if !onConn(conn) {
+			return
+		}
+	}
+}
+
+// ProvisionGroupRoute provisions a node of a multicast tree; the first switch in the tree (with an empty raddr) accepts the upstream adapter,
+// all other switches dial the downstream address of their parent, and adapters or switches can join and leave as downstreams at any time
+func (s *Switch) ProvisionGroupRoute(
+	ctx context.Context,
+	routeID string,
+	raddr string,
+	switchListenCert,
+	switchClientCert CertPair,
+) ([]string, error) {
+	if s.verbose.Load() {
+		log.Println("Provisioning group route with ID", routeID, "to raddr", raddr)
+	}
+
+	if s.draining.Load() {
+		return []string{}, ErrSwitchDraining
+	}
+
+	s.groupRoutesLock.Lock()
+	defer s.groupRoutesLock.Unlock()
+
+	if _, ok := s.groupRoutes[routeID]; ok {
+		return []string{}, ErrGroupRouteAlreadyExists
+	}
+
+	caCertPool := x509.NewCertPool()
+	caCertPool.AppendCertsFromPEM(s.caPEM)
+
+	cer, err := tls.X509KeyPair(switchListenCert.CertPEM, switchListenCert.CertPrivKeyPEM)
+	if err != nil {
+		return []string{}, err
+	}
+
+	listenCfg := func(roles ...string) *tls.Config {
+		return &tls.Config{
+			Certificates: []tls.Certificate{cer},
+			ClientCAs:    caCertPool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				cert := verifiedChains[0][0]
+
+				if !slices.Contains(roles, cert.Subject.CommonName) {
+					return ErrUnauthenticatedRole
+				}
+
+				if len(cert.Subject.Country) < 1 || cert.Subject.Country[0] != routeID {
+					return ErrUnauthenticatedRoute
+				}
+
+				return nil
+			},
+		}
+	}
+
+	gc := &groupConns{
+		upstreamRdy: make(chan struct{}),
+		downstreams: map[net.Conn]*groupDownstream{},
+	}
+
+	addrs := []string{}
+	if strings.TrimSpace(raddr) == "" {
+		lis, err := tls.Listen("tcp", net.JoinHostPort(s.getListenHost(), "0"), listenCfg(utils.RoleAdapterClient))
+		if err != nil {
+			return []string{}, err
+		}
+
+		gc.upstreamLis = lis
+		addrs = append(addrs, lis.Addr().String())
+
+		go s.acceptTLS(lis, func(conn *tls.Conn) bool {
+			gc.upstream = conn
+			close(gc.upstreamRdy)
+
+			// There is only one upstream
+			_ = lis.Close()
+
+			return false
+		})
+	} else {
+		clientCer, err := tls.X509KeyPair(switchClientCert.CertPEM, switchClientCert.CertPrivKeyPEM)
+		if err != nil {
+			return []string{}, err
+		}
+
+		host, _, err := net.SplitHostPort(raddr)
+		if err != nil {
+			return []string{}, err
+		}
+
+		conn, err := tls.Dial("tcp", raddr, &tls.Config{
+			RootCAs:      caCertPool,
+			Certificates: []tls.Certificate{clientCer},
+			ServerName:   host,
+		})
+		if err != nil {
+			return []string{}, err
+		}
+
+		gc.upstream = conn
+		close(gc.upstreamRdy)
+	}
+
+	lis, err := tls.Listen("tcp", net.JoinHostPort(s.getListenHost(), "0"), listenCfg(utils.RoleSwitchClient, utils.RoleAdapterClient))
+	if err != nil {
+		gc.close()
+
+		return []string{}, err
+	}
+
+	gc.downstreamLis = lis
+	addrs = append(addrs, lis.Addr().String())
+
+	go s.acceptTLS(lis, func(conn *tls.Conn) bool {
+		gc.addDownstream(s.verbose.Load(), conn)
+
+		go gc.merge(s.verbose.Load(), conn)
+
+		return true
+	})
+
+	go gc.replicate(s.verbose.Load())
+
+	s.groupRoutes[routeID] = gc
+
+	return addrs, nil
+}
+
 func testLatency(timeout time.Duration, addrs []string, dialer *tls.Dialer) ([]time.Duration, error) {
 	latencies := []time.Duration{}
 	var latencyLock sync.Mutex
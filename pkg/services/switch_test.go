@@ -0,0 +1,85 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGroupConnsRemovesStalledDownstream(t *testing.T) {
+	upstream, upstreamRemote := net.Pipe()
+	defer upstreamRemote.Close()
+
+	downstreamLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gc := &groupConns{
+		downstreamLis: downstreamLis,
+		upstream:      upstream,
+		upstreamRdy:   make(chan struct{}),
+		downstreams:   map[net.Conn]*groupDownstream{},
+	}
+	defer gc.close()
+
+	close(gc.upstreamRdy)
+
+	// Pipes block writes until they are read, so the stalled participant never accepts any chunks
+	fast, fastRemote := net.Pipe()
+	stalled, stalledRemote := net.Pipe()
+	defer fastRemote.Close()
+	defer stalledRemote.Close()
+
+	gc.addDownstream(false, fast)
+	gc.addDownstream(false, stalled)
+
+	go gc.replicate(false)
+
+	chunk := []byte("chunk")
+	for i := 0; i < groupDownstreamQueueLen+2; i++ {
+		done := make(chan error, 1)
+		go func() {
+			_, err := upstreamRemote.Write(chunk)
+
+			done <- err
+		}()
+
+		buf := make([]byte, len(chunk))
+		if err := fastRemote.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.ReadFull(fastRemote, buf); err != nil {
+			t.Fatalf("chunk %v: could not read from fast downstream: %v", i, err)
+		}
+
+		if !bytes.Equal(buf, chunk) {
+			t.Fatalf("chunk %v: fast downstream read %q, want %q", i, buf, chunk)
+		}
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gc.downstreamsLock.Lock()
+	_, fastOK := gc.downstreams[fast]
+	_, stalledOK := gc.downstreams[stalled]
+	gc.downstreamsLock.Unlock()
+
+	if !fastOK {
+		t.Error("fast downstream was removed")
+	}
+
+	if stalledOK {
+		t.Error("stalled downstream was not removed")
+	}
+
+	// The stalled downstream's connection is closed once it is removed
+	if _, err := stalledRemote.Read(make([]byte, 32*1024)); err != io.EOF {
+		t.Errorf("stalled downstream read error = %v, want %v", err, io.EOF)
+	}
+}
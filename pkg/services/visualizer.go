@@ -5,14 +5,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/dominikbraun/graph"
 	"github.com/dominikbraun/graph/draw"
 	"github.com/pojntfx/dudirekta/pkg/rpc"
+	"github.com/pojntfx/saltpanelo/pkg/persisters"
 	"github.com/pojntfx/saltpanelo/pkg/utils"
 )
 
@@ -31,9 +34,57 @@ type VisualizerRemote struct {
 	) error
 }
 
+func getSwitchEdgeWeight(switches map[string]SwitchMetadata, swID, candidateID string) (int, bool) {
+	latency, ok := switches[swID].Latencies[candidateID]
+	if !ok {
+		return 0, false
+	}
+
+	throughput, ok := switches[swID].Throughputs[candidateID]
+	if !ok {
+		return 0, false
+	}
+
+	return int(latency.Nanoseconds() + throughput.Read.Milliseconds() + throughput.Write.Milliseconds()), true
+}
+
+func getHolePunchEdgeWeight(switches map[string]SwitchMetadata, swID, candidateID string) (int, bool) {
+	// If the switch behind NAT could measure the reverse direction, use it
+	if weight, ok := getSwitchEdgeWeight(switches, candidateID, swID); ok {
+		return weight, true
+	}
+
+	// Otherwise estimate the weight using the shortest detour through a publicly reachable switch
+	found := false
+	minWeight := 0
+	for relayID, relay := range switches {
+		if !relay.NAT.IsPubliclyReachable() {
+			continue
+		}
+
+		swWeight, ok := getSwitchEdgeWeight(switches, swID, relayID)
+		if !ok {
+			continue
+		}
+
+		candidateWeight, ok := getSwitchEdgeWeight(switches, candidateID, relayID)
+		if !ok {
+			continue
+		}
+
+		if !found || swWeight+candidateWeight < minWeight {
+			minWeight = swWeight + candidateWeight
+			found = true
+		}
+	}
+
+	return minWeight, found
+}
+
 func createNetworkGraph(
 	switches map[string]SwitchMetadata,
 	adapters map[string]AdapterMetadata,
+	holePunching bool,
 ) (graph.Graph[string, string], error) {
 	g := graph.New(graph.StringHash, graph.Directed(), graph.Weighted())
 
@@ -56,20 +107,22 @@ func createNetworkGraph(
 				continue
 			}
 
-			latency, ok := switches[swID].Latencies[candidateID]
-			if !ok {
+			if weight, ok := getSwitchEdgeWeight(switches, swID, candidateID); ok {
+				if err := g.AddEdge(swID, candidateID, graph.EdgeWeight(weight), graph.EdgeAttribute("label", fmt.Sprint(weight))); err != nil {
+					return nil, err
+				}
+
 				continue
 			}
 
-			throughput, ok := switches[swID].Throughputs[candidateID]
-			if !ok {
+			if !holePunching || switches[candidateID].NAT.IsPubliclyReachable() || !switches[candidateID].NAT.CanHolePunch() || !switches[swID].NAT.CanHolePunch() {
 				continue
 			}
 
-			weight := int(latency.Nanoseconds() + throughput.Read.Milliseconds() + throughput.Write.Milliseconds())
-
-			if err := g.AddEdge(swID, candidateID, graph.EdgeWeight(weight), graph.EdgeAttribute("label", fmt.Sprint(weight))); err != nil {
-				return nil, err
+			if weight, ok := getHolePunchEdgeWeight(switches, swID, candidateID); ok {
+				if err := g.AddEdge(swID, candidateID, graph.EdgeWeight(weight), graph.EdgeAttribute("label", fmt.Sprintf("%v (hole punch)", weight))); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
@@ -140,8 +193,45 @@ func createRoutesGraph(
 	return g, nil
 }
 
+// ExportTopology writes the network and routes graphs as Graphviz DOT, e.g. for operators who don't run the visualizer
+func ExportTopology(switches []AdminSwitch, adapters []AdminAdapter, routes []persisters.RouteRecord, networkOut, routesOut io.Writer) error {
+	s := map[string]SwitchMetadata{}
+	for _, sw := range switches {
+		s[sw.ID] = sw.SwitchMetadata
+	}
+
+	a := map[string]AdapterMetadata{}
+	for _, adapter := range adapters {
+		a[adapter.ID] = adapter.AdapterMetadata
+	}
+
+	network, err := createNetworkGraph(getRoutableSwitches(s), a, true)
+	if err != nil {
+		return err
+	}
+
+	if err := draw.DOT(network, networkOut); err != nil {
+		return err
+	}
+
+	// The nodes of group routes aren't ordered by their branches, so only unicast routes are drawn
+	r := map[string][]string{}
+	for _, route := range routes {
+		if !route.Group {
+			r[route.RouteID] = route.Path
+		}
+	}
+
+	routesGraph, err := createRoutesGraph(r)
+	if err != nil {
+		return err
+	}
+
+	return draw.DOT(routesGraph, routesOut)
+}
+
 type Visualizer struct {
-	verbose bool
+	verbose atomic.Bool
 
 	networkFile     *os.File
 	networkFileLock sync.Mutex
@@ -156,6 +246,10 @@ type Visualizer struct {
 	Peers func() map[string]MetricsRemote
 }
 
+func SetVisualizerVerbose(visualizer *Visualizer, verbose bool) {
+	visualizer.verbose.Store(verbose)
+}
+
 func NewVisualizer(
 	verbose bool,
 	networkFile *os.File,
@@ -164,14 +258,16 @@ func NewVisualizer(
 
 	getIDToken func() (string, error),
 ) *Visualizer {
-	return &Visualizer{
-		verbose:     verbose,
+	v := &Visualizer{
 		networkFile: networkFile,
 		routesFile:  routesFile,
 		command:     command,
 
 		getIDToken: getIDToken,
 	}
+	v.verbose.Store(verbose)
+
+	return v
 }
 
 func (v *Visualizer) RenderNetworkVisualization(
@@ -184,11 +280,11 @@ func (v *Visualizer) RenderNetworkVisualization(
 
 	remoteID := rpc.GetRemoteID(ctx)
 
-	if v.verbose {
+	if v.verbose.Load() {
 		log.Println("Rendering network graph visualization for metrics service with ID", remoteID)
 	}
 
-	g, err := createNetworkGraph(switches, adapters)
+	g, err := createNetworkGraph(switches, adapters, true)
 	if err != nil {
 		return err
 	}
@@ -222,7 +318,7 @@ func (v *Visualizer) RenderRoutesVisualization(
 
 	remoteID := rpc.GetRemoteID(ctx)
 
-	if v.verbose {
+	if v.verbose.Load() {
 		log.Println("Rendering routes graph visualization for metrics service with ID", remoteID)
 	}
 
@@ -256,7 +352,7 @@ func (v *Visualizer) Attest(
 ) (string, error) {
 	remoteID := rpc.GetRemoteID(ctx)
 
-	if v.verbose {
+	if v.verbose.Load() {
 		log.Println("Doing remote attestation for metrics service with ID", remoteID)
 	}
 
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+
+	"nhooyr.io/websocket"
+)
+
+var (
+	ErrInvalidCACertificate = errors.New("could not parse CA certificate: No certificates found")
+)
+
+// GetCAHTTPClient returns a client which verifies the certificate of the control plane with the system roots and the
+// CA certificate at the path; if the CA certificate doesn't exist (e.g. because the control plane serves a certificate
+// from a public CA), only the system roots are used
+func GetCAHTTPClient(caPath string) (*http.Client, error) {
+	caCertPool, err := x509.SystemCertPool()
+	if err != nil {
+		caCertPool = x509.NewCertPool()
+	}
+
+	if caPath != "" {
+		caPEM, err := os.ReadFile(caPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+
+		if err == nil && !caCertPool.AppendCertsFromPEM(caPEM) {
+			return nil, ErrInvalidCACertificate
+		}
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: caCertPool,
+			},
+		},
+	}, nil
+}
+
+// GetCADialOptions returns the options which clients dial the control plane with, see GetCAHTTPClient
+func GetCADialOptions(caPath string) (*websocket.DialOptions, error) {
+	httpClient, err := GetCAHTTPClient(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &websocket.DialOptions{
+		HTTPClient: httpClient,
+	}, nil
+}
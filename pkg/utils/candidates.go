@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"net"
+)
+
+// filterCandidateIPs removes the IPs which other hosts can't dial
+func filterCandidateIPs(ips []net.IP) []string {
+	candidates := []string{}
+	for _, ip := range ips {
+		// Loopback addresses would reach the other host itself, and link-local addresses would require a zone to be dialed
+		if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+			continue
+		}
+
+		candidates = append(candidates, ip.String())
+	}
+
+	return candidates
+}
+
+// GetCandidateIPs returns the IPs which other hosts can dial a listener bound to host on; all interface IPs are only
+// candidates if the listener is bound to all interfaces
+func GetCandidateIPs(host string) ([]string, error) {
+	ip := net.ParseIP(host)
+	if host != "" && (ip == nil || !ip.IsUnspecified()) {
+		if ip != nil {
+			return filterCandidateIPs([]net.IP{ip}), nil
+		}
+
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return []string{}, err
+		}
+
+		return filterCandidateIPs(ips), nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return []string{}, err
+	}
+
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ips = append(ips, ipNet.IP)
+	}
+
+	return filterCandidateIPs(ips), nil
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestFilterCandidateIPs(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		want []string
+	}{
+		{"IPv4 loopback", []string{"127.0.0.1"}, []string{}},
+		{"IPv6 loopback", []string{"::1"}, []string{}},
+		{"IPv4 link-local", []string{"169.254.1.1"}, []string{}},
+		{"IPv6 link-local", []string{"fe80::1"}, []string{}},
+		{"multicast", []string{"224.0.0.1", "ff02::1"}, []string{}},
+		{"unspecified", []string{"0.0.0.0", "::"}, []string{}},
+		{"private and public", []string{"192.168.1.2", "203.0.113.1", "2001:db8::1"}, []string{"192.168.1.2", "203.0.113.1", "2001:db8::1"}},
+		{"mixed", []string{"127.0.0.1", "10.0.0.2", "fe80::1"}, []string{"10.0.0.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ips := []net.IP{}
+			for _, ip := range tt.ips {
+				ips = append(ips, net.ParseIP(ip))
+			}
+
+			if got := filterCandidateIPs(ips); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterCandidateIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCandidateIPs(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		want []string
+	}{
+		{"loopback host", "127.0.0.1", []string{}},
+		{"specific host", "192.0.2.1", []string{"192.0.2.1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetCandidateIPs(tt.host)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetCandidateIPs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCandidateIPsAllInterfaces(t *testing.T) {
+	for _, host := range []string{"", "0.0.0.0", "::"} {
+		got, err := GetCandidateIPs(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, candidate := range got {
+			if net.ParseIP(candidate).IsLoopback() {
+				t.Errorf("GetCandidateIPs(%q) contains loopback candidate %v", host, candidate)
+			}
+		}
+	}
+}
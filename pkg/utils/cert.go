@@ -2,15 +2,24 @@ package utils
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"math/big"
 	"net"
 	"strings"
 	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+var (
+	ErrInvalidNodeCertificate    = errors.New("could not verify node certificate: Certificate is not bound to a node identity with the required role")
+	ErrInvalidCertificateRequest = errors.New("could not parse certificate request: Request is not a valid PEM-encoded CSR")
 )
 
 const (
@@ -22,6 +31,12 @@ const (
 
 	RoleBenchmarkListener = "benchmark-listener"
 	RoleBenchmarkClient   = "benchmark-client"
+
+	RoleRouterListener = "router-listener"
+	RoleSwitchNode     = "switch-node"
+
+	RoleControlPlaneListener = "control-plane-listener"
+	RoleFederationPeer       = "federation-peer"
 )
 
 func GenerateCertificateAuthority(rsaBits int, validity time.Duration) (*x509.Certificate, []byte, []byte, *rsa.PrivateKey, error) {
@@ -68,14 +83,20 @@ func GenerateCertificateAuthority(rsaBits int, validity time.Duration) (*x509.Ce
 }
 
 func GenerateCertificate(rsaBits int, caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, routeID, ip, role string) ([]byte, []byte, error) {
+	return GenerateCertificateForIPs(rsaBits, caCfg, caPrivKey, validity, routeID, []string{ip}, role)
+}
+
+func GenerateCertificateForIPs(rsaBits int, caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, routeID string, rawIPs []string, role string) ([]byte, []byte, error) {
 	certPrivKey, err := rsa.GenerateKey(rand.Reader, rsaBits)
 	if err != nil {
 		return []byte{}, []byte{}, err
 	}
 
 	ips := []net.IP{}
-	if strings.TrimSpace(ip) != "" {
-		ips = append(ips, net.ParseIP(ip))
+	for _, ip := range rawIPs {
+		if strings.TrimSpace(ip) != "" {
+			ips = append(ips, net.ParseIP(ip))
+		}
 	}
 
 	certCfg := &x509.Certificate{
@@ -114,3 +135,210 @@ func GenerateCertificate(rsaBits int, caCfg *x509.Certificate, caPrivKey *rsa.Pr
 
 	return certPEM.Bytes(), certPrivKeyPEM.Bytes(), nil
 }
+
+// GenerateCertificateForHosts issues a certificate for a listener which clients dial by IP address or hostname
+func GenerateCertificateForHosts(rsaBits int, caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, hosts []string, role string) ([]byte, []byte, error) {
+	return generateCertificateForHosts(rsaBits, caCfg, caPrivKey, validity, hosts, role, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth})
+}
+
+// GeneratePeerCertificateForHosts issues a certificate which is both served to and presented to peers (mTLS)
+func GeneratePeerCertificateForHosts(rsaBits int, caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, hosts []string, role string) ([]byte, []byte, error) {
+	return generateCertificateForHosts(rsaBits, caCfg, caPrivKey, validity, hosts, role, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth})
+}
+
+func generateCertificateForHosts(rsaBits int, caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, hosts []string, role string, extKeyUsage []x509.ExtKeyUsage) ([]byte, []byte, error) {
+	certPrivKey, err := rsa.GenerateKey(rand.Reader, rsaBits)
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	ips := []net.IP{}
+	dnsNames := []string{}
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+
+			continue
+		}
+
+		dnsNames = append(dnsNames, host)
+	}
+
+	certCfg := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().Unix()),
+		Subject: pkix.Name{
+			CommonName: role,
+		},
+		IPAddresses: ips,
+		DNSNames:    dnsNames,
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validity),
+		ExtKeyUsage: extKeyUsage,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, certCfg, caCfg, &certPrivKey.PublicKey, caPrivKey)
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	var certPEM bytes.Buffer
+	if err := pem.Encode(&certPEM, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert,
+	}); err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	var certPrivKeyPEM bytes.Buffer
+	if err := pem.Encode(&certPrivKeyPEM, &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(certPrivKey),
+	}); err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	return certPEM.Bytes(), certPrivKeyPEM.Bytes(), nil
+}
+
+// GenerateCertificateRequest generates a private key and a certificate signing request for it, so that another CA can
+// issue a certificate for the key without the key leaving this control plane
+func GenerateCertificateRequest(rsaBits int) ([]byte, []byte, error) {
+	certPrivKey, err := rsa.GenerateKey(rand.Reader, rsaBits)
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, certPrivKey)
+	if err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	var csrPEM bytes.Buffer
+	if err := pem.Encode(&csrPEM, &pem.Block{
+		Type:  "CERTIFICATE REQUEST",
+		Bytes: csr,
+	}); err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	var certPrivKeyPEM bytes.Buffer
+	if err := pem.Encode(&certPrivKeyPEM, &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(certPrivKey),
+	}); err != nil {
+		return []byte{}, []byte{}, err
+	}
+
+	return csrPEM.Bytes(), certPrivKeyPEM.Bytes(), nil
+}
+
+// ParseCertificateRequest decodes a certificate signing request and checks that it was signed with its key
+func ParseCertificateRequest(csrPEM []byte) (*x509.CertificateRequest, error) {
+	b, _ := pem.Decode(csrPEM)
+	if b == nil || b.Type != "CERTIFICATE REQUEST" {
+		return nil, ErrInvalidCertificateRequest
+	}
+
+	csr, err := x509.ParseCertificateRequest(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+
+	return csr, nil
+}
+
+// SignCertificateRequest issues a certificate for the key of a certificate signing request; like for the certificates
+// which the CA generates the keys for, the subject is set by the CA and not taken from the request
+func SignCertificateRequest(caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, csrPEM []byte, routeID, role string) ([]byte, error) {
+	csr, err := ParseCertificateRequest(csrPEM)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	certCfg := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName: role,
+			Country:    []string{routeID},
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validity),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, certCfg, caCfg, csr.PublicKey, caPrivKey)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	var certPEM bytes.Buffer
+	if err := pem.Encode(&certPEM, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert,
+	}); err != nil {
+		return []byte{}, err
+	}
+
+	return certPEM.Bytes(), nil
+}
+
+// GenerateNodeCertificate issues a certificate for the identity of a switch, whose node ID is its common name
+func GenerateNodeCertificate(caCfg *x509.Certificate, caPrivKey *rsa.PrivateKey, validity time.Duration, pubKey ed25519.PublicKey, role string) ([]byte, error) {
+	certCfg := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject: pkix.Name{
+			CommonName:         GetNodeID(pubKey),
+			OrganizationalUnit: []string{role},
+		},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(validity),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, certCfg, caCfg, pubKey, caPrivKey)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	var certPEM bytes.Buffer
+	if err := pem.Encode(&certPEM, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert,
+	}); err != nil {
+		return []byte{}, err
+	}
+
+	return certPEM.Bytes(), nil
+}
+
+// VerifyNodeCertificate checks that a certificate was issued by the CA for the identity of a node with the role
+func VerifyNodeCertificate(caPEM []byte, cert *x509.Certificate, role string) error {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return err
+	}
+
+	pubKey, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok || cert.Subject.CommonName != GetNodeID(pubKey) || !slices.Contains(cert.Subject.OrganizationalUnit, role) {
+		return ErrInvalidNodeCertificate
+	}
+
+	return nil
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,3 +37,100 @@ func HandleTestConn(verbose bool, conn net.Conn, benchmarkLimit int64) error {
 
 	return <-errs
 }
+
+// Splice copies between both connections until one of them is closed, then closes both
+func Splice(a, b io.ReadWriteCloser) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		_ = a.Close()
+		_ = b.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		_, _ = io.Copy(a, b)
+
+		closeOnce.Do(closeBoth)
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		_, _ = io.Copy(b, a)
+
+		closeOnce.Do(closeBoth)
+	}()
+
+	wg.Wait()
+}
+
+// CountingWriter counts the bytes written to the underlying writer
+type CountingWriter struct {
+	io.Writer
+
+	Written *atomic.Int64
+}
+
+func (w CountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+
+	w.Written.Add(int64(n))
+
+	return n, err
+}
+
+// Gate blocks writes while it is held, which pauses a stream without closing it
+type Gate struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	held bool
+}
+
+func NewGate() *Gate {
+	g := &Gate{}
+	g.cond = sync.NewCond(&g.lock)
+
+	return g
+}
+
+func (g *Gate) SetHeld(held bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.held = held
+
+	g.cond.Broadcast()
+}
+
+func (g *Gate) IsHeld() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	return g.held
+}
+
+func (g *Gate) Wait() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for g.held {
+		g.cond.Wait()
+	}
+}
+
+// GatedWriter waits for the gate to be released before writing to the underlying writer
+type GatedWriter struct {
+	io.Writer
+
+	Gate *Gate
+}
+
+func (w GatedWriter) Write(p []byte) (int, error) {
+	w.Gate.Wait()
+
+	return w.Writer.Write(p)
+}
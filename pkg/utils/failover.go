@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+var (
+	ErrNoRemoteAddresses = errors.New("could not link: No remote addresses")
+)
+
+// SplitRemoteAddresses parses a comma-separated list of remote addresses, e.g. of control plane replicas
+func SplitRemoteAddresses(raddrs string) []string {
+	addrs := []string{}
+	for _, raddr := range strings.Split(raddrs, ",") {
+		if raddr = strings.TrimSpace(raddr); raddr != "" {
+			addrs = append(addrs, raddr)
+		}
+	}
+
+	return addrs
+}
+
+// getBackoff returns the exponentially increasing time to wait before the attempt with equal jitter, so that nodes which lost their
+// link at the same time (e.g. because the leader failed) don't all reconnect at the same time
+func getBackoff(attempt int, retryInterval, maxRetryInterval time.Duration) time.Duration {
+	backoff := retryInterval
+	for i := 0; i < attempt && backoff < maxRetryInterval; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxRetryInterval {
+		backoff = maxRetryInterval
+	}
+
+	if backoff <= 0 {
+		return 0
+	}
+
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// LinkWithFailover dials the remote addresses in turn and links each connection; once a connection is lost or a remote
+// can't be reached (e.g. because it is a control plane replica which isn't the leader), the next address is tried, and
+// once all addresses have been tried, it backs off exponentially up to the maximum retry interval
+func LinkWithFailover(
+	ctx context.Context,
+	raddrs []string,
+	retryInterval,
+	maxRetryInterval time.Duration,
+	dialOptions *websocket.DialOptions,
+	link func(conn io.ReadWriteCloser) error,
+) error {
+	if len(raddrs) < 1 {
+		return ErrNoRemoteAddresses
+	}
+
+	attempt := 0
+	for i := 0; ; i = (i + 1) % len(raddrs) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		raddr := raddrs[i]
+		connected := false
+		if err := func() error {
+			rawConn, _, err := websocket.Dial(ctx, raddr, dialOptions)
+			if err != nil {
+				return err
+			}
+			conn := websocket.NetConn(ctx, rawConn, websocket.MessageText)
+			defer conn.Close()
+
+			connected = true
+
+			log.Println("Connected to", conn.RemoteAddr())
+
+			return link(conn)
+		}(); err != nil && !IsClosedErr(err) {
+			log.Println("Could not link to", raddr, ", failing over:", err)
+		} else {
+			log.Println("Disconnected from", raddr, ", failing over")
+
+			// Links which were established reset the backoff so that a node reconnects quickly after a dropped link;
+			// links which failed (e.g. because the node couldn't register) keep backing off
+			if connected {
+				attempt = 0
+			}
+		}
+
+		if i == len(raddrs)-1 {
+			backoff := getBackoff(attempt, retryInterval, maxRetryInterval)
+			attempt++
+
+			log.Println("Reconnecting in", backoff)
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+	}
+}
+
+// LinkedConn remembers the connection which is currently linked, so that a node which can't register with the remote after
+// connecting can close the connection and fail over instead of stopping
+type LinkedConn struct {
+	lock sync.Mutex
+	conn io.Closer
+	err  error
+}
+
+// Link wraps link so that the connection which it links is tracked; if the connection was closed with Fail, the wrapped link
+// returns the error it was closed with, so that LinkWithFailover backs off before reconnecting
+func (l *LinkedConn) Link(link func(conn io.ReadWriteCloser) error) func(conn io.ReadWriteCloser) error {
+	return func(conn io.ReadWriteCloser) error {
+		l.lock.Lock()
+		l.conn = conn
+		l.err = nil
+		l.lock.Unlock()
+
+		err := link(conn)
+
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		l.conn = nil
+		if l.err != nil {
+			return l.err
+		}
+
+		return err
+	}
+}
+
+// Current returns the connection which is currently linked
+func (l *LinkedConn) Current() io.Closer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.conn
+}
+
+// Fail closes the connection with the error if it is still linked; connections which were replaced in the meantime are left open
+func (l *LinkedConn) Fail(conn io.Closer, err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if conn == nil || l.conn != conn {
+		return
+	}
+
+	l.err = err
+
+	_ = conn.Close()
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestLinkedConnFail(t *testing.T) {
+	errRegistration := errors.New("could not register")
+
+	tests := []struct {
+		name    string
+		replace bool
+		wantErr error
+	}{
+		{"current connection is closed with the error", false, errRegistration},
+		{"replaced connection is left open", true, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &LinkedConn{}
+
+			conn, remote := net.Pipe()
+			defer remote.Close()
+
+			link := l.Link(func(c io.ReadWriteCloser) error {
+				current := l.Current()
+				if current != c {
+					t.Fatalf("Current() = %v, want %v", current, c)
+				}
+
+				if tt.replace {
+					other, otherRemote := net.Pipe()
+					defer other.Close()
+					defer otherRemote.Close()
+
+					l.Fail(other, errRegistration)
+
+					return c.Close()
+				}
+
+				l.Fail(current, errRegistration)
+
+				// The connection must have been closed for the read to return
+				_, err := c.Read(make([]byte, 1))
+
+				return err
+			})
+
+			if err := link(conn); err != tt.wantErr {
+				t.Errorf("link() = %v, want %v", err, tt.wantErr)
+			}
+
+			if current := l.Current(); current != nil {
+				t.Errorf("Current() after link = %v, want nil", current)
+			}
+		})
+	}
+}
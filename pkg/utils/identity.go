@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ErrInvalidIdentity = errors.New("could not load identity: File does not contain an Ed25519 private key")
+)
+
+// LoadOrCreateIdentity loads the private key which identifies a switch or adapter across restarts and reconnects, and creates it if it doesn't exist yet
+func LoadOrCreateIdentity(identityPath string) (ed25519.PrivateKey, error) {
+	identityPEM, err := os.ReadFile(identityPath)
+	if err == nil {
+		block, _ := pem.Decode(identityPEM)
+		if block == nil {
+			return nil, ErrInvalidIdentity
+		}
+
+		rawPrivKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		privKey, ok := rawPrivKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, ErrInvalidIdentity
+		}
+
+		return privKey, nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	rawPrivKey, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(identityPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(identityPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: rawPrivKey,
+	}), 0600); err != nil {
+		return nil, err
+	}
+
+	return privKey, nil
+}
+
+// GetNodeID returns the ID of a switch or adapter, which is the fingerprint of its public key
+func GetNodeID(pubKey ed25519.PublicKey) string {
+	fingerprint := sha256.Sum256(pubKey)
+
+	return hex.EncodeToString(fingerprint[:16])
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrHolePunchTimedOut = errors.New("could not punch hole before timeout")
+)
+
+// ListenHolePunch reserves a local port which can be used for both accepting and dialing
+func ListenHolePunch(ctx context.Context, host string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: controlReuse,
+	}
+
+	return lc.Listen(ctx, "tcp", net.JoinHostPort(host, "0"))
+}
+
+// PunchHole does a TCP simultaneous open to `raddr` from the port reserved by `lis`;
+// the first connection to be established (dialed or accepted) wins
+func PunchHole(lis net.Listener, raddr string, timeout, interval time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conns := make(chan net.Conn)
+
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+
+		select {
+		case conns <- conn:
+		case <-ctx.Done():
+			_ = conn.Close()
+		}
+	}()
+
+	go func() {
+		dialer := net.Dialer{
+			LocalAddr: lis.Addr(),
+			Control:   controlReuse,
+			Timeout:   interval,
+		}
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			conn, err := dialer.DialContext(ctx, "tcp", raddr)
+			if err == nil {
+				select {
+				case conns <- conn:
+				case <-ctx.Done():
+					_ = conn.Close()
+				}
+
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	select {
+	case conn := <-conns:
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ErrHolePunchTimedOut
+	}
+}
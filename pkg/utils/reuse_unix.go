@@ -0,0 +1,24 @@
+//go:build !windows
+
+package utils
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func controlReuse(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return
+		}
+
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
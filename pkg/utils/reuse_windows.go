@@ -0,0 +1,18 @@
+//go:build windows
+
+package utils
+
+import (
+	"syscall"
+)
+
+func controlReuse(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
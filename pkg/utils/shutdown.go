@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	drainPollInterval = time.Millisecond * 500
+)
+
+// NotifyShutdown returns a channel which receives SIGINT and SIGTERM
+func NotifyShutdown() chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	return signals
+}
+
+// WaitForDrain waits until isDrained returns true or the timeout is reached, in which case it returns false; a second
+// SIGINT or SIGTERM on the signals channel stops waiting immediately
+func WaitForDrain(signals chan os.Signal, timeout time.Duration, isDrained func() bool) bool {
+	deadline := time.After(timeout)
+
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+
+	for !isDrained() {
+		select {
+		case <-deadline:
+			return false
+		case <-signals:
+			return false
+		case <-t.C:
+		}
+	}
+
+	return true
+}
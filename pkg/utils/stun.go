@@ -1,11 +1,56 @@
 package utils
 
 import (
+	"errors"
 	"net"
+	"strconv"
+	"time"
 
 	"github.com/pion/stun"
 )
 
+var (
+	ErrNoSTUNServers      = errors.New("could not continue without STUN servers")
+	ErrNoSTUNResponse     = errors.New("could not get a response from any STUN server")
+	ErrInvalidSTUNAddress = errors.New("received invalid address from STUN server")
+)
+
+type NATType string
+
+const (
+	// The switch is directly reachable on its public IP
+	NATTypeNone NATType = "none"
+	// The NAT keeps the same mapping for all destinations (full cone, restricted cone, port-restricted cone)
+	NATTypeEndpointIndependent NATType = "endpoint-independent"
+	// The NAT creates a new mapping for every destination (symmetric)
+	NATTypeEndpointDependent NATType = "endpoint-dependent"
+	// Not enough STUN servers responded to classify the NAT
+	NATTypeUnknown NATType = "unknown"
+)
+
+type NATInfo struct {
+	Type       NATType
+	PublicIP   string
+	MappedPort int
+	LocalPort  int
+}
+
+// IsPubliclyReachable returns whether other peers can dial the host directly
+func (n NATInfo) IsPubliclyReachable() bool {
+	return n.Type == NATTypeNone
+}
+
+// CanHolePunch returns whether the host can take part in coordinated hole punching.
+// Since the NAT is only classified using UDP, we can only assume that TCP mappings
+// are predictable if the NAT is endpoint-independent and preserves ports.
+func (n NATInfo) CanHolePunch() bool {
+	if n.IsPubliclyReachable() {
+		return true
+	}
+
+	return n.Type == NATTypeEndpointIndependent && n.MappedPort == n.LocalPort
+}
+
 func GetPublicIP(stunAddr string) (net.IP, error) {
 	c, err := stun.Dial("udp", stunAddr)
 	if err != nil {
@@ -43,3 +88,128 @@ func GetPublicIP(stunAddr string) (net.IP, error) {
 		return r, nil
 	}
 }
+
+// GetNATInfo classifies the NAT in front of the host by sending binding requests
+// to multiple STUN servers from the same local socket and comparing the XOR-mapped addresses
+func GetNATInfo(stunAddrs []string, timeout time.Duration) (NATInfo, error) {
+	if len(stunAddrs) < 1 {
+		return NATInfo{}, ErrNoSTUNServers
+	}
+
+	// Dialing UDP doesn't send any packets, but it allows us to find the outbound IP
+	probe, err := net.Dial("udp", stunAddrs[0])
+	if err != nil {
+		return NATInfo{}, err
+	}
+
+	outboundIP := probe.LocalAddr().(*net.UDPAddr).IP
+
+	if err := probe.Close(); err != nil {
+		return NATInfo{}, err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return NATInfo{}, err
+	}
+	defer conn.Close()
+
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+
+	mappedAddrs := []*net.UDPAddr{}
+	for _, stunAddr := range stunAddrs {
+		mappedAddr, err := getMappedAddr(conn, stunAddr, timeout)
+		if err != nil {
+			continue
+		}
+
+		mappedAddrs = append(mappedAddrs, mappedAddr)
+	}
+
+	if len(mappedAddrs) < 1 {
+		return NATInfo{}, ErrNoSTUNResponse
+	}
+
+	info := NATInfo{
+		Type:       NATTypeUnknown,
+		PublicIP:   mappedAddrs[0].IP.String(),
+		MappedPort: mappedAddrs[0].Port,
+		LocalPort:  localPort,
+	}
+
+	if mappedAddrs[0].IP.Equal(outboundIP) && mappedAddrs[0].Port == localPort {
+		info.Type = NATTypeNone
+
+		return info, nil
+	}
+
+	if len(mappedAddrs) < 2 {
+		return info, nil
+	}
+
+	info.Type = NATTypeEndpointIndependent
+	for _, mappedAddr := range mappedAddrs[1:] {
+		if !mappedAddr.IP.Equal(mappedAddrs[0].IP) || mappedAddr.Port != mappedAddrs[0].Port {
+			info.Type = NATTypeEndpointDependent
+
+			break
+		}
+	}
+
+	return info, nil
+}
+
+func getMappedAddr(conn *net.UDPConn, stunAddr string, timeout time.Duration) (*net.UDPAddr, error) {
+	raddr, err := net.ResolveUDPAddr("udp", stunAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := stun.Build(stun.TransactionID, stun.BindingRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.WriteToUDP(req.Raw, raddr); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ignore late responses from other STUN servers
+		if !from.IP.Equal(raddr.IP) || from.Port != raddr.Port {
+			continue
+		}
+
+		res := &stun.Message{
+			Raw: append([]byte{}, buf[:n]...),
+		}
+		if err := res.Decode(); err != nil {
+			return nil, err
+		}
+
+		if res.TransactionID != req.TransactionID {
+			continue
+		}
+
+		var addr stun.XORMappedAddress
+		if err := addr.GetFrom(res); err != nil {
+			return nil, err
+		}
+
+		if addr.IP == nil {
+			return nil, ErrInvalidSTUNAddress
+		}
+
+		return net.ResolveUDPAddr("udp", net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)))
+	}
+}
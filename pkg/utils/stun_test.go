@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+// listenSTUN starts a STUN responder which responds with the mapped address; if it is nil, it responds with the address
+// which the request was sent from like a STUN server without NAT in between, and if respond is false, it doesn't respond at all
+func listenSTUN(t *testing.T, mapped *net.UDPAddr, respond bool) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			if !respond {
+				continue
+			}
+
+			req := &stun.Message{
+				Raw: append([]byte{}, buf[:n]...),
+			}
+			if err := req.Decode(); err != nil {
+				continue
+			}
+
+			addr := from
+			if mapped != nil {
+				addr = mapped
+			}
+
+			res, err := stun.Build(
+				stun.NewTransactionIDSetter(req.TransactionID),
+				stun.BindingSuccess,
+				&stun.XORMappedAddress{IP: addr.IP, Port: addr.Port},
+				stun.Fingerprint,
+			)
+			if err != nil {
+				continue
+			}
+
+			if _, err := conn.WriteToUDP(res.Raw, from); err != nil {
+				return
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestGetNATInfo(t *testing.T) {
+	first := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40000}
+	second := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40001}
+	otherIP := &net.UDPAddr{IP: net.ParseIP("203.0.113.2"), Port: 40000}
+
+	type responder struct {
+		mapped  *net.UDPAddr
+		respond bool
+	}
+
+	tests := []struct {
+		name       string
+		responders []responder
+		wantType   NATType
+		wantIP     string
+		wantPort   int // Only checked for responders with mapped addresses
+		wantErr    error
+	}{
+		{
+			name:       "none",
+			responders: []responder{{nil, true}, {nil, true}},
+			wantType:   NATTypeNone,
+			wantIP:     "127.0.0.1",
+		},
+		{
+			name:       "endpoint-independent",
+			responders: []responder{{first, true}, {first, true}},
+			wantType:   NATTypeEndpointIndependent,
+			wantIP:     "203.0.113.1",
+			wantPort:   40000,
+		},
+		{
+			name:       "endpoint-dependent port",
+			responders: []responder{{first, true}, {second, true}},
+			wantType:   NATTypeEndpointDependent,
+			wantIP:     "203.0.113.1",
+			wantPort:   40000,
+		},
+		{
+			name:       "endpoint-dependent IP",
+			responders: []responder{{first, true}, {otherIP, true}},
+			wantType:   NATTypeEndpointDependent,
+			wantIP:     "203.0.113.1",
+			wantPort:   40000,
+		},
+		{
+			name:       "unknown with only one responder",
+			responders: []responder{{first, true}},
+			wantType:   NATTypeUnknown,
+			wantIP:     "203.0.113.1",
+			wantPort:   40000,
+		},
+		{
+			name:       "unknown with only one responding server",
+			responders: []responder{{first, true}, {first, false}},
+			wantType:   NATTypeUnknown,
+			wantIP:     "203.0.113.1",
+			wantPort:   40000,
+		},
+		{
+			name:       "no responses",
+			responders: []responder{{first, false}},
+			wantErr:    ErrNoSTUNResponse,
+		},
+		{
+			name:    "no servers",
+			wantErr: ErrNoSTUNServers,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stunAddrs := []string{}
+			for _, r := range tt.responders {
+				stunAddrs = append(stunAddrs, listenSTUN(t, r.mapped, r.respond))
+			}
+
+			info, err := GetNATInfo(stunAddrs, 200*time.Millisecond)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("GetNATInfo() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			if info.Type != tt.wantType {
+				t.Errorf("GetNATInfo() type = %v, want %v", info.Type, tt.wantType)
+			}
+
+			if info.PublicIP != tt.wantIP {
+				t.Errorf("GetNATInfo() public IP = %v, want %v", info.PublicIP, tt.wantIP)
+			}
+
+			// Without NAT, the mapped port is the local port
+			wantPort := tt.wantPort
+			if wantPort == 0 {
+				wantPort = info.LocalPort
+			}
+
+			if info.MappedPort != wantPort {
+				t.Errorf("GetNATInfo() mapped port = %v, want %v", info.MappedPort, wantPort)
+			}
+		})
+	}
+}
+
+func TestNATInfoCanHolePunch(t *testing.T) {
+	tests := []struct {
+		name string
+		info NATInfo
+		want bool
+	}{
+		{"none", NATInfo{Type: NATTypeNone, MappedPort: 1, LocalPort: 2}, true},
+		{"endpoint-independent with preserved port", NATInfo{Type: NATTypeEndpointIndependent, MappedPort: 1, LocalPort: 1}, true},
+		{"endpoint-independent with changed port", NATInfo{Type: NATTypeEndpointIndependent, MappedPort: 1, LocalPort: 2}, false},
+		{"endpoint-dependent", NATInfo{Type: NATTypeEndpointDependent, MappedPort: 1, LocalPort: 1}, false},
+		{"unknown", NATInfo{Type: NATTypeUnknown, MappedPort: 1, LocalPort: 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.CanHolePunch(); got != tt.want {
+				t.Errorf("CanHolePunch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}